@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api"
+
+	"github.com/influxdata/go-snippets/internal/flux"
+)
+
+// alertRule triggers when every value of a field of a user's data within the
+// last Duration compares to Threshold as given by Comparison, and resolves as
+// soon as one no longer does. Each change of state is written to the _alerts
+// measurement and posted to WebhookURL.
+type alertRule struct {
+	ID         string  `json:"id"`
+	UserID     string  `json:"user_id"`
+	Field      string  `json:"field"`
+	Comparison string  `json:"comparison"`
+	Threshold  float64 `json:"threshold"`
+	Duration   string  `json:"duration"`
+	WebhookURL string  `json:"webhook_url"`
+
+	// taskID is the ID of the task that evaluates the rule.
+	taskID string
+}
+
+var (
+	// alertComparisons lists the comparisons an alert rule may make.
+	alertComparisons = map[string]bool{">": true, ">=": true, "<": true, "<=": true}
+	// fluxDurationPattern matches the duration literals accepted by Flux, e.g. 90s or 1h30m.
+	fluxDurationPattern = regexp.MustCompile(`^([0-9]+(ns|us|µs|ms|s|mo|m|h|d|w|y))+$`)
+	// alertFieldPattern matches the fields an alert rule may watch: identifiers
+	// such as field1, like the fields written by ingest.
+	alertFieldPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// errAlertRuleNotFound is returned when a user has no alert rule with the requested ID.
+var errAlertRuleNotFound = errors.New("alert rule not found")
+
+// errInvalidAlertToken is returned for notifications posted to the alert
+// receiver without the token of their rule.
+var errInvalidAlertToken = &requestError{status: http.StatusUnauthorized, code: errorCodeUnauthenticated, message: "missing or invalid alert token"}
+
+// alertSecret signs the tokens alert tasks send to the alert receiver, and is
+// read from the BOILERPLATE_ALERT_SECRET environment variable. When it is
+// unset, a random secret is used, so that the receiver rejects notifications
+// from tasks created before your app last restarted.
+var alertSecret = os.Getenv("BOILERPLATE_ALERT_SECRET")
+
+func init() {
+	if alertSecret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatal(fmt.Errorf("Failed to generate the alert secret: %v", err))
+		}
+		alertSecret = hex.EncodeToString(secret)
+	}
+}
+
+// alertToken returns the token the task of a rule sends in the X-Alert-Token
+// header of its notifications. Each rule has its own token, so that a webhook
+// on another service can't use the tokens it receives to post notifications
+// of other rules to the alert receiver.
+func alertToken(userID, ruleID string) string {
+	mac := hmac.New(sha256.New, []byte(alertSecret))
+	mac.Write([]byte(userID + "\n" + ruleID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// alertTaskName returns the name shared by the tasks of all of a user's alert
+// rules, which lets them be listed with a single lookup.
+func alertTaskName(userID string) string {
+	return fmt.Sprintf("%s_alerts", userID)
+}
+
+// createAlertRule creates an alert rule for a user. Each rule is evaluated every
+// minute by a task, which records every change of state in the _alerts
+// measurement of your bucket and posts it to the rule's webhook.
+//
+// Note that "user" here refers to a user in your application, not an InfluxDB user.
+//
+// POST the following to the /alerts endpoint to be notified when field1 of
+// user1 stays above 100 for five minutes:
+// {"user_id":"user1", "field":"field1", "comparison":">", "threshold":100, "duration":"5m", "webhook_url":"http://localhost:8080/alerts/receiver"}
+//
+// GET /alerts?user_id=user1 to list the rules of a user, and DELETE
+// /alerts?user_id=user1&id=<rule ID> to remove one. The same operations are
+// served under /users/user1/alerts, where the user ID in the body is optional.
+func createAlertRule(w http.ResponseWriter, r *http.Request) {
+	var rule alertRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		handleError(w, invalidBody(err))
+		return
+	}
+	if err := bindUserID(r, &rule.UserID); err != nil {
+		handleError(w, err)
+		return
+	}
+	if err := validateAlertRule(rule); err != nil {
+		handleError(w, invalidRequest("%v", err))
+		return
+	}
+	if err := createAlertTask(r.Context(), &rule); err != nil {
+		handleError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rule)
+}
+
+func listAlertRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := findAlertRules(r.Context(), param(r, "user_id"))
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Rules []alertRule `json:"rules"`
+	}{rules})
+}
+
+func deleteAlertRule(w http.ResponseWriter, r *http.Request) {
+	rules, err := findAlertRules(r.Context(), param(r, "user_id"))
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	for _, rule := range rules {
+		if rule.ID != param(r, "id") {
+			continue
+		}
+		if err := organizationOf(r.Context()).client.TasksAPI().DeleteTaskWithID(r.Context(), rule.taskID); err != nil {
+			handleError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	handleError(w, errAlertRuleNotFound)
+}
+
+// validateAlertRule checks the parts of a rule that end up in its task's Flux
+// script, so that a rule can never produce a script that fails to compile.
+func validateAlertRule(rule alertRule) error {
+	if !alertFieldPattern.MatchString(rule.Field) {
+		return fmt.Errorf("invalid field %q: must be letters, digits and underscores, not starting with a digit", rule.Field)
+	}
+	if !alertComparisons[rule.Comparison] {
+		return fmt.Errorf("unsupported comparison %q", rule.Comparison)
+	}
+	if !fluxDurationPattern.MatchString(rule.Duration) {
+		return fmt.Errorf("invalid duration %q", rule.Duration)
+	}
+	webhook, err := url.Parse(rule.WebhookURL)
+	if err != nil || (webhook.Scheme != "http" && webhook.Scheme != "https") || webhook.Host == "" {
+		return fmt.Errorf("invalid webhook URL %q", rule.WebhookURL)
+	}
+	return nil
+}
+
+// findAlertRules returns the alert rules of a user.
+func findAlertRules(ctx context.Context, userID string) ([]alertRule, error) {
+	if err := authorize(ctx, userID); err != nil {
+		return nil, err
+	}
+	org := organizationOf(ctx)
+	orgID, err := org.ID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tasks, err := org.client.TasksAPI().FindTasks(ctx, &api.TaskFilter{
+		Name:  alertTaskName(userID),
+		OrgID: orgID,
+		Limit: 500,
+	})
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]alertRule, 0, len(tasks))
+	for _, task := range tasks {
+		// The rule a task was created from is kept in its description.
+		var rule alertRule
+		if task.Description == nil || json.Unmarshal([]byte(*task.Description), &rule) != nil {
+			continue
+		}
+		rule.taskID = task.Id
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// createAlertTask assigns the rule an ID and creates the task that evaluates it.
+func createAlertTask(ctx context.Context, rule *alertRule) error {
+	if err := authorize(ctx, rule.UserID); err != nil {
+		return err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	rule.ID = hex.EncodeToString(id)
+
+	description, err := json.Marshal(rule)
+	if err != nil {
+		return err
+	}
+	// The task option follows the imports, as Flux requires. See postTask.
+	script := fmt.Sprintf("import \"array\"\nimport \"http\"\nimport \"json\"\n\noption task = {name: %s, every: 1m}\n\n%s",
+		flux.Quote(alertTaskName(rule.UserID)), alertTaskQuery(*rule, organizationOf(ctx).bucket))
+	task, err := postTask(ctx, script, stringPtr(string(description)))
+	if err != nil {
+		return err
+	}
+	rule.taskID = task.Id
+	return nil
+}
+
+// alertTaskQuery formats the Flux script of the task that evaluates a rule.
+//
+// The rule's state is crit when every value of the field within the duration
+// crosses the threshold, and ok otherwise, including when there is no data.
+// When the state differs from the last one recorded in the _alerts measurement
+// the script posts the change to the webhook with http.post, along with the
+// rule's token (see alertToken), and records it.
+// To follow what a task does, view its runs and logs in the InfluxDB UI.
+//
+// Unlike the rollup tasks, the script isn't built with the flux package, which
+// builds pipelines of tables: it has no way to express findRecord, conditional
+// expressions, array.from or http.post. Every value is written in as a literal
+// with flux.Quote instead, and the field is checked by validateAlertRule.
+func alertTaskQuery(rule alertRule, bucket string) string {
+	return fmt.Sprintf(`summary = from(bucket: %[1]s)
+	|> range(start: -%[2]s)
+	|> filter(fn: (r) => r.user_id == %[3]s and r._field == %[4]s)
+	|> filter(fn: (r) => r._measurement !~ /%[11]s/)
+	|> group()
+	|> reduce(
+		identity: {total: 0, crossed: 0, last: 0.0},
+		fn: (r, accumulator) => ({
+			total: accumulator.total + 1,
+			crossed: accumulator.crossed + (if float(v: r._value) %[5]s %[6]s then 1 else 0),
+			last: float(v: r._value),
+		}),
+	)
+	|> findRecord(fn: (key) => true, idx: 0)
+
+previous = from(bucket: %[1]s)
+	|> range(start: -30d)
+	|> filter(fn: (r) => r._measurement == "_alerts" and r.rule_id == %[7]s and r._field == "state")
+	|> last()
+	|> findRecord(fn: (key) => true, idx: 0)
+
+state = if exists summary.total and summary.total > 0 and summary.crossed == summary.total then "crit" else "ok"
+previousState = if exists previous._value then previous._value else "ok"
+
+array.from(rows: [{
+	_time: now(),
+	_measurement: "_alerts",
+	_field: "state",
+	_value: state,
+	previous: previousState,
+	rule_id: %[7]s,
+	user_id: %[3]s,
+}])
+	|> filter(fn: (r) => r._value != r.previous)
+	|> map(fn: (r) => ({r with
+		webhook_status: http.post(
+			url: %[8]s,
+			headers: {"Content-Type": "application/json", "X-Alert-Token": %[12]s},
+			data: json.encode(v: {
+				rule_id: r.rule_id,
+				user_id: r.user_id,
+				field: %[4]s,
+				comparison: %[9]s,
+				threshold: %[6]s,
+				duration: %[10]s,
+				state: r._value,
+				previous: r.previous,
+				value: if exists summary.last then summary.last else 0.0,
+				time: r._time,
+			}),
+		),
+	}))
+	|> drop(columns: ["previous", "webhook_status"])
+	|> to(bucket: %[1]s)`,
+		flux.Quote(bucket), rule.Duration, flux.Quote(rule.UserID), flux.Quote(rule.Field), rule.Comparison,
+		flux.FormatFloat(rule.Threshold), flux.Quote(rule.ID), flux.Quote(rule.WebhookURL), flux.Quote(rule.Comparison), flux.Quote(rule.Duration),
+		internalMeasurements, flux.Quote(alertToken(rule.UserID, rule.ID)))
+}
+
+func stringPtr(value string) *string {
+	return &value
+}
+
+// alertNotification is the body each alert task posts to its webhook when the
+// state of its rule changes.
+type alertNotification struct {
+	RuleID     string    `json:"rule_id"`
+	UserID     string    `json:"user_id"`
+	Field      string    `json:"field"`
+	Comparison string    `json:"comparison"`
+	Threshold  float64   `json:"threshold"`
+	Duration   string    `json:"duration"`
+	State      string    `json:"state"`
+	Previous   string    `json:"previous"`
+	Value      float64   `json:"value"`
+	Time       time.Time `json:"time"`
+}
+
+// alertReceiverSize is the number of notifications kept by the alert receiver.
+const alertReceiverSize = 100
+
+var (
+	receivedAlertsMu sync.Mutex
+	// receivedAlerts holds the latest notifications posted to the alert receiver.
+	receivedAlerts []alertNotification
+)
+
+// receiveAlert is a webhook for alert rules that logs the notifications posted
+// to it and keeps the latest of them, so that you can try out alerting before
+// integrating it with a real notification service. Note that the webhook is
+// called by InfluxDB, which must be able to reach your app at its URL.
+//
+// Notifications are only accepted with the token of their rule in the
+// X-Alert-Token header, which the rule's task sends, so that callers can't
+// post fake ones.
+//
+// GET /alerts/receiver with the admin key to list the notifications received
+// so far, which hold the data of every user.
+func receiveAlert(w http.ResponseWriter, r *http.Request) {
+	var notification alertNotification
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&notification); err != nil {
+		handleError(w, invalidBody(err))
+		return
+	}
+	token := alertToken(notification.UserID, notification.RuleID)
+	if !hmac.Equal([]byte(r.Header.Get("X-Alert-Token")), []byte(token)) {
+		handleError(w, errInvalidAlertToken)
+		return
+	}
+	log.Printf("Alert rule %s of user %q changed from %s to %s: %s %s %v for %s",
+		notification.RuleID, notification.UserID, notification.Previous, notification.State,
+		notification.Field, notification.Comparison, notification.Threshold, notification.Duration)
+
+	receivedAlertsMu.Lock()
+	defer receivedAlertsMu.Unlock()
+	receivedAlerts = append(receivedAlerts, notification)
+	if len(receivedAlerts) > alertReceiverSize {
+		receivedAlerts = receivedAlerts[len(receivedAlerts)-alertReceiverSize:]
+	}
+}
+
+func listReceivedAlerts(w http.ResponseWriter, r *http.Request) {
+	receivedAlertsMu.Lock()
+	defer receivedAlertsMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Notifications []alertNotification `json:"notifications"`
+	}{append([]alertNotification{}, receivedAlerts...)})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidateAlertRule(t *testing.T) {
+	valid := alertRule{UserID: "user1", Field: "field1", Comparison: ">", Threshold: 10, Duration: "5m", WebhookURL: "https://example.com/hook"}
+	if err := validateAlertRule(valid); err != nil {
+		t.Fatalf("a valid rule was rejected: %v", err)
+	}
+	for _, field := range []string{"", "1field", "field-1", `field1" or true or "`, "${field1}", "field 1"} {
+		rule := valid
+		rule.Field = field
+		if err := validateAlertRule(rule); err == nil {
+			t.Errorf("field %q was accepted", field)
+		}
+	}
+}
+
+func TestAlertTaskQueryEscapesStrings(t *testing.T) {
+	rule := alertRule{
+		ID:         "0123456789abcdef",
+		UserID:     `user"${secrets.get(key: "token")}\`,
+		Field:      "field1",
+		Comparison: ">=",
+		Threshold:  10,
+		Duration:   "5m",
+		WebhookURL: "https://example.com/hook?user=${user}",
+	}
+	script := alertTaskQuery(rule, "my-bucket")
+	for _, want := range []string{
+		`r.user_id == "user\"\${secrets.get(key: \"token\")}\\" and r._field == "field1"`,
+		`url: "https://example.com/hook?user=\${user}"`,
+		`comparison: ">="`,
+		`duration: "5m"`,
+		`if float(v: r._value) >= 10.0 then`,
+		`to(bucket: "my-bucket")`,
+		`"X-Alert-Token": "` + alertToken(rule.UserID, rule.ID) + `"`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("the script doesn't contain %s:\n%s", want, script)
+		}
+	}
+	if strings.Contains(strings.ReplaceAll(script, `\${`, ""), "${") {
+		t.Errorf("the script interpolates a value:\n%s", script)
+	}
+}
+
+func TestCreateAlertRule(t *testing.T) {
+	app := newTestApp(t)
+
+	resp, body := app.do(t, http.MethodPost, "/users/user1/alerts", "key1",
+		`{"field":"field1\" or true or \"","comparison":">","threshold":1,"duration":"5m","webhook_url":"https://example.com/hook"}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d (%s) for an invalid field, want 400", resp.StatusCode, body)
+	}
+
+	resp, body = app.do(t, http.MethodPost, "/users/user1/alerts", "key1",
+		`{"field":"field1","comparison":">","threshold":1,"duration":"5m","webhook_url":"https://example.com/hook"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d (%s), want 201", resp.StatusCode, body)
+	}
+	var rule alertRule
+	if err := json.Unmarshal([]byte(body), &rule); err != nil {
+		t.Fatal(err)
+	}
+	tasks := app.influx.Tasks()
+	if len(tasks) != 1 {
+		t.Fatalf("got %d tasks, want 1", len(tasks))
+	}
+	// Flux requires the imports to come before the task option.
+	if task := tasks[0]; task.Name != alertTaskName("user1") || task.Every == nil || *task.Every != "1m" ||
+		!strings.HasPrefix(task.Flux, "import ") {
+		t.Errorf("got task %q every %v with script:\n%s", task.Name, task.Every, task.Flux)
+	}
+
+	resp, body = app.do(t, http.MethodGet, "/users/user1/alerts", "key1", "")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, rule.ID) {
+		t.Errorf("got status %d (%s) listing rules, want the rule created", resp.StatusCode, body)
+	}
+}
+
+func TestAlertReceiver(t *testing.T) {
+	app := newTestApp(t)
+	receivedAlerts = nil
+	notification := `{"rule_id":"rule1","user_id":"user1","field":"field1","comparison":">","threshold":1,"duration":"5m","state":"crit","previous":"ok","value":2,"time":"2022-01-01T00:00:00Z"}`
+	post := func(token string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, app.url+"/alerts/receiver", strings.NewReader(notification))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("X-Alert-Token", token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for _, token := range []string{"", alertToken("user1", "rule2"), alertToken("user2", "rule1")} {
+		if resp := post(token); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("got status %d posting with token %q, want 401", resp.StatusCode, token)
+		}
+	}
+	if resp := post(alertToken("user1", "rule1")); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d posting with the rule's token, want 200", resp.StatusCode)
+	}
+
+	for _, key := range []string{"", "key1"} {
+		if resp, body := app.do(t, http.MethodGet, "/alerts/receiver", key, ""); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("got status %d (%s) listing notifications with key %q, want 401", resp.StatusCode, body, key)
+		}
+	}
+	resp, body := app.do(t, http.MethodGet, "/alerts/receiver", "admin-key", "")
+	var listed struct {
+		Notifications []alertNotification `json:"notifications"`
+	}
+	if err := json.Unmarshal([]byte(body), &listed); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d (%s) listing notifications with the admin key, want 200", resp.StatusCode, body)
+	}
+	if len(listed.Notifications) != 1 || listed.Notifications[0].RuleID != "rule1" {
+		t.Errorf("got notifications %+v, want the one posted with its token", listed.Notifications)
+	}
+}
+
+func TestDeleteAlertRule(t *testing.T) {
+	app := newTestApp(t)
+	resp, body := app.do(t, http.MethodPost, "/users/user1/alerts", "key1",
+		`{"field":"field1","comparison":">","threshold":1,"duration":"5m","webhook_url":"https://example.com/hook"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d (%s), want 201", resp.StatusCode, body)
+	}
+	var rule alertRule
+	if err := json.Unmarshal([]byte(body), &rule); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp, body := app.do(t, http.MethodDelete, "/users/user1/alerts/"+rule.ID, "key2", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got status %d (%s) deleting another user's rule, want 403", resp.StatusCode, body)
+	}
+	if resp, body := app.do(t, http.MethodDelete, "/users/user1/alerts/"+rule.ID, "key1", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("got status %d (%s), want 204", resp.StatusCode, body)
+	}
+	if tasks := app.influx.Tasks(); len(tasks) != 0 {
+		t.Errorf("got %d tasks after deleting the rule, want none", len(tasks))
+	}
+	resp, body = app.do(t, http.MethodGet, "/users/user1/alerts", "key1", "")
+	if resp.StatusCode != http.StatusOK || strings.Contains(body, rule.ID) {
+		t.Errorf("got status %d (%s) listing rules, want the rule gone", resp.StatusCode, body)
+	}
+	resp, body = app.do(t, http.MethodDelete, "/users/user1/alerts/"+rule.ID, "key1", "")
+	if resp.StatusCode != http.StatusNotFound || errorCode(t, body) != errorCodeNotFound {
+		t.Errorf("got status %d (%s) deleting the rule again, want 404", resp.StatusCode, body)
+	}
+}
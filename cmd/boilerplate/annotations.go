@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+
+	"github.com/influxdata/go-snippets/internal/flux"
+)
+
+// annotationsMeasurement is the measurement annotations are stored in. Like
+// _alerts, its name starts with an underscore to keep it apart from user data.
+const annotationsMeasurement = "_annotations"
+
+// annotation marks an event in a user's data, such as a firmware upgrade or a
+// replaced sensor, so that it can be overlaid on charts of the data.
+//
+// Each annotation is stored as a point in the _annotations measurement, tagged
+// with the user's ID and its own ID, with title, text and tags fields. The tags
+// are stored as a comma-separated list.
+type annotation struct {
+	ID     string    `json:"id"`
+	UserID string    `json:"user_id"`
+	Time   time.Time `json:"time"`
+	Title  string    `json:"title"`
+	Text   string    `json:"text"`
+	Tags   []string  `json:"tags"`
+}
+
+var (
+	// errAnnotationNotFound is returned when a user has no annotation with the requested ID.
+	errAnnotationNotFound = errors.New("annotation not found")
+	// annotationIDPattern matches the IDs of annotations.
+	annotationIDPattern = regexp.MustCompile(`^[0-9a-f]{16}$`)
+	// maxAnnotationTime is the latest time an annotation is looked for when it
+	// is deleted, close to the latest time InfluxDB can store.
+	maxAnnotationTime = time.Date(2262, time.January, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// createAnnotation annotates a user's data with an event. The time defaults to
+// the current time.
+//
+// Note that "user" here refers to a user in your application, not an InfluxDB user.
+//
+// POST the following to the /annotations endpoint to test this function:
+// {"user_id":"user1", "title":"Firmware upgraded", "text":"Upgraded to 2.1.0", "tags":["firmware"]}
+//
+// GET /annotations?user_id=user1 to list the annotations of a user, optionally
+// within a time range given by start and stop parameters, and DELETE
+// /annotations?user_id=user1&id=<annotation ID> to remove one.
+func createAnnotation(w http.ResponseWriter, r *http.Request) {
+	var request annotation
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		handleError(w, invalidBody(err))
+		return
+	}
+	if err := bindUserID(r, &request.UserID); err != nil {
+		handleError(w, err)
+		return
+	}
+	for _, tag := range request.Tags {
+		if tag == "" || strings.Contains(tag, ",") {
+			handleError(w, invalidRequest("invalid tag %q, tags must not be empty or contain commas", tag))
+			return
+		}
+	}
+	if err := writeAnnotation(r.Context(), &request); err != nil {
+		handleError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(request)
+}
+
+// writeAnnotation assigns an annotation an ID and writes it to InfluxDB.
+// Annotations are written straight away rather than queued, so that they are
+// listed as soon as they are created.
+func writeAnnotation(ctx context.Context, a *annotation) error {
+	if err := authorize(ctx, a.UserID); err != nil {
+		return err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	a.ID = hex.EncodeToString(id)
+	if a.Time.IsZero() {
+		a.Time = time.Now()
+	}
+	a.Time = a.Time.UTC()
+	if a.Tags == nil {
+		a.Tags = []string{}
+	}
+
+	point := influxdb2.NewPoint(annotationsMeasurement, map[string]string{
+		"user_id":       a.UserID,
+		"annotation_id": a.ID,
+	}, map[string]interface{}{
+		"title": a.Title,
+		"text":  a.Text,
+		"tags":  strings.Join(a.Tags, ","),
+	}, a.Time)
+	if err := organizationOf(ctx).writeAPI.WritePoint(ctx, point); err != nil {
+		return err
+	}
+	cache.invalidate(ctx, a.UserID)
+	return nil
+}
+
+func listAnnotations(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	start, stop, err := parseTimeRange(values)
+	if err != nil {
+		handleError(w, invalidRequest("%v", err))
+		return
+	}
+	annotations, err := findAnnotations(r.Context(), param(r, "user_id"), "", start, stop)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Annotations []annotation `json:"annotations"`
+	}{annotations})
+}
+
+func deleteAnnotation(w http.ResponseWriter, r *http.Request) {
+	userID, id := param(r, "user_id"), param(r, "id")
+	// Delete predicates can't escape quotes, so a user ID containing one could
+	// never be matched.
+	if !annotationIDPattern.MatchString(id) || strings.ContainsAny(userID, `"\`) {
+		handleError(w, errAnnotationNotFound)
+		return
+	}
+	annotations, err := findAnnotations(r.Context(), userID, id, time.Unix(0, 0), maxAnnotationTime)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if len(annotations) == 0 {
+		handleError(w, errAnnotationNotFound)
+		return
+	}
+	predicate := fmt.Sprintf(`_measurement="%s" AND user_id="%s" AND annotation_id="%s"`, annotationsMeasurement, userID, id)
+	at := annotations[0].Time
+	org := organizationOf(r.Context())
+	if err := org.client.DeleteAPI().DeleteWithName(r.Context(), org.name, org.bucket, at, at.Add(time.Nanosecond), predicate); err != nil {
+		handleError(w, err)
+		return
+	}
+	cache.invalidate(r.Context(), userID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// findAnnotations returns the annotations of a user within a time range,
+// oldest first, or only the one with the given ID if id is not empty.
+func findAnnotations(ctx context.Context, userID, id string, start, stop time.Time) ([]annotation, error) {
+	if err := authorize(ctx, userID); err != nil {
+		return nil, err
+	}
+	org := organizationOf(ctx)
+	builder := flux.From(org.bucket).
+		RangeBetween(flux.Time(start), flux.Time(stop)).
+		Filter(flux.Measurement(annotationsMeasurement)).
+		Filter(flux.Tag("user_id", userID))
+	if id != "" {
+		builder = builder.Filter(flux.Tag("annotation_id", id))
+	}
+	query, params := builder.Render()
+	result, err := cache.get(ctx, cacheEndpointAnnotations, userID, query, params, func() (interface{}, error) {
+		return queryAnnotations(ctx, userID, query, params)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.([]annotation), nil
+}
+
+// queryAnnotations runs a query for the annotations of a user, and returns them
+// oldest first.
+func queryAnnotations(ctx context.Context, userID, query string, params map[string]string) ([]annotation, error) {
+	tables, err := organizationOf(ctx).queryAPI.QueryWithParams(ctx, query, params)
+	if err != nil {
+		return nil, err
+	}
+	defer tables.Close()
+
+	// Each field of an annotation is a separate record, so gather them by ID.
+	byID := make(map[string]*annotation)
+	for tables.Next() {
+		record := tables.Record()
+		id, _ := record.ValueByKey("annotation_id").(string)
+		a, ok := byID[id]
+		if !ok {
+			a = &annotation{ID: id, UserID: userID, Time: record.Time().UTC(), Tags: []string{}}
+			byID[id] = a
+		}
+		value, _ := record.Value().(string)
+		switch record.Field() {
+		case "title":
+			a.Title = value
+		case "text":
+			a.Text = value
+		case "tags":
+			if value != "" {
+				a.Tags = strings.Split(value, ",")
+			}
+		}
+	}
+	if err := tables.Err(); err != nil {
+		return nil, err
+	}
+
+	annotations := make([]annotation, 0, len(byID))
+	for _, a := range byID {
+		annotations = append(annotations, *a)
+	}
+	sort.Slice(annotations, func(i, j int) bool {
+		if annotations[i].Time.Equal(annotations[j].Time) {
+			return annotations[i].ID < annotations[j].ID
+		}
+		return annotations[i].Time.Before(annotations[j].Time)
+	})
+	return annotations, nil
+}
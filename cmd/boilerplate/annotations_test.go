@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// createTestAnnotation annotates the data of a user at a time, with the key of
+// the user, and returns the annotation created.
+func createTestAnnotation(t *testing.T, app *testApp, userID, key, title string, at time.Time) annotation {
+	t.Helper()
+	resp, body := app.do(t, http.MethodPost, "/users/"+userID+"/annotations", key,
+		fmt.Sprintf(`{"title":%q,"text":"details","tags":["firmware","v2"],"time":%q}`, title, at.Format(time.RFC3339)))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d (%s) creating %q, want 201", resp.StatusCode, body, title)
+	}
+	var created annotation
+	if err := json.Unmarshal([]byte(body), &created); err != nil {
+		t.Fatal(err)
+	}
+	return created
+}
+
+// listTestAnnotations lists the annotations of user1 with the query, and
+// returns their titles.
+func listTestAnnotations(t *testing.T, app *testApp, query string) []string {
+	t.Helper()
+	resp, body := app.do(t, http.MethodGet, "/users/user1/annotations?"+query, "key1", "")
+	var listed struct {
+		Annotations []annotation `json:"annotations"`
+	}
+	if err := json.Unmarshal([]byte(body), &listed); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d (%s) listing annotations, want 200", resp.StatusCode, body)
+	}
+	titles := []string{}
+	for _, a := range listed.Annotations {
+		if a.UserID != "user1" || a.Text != "details" || fmt.Sprint(a.Tags) != "[firmware v2]" {
+			t.Errorf("got annotation %+v, want one of user1 with its text and tags", a)
+		}
+		titles = append(titles, a.Title)
+	}
+	return titles
+}
+
+func TestAnnotations(t *testing.T) {
+	app := newTestApp(t)
+	now := time.Now().Truncate(time.Second)
+	createTestAnnotation(t, app, "user1", "key1", "first", now.Add(-3*time.Hour))
+	second := createTestAnnotation(t, app, "user1", "key1", "second", now.Add(-2*time.Hour))
+	createTestAnnotation(t, app, "user1", "key1", "third", now.Add(-time.Hour))
+	createTestAnnotation(t, app, "user2", "key2", "other", now.Add(-2*time.Hour))
+
+	// Annotations are listed oldest first, by user and within the time range.
+	if got := listTestAnnotations(t, app, ""); fmt.Sprint(got) != "[first second third]" {
+		t.Errorf("got annotations %v, want first, second and third", got)
+	}
+	timeRange := url.Values{
+		"start": {now.Add(-150 * time.Minute).Format(time.RFC3339)},
+		"stop":  {now.Add(-90 * time.Minute).Format(time.RFC3339)},
+	}
+	if got := listTestAnnotations(t, app, timeRange.Encode()); fmt.Sprint(got) != "[second]" {
+		t.Errorf("got annotations %v within %v, want second", got, timeRange)
+	}
+	resp, body := app.do(t, http.MethodGet, "/users/user1/annotations?start=yesterday", "key1", "")
+	if resp.StatusCode != http.StatusBadRequest || errorCode(t, body) != errorCodeInvalidRequest {
+		t.Errorf("got status %d (%s) for an invalid start, want 400", resp.StatusCode, body)
+	}
+	if resp, body := app.do(t, http.MethodGet, "/users/user1/annotations", "key2", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got status %d (%s) listing another user's annotations, want 403", resp.StatusCode, body)
+	}
+	resp, body = app.do(t, http.MethodPost, "/users/user1/annotations", "key1", `{"title":"bad","tags":["a,b"]}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d (%s) for a tag with a comma, want 400", resp.StatusCode, body)
+	}
+
+	if resp, body := app.do(t, http.MethodDelete, "/users/user1/annotations/"+second.ID, "key2", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got status %d (%s) deleting another user's annotation, want 403", resp.StatusCode, body)
+	}
+	if resp, body := app.do(t, http.MethodDelete, "/users/user1/annotations/"+second.ID, "key1", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("got status %d (%s) deleting an annotation, want 204", resp.StatusCode, body)
+	}
+	if got := listTestAnnotations(t, app, ""); fmt.Sprint(got) != "[first third]" {
+		t.Errorf("got annotations %v after deleting second, want first and third", got)
+	}
+	resp, body = app.do(t, http.MethodDelete, "/users/user1/annotations/"+second.ID, "key1", "")
+	if resp.StatusCode != http.StatusNotFound || errorCode(t, body) != errorCodeNotFound {
+		t.Errorf("got status %d (%s) deleting the annotation again, want 404", resp.StatusCode, body)
+	}
+}
+
+func TestQueryIncludesAnnotations(t *testing.T) {
+	app := newTestApp(t)
+	now := time.Now().Truncate(time.Minute)
+	writeRollups(t, app, "rollup_1m,user_id=user1,_source=measurement1 field1_mean=1.5 "+formatNanos(now.Add(-time.Hour)))
+	createTestAnnotation(t, app, "user1", "key1", "recent", now.Add(-time.Hour))
+	createTestAnnotation(t, app, "user1", "key1", "old", now.Add(-48*time.Hour))
+	createTestAnnotation(t, app, "user2", "key2", "other", now.Add(-time.Hour))
+
+	for _, test := range []struct {
+		method, path, body string
+	}{
+		{http.MethodGet, "/users/user1/points?include_annotations=true", ""},
+		{http.MethodPost, "/query", `{"user_id":"user1","include_annotations":true}`},
+	} {
+		resp, body := app.do(t, test.method, test.path, "key1", test.body)
+		var response struct {
+			Tables []struct {
+				Records []map[string]string `json:"records"`
+			} `json:"tables"`
+			Annotations []annotation `json:"annotations"`
+		}
+		if err := json.Unmarshal([]byte(body), &response); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s: got status %d (%s), want 200", test.method, test.path, resp.StatusCode, body)
+		}
+		// Only the annotations of the user within the queried range are returned.
+		if len(response.Annotations) != 1 || response.Annotations[0].Title != "recent" {
+			t.Errorf("%s %s: got annotations %+v, want the recent one of user1", test.method, test.path, response.Annotations)
+		}
+		// Annotations are not mistaken for the user's data.
+		if len(response.Tables) != 1 || len(response.Tables[0].Records) != 1 {
+			t.Errorf("%s %s: got tables %+v, want a single record", test.method, test.path, response.Tables)
+		}
+	}
+
+	resp, body := app.do(t, http.MethodGet, "/users/user1/points", "key1", "")
+	if resp.StatusCode != http.StatusOK || containsKey(t, body, "annotations") {
+		t.Errorf("got status %d (%s) without include_annotations, want no annotations", resp.StatusCode, body)
+	}
+}
+
+// containsKey reports whether a JSON object has a key.
+func containsKey(t *testing.T, body, key string) bool {
+	t.Helper()
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(body), &object); err != nil {
+		t.Fatal(err)
+	}
+	_, ok := object[key]
+	return ok
+}
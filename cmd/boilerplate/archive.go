@@ -0,0 +1,571 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	influxquery "github.com/influxdata/influxdb-client-go/v2/api/query"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+
+	"github.com/influxdata/go-snippets/internal/flux"
+)
+
+const (
+	// archiveVersion is the version of the archive format written by export.
+	archiveVersion = 1
+	// archiveManifestName is the name of the manifest in an archive.
+	archiveManifestName = "manifest.json"
+	// archiveChunkPoints is the number of points an exported chunk holds at most.
+	archiveChunkPoints = 10000
+	// importBatchSize is the number of points written at a time during an import.
+	importBatchSize = 5000
+	// maxImportSize is the size of the largest archive that can be imported.
+	maxImportSize = 1 << 30
+)
+
+// archiveManifest describes the contents of an archive of a user's data. It is
+// the last file in the archive, after the chunks it describes.
+type archiveManifest struct {
+	Version      int                  `json:"version"`
+	UserID       string               `json:"user_id"`
+	Bucket       string               `json:"bucket"`
+	Start        time.Time            `json:"start"`
+	Stop         time.Time            `json:"stop"`
+	ExportedAt   time.Time            `json:"exported_at"`
+	Measurements []archiveMeasurement `json:"measurements"`
+	Chunks       []archiveChunk       `json:"chunks"`
+}
+
+// archiveMeasurement summarises the data of one measurement in an archive.
+type archiveMeasurement struct {
+	Name   string    `json:"name"`
+	First  time.Time `json:"first"`
+	Last   time.Time `json:"last"`
+	Points int       `json:"points"`
+}
+
+// archiveChunk describes one file of line protocol in an archive, holding
+// points of a single measurement with one field each.
+type archiveChunk struct {
+	File        string    `json:"file"`
+	Measurement string    `json:"measurement"`
+	First       time.Time `json:"first"`
+	Last        time.Time `json:"last"`
+	Points      int       `json:"points"`
+	// SHA256 is the hex encoded SHA-256 checksum of the file.
+	SHA256 string `json:"sha256"`
+}
+
+var (
+	// errCorruptArchive is returned when an archive does not match its manifest.
+	errCorruptArchive = errors.New("corrupt archive")
+	// errImportInProgress is returned when the same archive is already being
+	// imported into the same bucket.
+	errImportInProgress = errors.New("the archive is already being imported into this bucket")
+)
+
+// parseTimeRange parses the start and stop query parameters as RFC 3339
+// timestamps, defaulting to the Unix epoch and the current time.
+func parseTimeRange(values url.Values) (time.Time, time.Time, error) {
+	start, stop := time.Unix(0, 0).UTC(), time.Now().UTC()
+	for name, value := range map[string]*time.Time{"start": &start, "stop": &stop} {
+		if values.Get(name) == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339Nano, values.Get(name))
+		if err != nil {
+			return start, stop, fmt.Errorf("invalid %s: %v", name, err)
+		}
+		*value = parsed.UTC()
+	}
+	if !start.Before(stop) {
+		return start, stop, errors.New("start must be before stop")
+	}
+	return start, stop, nil
+}
+
+// exportUserData downloads the data of a user within a time range as a gzip
+// compressed tar archive. The archive holds the points in line protocol,
+// split into chunks of at most 10,000 points of a single measurement, followed
+// by a manifest listing the measurements, their time ranges and point counts,
+// and the checksum of every chunk.
+//
+// Note that "user" here refers to a user in your application, not an InfluxDB user.
+//
+// GET /export?user_id=user1 to download all of a user's data, and add start
+// and stop parameters as RFC 3339 timestamps to limit it to a time range.
+func exportUserData(w http.ResponseWriter, r *http.Request) {
+	userID := param(r, "user_id")
+	start, stop, err := parseTimeRange(r.URL.Query())
+	if err != nil {
+		handleError(w, invalidRequest("%v", err))
+		return
+	}
+	if err := authorize(r.Context(), userID); err != nil {
+		handleError(w, err)
+		return
+	}
+
+	org := organizationOf(r.Context())
+	query, params := flux.From(org.bucket).
+		RangeBetween(flux.Time(start), flux.Time(stop)).
+		Filter(flux.Tag("user_id", userID)).
+		Sort("_time").
+		Render()
+	tables, err := org.queryAPI.QueryWithParams(r.Context(), query, params)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	defer tables.Close()
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q",
+		fmt.Sprintf("%s-%s.tar.gz", url.PathEscape(userID), start.Format("20060102T150405Z"))))
+	manifest := archiveManifest{
+		Version:    archiveVersion,
+		UserID:     userID,
+		Bucket:     org.bucket,
+		Start:      start,
+		Stop:       stop,
+		ExportedAt: time.Now().UTC(),
+	}
+	if err := writeArchive(w, tables, &manifest); err != nil {
+		// The response has already begun, so abort it rather than let the
+		// client mistake a truncated archive for a complete one.
+		log.Printf("Failed to export the data of user %q: %v", userID, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// writeArchive writes the records of a query result to w as an archive, and
+// completes the manifest with its contents.
+func writeArchive(w io.Writer, tables *api.QueryTableResult, manifest *archiveManifest) error {
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+
+	var data bytes.Buffer
+	var chunk archiveChunk
+	flush := func() error {
+		if chunk.Points == 0 {
+			return nil
+		}
+		checksum := sha256.Sum256(data.Bytes())
+		chunk.File = fmt.Sprintf("chunks/%06d.lp", len(manifest.Chunks)+1)
+		chunk.SHA256 = hex.EncodeToString(checksum[:])
+		if err := writeArchiveFile(archive, chunk.File, data.Bytes(), manifest.ExportedAt); err != nil {
+			return err
+		}
+		manifest.Chunks = append(manifest.Chunks, chunk)
+		data.Reset()
+		chunk = archiveChunk{}
+		return nil
+	}
+
+	for tables.Next() {
+		record := tables.Record()
+		if chunk.Points > 0 && (record.Measurement() != chunk.Measurement || chunk.Points >= archiveChunkPoints) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		line, err := recordLineProtocol(record)
+		if err != nil {
+			return err
+		}
+		if chunk.Points == 0 {
+			chunk.Measurement, chunk.First, chunk.Last = record.Measurement(), record.Time(), record.Time()
+		}
+		if record.Time().Before(chunk.First) {
+			chunk.First = record.Time()
+		}
+		if record.Time().After(chunk.Last) {
+			chunk.Last = record.Time()
+		}
+		data.WriteString(line)
+		chunk.Points++
+	}
+	if err := tables.Err(); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	// Summarise the chunks of each measurement.
+	measurements := make(map[string]*archiveMeasurement)
+	for _, chunk := range manifest.Chunks {
+		summary, ok := measurements[chunk.Measurement]
+		if !ok {
+			summary = &archiveMeasurement{Name: chunk.Measurement, First: chunk.First, Last: chunk.Last}
+			measurements[chunk.Measurement] = summary
+		}
+		if chunk.First.Before(summary.First) {
+			summary.First = chunk.First
+		}
+		if chunk.Last.After(summary.Last) {
+			summary.Last = chunk.Last
+		}
+		summary.Points += chunk.Points
+	}
+	manifest.Measurements = make([]archiveMeasurement, 0, len(measurements))
+	for _, summary := range measurements {
+		manifest.Measurements = append(manifest.Measurements, *summary)
+	}
+	sort.Slice(manifest.Measurements, func(i, j int) bool {
+		return manifest.Measurements[i].Name < manifest.Measurements[j].Name
+	})
+	if manifest.Chunks == nil {
+		manifest.Chunks = []archiveChunk{}
+	}
+
+	encoded, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeArchiveFile(archive, archiveManifestName, encoded, manifest.ExportedAt); err != nil {
+		return err
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeArchiveFile(archive *tar.Writer, name string, data []byte, modified time.Time) error {
+	header := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), ModTime: modified}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := archive.Write(data)
+	return err
+}
+
+// nonTagColumns are the columns of a query result that are not tags.
+var nonTagColumns = map[string]bool{
+	"result": true, "table": true, "_start": true, "_stop": true,
+	"_time": true, "_value": true, "_field": true, "_measurement": true,
+}
+
+// recordLineProtocol formats a record of a query result as a point in line
+// protocol, with its string columns as tags and nanosecond precision.
+func recordLineProtocol(record *influxquery.FluxRecord) (string, error) {
+	tags := make(map[string]string)
+	for column, value := range record.Values() {
+		if value, ok := value.(string); ok && !nonTagColumns[column] && value != "" {
+			tags[column] = value
+		}
+	}
+	switch record.Value().(type) {
+	case float64, int64, uint64, string, bool:
+	default:
+		return "", fmt.Errorf("field %q of measurement %q has unsupported value %v", record.Field(), record.Measurement(), record.Value())
+	}
+	point := write.NewPoint(record.Measurement(), tags, map[string]interface{}{record.Field(): record.Value()}, record.Time())
+	return write.PointToLineProtocol(point, time.Nanosecond), nil
+}
+
+// importDir is the directory the progress of imports is kept in, and is read
+// from the BOILERPLATE_IMPORT_DIR environment variable. It defaults to "imports".
+var importDir = os.Getenv("BOILERPLATE_IMPORT_DIR")
+
+// importProgress records which chunks of an archive have been written to a
+// bucket, so that an interrupted import resumes where it left off.
+type importProgress struct {
+	ID           string     `json:"id"`
+	Organization string     `json:"organization"`
+	Bucket       string     `json:"bucket"`
+	UserID       string     `json:"user_id"`
+	Chunks       int        `json:"chunks"`
+	Completed    []string   `json:"completed"`
+	Points       int        `json:"points"`
+	Started      time.Time  `json:"started"`
+	Finished     *time.Time `json:"finished,omitempty"`
+}
+
+var (
+	importsMu sync.Mutex
+	// importsRunning holds the IDs of the imports in progress.
+	importsRunning = make(map[string]bool)
+)
+
+// importUserData replays an archive made by exportUserData into a bucket,
+// which defaults to the bucket of this application. The archive is verified
+// against the checksums and point counts in its manifest before anything is
+// written.
+//
+// Each chunk is recorded once it is written, so if an import is interrupted,
+// post the same archive again to resume it: chunks already written are
+// skipped. Writing a chunk again after an interruption part way through it is
+// safe, as points with the same series and timestamp overwrite each other.
+//
+// POST an archive to /admin/import?bucket=<bucket> to test this endpoint.
+func importUserData(w http.ResponseWriter, r *http.Request) {
+	org := organizationOf(r.Context())
+	bucket := r.URL.Query().Get("bucket")
+	if bucket == "" {
+		bucket = org.bucket
+	}
+	if err := os.MkdirAll(importDir, 0o755); err != nil {
+		handleError(w, err)
+		return
+	}
+
+	// Spool the archive to disk, as it is read twice: once to verify it and once
+	// to write it.
+	upload, err := ioutil.TempFile(importDir, "upload-*.tar.gz")
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	defer os.Remove(upload.Name())
+	defer upload.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(upload, hash), http.MaxBytesReader(w, r.Body, maxImportSize)); err != nil {
+		handleError(w, invalidRequest("failed to read the archive: %v", err))
+		return
+	}
+
+	// The import is identified by the archive, the organization and the bucket,
+	// so that posting the same archive again resumes it.
+	id := fingerprint(hash.Sum(nil), []byte(org.name), []byte(bucket))[:32]
+	importsMu.Lock()
+	if importsRunning[id] {
+		importsMu.Unlock()
+		handleError(w, errImportInProgress)
+		return
+	}
+	importsRunning[id] = true
+	importsMu.Unlock()
+	defer func() {
+		importsMu.Lock()
+		delete(importsRunning, id)
+		importsMu.Unlock()
+	}()
+
+	manifest, err := verifyArchive(upload.Name())
+	if err != nil {
+		handleError(w, invalidRequest("%v", err))
+		return
+	}
+	progress, err := loadImportProgress(id)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if progress == nil {
+		progress = &importProgress{
+			ID:           id,
+			Organization: org.name,
+			Bucket:       bucket,
+			UserID:       manifest.UserID,
+			Chunks:       len(manifest.Chunks),
+			Completed:    []string{},
+			Started:      time.Now().UTC(),
+		}
+	}
+	err = replayArchive(r.Context(), upload.Name(), progress)
+	cache.invalidate(r.Context(), progress.UserID)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(progress)
+}
+
+// verifyArchive checks that every chunk of the archive at path is listed in
+// its manifest with the right checksum and point count, and returns the manifest.
+func verifyArchive(path string) (*archiveManifest, error) {
+	type chunkSummary struct {
+		checksum string
+		points   int
+	}
+	var manifest *archiveManifest
+	chunks := make(map[string]chunkSummary)
+	err := readArchive(path, func(name string, data io.Reader) error {
+		if name == archiveManifestName {
+			manifest = &archiveManifest{}
+			if err := json.NewDecoder(data).Decode(manifest); err != nil {
+				return fmt.Errorf("%w: invalid manifest: %v", errCorruptArchive, err)
+			}
+			return nil
+		}
+		hash := sha256.New()
+		points := 0
+		reader := bufio.NewReader(io.TeeReader(data, hash))
+		for {
+			line, err := reader.ReadString('\n')
+			if strings.TrimSpace(line) != "" {
+				points++
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		chunks[name] = chunkSummary{hex.EncodeToString(hash.Sum(nil)), points}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("%w: missing %s", errCorruptArchive, archiveManifestName)
+	}
+	if manifest.Version != archiveVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", errCorruptArchive, manifest.Version)
+	}
+	for _, chunk := range manifest.Chunks {
+		summary, ok := chunks[chunk.File]
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("%w: missing chunk %s", errCorruptArchive, chunk.File)
+		case summary.checksum != chunk.SHA256:
+			return nil, fmt.Errorf("%w: checksum mismatch in chunk %s", errCorruptArchive, chunk.File)
+		case summary.points != chunk.Points:
+			return nil, fmt.Errorf("%w: chunk %s has %d points, expected %d", errCorruptArchive, chunk.File, summary.points, chunk.Points)
+		}
+		delete(chunks, chunk.File)
+	}
+	if len(chunks) > 0 {
+		unexpected := make([]string, 0, len(chunks))
+		for name := range chunks {
+			unexpected = append(unexpected, name)
+		}
+		sort.Strings(unexpected)
+		return nil, fmt.Errorf("%w: unexpected files %s", errCorruptArchive, strings.Join(unexpected, ", "))
+	}
+	return manifest, nil
+}
+
+// readArchive calls fn with the name and contents of each file in the archive at path.
+func readArchive(path string, fn func(name string, data io.Reader) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errCorruptArchive, err)
+	}
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", errCorruptArchive, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(header.Name, archive); err != nil {
+			return err
+		}
+	}
+}
+
+// replayArchive writes the chunks of a verified archive that progress does not
+// list as completed, recording each one as it is written.
+func replayArchive(ctx context.Context, path string, progress *importProgress) error {
+	writer := organizationOf(ctx).client.WriteAPIBlocking(progress.Organization, progress.Bucket)
+	completed := make(map[string]bool)
+	for _, name := range progress.Completed {
+		completed[name] = true
+	}
+	err := readArchive(path, func(name string, data io.Reader) error {
+		if name == archiveManifestName || completed[name] {
+			return nil
+		}
+		reader := bufio.NewReader(data)
+		var batch []string
+		points := 0
+		for {
+			line, err := reader.ReadString('\n')
+			if line = strings.TrimSpace(line); line != "" {
+				batch = append(batch, line)
+			}
+			if len(batch) == importBatchSize || (err == io.EOF && len(batch) > 0) {
+				if err := writer.WriteRecord(ctx, batch...); err != nil {
+					return fmt.Errorf("failed to write chunk %s: %w", name, err)
+				}
+				points += len(batch)
+				batch = batch[:0]
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		progress.Completed = append(progress.Completed, name)
+		progress.Points += points
+		return saveImportProgress(progress)
+	})
+	if err != nil {
+		return err
+	}
+	if progress.Finished == nil {
+		finished := time.Now().UTC()
+		progress.Finished = &finished
+		return saveImportProgress(progress)
+	}
+	return nil
+}
+
+func importProgressPath(id string) string {
+	return filepath.Join(importDir, id+".json")
+}
+
+// loadImportProgress returns the progress of an import, or nil if it has not started.
+func loadImportProgress(id string) (*importProgress, error) {
+	data, err := ioutil.ReadFile(importProgressPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var progress importProgress
+	return &progress, json.Unmarshal(data, &progress)
+}
+
+// saveImportProgress durably records the progress of an import.
+func saveImportProgress(progress *importProgress) error {
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	path := importProgressPath(progress.ID)
+	if err := ioutil.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/go-snippets/internal/fakeinflux"
+)
+
+// archiveFile is a file of an archive.
+type archiveFile struct {
+	name string
+	data []byte
+}
+
+// exportTestArchive writes points for user1 and user2 and exports those of
+// user1 with the /export endpoint, returning the archive and its files.
+func exportTestArchive(t *testing.T, app *testApp) ([]byte, []archiveFile) {
+	t.Helper()
+	now := time.Now().Truncate(time.Second)
+	writeRollups(t, app,
+		"m1,user_id=user1 field1=1 "+formatNanos(now.Add(-2*time.Minute)),
+		"m1,user_id=user1 field1=2 "+formatNanos(now.Add(-time.Minute)),
+		"m2,user_id=user1 field1=3 "+formatNanos(now),
+		"m1,user_id=user2 field1=4 "+formatNanos(now))
+
+	resp, body := app.do(t, http.MethodGet, "/users/user1/export", "key1", "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/gzip" {
+		t.Fatalf("got status %d and type %q (%s), want an archive", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+	return []byte(body), readTestArchive(t, []byte(body))
+}
+
+// readTestArchive returns the files of an archive in order.
+func readTestArchive(t *testing.T, archive []byte) []archiveFile {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := tar.NewReader(gz)
+	var files []archiveFile
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, archiveFile{header.Name, data})
+	}
+}
+
+// writeTestArchive returns an archive of files.
+func writeTestArchive(t *testing.T, files []archiveFile) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	archive := tar.NewWriter(gz)
+	for _, file := range files {
+		if err := writeArchiveFile(archive, file.name, file.data, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// postArchive imports an archive into a bucket with the /admin/import endpoint.
+func postArchive(t *testing.T, app *testApp, bucket string, archive []byte) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, app.url+"/admin/import?bucket="+bucket, bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer admin-key")
+	req.Header.Set("Content-Type", "application/gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+// bucketPoints returns the points InfluxDB holds in a bucket.
+func bucketPoints(app *testApp, bucket string) []fakeinflux.Point {
+	var points []fakeinflux.Point
+	for _, point := range app.influx.Points() {
+		if point.Bucket == bucket {
+			points = append(points, point)
+		}
+	}
+	return points
+}
+
+func TestExportUserData(t *testing.T) {
+	app := newTestApp(t)
+	_, files := exportTestArchive(t, app)
+
+	last := files[len(files)-1]
+	if last.name != archiveManifestName {
+		t.Fatalf("the last file is %s, want the manifest", last.name)
+	}
+	var manifest archiveManifest
+	if err := json.Unmarshal(last.data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Version != archiveVersion || manifest.UserID != "user1" || manifest.Bucket != "my-bucket" {
+		t.Errorf("got manifest version %d for user %q of bucket %q", manifest.Version, manifest.UserID, manifest.Bucket)
+	}
+	points := make(map[string]int)
+	for _, measurement := range manifest.Measurements {
+		points[measurement.Name] = measurement.Points
+	}
+	if len(points) != 2 || points["m1"] != 2 || points["m2"] != 1 {
+		t.Errorf("got measurements %+v, want 2 points of m1 and 1 of m2", manifest.Measurements)
+	}
+
+	// Each chunk holds the points of one measurement of user1, and is listed
+	// with its checksum.
+	if len(manifest.Chunks) != 2 || len(files) != 3 {
+		t.Fatalf("got chunks %+v in %d files, want 2 chunks and the manifest", manifest.Chunks, len(files))
+	}
+	for i, chunk := range manifest.Chunks {
+		file := files[i]
+		checksum := sha256.Sum256(file.data)
+		if file.name != chunk.File || hex.EncodeToString(checksum[:]) != chunk.SHA256 {
+			t.Errorf("chunk %s has checksum %s, but the manifest lists %s with %s", file.name, hex.EncodeToString(checksum[:]), chunk.File, chunk.SHA256)
+		}
+		lines := strings.Split(strings.TrimSpace(string(file.data)), "\n")
+		if len(lines) != chunk.Points {
+			t.Errorf("chunk %s has %d points, want %d", file.name, len(lines), chunk.Points)
+		}
+		for _, line := range lines {
+			if !strings.HasPrefix(line, chunk.Measurement+",") || !strings.Contains(line, "user_id=user1") {
+				t.Errorf("chunk %s of %s holds %q", file.name, chunk.Measurement, line)
+			}
+		}
+	}
+
+	resp, body := app.do(t, http.MethodGet, "/users/user1/export", "key2", "")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got status %d (%s) exporting another user's data, want 403", resp.StatusCode, body)
+	}
+}
+
+func TestImportUserDataResumes(t *testing.T) {
+	app := newTestApp(t)
+	archive, files := exportTestArchive(t, app)
+	app.influx.CreateBucket(app.orgID, "imported")
+
+	// Record the first chunk as written, as an import interrupted after it would.
+	checksum := sha256.Sum256(archive)
+	progress := &importProgress{
+		ID:           fingerprint(checksum[:], []byte("my-org"), []byte("imported"))[:32],
+		Organization: "my-org",
+		Bucket:       "imported",
+		UserID:       "user1",
+		Chunks:       2,
+		Completed:    []string{files[0].name},
+		Points:       2,
+		Started:      time.Now().UTC(),
+	}
+	if err := os.MkdirAll(importDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveImportProgress(progress); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next attempt fails while writing the second chunk, and resumes from
+	// it when the archive is posted again.
+	app.influx.FailNext("/api/v2/write", http.StatusServiceUnavailable, "overloaded", 0)
+	if resp, body := postArchive(t, app, "imported", archive); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d (%s) when InfluxDB is unavailable, want 503", resp.StatusCode, body)
+	}
+	resp, body := postArchive(t, app, "imported", archive)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d (%s) resuming the import, want 200", resp.StatusCode, body)
+	}
+	var finished importProgress
+	if err := json.Unmarshal([]byte(body), &finished); err != nil {
+		t.Fatal(err)
+	}
+	if finished.ID != progress.ID || len(finished.Completed) != 2 || finished.Points != 3 || finished.Finished == nil {
+		t.Errorf("got progress %+v, want both chunks and 3 points written", finished)
+	}
+	// Only the second chunk, which holds the point of m2, was written.
+	if points := bucketPoints(app, "imported"); len(points) != 1 || points[0].Measurement != "m2" || points[0].Tags["user_id"] != "user1" {
+		t.Errorf("imported %+v, want the point of m2 only", points)
+	}
+
+	// Posting the archive once it is imported writes nothing more.
+	if resp, body := postArchive(t, app, "imported", archive); resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d (%s) posting an imported archive, want 200", resp.StatusCode, body)
+	}
+	if points := bucketPoints(app, "imported"); len(points) != 1 {
+		t.Errorf("got %d points after posting the archive again, want 1", len(points))
+	}
+}
+
+func TestImportUserDataRejectsTamperedArchives(t *testing.T) {
+	app := newTestApp(t)
+	_, files := exportTestArchive(t, app)
+	app.influx.CreateBucket(app.orgID, "imported")
+
+	// Change a value of the first chunk, keeping its number of points.
+	tampered := append([]archiveFile{}, files...)
+	tampered[0].data = bytes.Replace(files[0].data, []byte("field1=1"), []byte("field1=9"), 1)
+	if bytes.Equal(tampered[0].data, files[0].data) {
+		t.Fatalf("failed to tamper with chunk %s:\n%s", files[0].name, files[0].data)
+	}
+	resp, body := postArchive(t, app, "imported", writeTestArchive(t, tampered))
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, "checksum mismatch") {
+		t.Errorf("got status %d (%s), want 400 for a checksum mismatch", resp.StatusCode, body)
+	}
+	if points := bucketPoints(app, "imported"); len(points) != 0 {
+		t.Errorf("imported %d points from a tampered archive, want none", len(points))
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditEntry records an administrative action, such as erasing a user's data.
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	// RemoteAddr is the address the action was requested from.
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// Details describes what the action did.
+	Details interface{} `json:"details,omitempty"`
+	// Error is set when the action failed, possibly after doing part of its work.
+	Error string `json:"error,omitempty"`
+}
+
+// auditLog is an append-only file of JSON encoded audit entries, one per line,
+// that lets you show when and how administrative actions were carried out.
+type auditLog struct {
+	path string
+	mu   sync.Mutex
+}
+
+// audit records the administrative actions taken through the admin API.
+var audit *auditLog
+
+// openAuditLog opens the audit log at path, creating it if needed.
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{path: path}, file.Close()
+}
+
+// record durably appends an entry to the log, stamping it with the current time.
+func (a *auditLog) record(entry auditEntry) error {
+	entry.Time = time.Now().UTC()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// apiKeys maps each API key accepted by your app to the user it authenticates,
+// and is read from the BOILERPLATE_API_KEYS environment variable formatted as a
+// comma-separated list of key:user_id pairs, e.g. "key1:user1,key2:user2". A
+// key may also be bound to the organization the user belongs to when your app
+// serves several, as in "key1:user1:eu".
+//
+// When no keys are configured, requests are not authenticated and any caller
+// may access the data of any user, which is convenient while you get started.
+// A real-world production app should store keys securely rather than in its
+// environment, and should never run without authentication.
+var apiKeys = parseAPIKeys(os.Getenv("BOILERPLATE_API_KEYS"))
+
+// errUnauthenticated is returned when a request has no valid API key.
+var errUnauthenticated = errors.New("missing or invalid API key")
+
+// errForbidden is returned when the caller may not access the requested user's data.
+var errForbidden = errors.New("access to the requested user is forbidden")
+
+// apiKey identifies the user an API key authenticates and, optionally, the
+// organization the user belongs to.
+type apiKey struct {
+	userID       string
+	organization string
+}
+
+// parseAPIKeys parses a comma-separated list of key:user_id pairs, each
+// optionally followed by :organization.
+func parseAPIKeys(value string) map[string]apiKey {
+	keys := make(map[string]apiKey)
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 3)
+		if len(parts) >= 2 && parts[0] != "" && parts[1] != "" {
+			key := apiKey{userID: parts[1]}
+			if len(parts) == 3 {
+				key.organization = parts[2]
+			}
+			keys[parts[0]] = key
+		}
+	}
+	return keys
+}
+
+// callerKey is the context key of the user authenticated for a request.
+type callerKey struct{}
+
+// callerOrganizationKey is the context key of the organization the API key of
+// a request is bound to.
+type callerOrganizationKey struct{}
+
+// authenticate returns a context carrying the user identified by the provided
+// API key, or errUnauthenticated if the key is unknown. The context is returned
+// unchanged when authentication is disabled.
+func authenticate(ctx context.Context, key string) (context.Context, error) {
+	if len(apiKeys) == 0 {
+		return ctx, nil
+	}
+	apiKey, ok := apiKeys[key]
+	if !ok {
+		return ctx, errUnauthenticated
+	}
+	ctx = context.WithValue(ctx, callerKey{}, apiKey.userID)
+	if apiKey.organization != "" {
+		ctx = context.WithValue(ctx, callerOrganizationKey{}, apiKey.organization)
+	}
+	return ctx, nil
+}
+
+// caller returns the user authenticated for a request, if any.
+func caller(ctx context.Context) (string, bool) {
+	userID, ok := ctx.Value(callerKey{}).(string)
+	return userID, ok
+}
+
+// callerOrganization returns the organization the caller's API key is bound to, if any.
+func callerOrganization(ctx context.Context) (string, bool) {
+	org, ok := ctx.Value(callerOrganizationKey{}).(string)
+	return org, ok
+}
+
+// authorize returns errForbidden unless the caller may access the data of the
+// user identified by userID. Callers may only access their own data.
+func authorize(ctx context.Context, userID string) error {
+	authenticated, ok := caller(ctx)
+	if !ok {
+		if len(apiKeys) == 0 {
+			return nil
+		}
+		return errForbidden
+	}
+	if authenticated != userID {
+		return errForbidden
+	}
+	return nil
+}
+
+// authenticated is a middleware that authenticates the caller with the API key
+// passed as a bearer token in the Authorization header, and returns a 401
+// http.StatusUnauthorized if it is missing or invalid. Requests without a key
+// over a connection with a verified client certificate are authenticated by
+// the certificate instead. See tls.go for details.
+func authenticated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if key == "" {
+			if ctx, ok := authenticateCertificate(r.Context(), r.TLS); ok {
+				handler(w, r.WithContext(ctx))
+				return
+			}
+		}
+		ctx, err := authenticate(r.Context(), key)
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		handler(w, r.WithContext(ctx))
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// queryCacheSize is the number of query results the query cache holds, and
+	// is read from the BOILERPLATE_QUERY_CACHE_SIZE environment variable. It
+	// defaults to 1000, and 0 disables the cache.
+	queryCacheSize = os.Getenv("BOILERPLATE_QUERY_CACHE_SIZE")
+	// queryCacheTTLs overrides how long the results of the queries of each
+	// endpoint are cached for, and is read from the BOILERPLATE_QUERY_CACHE_TTLS
+	// environment variable as a comma-separated list of endpoint=duration
+	// pairs, e.g. "points=10s,annotations=5m". A duration of 0 disables caching
+	// for the endpoint.
+	queryCacheTTLs = os.Getenv("BOILERPLATE_QUERY_CACHE_TTLS")
+)
+
+// The endpoints whose queries are cached, with the default time their results
+// are cached for.
+const (
+	cacheEndpointPoints      = "points"
+	cacheEndpointAnnotations = "annotations"
+	cacheEndpointQueries     = "queries"
+)
+
+var defaultCacheTTLs = map[string]time.Duration{
+	cacheEndpointPoints:      30 * time.Second,
+	cacheEndpointAnnotations: time.Minute,
+	cacheEndpointQueries:     30 * time.Second,
+}
+
+// cache caches the results of the queries dashboards repeat, such as those of
+// /query. It is nil when caching is disabled.
+var cache *queryCache
+
+// queryCache is an in-process cache of query results, keyed by the Flux query
+// with its whitespace normalised and its parameters. Results expire after the
+// TTL of the endpoint that queried them, and once the cache holds maxEntries
+// results, the least recently used one is evicted to make room for a new one.
+//
+// Concurrent identical queries are collapsed into one, whose result is shared
+// by all of them. The results of a user's queries are invalidated whenever new
+// data for the user is written to InfluxDB, e.g. once the write queue has
+// written ingested points, so that it is seen straight away rather than once
+// the results expire.
+//
+// Cached results are shared, and must not be modified.
+type queryCache struct {
+	maxEntries int
+	ttls       map[string]time.Duration
+
+	mu sync.Mutex
+	// entries holds the elements of lru by key. The most recently used entry is
+	// at the front of lru.
+	entries map[string]*list.Element
+	lru     *list.List
+	// users holds the entries and running queries of each user that has any.
+	users map[cacheUser]*cacheUserState
+	// calls holds the queries running for cache misses by key.
+	calls map[string]*cacheCall
+	stats map[string]*cacheStats
+}
+
+// cacheUser identifies a user across the organizations your app serves.
+type cacheUser struct {
+	organization string
+	userID       string
+}
+
+// cacheUserState tracks the entries of a user and the queries running for them.
+type cacheUserState struct {
+	keys map[string]struct{}
+	// generation counts the invalidations of the user's entries, so that the
+	// results of queries that were running while the user's data changed are
+	// not cached. It only needs to be kept while loading is positive.
+	generation uint64
+	// loading counts the queries running for cache misses of the user.
+	loading int
+}
+
+type cacheEntry struct {
+	key      string
+	user     cacheUser
+	endpoint string
+	value    interface{}
+	expires  time.Time
+}
+
+// cacheCall is a query running for a cache miss, whose result is shared by
+// the identical queries made while it runs.
+type cacheCall struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// cacheStats counts the lookups of the queries of an endpoint.
+type cacheStats struct {
+	TTL string `json:"ttl"`
+	// Hits counts the queries answered from the cache.
+	Hits uint64 `json:"hits"`
+	// Misses counts the queries sent to InfluxDB.
+	Misses uint64 `json:"misses"`
+	// Shared counts the queries that waited for an identical query to return.
+	Shared        uint64 `json:"shared"`
+	Evictions     uint64 `json:"evictions"`
+	Invalidations uint64 `json:"invalidations"`
+}
+
+// newQueryCacheFromEnv returns the query cache configured by the environment,
+// or nil if it is disabled.
+func newQueryCacheFromEnv() (*queryCache, error) {
+	size := 1000
+	if queryCacheSize != "" {
+		var err error
+		if size, err = strconv.Atoi(queryCacheSize); err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid BOILERPLATE_QUERY_CACHE_SIZE %q", queryCacheSize)
+		}
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	ttls := make(map[string]time.Duration)
+	for endpoint, ttl := range defaultCacheTTLs {
+		ttls[endpoint] = ttl
+	}
+	for _, pair := range strings.Split(queryCacheTTLs, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if _, ok := defaultCacheTTLs[parts[0]]; !ok || len(parts) != 2 {
+			return nil, fmt.Errorf("invalid BOILERPLATE_QUERY_CACHE_TTLS entry %q", pair)
+		}
+		ttl, err := time.ParseDuration(parts[1])
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("invalid BOILERPLATE_QUERY_CACHE_TTLS entry %q", pair)
+		}
+		ttls[parts[0]] = ttl
+	}
+	return newQueryCache(size, ttls), nil
+}
+
+func newQueryCache(maxEntries int, ttls map[string]time.Duration) *queryCache {
+	c := &queryCache{
+		maxEntries: maxEntries,
+		ttls:       ttls,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		users:      make(map[cacheUser]*cacheUserState),
+		calls:      make(map[string]*cacheCall),
+		stats:      make(map[string]*cacheStats),
+	}
+	for endpoint, ttl := range ttls {
+		c.stats[endpoint] = &cacheStats{TTL: ttl.String()}
+	}
+	return c
+}
+
+// get returns the cached result of a query of a user made by an endpoint, or
+// calls load to run the query and caches its result. Errors are not cached.
+// The cache is bypassed when it is nil or the endpoint's TTL is 0.
+func (c *queryCache) get(ctx context.Context, endpoint, userID, query string, params map[string]string, load func() (interface{}, error)) (interface{}, error) {
+	if c == nil || c.ttls[endpoint] <= 0 {
+		return load()
+	}
+	user := cacheUser{organization: organizationOf(ctx).name, userID: userID}
+	key := cacheKey(user, endpoint, query, params)
+
+	c.mu.Lock()
+	stats := c.stats[endpoint]
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*cacheEntry)
+		if time.Now().Before(entry.expires) {
+			c.lru.MoveToFront(element)
+			stats.Hits++
+			c.mu.Unlock()
+			return entry.value, nil
+		}
+		c.remove(element)
+	}
+	if call, ok := c.calls[key]; ok {
+		stats.Shared++
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// The query was cancelled along with the request that made it, rather
+		// than failing, so make it again.
+		if (errors.Is(call.err, context.Canceled) || errors.Is(call.err, context.DeadlineExceeded)) && ctx.Err() == nil {
+			return c.get(ctx, endpoint, userID, query, params, load)
+		}
+		return call.value, call.err
+	}
+	stats.Misses++
+	call := &cacheCall{done: make(chan struct{})}
+	c.calls[key] = call
+	state := c.user(user)
+	state.loading++
+	generation := state.generation
+	c.mu.Unlock()
+
+	call.value, call.err = load()
+	close(call.done)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.calls[key] == call {
+		delete(c.calls, key)
+	}
+	state.loading--
+	if call.err == nil && state.generation == generation {
+		c.add(&cacheEntry{key: key, user: user, endpoint: endpoint, value: call.value, expires: time.Now().Add(c.ttls[endpoint])})
+	}
+	c.prune(user)
+	return call.value, call.err
+}
+
+// user returns the state of a user, adding it if needed. The caller must hold
+// c.mu, and call prune once done with it.
+func (c *queryCache) user(user cacheUser) *cacheUserState {
+	state, ok := c.users[user]
+	if !ok {
+		state = &cacheUserState{keys: make(map[string]struct{})}
+		c.users[user] = state
+	}
+	return state
+}
+
+// prune drops the state of a user once they have no entries or running
+// queries left, so that the cache doesn't grow with every user it has seen.
+// The caller must hold c.mu.
+func (c *queryCache) prune(user cacheUser) {
+	if state, ok := c.users[user]; ok && len(state.keys) == 0 && state.loading == 0 {
+		delete(c.users, user)
+	}
+}
+
+// add adds an entry, evicting the least recently used entry if the cache is
+// full. The caller must hold c.mu.
+func (c *queryCache) add(entry *cacheEntry) {
+	if element, ok := c.entries[entry.key]; ok {
+		c.remove(element)
+	}
+	for c.lru.Len() >= c.maxEntries {
+		oldest := c.lru.Back()
+		c.stats[oldest.Value.(*cacheEntry).endpoint].Evictions++
+		c.remove(oldest)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.user(entry.user).keys[entry.key] = struct{}{}
+}
+
+// remove removes an entry. The caller must hold c.mu.
+func (c *queryCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	if state, ok := c.users[entry.user]; ok {
+		delete(state.keys, entry.key)
+		c.prune(entry.user)
+	}
+}
+
+// invalidate removes the cached results of the queries of a user, and keeps
+// the results of those running from being cached. Queries made from now on
+// don't share the results of those already running either.
+func (c *queryCache) invalidate(ctx context.Context, userID string) {
+	if c == nil {
+		return
+	}
+	c.invalidateUser(cacheUser{organization: organizationOf(ctx).name, userID: userID})
+}
+
+// invalidateWritten invalidates the results of the queries of the users whose
+// points, in line protocol, were written to InfluxDB for an organization.
+func (c *queryCache) invalidateWritten(organization string, lines ...string) {
+	if c == nil {
+		return
+	}
+	invalidated := map[string]bool{}
+	for _, line := range lines {
+		for _, line := range strings.Split(line, "\n") {
+			if userID, ok := lineUserID(line); ok && !invalidated[userID] {
+				c.invalidateUser(cacheUser{organization: organization, userID: userID})
+				invalidated[userID] = true
+			}
+		}
+	}
+}
+
+func (c *queryCache) invalidateUser(user cacheUser) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state, ok := c.users[user]
+	if !ok {
+		// The user has neither entries nor running queries.
+		return
+	}
+	state.generation++
+	for key := range state.keys {
+		element := c.entries[key]
+		c.stats[element.Value.(*cacheEntry).endpoint].Invalidations++
+		c.remove(element)
+	}
+	for key := range c.calls {
+		if strings.HasPrefix(key, userCachePrefix(user)) {
+			delete(c.calls, key)
+		}
+	}
+	c.prune(user)
+}
+
+// cacheKey returns the key of the result of a query of a user, which starts
+// with userCachePrefix. The whitespace of the query is normalised, so that
+// queries that differ only in formatting share a result.
+func cacheKey(user cacheUser, endpoint, query string, params map[string]string) string {
+	var key strings.Builder
+	key.WriteString(userCachePrefix(user))
+	key.WriteString(endpoint)
+	key.WriteByte(0)
+	key.WriteString(strings.Join(strings.Fields(query), " "))
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		key.WriteByte(0)
+		key.WriteString(name)
+		key.WriteByte('=')
+		key.WriteString(params[name])
+	}
+	return key.String()
+}
+
+// userCachePrefix returns the prefix of the keys of a user's results.
+func userCachePrefix(user cacheUser) string {
+	return strconv.Quote(user.organization) + strconv.Quote(user.userID)
+}
+
+// cacheStatus serves the hit, miss, eviction and invalidation counts of the
+// query cache for each endpoint, and the number of results it holds.
+//
+// GET /admin/cache to test this endpoint.
+func cacheStatus(w http.ResponseWriter, r *http.Request) {
+	status := struct {
+		Enabled    bool                  `json:"enabled"`
+		Entries    int                   `json:"entries"`
+		MaxEntries int                   `json:"max_entries"`
+		Endpoints  map[string]cacheStats `json:"endpoints"`
+	}{Endpoints: map[string]cacheStats{}}
+	if cache != nil {
+		cache.mu.Lock()
+		status.Enabled = true
+		status.Entries = cache.lru.Len()
+		status.MaxEntries = cache.maxEntries
+		for endpoint, stats := range cache.stats {
+			status.Endpoints[endpoint] = *stats
+		}
+		cache.mu.Unlock()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
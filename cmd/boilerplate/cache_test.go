@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// cacheLoader returns a load function for queryCache.get that counts its calls
+// in loads and returns the count.
+func cacheLoader(loads *int32) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		return int(atomic.AddInt32(loads, 1)), nil
+	}
+}
+
+// orgContext returns a context carrying an organization named name.
+func orgContext(name string) context.Context {
+	return context.WithValue(context.Background(), organizationKey{}, &organization{name: name})
+}
+
+func TestQueryCacheExpiresResults(t *testing.T) {
+	c := newQueryCache(10, map[string]time.Duration{cacheEndpointPoints: 50 * time.Millisecond})
+	ctx := orgContext("my-org")
+	var loads int32
+	for i, want := range []int{1, 1} {
+		if got, err := c.get(ctx, cacheEndpointPoints, "user1", "q", nil, cacheLoader(&loads)); err != nil || got != want {
+			t.Fatalf("lookup %d: got %v and error %v, want %d", i, got, err, want)
+		}
+	}
+	time.Sleep(60 * time.Millisecond)
+	if got, _ := c.get(ctx, cacheEndpointPoints, "user1", "q", nil, cacheLoader(&loads)); got != 2 {
+		t.Errorf("got %v once the result expired, want it loaded again", got)
+	}
+	if stats := c.stats[cacheEndpointPoints]; stats.Hits != 1 || stats.Misses != 2 {
+		t.Errorf("got %d hits and %d misses, want 1 and 2", stats.Hits, stats.Misses)
+	}
+}
+
+func TestQueryCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newQueryCache(2, defaultCacheTTLs)
+	ctx := orgContext("my-org")
+	loads := map[string]*int32{"a": new(int32), "b": new(int32), "c": new(int32)}
+	get := func(query string) {
+		t.Helper()
+		if _, err := c.get(ctx, cacheEndpointPoints, "user1", query, nil, cacheLoader(loads[query])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get("a")
+	get("b")
+	get("a")
+	get("c") // Evicts b, the least recently used.
+	get("a")
+	get("b")
+	if *loads["a"] != 1 || *loads["b"] != 2 || *loads["c"] != 1 {
+		t.Errorf("loaded a %d, b %d and c %d times, want 1, 2 and 1", *loads["a"], *loads["b"], *loads["c"])
+	}
+	if evictions := c.stats[cacheEndpointPoints].Evictions; evictions != 2 {
+		t.Errorf("got %d evictions, want 2", evictions)
+	}
+	if c.lru.Len() != 2 {
+		t.Errorf("the cache holds %d results, want 2", c.lru.Len())
+	}
+}
+
+func TestQueryCacheCollapsesConcurrentQueries(t *testing.T) {
+	c := newQueryCache(10, defaultCacheTTLs)
+	ctx := orgContext("my-org")
+	var loads int32
+	release := make(chan struct{})
+	load := func() (interface{}, error) {
+		<-release
+		return cacheLoader(&loads)()
+	}
+
+	const callers = 5
+	var wg sync.WaitGroup
+	results := make(chan interface{}, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := c.get(ctx, cacheEndpointPoints, "user1", "q", nil, load)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- value
+		}()
+	}
+	// Release the query once every other caller waits for it.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		c.mu.Lock()
+		shared := c.stats[cacheEndpointPoints].Shared
+		c.mu.Unlock()
+		if shared == callers-1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d callers share the query, want %d", shared, callers-1)
+		}
+	}
+	close(release)
+	wg.Wait()
+	close(results)
+	for value := range results {
+		if value != 1 {
+			t.Errorf("got %v, want the result of the single query", value)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("queried InfluxDB %d times, want once", loads)
+	}
+}
+
+func TestQueryCacheInvalidatesPerOrganizationAndUser(t *testing.T) {
+	c := newQueryCache(10, defaultCacheTTLs)
+	type lookup struct{ org, userID string }
+	lookups := []lookup{{"eu", "user1"}, {"eu", "user2"}, {"us", "user1"}}
+	loads := make(map[lookup]*int32)
+	get := func(l lookup) {
+		t.Helper()
+		if loads[l] == nil {
+			loads[l] = new(int32)
+		}
+		if _, err := c.get(orgContext(l.org), cacheEndpointPoints, l.userID, "q", nil, cacheLoader(loads[l])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, l := range lookups {
+		get(l)
+	}
+
+	c.invalidateWritten("eu", "m,user_id=user1 f=1 1\nm,user_id=user1 f=2 2")
+	c.invalidate(orgContext("us"), "user3")
+	for _, l := range lookups {
+		get(l)
+	}
+	for l, want := range map[lookup]int32{{"eu", "user1"}: 2, {"eu", "user2"}: 1, {"us", "user1"}: 1} {
+		if got := *loads[l]; got != want {
+			t.Errorf("queried %s of %s %d times, want %d", l.userID, l.org, got, want)
+		}
+	}
+	if invalidations := c.stats[cacheEndpointPoints].Invalidations; invalidations != 1 {
+		t.Errorf("got %d invalidations, want 1", invalidations)
+	}
+
+	// A query running while its user's data changes doesn't cache its result.
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.get(orgContext("eu"), cacheEndpointPoints, "user2", "other", nil, func() (interface{}, error) {
+			<-release
+			return 0, nil
+		})
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		c.mu.Lock()
+		running := len(c.calls)
+		c.mu.Unlock()
+		if running == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the query didn't start")
+		}
+	}
+	c.invalidate(orgContext("eu"), "user2")
+	close(release)
+	<-done
+	if c.lru.Len() != 2 {
+		t.Errorf("the cache holds %d results, want the 2 left after the invalidation", c.lru.Len())
+	}
+
+	// Users without cached results are forgotten.
+	c.invalidate(orgContext("us"), "user1")
+	if len(c.users) != 1 {
+		t.Errorf("the cache tracks %d users, want only user1 of eu", len(c.users))
+	}
+}
+
+func TestQueryCacheKeepsResultsUntilIngestedPointsAreWritten(t *testing.T) {
+	app := newTestApp(t)
+	ctx := orgContext("my-org")
+	// A query counting the user's points in InfluxDB.
+	count := func() int {
+		t.Helper()
+		value, err := cache.get(ctx, cacheEndpointPoints, "user1", "count", nil, func() (interface{}, error) {
+			return len(app.influx.Points()), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value.(int)
+	}
+
+	// Keep the point in the write queue for a second, and query meanwhile.
+	app.influx.FailNext("/api/v2/write", http.StatusServiceUnavailable, "overloaded", 1)
+	resp, body := app.do(t, http.MethodPost, "/users/user1/points", "key1", `{"measurement":"m","field1":1}`)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("got status %d (%s), want 202", resp.StatusCode, body)
+	}
+	if got := count(); got != 0 {
+		t.Fatalf("counted %d points before the write, want 0", got)
+	}
+	app.waitForPoints(t, 1)
+
+	// The result cached while the point was queued is dropped once it is written.
+	deadline := time.Now().Add(time.Second)
+	for count() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("the cache still counts no points a second after they were written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
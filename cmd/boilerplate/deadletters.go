@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deadLetter is a batch that InfluxDB rejected, along with why.
+type deadLetter struct {
+	ID         string    `json:"id"`
+	Lines      string    `json:"lines"`
+	Enqueued   time.Time `json:"enqueued"`
+	FailedAt   time.Time `json:"failed_at"`
+	Attempts   int       `json:"attempts"`
+	StatusCode int       `json:"status_code"`
+	Error      string    `json:"error"`
+}
+
+// deadLetters stores the batches of the write queue that InfluxDB rejected
+// outright, one JSON file per batch named after its sequence number, until an
+// administrator inspects them and replays or purges them.
+type deadLetters struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// errDeadLetterNotFound is returned when there is no dead letter with the requested ID.
+var errDeadLetterNotFound = errors.New("dead letter not found")
+
+// openDeadLetters opens the dead letter store in dir, creating it if needed.
+func openDeadLetters(dir string) (*deadLetters, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &deadLetters{dir: dir}, nil
+}
+
+func (d *deadLetters) path(id string) string {
+	return filepath.Join(d.dir, id+".json")
+}
+
+// add stores a rejected batch.
+func (d *deadLetters) add(batch queuedBatch, statusCode int, cause error, attempts int) error {
+	data, err := json.Marshal(deadLetter{
+		ID:         strconv.FormatUint(batch.Seq, 10),
+		Lines:      batch.Lines,
+		Enqueued:   batch.Enqueued,
+		FailedAt:   time.Now().UTC(),
+		Attempts:   attempts,
+		StatusCode: statusCode,
+		Error:      cause.Error(),
+	})
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return ioutil.WriteFile(d.path(strconv.FormatUint(batch.Seq, 10)), data, 0o644)
+}
+
+// list returns the dead letters with the given ID, or all of them if id is
+// empty, oldest first.
+func (d *deadLetters) list(id string) ([]deadLetter, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pattern := "*"
+	if id != "" {
+		// IDs are sequence numbers, which keeps them from escaping the directory.
+		if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+			return nil, errDeadLetterNotFound
+		}
+		pattern = id
+	}
+	names, err := filepath.Glob(d.path(pattern))
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]deadLetter, 0, len(names))
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var letter deadLetter
+		if err := json.Unmarshal(data, &letter); err != nil {
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+	if id != "" && len(letters) == 0 {
+		return nil, errDeadLetterNotFound
+	}
+	sort.Slice(letters, func(i, j int) bool {
+		a, _ := strconv.ParseUint(letters[i].ID, 10, 64)
+		b, _ := strconv.ParseUint(letters[j].ID, 10, 64)
+		return a < b
+	})
+	return letters, nil
+}
+
+// remove deletes a dead letter.
+func (d *deadLetters) remove(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return os.Remove(d.path(id))
+}
+
+// purge removes the points in line protocol that match reports true for from
+// the dead letters, for example to erase the data of a user, and returns the
+// number removed. Dead letters left empty are removed. When dryRun is set, the
+// points are only counted.
+func (d *deadLetters) purge(match func(line string) bool, dryRun bool) (int, error) {
+	letters, err := d.list("")
+	if err != nil {
+		return 0, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	purged := 0
+	for _, letter := range letters {
+		var lines []string
+		for _, line := range strings.Split(letter.Lines, "\n") {
+			if !match(line) {
+				lines = append(lines, line)
+			}
+		}
+		removed := strings.Count(letter.Lines, "\n") + 1 - len(lines)
+		if removed == 0 {
+			continue
+		}
+		purged += removed
+		if dryRun {
+			continue
+		}
+		if len(lines) == 0 {
+			if err := os.Remove(d.path(letter.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return purged, err
+			}
+			continue
+		}
+		letter.Lines = strings.Join(lines, "\n")
+		data, err := json.Marshal(letter)
+		if err != nil {
+			return purged, err
+		}
+		if err := ioutil.WriteFile(d.path(letter.ID), data, 0o644); err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+// listDeadLetters lists the batches that InfluxDB rejected, oldest first. Like
+// the other admin endpoints, it acts on the organization named by the
+// X-Organization header, or the default organization if there is none.
+//
+// GET /admin/dead-letters to list all of them, or add ?id=<ID> to get one.
+func listDeadLetters(w http.ResponseWriter, r *http.Request) {
+	queue := organizationOf(r.Context()).queue
+	letters, err := queue.dead.list(param(r, "id"))
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		DeadLetters []deadLetter `json:"dead_letters"`
+	}{letters})
+}
+
+// replayDeadLetters moves dead letters back to the write queue, for example
+// after fixing the schema conflict that made InfluxDB reject them. Batches
+// rejected again return to the dead letter store with a new ID.
+//
+// POST /admin/dead-letters/replay to replay all of them, or add ?id=<ID> to
+// replay one.
+func replayDeadLetters(w http.ResponseWriter, r *http.Request) {
+	queue := organizationOf(r.Context()).queue
+	letters, err := queue.dead.list(param(r, "id"))
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	replayed := 0
+	for _, letter := range letters {
+		if err := queue.enqueue(letter.Lines); err != nil {
+			handleError(w, err)
+			return
+		}
+		if err := queue.dead.remove(letter.ID); err != nil {
+			handleError(w, err)
+			return
+		}
+		replayed++
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Replayed int `json:"replayed"`
+	}{replayed})
+}
+
+// purgeDeadLetters permanently deletes dead letters.
+//
+// DELETE /admin/dead-letters to purge all of them, or add ?id=<ID> to purge one.
+func purgeDeadLetters(w http.ResponseWriter, r *http.Request) {
+	queue := organizationOf(r.Context()).queue
+	letters, err := queue.dead.list(param(r, "id"))
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	purged := 0
+	for _, letter := range letters {
+		if err := queue.dead.remove(letter.ID); err != nil {
+			handleError(w, err)
+			return
+		}
+		purged++
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Purged int `json:"purged"`
+	}{purged})
+}
+
+// adminKey is the API key required to call the admin endpoints, and is read
+// from the BOILERPLATE_ADMIN_KEY environment variable. When it is unset, the
+// admin endpoints are only available while authentication is disabled.
+var adminKey = os.Getenv("BOILERPLATE_ADMIN_KEY")
+
+// admin is a middleware that only lets callers with the admin key through, and
+// returns a 401 http.StatusUnauthorized otherwise.
+func admin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if (adminKey == "" && len(apiKeys) > 0) ||
+			(adminKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) != 1) {
+			handleError(w, errUnauthenticated)
+			return
+		}
+		handler(w, r)
+	}
+}
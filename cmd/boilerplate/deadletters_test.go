@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestDeadLetterEndpoints(t *testing.T) {
+	app := newTestApp(t)
+	dead := defaultOrganization.queue.dead
+	dead.add(queuedBatch{Seq: 7, Lines: "measurement1,user_id=user1 field1=1 1"}, http.StatusBadRequest, errors.New("field type conflict"), 1)
+	dead.add(queuedBatch{Seq: 8, Lines: "measurement1,user_id=user2 field1=2 2"}, http.StatusBadRequest, errors.New("field type conflict"), 1)
+	dead.add(queuedBatch{Seq: 9, Lines: "measurement1,user_id=user2 field1=3 3"}, http.StatusBadRequest, errors.New("field type conflict"), 1)
+
+	if resp, body := app.do(t, http.MethodGet, "/admin/dead-letters", "key1", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d (%s) without the admin key, want 401", resp.StatusCode, body)
+	}
+	list := func(path string) []deadLetter {
+		t.Helper()
+		resp, body := app.do(t, http.MethodGet, path, "admin-key", "")
+		var listed struct {
+			DeadLetters []deadLetter `json:"dead_letters"`
+		}
+		if err := json.Unmarshal([]byte(body), &listed); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("got status %d (%s) listing %s, want 200", resp.StatusCode, body, path)
+		}
+		return listed.DeadLetters
+	}
+	if letters := list("/admin/dead-letters"); len(letters) != 3 || letters[0].ID != "7" || letters[0].Error != "field type conflict" {
+		t.Errorf("got dead letters %+v, want 7, 8 and 9", letters)
+	}
+	if letters := list("/admin/dead-letters/8"); len(letters) != 1 || letters[0].Lines != "measurement1,user_id=user2 field1=2 2" {
+		t.Errorf("got dead letters %+v, want 8", letters)
+	}
+	resp, body := app.do(t, http.MethodGet, "/admin/dead-letters/10", "admin-key", "")
+	if resp.StatusCode != http.StatusNotFound || errorCode(t, body) != errorCodeNotFound {
+		t.Errorf("got status %d (%s) for an unknown dead letter, want 404", resp.StatusCode, body)
+	}
+
+	// Replayed batches go back to the write queue.
+	resp, body = app.do(t, http.MethodPost, "/admin/dead-letters/7/replay", "admin-key", "")
+	if resp.StatusCode != http.StatusOK || body != "{\"replayed\":1}\n" {
+		t.Errorf("got status %d (%s) replaying 7, want 1 replayed", resp.StatusCode, body)
+	}
+	if points := app.waitForPoints(t, 1); points[0].Tags["user_id"] != "user1" {
+		t.Errorf("got point %+v, want the point of user1", points[0])
+	}
+
+	resp, body = app.do(t, http.MethodDelete, "/admin/dead-letters", "admin-key", "")
+	if resp.StatusCode != http.StatusOK || body != "{\"purged\":2}\n" {
+		t.Errorf("got status %d (%s) purging, want 2 purged", resp.StatusCode, body)
+	}
+	if letters := list("/admin/dead-letters"); len(letters) != 0 {
+		t.Errorf("got dead letters %+v after purging, want none", letters)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/go-snippets/internal/flux"
+)
+
+// erasureRequest asks for the data of a user to be erased, for example to
+// honour a GDPR erasure request. Start and Stop default to the Unix epoch and
+// the current time, which erases all of the user's data.
+type erasureRequest struct {
+	UserID string     `json:"user_id"`
+	Start  *time.Time `json:"start"`
+	Stop   *time.Time `json:"stop"`
+	// DryRun reports what would be erased without erasing anything.
+	DryRun bool `json:"dry_run"`
+}
+
+// erasureReport describes what was erased, or would be in a dry run.
+type erasureReport struct {
+	UserID       string    `json:"user_id"`
+	Organization string    `json:"organization"`
+	DryRun       bool      `json:"dry_run"`
+	Start        time.Time `json:"start"`
+	Stop         time.Time `json:"stop"`
+	Buckets      []string  `json:"buckets"`
+	// Series is the number of series of the user's data within the time range.
+	Series int `json:"series"`
+	// Tasks are the user's downsampling and alert tasks.
+	Tasks []erasedTask `json:"tasks"`
+	// AlertRules is the number of the user's alert rules, each of which is one of Tasks.
+	AlertRules int `json:"alert_rules"`
+	// QueuedPoints, BufferedPoints and DeadLetterPoints are the numbers of the
+	// user's points within the time range held by the application rather than
+	// InfluxDB: in the write queue, the offline buffer and the dead letter store.
+	QueuedPoints     int `json:"queued_points"`
+	BufferedPoints   int `json:"buffered_points"`
+	DeadLetterPoints int `json:"dead_letter_points"`
+}
+
+// erasedTask identifies a task removed by an erasure.
+type erasedTask struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// userDataBuckets returns the buckets of an organization that hold the data of
+// users. This application writes both raw and downsampled data to the same
+// bucket, so there is just one.
+func userDataBuckets(org *organization) []string {
+	return []string{org.bucket}
+}
+
+// eraseUser deletes the points of a user within a time range from every bucket
+// holding user data, using the delete API with a user_id predicate, and
+// removes the user's downsampling tasks and alert rules. Tasks are removed
+// first so that they don't write downsampled data for the user again. The
+// user's points not yet written to InfluxDB are purged from the write queue,
+// the offline buffer and the dead letter store before the delete, so that they
+// aren't written afterwards.
+//
+// It returns what was erased, or would be in a dry run. When an error occurs
+// part way through, the report still describes what was found.
+func eraseUser(ctx context.Context, request erasureRequest) (erasureReport, error) {
+	org := organizationOf(ctx)
+	report := erasureReport{
+		UserID:       request.UserID,
+		Organization: org.name,
+		DryRun:       request.DryRun,
+		Start:        time.Unix(0, 0).UTC(),
+		Stop:         time.Now().UTC(),
+		Buckets:      userDataBuckets(org),
+		Tasks:        []erasedTask{},
+	}
+	if request.Start != nil {
+		report.Start = request.Start.UTC()
+	}
+	if request.Stop != nil {
+		report.Stop = request.Stop.UTC()
+	}
+
+	for _, bucket := range report.Buckets {
+		series, err := countUserSeries(ctx, bucket, request.UserID, report.Start, report.Stop)
+		if err != nil {
+			return report, err
+		}
+		report.Series += series
+	}
+
+	tasks, err := findUserTasks(ctx, request.UserID)
+	if err != nil {
+		return report, err
+	}
+	for _, task := range tasks {
+		report.Tasks = append(report.Tasks, erasedTask{ID: task.Id, Name: task.Name})
+		if task.Name == alertTaskName(request.UserID) {
+			report.AlertRules++
+		}
+	}
+	if request.DryRun {
+		return report, purgeUserPoints(ctx, &report, true)
+	}
+
+	for _, task := range report.Tasks {
+		if err := org.client.TasksAPI().DeleteTaskWithID(ctx, task.ID); err != nil {
+			return report, fmt.Errorf("failed to delete task %s: %w", task.ID, err)
+		}
+	}
+	if err := purgeUserPoints(ctx, &report, false); err != nil {
+		return report, err
+	}
+	predicate := fmt.Sprintf(`user_id="%s"`, request.UserID)
+	for _, bucket := range report.Buckets {
+		if err := org.client.DeleteAPI().DeleteWithName(ctx, org.name, bucket, report.Start, report.Stop, predicate); err != nil {
+			return report, fmt.Errorf("failed to delete data from bucket %q: %w", bucket, err)
+		}
+	}
+	return report, nil
+}
+
+// purgeUserPoints purges the points of the user of an erasure report within
+// its time range from the write queue, the offline buffer and the dead letter
+// store of the organization a request is served from, recording the number
+// purged from each in the report. When dryRun is set, the points are only
+// counted.
+func purgeUserPoints(ctx context.Context, report *erasureReport, dryRun bool) error {
+	org := organizationOf(ctx)
+	match := userLines(report.UserID, report.Start, report.Stop)
+	var err error
+	if report.QueuedPoints, err = org.queue.purge(match, dryRun); err != nil {
+		return fmt.Errorf("failed to purge the write queue: %w", err)
+	}
+	if org.forwarder != nil {
+		buffered, err := org.forwarder.Purge(ctx, match, dryRun)
+		if err != nil {
+			return fmt.Errorf("failed to purge the offline buffer: %w", err)
+		}
+		report.BufferedPoints = int(buffered)
+	}
+	if report.DeadLetterPoints, err = org.queue.dead.purge(match, dryRun); err != nil {
+		return fmt.Errorf("failed to purge the dead letter store: %w", err)
+	}
+	return nil
+}
+
+// userLines returns a function that reports whether a point in line protocol
+// is one of a user's points within a time range, as the delete API would
+// match it: tagged with the user's ID, and timestamped within the range
+// inclusive of both ends. Points without a timestamp are timed when they are
+// written, so they are matched regardless.
+func userLines(userID string, start, stop time.Time) func(line string) bool {
+	return func(line string) bool {
+		if id, ok := lineUserID(line); !ok || id != userID {
+			return false
+		}
+		// The timestamp is the last element of the line when present, which
+		// is the only one that can be an integer on its own.
+		i := strings.LastIndexByte(line, ' ')
+		timestamp, err := strconv.ParseInt(line[i+1:], 10, 64)
+		if err != nil {
+			return true
+		}
+		at := time.Unix(0, timestamp)
+		return !at.Before(start) && !at.After(stop)
+	}
+}
+
+// lineUserID returns the user_id tag of a point in line protocol, if it has one.
+func lineUserID(line string) (string, bool) {
+	key := splitEscaped(line, ' ')[0]
+	for _, tag := range splitEscaped(key, ',')[1:] {
+		pair := splitEscaped(tag, '=')
+		if len(pair) == 2 && lineProtocolUnescaper.Replace(pair[0]) == "user_id" {
+			return lineProtocolUnescaper.Replace(pair[1]), true
+		}
+	}
+	return "", false
+}
+
+// splitEscaped splits s at each separator not escaped with a backslash, as
+// the elements of line protocol are separated.
+func splitEscaped(s string, separator byte) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case separator:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// lineProtocolUnescaper unescapes the keys and values of the tags of a point
+// in line protocol.
+var lineProtocolUnescaper = strings.NewReplacer(`\,`, ",", `\=`, "=", `\ `, " ")
+
+// countUserSeries returns the number of series of a user's data within a time
+// range in a bucket. Each series is returned as a separate table.
+func countUserSeries(ctx context.Context, bucket, userID string, start, stop time.Time) (int, error) {
+	query, params := flux.From(bucket).
+		RangeBetween(flux.Time(start), flux.Time(stop)).
+		Filter(flux.Tag("user_id", userID)).
+		Aggregate(flux.First).
+		Render()
+	tables, err := organizationOf(ctx).queryAPI.QueryWithParams(ctx, query, params)
+	if err != nil {
+		return 0, err
+	}
+	defer tables.Close()
+	series := 0
+	for tables.Next() {
+		if tables.TableChanged() {
+			series++
+		}
+	}
+	return series, tables.Err()
+}
+
+// eraseUserData erases the data of a user: their points in every bucket within
+// a time range, including those not yet written to InfluxDB, their
+// downsampling tasks and their alert rules. Every erasure
+// is recorded in the audit log, along with what it erased. Set dry_run to see
+// what would be erased first.
+//
+// Note that "user" here refers to a user in your application, not an InfluxDB user.
+//
+// POST the following to the /admin/users/erase endpoint to test this function:
+// {"user_id":"user1", "dry_run":true}
+func eraseUserData(w http.ResponseWriter, r *http.Request) {
+	var request erasureRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		handleError(w, invalidBody(err))
+		return
+	}
+	erase(w, r, request)
+}
+
+// deleteUser erases the data of a user in the same way as eraseUserData, with
+// the time range and dry_run passed as query parameters.
+//
+// DELETE /admin/users/user1?dry_run=true to test this endpoint.
+func deleteUser(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	request := erasureRequest{UserID: param(r, "user_id"), DryRun: values.Get("dry_run") == "true"}
+	if values.Get("start") != "" || values.Get("stop") != "" {
+		start, stop, err := parseTimeRange(values)
+		if err != nil {
+			handleError(w, invalidRequest("%v", err))
+			return
+		}
+		request.Start, request.Stop = &start, &stop
+	}
+	erase(w, r, request)
+}
+
+// erase carries out an erasure request and records it in the audit log.
+func erase(w http.ResponseWriter, r *http.Request, request erasureRequest) {
+	// Delete predicates can't escape quotes, so a user ID containing one could
+	// never be matched exactly.
+	if request.UserID == "" || strings.ContainsAny(request.UserID, `"\`) {
+		handleError(w, invalidRequest("user_id must not be empty or contain quotes or backslashes"))
+		return
+	}
+	if request.Start != nil && request.Stop != nil && !request.Start.Before(*request.Stop) {
+		handleError(w, invalidRequest("start must be before stop"))
+		return
+	}
+
+	report, err := eraseUser(r.Context(), request)
+	if !request.DryRun {
+		cache.invalidate(r.Context(), request.UserID)
+	}
+	if !request.DryRun {
+		entry := auditEntry{Action: "erase_user", RemoteAddr: r.RemoteAddr, Details: report}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		if auditErr := audit.record(entry); auditErr != nil {
+			log.Printf("Failed to record the erasure of user %q in the audit log: %v", request.UserID, auditErr)
+		}
+	}
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
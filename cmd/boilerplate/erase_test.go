@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/go-snippets/internal/storeforward"
+)
+
+func TestUserLines(t *testing.T) {
+	start, stop := time.Unix(0, 100), time.Unix(0, 200)
+	match := userLines("user 1", start, stop)
+	for line, want := range map[string]bool{
+		`m,user_id=user\ 1 f=1 150`:              true,
+		`m,a=b,user_id=user\ 1,c=d f=1 100`:      true,
+		`m,user_id=user\ 1 f=1 200`:              true,
+		`m,user_id=user\ 1 f="a b" 150`:          true,
+		`m,user_id=user\ 1 f=1`:                  true,
+		`m,user_id=user\ 1 f="in 150"`:           true,
+		`m,user_id=user\ 1 f=1 99`:               false,
+		`m,user_id=user\ 1 f=1 201`:              false,
+		`m,user_id=user\ 12 f=1 150`:             false,
+		`m,other_user_id=user\ 1 f=1 150`:        false,
+		`m\,user_id=user\ 1,user_id=x f=1 150`:   false,
+		`m,user_id=user2 f="user_id=user 1" 150`: false,
+	} {
+		if got := match(line); got != want {
+			t.Errorf("userLines matched %q: got %v, want %v", line, got, want)
+		}
+	}
+}
+
+func TestEraseUserPurgesLocalPoints(t *testing.T) {
+	app := newTestApp(t)
+	org := defaultOrganization
+
+	// Hold up the write queue by failing its first batch with a long
+	// Retry-After, so that the batches queued after it wait in the queue.
+	app.influx.FailNext("/api/v2/write", http.StatusServiceUnavailable, "down for maintenance", 3600)
+	for _, lines := range []string{
+		"m,user_id=user2 f=0 1",
+		"m,user_id=user1 f=1 1\nm,user_id=user2 f=2 2",
+		"m,user_id=user1 f=3 3",
+	} {
+		if err := org.queue.enqueue(lines); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buffer, err := storeforward.Open(filepath.Join(app.dir, "buffer.db"), 0, storeforward.DropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buffer.Close()
+	org.forwarder = storeforward.NewForwarder(org.client, org.name, org.bucket, buffer)
+	defer func() { org.forwarder = nil }()
+	if err := buffer.AddRecord(context.Background(), "m,user_id=user1 f=4 4", "m,user_id=user2 f=5 5"); err != nil {
+		t.Fatal(err)
+	}
+	org.queue.dead.add(queuedBatch{Seq: 100, Lines: "m,user_id=user1 f=6 6"}, http.StatusBadRequest, errors.New("bad"), 1)
+
+	for _, dryRun := range []bool{true, false} {
+		path := "/admin/users/user1"
+		if dryRun {
+			path += "?dry_run=true"
+		}
+		resp, body := app.do(t, http.MethodDelete, path, "admin-key", "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("got status %d (%s), want 200", resp.StatusCode, body)
+		}
+		var report erasureReport
+		if err := json.Unmarshal([]byte(body), &report); err != nil {
+			t.Fatal(err)
+		}
+		if report.QueuedPoints != 2 || report.BufferedPoints != 1 || report.DeadLetterPoints != 1 {
+			t.Errorf("dry run %v: got %d queued, %d buffered and %d dead letter points, want 2, 1 and 1",
+				dryRun, report.QueuedPoints, report.BufferedPoints, report.DeadLetterPoints)
+		}
+	}
+
+	match := userLines("user1", time.Unix(0, 0), time.Now())
+	if left, err := org.queue.purge(match, true); err != nil || left != 0 {
+		t.Errorf("got %d of the user's points left in the write queue and error %v", left, err)
+	}
+	if stats, err := buffer.Stats(context.Background()); err != nil || stats.Depth != 1 {
+		t.Errorf("got %d points left in the offline buffer and error %v, want only the point of user2", stats.Depth, err)
+	}
+	if letters, err := org.queue.dead.list(""); err != nil || len(letters) != 0 {
+		t.Errorf("got dead letters %+v and error %v, want none", letters, err)
+	}
+	segments, err := filepath.Glob(filepath.Join(app.dir, "queue", "*.log"))
+	if err != nil || len(segments) == 0 {
+		t.Fatalf("found segments %v and error %v", segments, err)
+	}
+	for _, segment := range segments {
+		data, err := ioutil.ReadFile(segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "user_id=user1") {
+			t.Errorf("segment %s still holds points of user1: %s", segment, data)
+		}
+	}
+}
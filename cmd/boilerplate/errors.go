@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// The codes of the errors returned by your app. Clients should branch on these
+// rather than on messages, which may change.
+const (
+	errorCodeInvalidRequest       = "invalid_request"
+	errorCodeSchemaViolation      = "schema_violation"
+	errorCodeUnauthenticated      = "unauthenticated"
+	errorCodeForbidden            = "forbidden"
+	errorCodeNotFound             = "not_found"
+	errorCodeMethodNotAllowed     = "method_not_allowed"
+	errorCodeConflict             = "conflict"
+	errorCodeIdempotencyKeyReused = "idempotency_key_reused"
+	errorCodeInsufficientHistory  = "insufficient_history"
+	errorCodeRateLimited          = "rate_limited"
+	errorCodeInternal             = "internal_error"
+
+	// The codes of errors returned by InfluxDB.
+	errorCodeBucketNotFound       = "bucket_not_found"
+	errorCodeOrganizationNotFound = "organization_not_found"
+	errorCodeUnauthorized         = "unauthorized"
+	errorCodePayloadTooLarge      = "payload_too_large"
+	errorCodeUnavailable          = "unavailable"
+	errorCodeUpstream             = "upstream_error"
+)
+
+// errorResponse is the JSON body of every error response of your app.
+type errorResponse struct {
+	// Code identifies the kind of error, e.g. bucket_not_found.
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// InfluxDBCode and InfluxDBMessage are the code and message of the error
+	// returned by InfluxDB, if the request failed because of one.
+	InfluxDBCode    string `json:"influxdb_code,omitempty"`
+	InfluxDBMessage string `json:"influxdb_message,omitempty"`
+	// RequestID identifies the request in the logs of your app.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// requestError is an error that results in a response with a particular status
+// and code, such as a 400 http.StatusBadRequest for a malformed request body.
+type requestError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// errRouteNotFound is returned for requests whose path matches no route.
+var errRouteNotFound = &requestError{status: http.StatusNotFound, code: errorCodeNotFound, message: "no route matches the path"}
+
+// errMethodNotAllowed is returned for requests with a method their route doesn't support.
+var errMethodNotAllowed = &requestError{status: http.StatusMethodNotAllowed, code: errorCodeMethodNotAllowed, message: "method not allowed"}
+
+// invalidRequest returns a requestError resulting in a 400 http.StatusBadRequest.
+func invalidRequest(format string, args ...interface{}) error {
+	return &requestError{status: http.StatusBadRequest, code: errorCodeInvalidRequest, message: fmt.Sprintf(format, args...)}
+}
+
+// invalidBody returns the error for a request body that could not be decoded.
+func invalidBody(err error) error {
+	return invalidRequest("invalid request body: %v", err)
+}
+
+// writeError writes an error response with the given status and body, filling
+// in the ID of the request.
+func writeError(w http.ResponseWriter, status int, body errorResponse) {
+	body.RequestID = w.Header().Get("X-Request-ID")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// requestIDPattern matches the request IDs accepted from clients.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// identified is a middleware that assigns each request an ID, taken from its
+// X-Request-ID header if it has a valid one so that requests can be traced
+// across services, and returns it in the X-Request-ID header of the response.
+// Error responses include it too.
+func identified(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			random := make([]byte, 8)
+			rand.Read(random)
+			id = hex.EncodeToString(random)
+		}
+		w.Header().Set("X-Request-ID", id)
+		handler(w, r)
+	}
+}
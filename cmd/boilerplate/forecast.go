@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/influxdata/go-snippets/internal/flux"
+)
+
+// The bounds of a forecast, in windows.
+const (
+	maxForecastHistory = 10000
+	maxForecastHorizon = 1000
+)
+
+// defaultForecastHistory and defaultForecastHorizon are how far back the
+// history a forecast is made from goes, and how far ahead it forecasts, unless
+// the request says otherwise.
+const (
+	defaultForecastHistory = 7 * 24 * time.Hour
+	defaultForecastHorizon = 24 * time.Hour
+)
+
+// forecastRequest asks for a forecast of a field of a user's data, aggregated
+// into windows over a history of its rollups.
+type forecastRequest struct {
+	field     string
+	aggregate flux.Aggregate
+	history   rollupRequest
+	// horizon is the number of windows to forecast.
+	horizon     int
+	seasonality int
+}
+
+// forecastPoint is a value of a forecast, either one of the history it was
+// made from or a predicted one.
+type forecastPoint struct {
+	Time     time.Time `json:"time"`
+	Value    float64   `json:"value"`
+	Forecast bool      `json:"forecast"`
+}
+
+// insufficientHistoryError returns the error for a forecast whose history holds
+// too few values to fit.
+func insufficientHistoryError(found, needed int) error {
+	return &requestError{
+		status:  http.StatusUnprocessableEntity,
+		code:    errorCodeInsufficientHistory,
+		message: fmt.Sprintf("the history holds %d values, and at least %d are needed", found, needed),
+	}
+}
+
+// getForecast forecasts a field of a user's data with the Holt-Winters method,
+// and returns the history it was made from followed by the predicted values.
+func getForecast(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	request, err := parseForecastRequest(values.Get("field"), values.Get("aggregate"), values.Get("start"),
+		values.Get("stop"), values.Get("window"), values.Get("horizon"), values.Get("seasonality"))
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	userID := param(r, "user_id")
+	points, tier, err := forecast(r.Context(), userID, *request)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Field     string          `json:"field"`
+		Aggregate string          `json:"aggregate"`
+		Points    []forecastPoint `json:"points"`
+		Metadata  queryMetadata   `json:"metadata"`
+	}{request.field, string(request.aggregate), points, queryMetadata{
+		Tier:   tier.name,
+		Window: request.history.window.String(),
+		Start:  &request.history.start,
+		Stop:   &request.history.stop,
+	}})
+}
+
+// parseForecastRequest parses the parameters of a request to getForecast. The
+// history defaults to the last week, and is aggregated into windows like the
+// rollups returned by getPoints, except that windows must have a fixed length,
+// so days are counted in UTC and months are rejected. The aggregate defaults to
+// the mean, the horizon, which must be a whole number of windows, to a day, and
+// the seasonality to none. The history must span at least two seasons.
+func parseForecastRequest(field, aggregate, start, stop, window, horizon, seasonality string) (*forecastRequest, error) {
+	if field == "" {
+		return nil, invalidRequest("field is required")
+	}
+	request := &forecastRequest{field: field, aggregate: flux.Mean}
+	if aggregate != "" {
+		request.aggregate = ""
+		for _, fn := range rollupAggregates {
+			if aggregate == string(fn) {
+				request.aggregate = fn
+			}
+		}
+		if request.aggregate == "" {
+			return nil, invalidRequest("invalid aggregate %q: must be one of max, min or mean", aggregate)
+		}
+	}
+
+	if start == "" {
+		end := time.Now()
+		if stop != "" {
+			if parsed, err := parseQueryTime(stop, end); err == nil {
+				end = parsed
+			}
+		}
+		start = end.Add(-defaultForecastHistory).Format(time.RFC3339Nano)
+	}
+	history, err := parseRollupRequest(start, stop, window, "")
+	if err != nil {
+		return nil, err
+	}
+	if history.window.months > 0 {
+		return nil, invalidRequest("invalid window %q: must be a whole number of minutes or days, e.g. 1h or 1d", window)
+	}
+	// Without a timezone, days are 24 hours long, and windows of days start at
+	// midnight UTC like windows of whole multiples of 24 hours.
+	if history.window.days > 0 {
+		history.window = rollupWindow{every: time.Duration(history.window.days) * 24 * time.Hour}
+	}
+	request.history = *history
+	windows := int(history.stop.Sub(history.start) / history.window.every)
+	if windows > maxForecastHistory {
+		return nil, invalidRequest("the history spans %d windows, and at most %d are allowed", windows, maxForecastHistory)
+	}
+
+	length := defaultForecastHorizon
+	if horizon != "" {
+		if length, err = time.ParseDuration(horizon); err != nil || length <= 0 {
+			return nil, invalidRequest("invalid horizon %q: must be a positive duration, e.g. 24h", horizon)
+		}
+	}
+	if length%history.window.every != 0 {
+		return nil, invalidRequest("the horizon %s must be a whole number of %s windows", flux.FormatDuration(length), history.window)
+	}
+	if request.horizon = int(length / history.window.every); request.horizon > maxForecastHorizon {
+		return nil, invalidRequest("the horizon spans %d windows, and at most %d are allowed", request.horizon, maxForecastHorizon)
+	}
+
+	if seasonality != "" {
+		if request.seasonality, err = strconv.Atoi(seasonality); err != nil || request.seasonality < 0 {
+			return nil, invalidRequest("invalid seasonality %q: must be a number of windows, or 0 for none", seasonality)
+		}
+	}
+	if needed := request.minHistory(); windows < needed {
+		return nil, invalidRequest("the history spans %d windows, and at least %d are needed", windows, needed)
+	}
+	return request, nil
+}
+
+// minHistory returns the number of values the history of a forecast must hold
+// for the Holt-Winters method to fit: two whole seasons, or two values without
+// seasonality.
+func (f forecastRequest) minHistory() int {
+	if f.seasonality > 0 {
+		return 2 * f.seasonality
+	}
+	return 2
+}
+
+// forecast queries the history of a forecast from the coarsest tier of rollups
+// that holds it, like queryRollups, checks it holds enough values to fit, and
+// then forecasts it. It returns the history followed by the forecast, and the
+// tier it read.
+func forecast(ctx context.Context, userID string, request forecastRequest) ([]forecastPoint, rollupTier, error) {
+	tiers := selectTiers(request.history)
+	if err := authorize(ctx, userID); err != nil {
+		return nil, tiers[0], err
+	}
+	org := organizationOf(ctx)
+
+	// The values of the field in each series are aggregated together, so the
+	// forecast is of the field across all of the user's series.
+	historyOf := func(program *flux.Program, tier rollupTier) *flux.Query {
+		return rollupsOf(program, org.bucket, userID, request.history, tier).
+			Filter(flux.Field(request.field+"_"+string(request.aggregate))).
+			Group("_field").
+			AggregateWindowStart(request.history.window.expr(), request.aggregate, false)
+	}
+	run := func(program *flux.Program, isForecast bool) ([]forecastPoint, error) {
+		query, params := program.Render()
+		result, err := cache.get(ctx, cacheEndpointPoints, userID, query, params, func() (interface{}, error) {
+			tables, err := org.queryAPI.QueryWithParams(ctx, query, params)
+			if err != nil {
+				return nil, err
+			}
+			defer tables.Close()
+			var points []forecastPoint
+			for tables.Next() {
+				if value, ok := toFloat(tables.Record().Value()); ok {
+					points = append(points, forecastPoint{Time: tables.Record().Time(), Value: value, Forecast: isForecast})
+				}
+			}
+			return points, tables.Err()
+		})
+		if err != nil {
+			return nil, err
+		}
+		points := append([]forecastPoint(nil), result.([]forecastPoint)...)
+		sort.Slice(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+		return points, nil
+	}
+
+	for i, tier := range tiers {
+		var program flux.Program
+		program.Add(historyOf(&program, tier))
+		history, err := run(&program, false)
+		if err != nil {
+			return nil, tier, err
+		}
+		if len(history) == 0 && tier.calendar && i < len(tiers)-1 {
+			continue
+		}
+		if needed := request.minHistory(); len(history) < needed {
+			return nil, tier, insufficientHistoryError(len(history), needed)
+		}
+
+		program = flux.Program{}
+		program.Add(historyOf(&program, tier).
+			HoltWinters(request.horizon, request.seasonality, request.history.window.expr()))
+		predicted, err := run(&program, true)
+		if err != nil {
+			return nil, tier, err
+		}
+		return append(history, predicted...), tier, nil
+	}
+	return nil, tiers[len(tiers)-1], nil
+}
+
+// toFloat converts the numeric value of a record to a float64.
+func toFloat(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, true
+	case int64:
+		return float64(value), true
+	case uint64:
+		return float64(value), true
+	}
+	return 0, false
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// valuesCSV returns an annotated CSV response with a row for each value, one
+// window apart from start.
+func valuesCSV(start time.Time, window time.Duration, values ...float64) string {
+	csv := "#datatype,string,long,dateTime:RFC3339,double,string\r\n#group,false,false,false,false,true\r\n#default,_result,,,,\r\n,result,table,_time,_value,_field\r\n"
+	for i, value := range values {
+		csv += ",,0," + start.Add(time.Duration(i)*window).Format(time.RFC3339) + "," +
+			strconv.FormatFloat(value, 'f', -1, 64) + ",field1_mean\r\n"
+	}
+	return csv + "\r\n"
+}
+
+func TestForecast(t *testing.T) {
+	app := newTestApp(t)
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	app.influx.HandleQuery(`holtWinters\(`, valuesCSV(start.Add(4*time.Hour), time.Hour, 5, 6))
+	app.influx.HandleQuery(`aggregateWindow\(`, valuesCSV(start, time.Hour, 1, 2, 3, 4))
+
+	resp, body := app.do(t, http.MethodGet, "/users/user1/forecast?field=field1&start=2022-01-01T00:00:00Z&stop=2022-01-01T04:00:00Z&window=1h&horizon=2h", "key1", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d (%s), want 200", resp.StatusCode, body)
+	}
+	var response struct {
+		Field     string          `json:"field"`
+		Aggregate string          `json:"aggregate"`
+		Points    []forecastPoint `json:"points"`
+		Metadata  queryMetadata   `json:"metadata"`
+	}
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Field != "field1" || response.Aggregate != "mean" || response.Metadata.Window != "1h" {
+		t.Errorf("got the %s of %s over %s windows, want the mean of field1 over 1h windows", response.Aggregate, response.Field, response.Metadata.Window)
+	}
+	// The history comes first, followed by the predicted values.
+	if len(response.Points) != 6 {
+		t.Fatalf("got points %+v, want 4 of history and 2 predicted", response.Points)
+	}
+	for i, point := range response.Points {
+		want := forecastPoint{Time: start.Add(time.Duration(i) * time.Hour), Value: float64(i + 1), Forecast: i >= 4}
+		if !point.Time.Equal(want.Time) || point.Value != want.Value || point.Forecast != want.Forecast {
+			t.Errorf("point %d is %+v, want %+v", i, point, want)
+		}
+	}
+
+	resp, body = app.do(t, http.MethodGet, "/users/user1/forecast?field=field1", "key2", "")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got status %d (%s) forecasting another user's data, want 403", resp.StatusCode, body)
+	}
+}
+
+func TestForecastNeedsEnoughHistory(t *testing.T) {
+	app := newTestApp(t)
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	app.influx.HandleQuery(`holtWinters\(`, valuesCSV(start, time.Hour, 1))
+	// Only 4 of the 8 windows of the history hold values.
+	app.influx.HandleQuery(`aggregateWindow\(`, valuesCSV(start, time.Hour, 1, 2, 3, 4))
+
+	for _, test := range []struct {
+		name, query string
+		status      int
+		code        string
+	}{
+		{"too few values for two seasons", "start=2022-01-01T00:00:00Z&stop=2022-01-01T08:00:00Z&window=1h&seasonality=3",
+			http.StatusUnprocessableEntity, errorCodeInsufficientHistory},
+		{"too few windows for two seasons", "start=2022-01-01T00:00:00Z&stop=2022-01-01T04:00:00Z&window=1h&seasonality=3",
+			http.StatusBadRequest, errorCodeInvalidRequest},
+		{"a single window", "start=2022-01-01T00:00:00Z&stop=2022-01-01T01:00:00Z&window=1h",
+			http.StatusBadRequest, errorCodeInvalidRequest},
+		{"a horizon of part of a window", "start=2022-01-01T00:00:00Z&stop=2022-01-01T04:00:00Z&window=1h&horizon=90m",
+			http.StatusBadRequest, errorCodeInvalidRequest},
+		{"months", "start=2021-01-01T00:00:00Z&stop=2022-01-01T00:00:00Z&window=1mo",
+			http.StatusBadRequest, errorCodeInvalidRequest},
+	} {
+		resp, body := app.do(t, http.MethodGet, "/users/user1/forecast?field=field1&"+test.query, "key1", "")
+		if resp.StatusCode != test.status || errorCode(t, body) != test.code {
+			t.Errorf("%s: got status %d (%s), want %d with code %s", test.name, resp.StatusCode, body, test.status, test.code)
+		}
+	}
+}
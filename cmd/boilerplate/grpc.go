@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	influxdb2http "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/influxdata/go-snippets/pkg/boilerplatepb"
+)
+
+// newGRPCServer returns a gRPC server for the Boilerplate service. Its
+// interceptors authenticate and rate limit callers in the same way as the
+// middleware registered for the HTTP routes. When certificates is not nil, the
+// server only accepts TLS connections presenting its certificate.
+func newGRPCServer(certificates *certificateReloader) *grpc.Server {
+	options := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(authenticatedUnary, rateLimitedUnary),
+		grpc.ChainStreamInterceptor(authenticatedStream, rateLimitedStream),
+	}
+	if certificates != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(certificates.config("h2"))))
+	}
+	server := grpc.NewServer(options...)
+	pb.RegisterBoilerplateServer(server, &boilerplateServer{})
+	return server
+}
+
+// boilerplateServer implements the Boilerplate gRPC service on top of the same
+// functions as the HTTP handlers.
+type boilerplateServer struct {
+	pb.UnimplementedBoilerplateServer
+}
+
+// Ingest queues a point for a user to be written. See ingest for details.
+func (s *boilerplateServer) Ingest(ctx context.Context, request *pb.IngestRequest) (*pb.IngestResponse, error) {
+	if err := validateIngestRequest(request); err != nil {
+		return nil, err
+	}
+	return ingestIdempotently(ctx, "Ingest", []*pb.IngestRequest{request})
+}
+
+// IngestStream queues each point sent by the client until it closes the stream.
+//
+// When the client sends an idempotency key, the points are only queued once
+// the stream is closed, so that the whole stream can be checked against the
+// streams sent with the key before.
+func (s *boilerplateServer) IngestStream(stream pb.Boilerplate_IngestStreamServer) error {
+	var requests []*pb.IngestRequest
+	var written int64
+	idempotent := grpcIdempotencyKey(stream.Context()) != ""
+	for {
+		request, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := validateIngestRequest(request); err != nil {
+			return err
+		}
+		if idempotent {
+			requests = append(requests, request)
+			continue
+		}
+		if err := writePoint(stream.Context(), request.UserId, request.Measurement, request.Field1); err != nil {
+			return grpcError(err)
+		}
+		written++
+	}
+	if !idempotent {
+		return stream.SendAndClose(&pb.IngestResponse{PointsWritten: written})
+	}
+	response, err := ingestIdempotently(stream.Context(), "IngestStream", requests)
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(response)
+}
+
+// grpcIdempotencyKey returns the idempotency key sent by the client in the
+// "idempotency-key" metadata, if any.
+func grpcIdempotencyKey(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("idempotency-key"); len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// ingestIdempotently queues the points of requests made by the named method,
+// either all of them or, when any of them is rejected, none.
+// When the client sends an idempotency key with a call, the response to the
+// first call with the key is returned in reply to any retry within the
+// idempotency window without queueing the points again, in the same way as the
+// idempotent middleware does for HTTP requests. Only successful responses are
+// stored.
+func ingestIdempotently(ctx context.Context, method string, requests []*pb.IngestRequest) (*pb.IngestResponse, error) {
+	ingest := func() (*pb.IngestResponse, error) {
+		// Check every point before queueing any of them, so that a call that
+		// fails queues nothing and can be retried as a whole.
+		points := make([]*write.Point, 0, len(requests))
+		for _, request := range requests {
+			point, err := newPoint(ctx, request.UserId, request.Measurement, request.Field1)
+			if err != nil {
+				return nil, grpcError(err)
+			}
+			points = append(points, point)
+		}
+		if len(points) > 0 {
+			if err := queuePoints(ctx, points...); err != nil {
+				return nil, grpcError(err)
+			}
+		}
+		return &pb.IngestResponse{PointsWritten: int64(len(requests))}, nil
+	}
+	key := grpcIdempotencyKey(ctx)
+	if key == "" || idempotencyKeys == nil {
+		return ingest()
+	}
+
+	parts := [][]byte{[]byte(method), []byte(organizationOf(ctx).name)}
+	for _, request := range requests {
+		data, err := proto.MarshalOptions{Deterministic: true}.Marshal(request)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		parts = append(parts, data)
+	}
+	scope, _ := caller(ctx)
+	stored, finish, err := idempotencyKeys.begin(ctx, scope, key, fingerprint(parts...))
+	switch {
+	case errors.Is(err, errIdempotencyKeyReused), errors.Is(err, errIdempotencyKeyInvalid):
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	case err != nil:
+		return nil, grpcError(err)
+	case stored != nil:
+		var response pb.IngestResponse
+		if err := proto.Unmarshal(stored.body, &response); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		grpc.SetHeader(ctx, metadata.Pairs("idempotent-replayed", "true"))
+		return &response, nil
+	}
+
+	var toStore *storedResponse
+	defer func() { finish(toStore) }()
+	response, err := ingest()
+	if err != nil {
+		return nil, err
+	}
+	if body, err := proto.Marshal(response); err == nil {
+		toStore = &storedResponse{status: http.StatusOK, contentType: "application/protobuf", body: body}
+	}
+	return response, nil
+}
+
+// Query streams the latest down sampled records for a user. See query for details.
+func (s *boilerplateServer) Query(request *pb.QueryRequest, stream pb.Boilerplate_QueryServer) error {
+	if request.UserId == "" {
+		return status.Error(codes.InvalidArgument, "user_id is required")
+	}
+	err := queryLatest(stream.Context(), request.UserId, func(table int, record map[string]string) error {
+		return stream.Send(&pb.Record{Table: int32(table), Values: record})
+	})
+	return grpcError(err)
+}
+
+// Setup creates the tasks that roll up a user's data, and returns the ID of the
+// task of the finest tier. See setup for details.
+func (s *boilerplateServer) Setup(ctx context.Context, request *pb.SetupRequest) (*pb.SetupResponse, error) {
+	if request.UserId == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_id is required")
+	}
+	// SetupRequest has no timezone, so the days of the calendar tier are
+	// counted in UTC.
+	tasks, err := createRollupTasks(ctx, request.UserId, time.UTC)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &pb.SetupResponse{TaskId: tasks[0].Id}, nil
+}
+
+// validateIngestRequest applies the checks the OpenAPI document makes of
+// requests to the /ingest endpoint.
+func validateIngestRequest(request *pb.IngestRequest) error {
+	switch {
+	case request.UserId == "":
+		return status.Error(codes.InvalidArgument, "user_id is required")
+	case request.Measurement == "":
+		return status.Error(codes.InvalidArgument, "measurement is required")
+	}
+	return nil
+}
+
+// grpcError converts an error returned by the shared business logic into a
+// gRPC status error, mapping HTTP status codes returned by InfluxDB onto their
+// closest gRPC equivalents.
+func grpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch {
+	case errors.Is(err, errUnauthenticated):
+		return status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, errForbidden):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, errUnknownOrganization):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	var violation *schemaViolation
+	if errors.As(err, &violation) {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	var requestErr *requestError
+	if errors.As(err, &requestErr) {
+		code, ok := httpStatusCodes[requestErr.status]
+		if !ok {
+			code = codes.Unknown
+		}
+		return status.Error(code, err.Error())
+	}
+	var influxErr *influxdb2http.Error
+	if errors.As(err, &influxErr) {
+		code, ok := httpStatusCodes[influxErr.StatusCode]
+		if !ok {
+			code = codes.Unknown
+		}
+		return status.Error(code, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// httpStatusCodes maps HTTP status codes onto gRPC codes. Status codes not
+// listed here map to codes.Unknown.
+var httpStatusCodes = map[int]codes.Code{
+	http.StatusBadRequest:            codes.InvalidArgument,
+	http.StatusUnauthorized:          codes.Unauthenticated,
+	http.StatusForbidden:             codes.PermissionDenied,
+	http.StatusNotFound:              codes.NotFound,
+	http.StatusConflict:              codes.AlreadyExists,
+	http.StatusRequestEntityTooLarge: codes.ResourceExhausted,
+	http.StatusUnprocessableEntity:   codes.InvalidArgument,
+	http.StatusTooManyRequests:       codes.ResourceExhausted,
+	http.StatusInternalServerError:   codes.Internal,
+	http.StatusServiceUnavailable:    codes.Unavailable,
+	http.StatusGatewayTimeout:        codes.DeadlineExceeded,
+}
+
+// authenticateGRPC authenticates the caller with the API key passed as a bearer
+// token in the "authorization" metadata, and selects the organization to serve
+// the call from by the caller and the "x-organization" metadata. Calls without
+// a key over a connection with a verified client certificate are authenticated
+// by the certificate instead. It is the gRPC equivalent of the authenticated
+// and tenanted middlewares.
+func authenticateGRPC(ctx context.Context) (context.Context, error) {
+	var key, org string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			key = strings.TrimPrefix(values[0], "Bearer ")
+		}
+		if values := md.Get("x-organization"); len(values) > 0 {
+			org = values[0]
+		}
+	}
+	authenticatedByCertificate := false
+	if p, ok := peer.FromContext(ctx); ok && key == "" {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			ctx, authenticatedByCertificate = authenticateCertificate(ctx, &info.State)
+		}
+	}
+	if !authenticatedByCertificate {
+		var err error
+		if ctx, err = authenticate(ctx, key); err != nil {
+			return ctx, grpcError(err)
+		}
+	}
+	ctx, err := selectOrganization(ctx, org)
+	return ctx, grpcError(err)
+}
+
+// rateLimitGRPC is the gRPC equivalent of the rateLimited middleware.
+func rateLimitGRPC(ctx context.Context) error {
+	key, ok := caller(ctx)
+	if !ok {
+		if p, ok := peer.FromContext(ctx); ok {
+			key, _, _ = net.SplitHostPort(p.Addr.String())
+		}
+	}
+	if !allow(key) {
+		return status.Error(codes.ResourceExhausted, "rate limit exceeded")
+	}
+	return nil
+}
+
+func authenticatedUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := authenticateGRPC(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func rateLimitedUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := rateLimitGRPC(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func authenticatedStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := authenticateGRPC(stream.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &contextStream{stream, ctx})
+}
+
+func rateLimitedStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := rateLimitGRPC(stream.Context()); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
+
+// contextStream overrides the context of a grpc.ServerStream, so that stream
+// interceptors can pass values such as the authenticated caller to handlers.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "github.com/influxdata/go-snippets/pkg/boilerplatepb"
+)
+
+// newTestGRPCClient serves the gRPC service of the test app over an in-memory
+// connection and returns a client for it.
+func newTestGRPCClient(t *testing.T) pb.BoilerplateClient {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	server := newGRPCServer(nil)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewBoilerplateClient(conn)
+}
+
+// withKey returns a context that sends the API key, and any other metadata,
+// with a call.
+func withKey(key string, pairs ...string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), append([]string{"authorization", "Bearer " + key}, pairs...)...)
+}
+
+func TestGRPCIngest(t *testing.T) {
+	app := newTestApp(t)
+	client := newTestGRPCClient(t)
+
+	response, err := client.Ingest(withKey("key1"), &pb.IngestRequest{UserId: "user1", Measurement: "measurement1", Field1: 1.5})
+	if err != nil {
+		t.Fatalf("Ingest failed: %v", err)
+	}
+	if response.PointsWritten != 1 {
+		t.Errorf("got %d points written, want 1", response.PointsWritten)
+	}
+	points := app.waitForPoints(t, 1)
+	if got := points[0]; got.Measurement != "measurement1" || got.Tags["user_id"] != "user1" || got.Fields["field1"] != 1.5 {
+		t.Errorf("got point %+v, want measurement1 for user1 with field1 1.5", got)
+	}
+
+	_, err = client.Ingest(withKey("key1"), &pb.IngestRequest{UserId: "user1"})
+	if code := status.Code(err); code != codes.InvalidArgument {
+		t.Errorf("got %v without a measurement, want InvalidArgument", err)
+	}
+}
+
+func TestGRPCIngestIdempotently(t *testing.T) {
+	app := newTestApp(t)
+	client := newTestGRPCClient(t)
+	request := &pb.IngestRequest{UserId: "user1", Measurement: "measurement1", Field1: 1}
+
+	// Calls with the same key made at once are collapsed into the first, whose
+	// response the others receive.
+	const calls = 10
+	type result struct {
+		written  int64
+		replayed bool
+		err      error
+	}
+	results := make(chan result, calls)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			var header metadata.MD
+			response, err := client.Ingest(withKey("key1", "idempotency-key", "call-1"), request, grpc.Header(&header))
+			r := result{replayed: len(header.Get("idempotent-replayed")) > 0, err: err}
+			if response != nil {
+				r.written = response.PointsWritten
+			}
+			results <- r
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(results)
+	replayed := 0
+	for r := range results {
+		if r.err != nil || r.written != 1 {
+			t.Errorf("got %d points written and error %v, want 1", r.written, r.err)
+		}
+		if r.replayed {
+			replayed++
+		}
+	}
+	if replayed != calls-1 {
+		t.Errorf("%d responses were replayed, want all %d but the first", replayed, calls-1)
+	}
+
+	// The key can't be used for another request.
+	_, err := client.Ingest(withKey("key1", "idempotency-key", "call-1"), &pb.IngestRequest{UserId: "user1", Measurement: "measurement1", Field1: 2})
+	if code := status.Code(err); code != codes.InvalidArgument {
+		t.Errorf("got %v for another request with the same key, want InvalidArgument", err)
+	}
+	app.waitForPoints(t, 1)
+	time.Sleep(50 * time.Millisecond)
+	if points := app.influx.Points(); len(points) != 1 {
+		t.Errorf("got %d points in InfluxDB, want 1", len(points))
+	}
+}
+
+func TestGRPCIngestStream(t *testing.T) {
+	app := newTestApp(t)
+	client := newTestGRPCClient(t)
+
+	stream, err := client.IngestStream(withKey("key1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := stream.Send(&pb.IngestRequest{UserId: "user1", Measurement: "measurement1", Field1: float64(i)}); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	response, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("IngestStream failed: %v", err)
+	}
+	if response.PointsWritten != 3 {
+		t.Errorf("got %d points written, want 3", response.PointsWritten)
+	}
+	app.waitForPoints(t, 3)
+
+	// Retrying a stream with the same idempotency key replays the response
+	// without queueing the points again.
+	for attempt := 0; attempt < 2; attempt++ {
+		var header metadata.MD
+		stream, err := client.IngestStream(withKey("key1", "idempotency-key", "stream-1"), grpc.Header(&header))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.Send(&pb.IngestRequest{UserId: "user1", Measurement: "measurement1", Field1: 9})
+		response, err := stream.CloseAndRecv()
+		if err != nil {
+			t.Fatalf("attempt %d: IngestStream failed: %v", attempt+1, err)
+		}
+		if response.PointsWritten != 1 {
+			t.Errorf("attempt %d: got %d points written, want 1", attempt+1, response.PointsWritten)
+		}
+		if replayed := len(header.Get("idempotent-replayed")) > 0; replayed != (attempt > 0) {
+			t.Errorf("attempt %d: got replayed %v", attempt+1, replayed)
+		}
+	}
+	app.waitForPoints(t, 4)
+}
+
+func TestGRPCIngestStreamQueuesNothingWhenAPointIsRejected(t *testing.T) {
+	app := newTestApp(t)
+	client := newTestGRPCClient(t)
+	max := 10.0
+	schemas.measurements["measurement1"] = measurementSchema{Name: "measurement1", Tags: []string{},
+		Fields: []fieldSchema{{Name: "field1", Type: fieldTypeFloat, Max: &max}}}
+
+	for _, test := range []struct {
+		name     string
+		rejected *pb.IngestRequest
+		want     codes.Code
+	}{
+		{"schema violation", &pb.IngestRequest{UserId: "user1", Measurement: "measurement1", Field1: 100}, codes.InvalidArgument},
+		{"another user", &pb.IngestRequest{UserId: "user2", Measurement: "measurement1", Field1: 1}, codes.PermissionDenied},
+		{"internal measurement", &pb.IngestRequest{UserId: "user1", Measurement: "rollup_1m", Field1: 1}, codes.InvalidArgument},
+	} {
+		stream, err := client.IngestStream(withKey("key1", "idempotency-key", test.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.Send(&pb.IngestRequest{UserId: "user1", Measurement: "measurement1", Field1: 1})
+		stream.Send(test.rejected)
+		stream.Send(&pb.IngestRequest{UserId: "user1", Measurement: "measurement1", Field1: 2})
+		_, err = stream.CloseAndRecv()
+		if code := status.Code(err); code != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	if _, err := client.Ingest(withKey("key1"), &pb.IngestRequest{UserId: "user1", Measurement: "measurement1", Field1: 3}); err != nil {
+		t.Fatalf("Ingest failed: %v", err)
+	}
+	// The queue delivers batches in order, so once the last point is written
+	// any point queued by the rejected streams would have been too.
+	app.waitForPoints(t, 1)
+	time.Sleep(50 * time.Millisecond)
+	if points := app.influx.Points(); len(points) != 1 || points[0].Fields["field1"] != 3.0 {
+		t.Errorf("got points %+v, want only the point of the last call", points)
+	}
+}
+
+func TestGRPCQuery(t *testing.T) {
+	app := newTestApp(t)
+	client := newTestGRPCClient(t)
+	now := time.Now().Truncate(time.Minute)
+	writeRollups(t, app,
+		"rollup_1m,user_id=user1,_source=measurement1 field1_mean=1.5 "+formatNanos(now),
+		"rollup_1m,user_id=user2,_source=measurement1 field1_mean=9 "+formatNanos(now))
+
+	stream, err := client.Query(withKey("key1"), &pb.QueryRequest{UserId: "user1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []*pb.Record
+	for {
+		record, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want 1", len(records))
+	}
+	if values := records[0].Values; values["user_id"] != "user1" || values["_value"] != "1.5" {
+		t.Errorf("got record %v, want field1_mean 1.5 of user1", values)
+	}
+}
+
+func TestGRPCAuthentication(t *testing.T) {
+	app := newTestApp(t)
+	client := newTestGRPCClient(t)
+	request := &pb.IngestRequest{UserId: "user1", Measurement: "measurement1", Field1: 1}
+
+	_, err := client.Ingest(context.Background(), request)
+	if code := status.Code(err); code != codes.Unauthenticated {
+		t.Errorf("got %v without a key, want Unauthenticated", err)
+	}
+	_, err = client.Ingest(withKey("key3"), request)
+	if code := status.Code(err); code != codes.Unauthenticated {
+		t.Errorf("got %v with an unknown key, want Unauthenticated", err)
+	}
+	_, err = client.Ingest(withKey("key2"), request)
+	if code := status.Code(err); code != codes.PermissionDenied {
+		t.Errorf("got %v for another user, want PermissionDenied", err)
+	}
+	_, err = client.Ingest(withKey("key1", "x-organization", "unknown"), request)
+	if code := status.Code(err); code != codes.InvalidArgument {
+		t.Errorf("got %v for an unknown organization, want InvalidArgument", err)
+	}
+
+	// Stream calls are authenticated by the stream interceptor.
+	stream, err := client.Query(context.Background(), &pb.QueryRequest{UserId: "user1"})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if code := status.Code(err); code != codes.Unauthenticated {
+		t.Errorf("got %v querying without a key, want Unauthenticated", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if points := app.influx.Points(); len(points) != 0 {
+		t.Errorf("rejected calls wrote %d points", len(points))
+	}
+}
+
+func TestGRPCRateLimit(t *testing.T) {
+	newTestApp(t)
+	client := newTestGRPCClient(t)
+	rateLimit = 1
+	defer func() { rateLimit = 0 }()
+	request := &pb.IngestRequest{UserId: "user1", Measurement: "measurement1", Field1: 1}
+
+	if _, err := client.Ingest(withKey("key1"), request); err != nil {
+		t.Fatalf("the first call failed: %v", err)
+	}
+	_, err := client.Ingest(withKey("key1"), request)
+	if code := status.Code(err); code != codes.ResourceExhausted {
+		t.Errorf("got %v over the limit, want ResourceExhausted", err)
+	}
+	stream, err := client.IngestStream(withKey("key1"))
+	if err == nil {
+		_, err = stream.CloseAndRecv()
+	}
+	if code := status.Code(err); code != codes.ResourceExhausted {
+		t.Errorf("got %v streaming over the limit, want ResourceExhausted", err)
+	}
+
+	// Each caller has their own limit.
+	if _, err := client.Ingest(withKey("key2"), &pb.IngestRequest{UserId: "user2", Measurement: "measurement1", Field1: 1}); err != nil {
+		t.Errorf("another caller was limited: %v", err)
+	}
+}
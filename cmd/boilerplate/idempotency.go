@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // Need the sqlite3 driver.
+)
+
+// maxIdempotencyKeyLength is the length of the longest idempotency key accepted.
+const maxIdempotencyKeyLength = 255
+
+var (
+	// errIdempotencyKeyReused is returned when an idempotency key is sent with a
+	// different request than the one it was first used for.
+	errIdempotencyKeyReused = errors.New("idempotency key was already used for a different request")
+	// errIdempotencyKeyInvalid is returned when an idempotency key is too long.
+	errIdempotencyKeyInvalid = fmt.Errorf("idempotency key must be at most %d characters", maxIdempotencyKeyLength)
+)
+
+// storedResponse is the response to a request made with an idempotency key,
+// which is sent again in reply to retries of the request.
+type storedResponse struct {
+	status      int
+	contentType string
+	body        []byte
+}
+
+// idempotencyStore remembers the responses to requests made with idempotency
+// keys in a SQLite database, so that a client can safely retry a request whose
+// response it never received without the request taking effect twice.
+//
+// Keys are scoped to the caller, so different users may use the same keys.
+// Requests with the same key as a request still in progress wait for it to
+// finish and then receive its response.
+type idempotencyStore struct {
+	db     *sql.DB
+	window time.Duration
+
+	mu sync.Mutex
+	// inFlight holds a channel for each key with a request in progress, which
+	// is closed when the request finishes.
+	inFlight map[string]chan struct{}
+}
+
+// idempotencyKeys remembers the responses to requests with idempotency keys.
+var idempotencyKeys *idempotencyStore
+
+// openIdempotencyStore opens the idempotency store in the SQLite database at
+// path, creating it if needed.
+func openIdempotencyStore(path string, window time.Duration) (*idempotencyStore, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=5000", path))
+	if err != nil {
+		return nil, err
+	}
+	create := `CREATE TABLE IF NOT EXISTS idempotency_keys(
+		scope TEXT NOT NULL,
+		key TEXT NOT NULL,
+		fingerprint TEXT NOT NULL,
+		status INTEGER NOT NULL,
+		content_type TEXT NOT NULL,
+		body BLOB,
+		created INTEGER NOT NULL,
+		PRIMARY KEY (scope, key));
+		CREATE INDEX IF NOT EXISTS idempotency_keys_created ON idempotency_keys(created)`
+	if _, err := db.Exec(create); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("idempotency table create failed: %v", err)
+	}
+	return &idempotencyStore{db: db, window: window, inFlight: make(map[string]chan struct{})}, nil
+}
+
+// begin starts a request made with an idempotency key. If the key was used
+// within the window, begin returns the stored response, or errIdempotencyKeyReused
+// if the fingerprint of the request differs. Otherwise the caller must make the
+// request and call finish with its response, or with nil if the response should
+// not be stored so that retries make the request again.
+func (s *idempotencyStore) begin(ctx context.Context, scope, key, fingerprint string) (*storedResponse, func(*storedResponse), error) {
+	if len(key) > maxIdempotencyKeyLength {
+		return nil, nil, errIdempotencyKeyInvalid
+	}
+	id := strconv.Quote(scope) + " " + key
+	for {
+		s.mu.Lock()
+		if done, ok := s.inFlight[id]; ok {
+			s.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			case <-done:
+				continue
+			}
+		}
+
+		var stored storedResponse
+		var storedFingerprint string
+		err := s.db.QueryRowContext(ctx,
+			`SELECT fingerprint, status, content_type, body FROM idempotency_keys WHERE scope=$1 AND key=$2 AND created>$3`,
+			scope, key, time.Now().Add(-s.window).UnixNano(),
+		).Scan(&storedFingerprint, &stored.status, &stored.contentType, &stored.body)
+		if err == nil {
+			s.mu.Unlock()
+			if storedFingerprint != fingerprint {
+				return nil, nil, errIdempotencyKeyReused
+			}
+			return &stored, nil, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			s.mu.Unlock()
+			return nil, nil, err
+		}
+
+		done := make(chan struct{})
+		s.inFlight[id] = done
+		s.mu.Unlock()
+
+		return nil, func(response *storedResponse) {
+			if response != nil {
+				s.store(scope, key, fingerprint, response)
+			}
+			s.mu.Lock()
+			delete(s.inFlight, id)
+			s.mu.Unlock()
+			close(done)
+		}, nil
+	}
+}
+
+// store saves the response to a request, and forgets keys older than the window.
+func (s *idempotencyStore) store(scope, key, fingerprint string, response *storedResponse) {
+	now := time.Now()
+	if _, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE created<=$1`, now.Add(-s.window).UnixNano()); err != nil {
+		log.Printf("Failed to expire idempotency keys: %v", err)
+	}
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO idempotency_keys VALUES($1, $2, $3, $4, $5, $6, $7)`,
+		scope, key, fingerprint, response.status, response.contentType, response.body, now.UnixNano())
+	if err != nil {
+		log.Printf("Failed to store idempotency key: %v", err)
+	}
+}
+
+// fingerprint returns a digest identifying a request by the given parts.
+func fingerprint(parts ...[]byte) string {
+	hash := sha256.New()
+	for _, part := range parts {
+		fmt.Fprintf(hash, "%d:", len(part))
+		hash.Write(part)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// idempotent is a middleware that lets clients safely retry a request by
+// sending the same Idempotency-Key header with each attempt. The response to
+// the first attempt is stored, and sent in reply to any retry within the
+// idempotency window with an Idempotent-Replayed header, without calling the
+// handler again. Responses with a 429 or 5xx status are not stored, so that
+// the request can be retried. Sending a key again with a different request
+// returns a 422 http.StatusUnprocessableEntity.
+//
+// It must be applied after the authenticated middleware to scope keys to the
+// caller, and after the tenanted middleware, as a key identifies a request to
+// one organization.
+func idempotent(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || idempotencyKeys == nil {
+			handler(w, r)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			handleError(w, invalidBody(err))
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		scope, _ := caller(r.Context())
+		stored, finish, err := idempotencyKeys.begin(r.Context(), scope, key,
+			fingerprint([]byte(r.Method), []byte(r.URL.Path), []byte(organizationOf(r.Context()).name), body))
+		switch {
+		case err != nil:
+			handleError(w, err)
+			return
+		case stored != nil:
+			if stored.contentType != "" {
+				w.Header().Set("Content-Type", stored.contentType)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.status)
+			w.Write(stored.body)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		var response *storedResponse
+		defer func() { finish(response) }()
+		handler(recorder, r)
+		if recorder.status < 500 && recorder.status != http.StatusTooManyRequests {
+			response = &storedResponse{
+				status:      recorder.status,
+				contentType: w.Header().Get("Content-Type"),
+				body:        recorder.body.Bytes(),
+			}
+		}
+	}
+}
+
+// responseRecorder records the status and body of a response while writing it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status, r.wroteHeader = status, true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.wroteHeader = true
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
@@ -9,16 +9,22 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
-	"github.com/influxdata/influxdb-client-go/v2/api"
 	influxdb2http "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+
+	"github.com/influxdata/go-snippets/internal/flux"
 )
 
 // Your app needs the following information:
@@ -31,59 +37,258 @@ var (
 	// Organizations are used by InfluxDB to group resources such as users,
 	// tasks, buckets, dashboards and more.
 	organizationName = os.Getenv("INFLUXDB_ORGANIZATION")
-	// organizationID is used by the task API and is populated
-	// by looking up the organizationName at startup.
-	organizationID string
-	// host is the URL of your InfluxDB instance or Cloud environment.
-	// This is also the URL where you reach the UI for your account.
-	host = os.Getenv("INFLUXDB_HOST")
-	// token appropriately scoped to access the resources needed by your app.
-	// For ease of use in this example, you should use an "all access" token.
-	// In a production application, you should use a properly scoped token to
-	// access only the resources needed by your application and store it securely.
-	// More information about permissions and tokens can be found here:
-	// https://docs.influxdata.com/influxdb/v2.1/security/tokens/
-	token = os.Getenv("INFLUXDB_TOKEN")
+	// Your app can also serve several organizations, each with its own host,
+	// token and bucket. See orgs.go for details.
+	//
+	// The host and token are read from the environment along with the rest of
+	// the configuration of the InfluxDB client, such as a custom CA or proxy.
+	// See internal/influxclient for details.
+	// - INFLUXDB_HOST is the URL of your InfluxDB instance or Cloud environment.
+	//   This is also the URL where you reach the UI for your account.
+	// - INFLUXDB_TOKEN is a token appropriately scoped to access the resources
+	//   needed by your app. For ease of use in this example, you should use an
+	//   "all access" token. In a production application, you should use a
+	//   properly scoped token to access only the resources needed by your
+	//   application and store it securely. More information about permissions
+	//   and tokens can be found here:
+	//   https://docs.influxdata.com/influxdb/v2.1/security/tokens/
 	// bucketName specifies an InfluxDB bucket in your organization.
 	// A bucket is where you store data, and you can group related data into a bucket.
 	// You can also scope permissions to the bucket level as well.
 	bucketName = os.Getenv("INFLUXDB_BUCKET")
 
-	// client for accessing InfluxDB
-	client   influxdb2.Client
-	writeAPI api.WriteAPIBlocking
-	queryAPI api.QueryAPI
+	// queueDir is the directory the write queues are stored in, and is read from
+	// the BOILERPLATE_QUEUE_DIR environment variable. It defaults to "queue".
+	queueDir = os.Getenv("BOILERPLATE_QUEUE_DIR")
+	// idempotencyDB is the path of the SQLite database idempotency keys are
+	// stored in, and is read from the BOILERPLATE_IDEMPOTENCY_DB environment
+	// variable. It defaults to "idempotency.db".
+	idempotencyDB = os.Getenv("BOILERPLATE_IDEMPOTENCY_DB")
+	// idempotencyWindow is how long idempotency keys are remembered for, and is
+	// read from the BOILERPLATE_IDEMPOTENCY_WINDOW environment variable as a Go
+	// duration, e.g. "1h". It defaults to 24 hours.
+	idempotencyWindow = os.Getenv("BOILERPLATE_IDEMPOTENCY_WINDOW")
+	// schemaFile is the path of the JSON file the schema registry is stored in,
+	// and is read from the BOILERPLATE_SCHEMA environment variable. When it is
+	// unset, the registry is only kept in memory.
+	schemaFile = os.Getenv("BOILERPLATE_SCHEMA")
+	// auditLogFile is the path of the file administrative actions are recorded
+	// in, and is read from the BOILERPLATE_AUDIT_LOG environment variable. It
+	// defaults to "audit.log".
+	auditLogFile = os.Getenv("BOILERPLATE_AUDIT_LOG")
 )
 
-// init sets up the InfluxDB client and its read and write APIs.
+// init sets up an InfluxDB client and its read and write APIs for each
+// organization your app serves.
 func init() {
-	client = influxdb2.NewClient(host, token)
-	writeAPI = client.WriteAPIBlocking(organizationName, bucketName)
-	queryAPI = client.QueryAPI(organizationName)
+	if err := configureOrganizations(); err != nil {
+		log.Fatal(fmt.Errorf("Failed to configure organizations: %v", err))
+	}
 }
 
 // main starts your Go application and begins listening on port 8080.
 func main() {
 
-	// Lookup the organizationID using the organizationName.
-	org, err := client.OrganizationsAPI().FindOrganizationByName(context.Background(), organizationName)
+	// Open the write queue of each organization and start writing the points in
+	// it to InfluxDB. See queue.go and orgs.go for details. The ID of each
+	// organization is looked up when it is first needed rather than here.
+	if queueDir == "" {
+		queueDir = "queue"
+	}
+	for _, org := range organizations {
+		if err := org.start(context.Background(), queueDir); err != nil {
+			log.Fatal(fmt.Errorf("Failed to start organization %q: %v", org.name, err))
+		}
+	}
+
+	// Remember the responses to requests with idempotency keys, so that clients
+	// can safely retry them. See idempotency.go for details.
+	if idempotencyDB == "" {
+		idempotencyDB = "idempotency.db"
+	}
+	var err error
+	window := 24 * time.Hour
+	if idempotencyWindow != "" {
+		if window, err = time.ParseDuration(idempotencyWindow); err != nil {
+			log.Fatal(fmt.Errorf("Invalid BOILERPLATE_IDEMPOTENCY_WINDOW %q: %v", idempotencyWindow, err))
+		}
+	}
+	if idempotencyKeys, err = openIdempotencyStore(idempotencyDB, window); err != nil {
+		log.Fatal(fmt.Errorf("Failed to open the idempotency store in %q: %v", idempotencyDB, err))
+	}
+
+	// Limit the rate of the requests of each caller. See ratelimit.go for
+	// details.
+	if rateLimitSetting != "" {
+		rateLimit, err = strconv.ParseFloat(rateLimitSetting, 64)
+		if err != nil || !(rateLimit >= 0) || math.IsInf(rateLimit, 1) {
+			log.Fatal(fmt.Errorf("Invalid BOILERPLATE_RATE_LIMIT %q: must be a non-negative number", rateLimitSetting))
+		}
+	}
+
+	// Load the schema registry that ingested points are validated against. See
+	// schema.go for details.
+	if schemas, err = openSchemaRegistry(schemaFile); err != nil {
+		log.Fatal(fmt.Errorf("Failed to load the schema registry from %q: %v", schemaFile, err))
+	}
+
+	// Keep the progress of imports in the import directory, so that interrupted
+	// imports can be resumed. See archive.go for details.
+	if importDir == "" {
+		importDir = "imports"
+	}
+
+	// Load the saved queries served at /queries. See savedqueries.go for details.
+	if savedQueriesDir == "" {
+		savedQueriesDir = "queries"
+	}
+	if savedQueries, err = loadSavedQueries(savedQueriesDir); err != nil {
+		log.Fatal(fmt.Errorf("Failed to load the saved queries: %v", err))
+	}
+
+	// Cache the results of the queries dashboards repeat. See cache.go for details.
+	if cache, err = newQueryCacheFromEnv(); err != nil {
+		log.Fatal(fmt.Errorf("Failed to configure the query cache: %v", err))
+	}
+
+	// Open the audit log that erasures of user data are recorded in.
+	if auditLogFile == "" {
+		auditLogFile = "audit.log"
+	}
+	if audit, err = openAuditLog(auditLogFile); err != nil {
+		log.Fatal(fmt.Errorf("Failed to open the audit log %q: %v", auditLogFile, err))
+	}
+
+	// Register the routes of your application. See newRouter for details.
+	routes := newRouter()
+
+	// Load the certificates both servers present when TLS is enabled, and reload
+	// them whenever they change. See tls.go for details.
+	certificates, err := newCertificateReloader()
 	if err != nil {
-		log.Fatal(fmt.Errorf("Failed to lookup organization named %q: %v", organizationName, err))
+		log.Fatal(fmt.Errorf("Failed to load the TLS certificate: %v", err))
+	}
+	if certificates != nil {
+		go certificates.watch(context.Background(), certReloadInterval)
 	}
-	organizationID = *org.Id
 
-	// Register some routes for your application. Check out the documentation of
-	// each function registered below for more details on how it works.
-	http.HandleFunc("/", GET(welcome))
-	http.HandleFunc("/ingest", POST(ingest)) // Ingest application user data.
-	http.HandleFunc("/query", POST(query))   // Query application user data.
-	http.HandleFunc("/setup", POST(setup))   // Set up a new user of your application.
+	// Serve the same functionality over gRPC on port 9090, for internal services
+	// that prefer it to HTTP. See grpc.go for details.
+	listener, err := net.Listen("tcp", ":9090")
+	if err != nil {
+		log.Fatal(fmt.Errorf("Failed to listen for gRPC requests: %v", err))
+	}
+	go newGRPCServer(certificates).Serve(listener)
 
-	// Serve the routes configured above on port 8080.
+	// Serve the routes configured above on port 8080, over HTTPS when TLS is
+	// enabled, assigning each request an ID that is returned in error responses.
+	// See errors.go for details.
 	// Note that while this app uses Go's HTTP defaults for brevity, a real-world
 	// production app exposed on the internet should use a server with properly
-	// configured timeouts, certificates, etc.
-	http.ListenAndServe(":8080", nil)
+	// configured timeouts.
+	server := &http.Server{Addr: ":8080", Handler: identified(routes.ServeHTTP)}
+	if certificates == nil {
+		log.Fatal(server.ListenAndServe())
+	}
+	server.TLSConfig = certificates.config("h2", "http/1.1")
+	log.Fatal(server.ListenAndServeTLS("", ""))
+}
+
+// newRouter registers the routes of your application. Check out the
+// documentation of each function registered below for more details on how it
+// works. The router answers requests with a method a route doesn't support
+// with a 405 and an Allow header listing the methods it does. See router.go for
+// details.
+func newRouter() *router {
+	routes := &router{}
+	routes.handle(http.MethodGet, "/", welcome)
+	routes.handle(http.MethodGet, "/openapi.json", openAPI) // Describe the API of your application.
+
+	// The data of each user of your application is a resource under /users.
+	// Routes that access it authenticate the caller, limit the rate of their
+	// requests, select the organization to serve them from and validate the
+	// request against the OpenAPI document of your app, in that order.
+	api := chain(authenticated, rateLimited, tenanted, validated)
+	users := routes.group("/users/{user_id}", api)
+	users.handle(http.MethodGet, "/points", getPoints)           // Query application user data.
+	users.handle(http.MethodPost, "/points", idempotent(ingest)) // Ingest application user data.
+	users.handle(http.MethodGet, "/points/stream", stream)       // Stream application user data as it is written.
+	users.handle(http.MethodGet, "/forecast", getForecast)       // Forecast application user data.
+	users.handle(http.MethodGet, "/export", exportUserData)      // Download application user data as an archive.
+	users.handle(http.MethodGet, "/tasks", listTasks)            // List the tasks of a user.
+	users.handle(http.MethodPost, "/tasks", createTask)          // Set up a new user of your application.
+	users.handle(http.MethodGet, "/tasks/{id}", getTask)         // Inspect a task of a user.
+	users.handle(http.MethodDelete, "/tasks/{id}", deleteTask)   // Remove a task of a user.
+
+	// Manage alert rules for application user data.
+	users.handle(http.MethodGet, "/alerts", listAlertRules)
+	users.handle(http.MethodPost, "/alerts", createAlertRule)
+	users.handle(http.MethodDelete, "/alerts/{id}", deleteAlertRule)
+
+	// Mark events such as deployments and incidents in application user data.
+	users.handle(http.MethodGet, "/annotations", listAnnotations)
+	users.handle(http.MethodPost, "/annotations", createAnnotation)
+	users.handle(http.MethodDelete, "/annotations/{id}", deleteAnnotation)
+
+	// The flat routes that came before the /users resources are kept as
+	// aliases, taking the user ID in the body or the query string instead.
+	flat := routes.group("", api)
+	flat.handle(http.MethodPost, "/ingest", idempotent(ingest))
+	flat.handle(http.MethodPost, "/query", query)
+	flat.handle(http.MethodPost, "/setup", setup)
+	flat.handle(http.MethodGet, "/stream", stream)
+	flat.handle(http.MethodGet, "/export", exportUserData)
+	flat.handle(http.MethodGet, "/alerts", listAlertRules)
+	flat.handle(http.MethodPost, "/alerts", createAlertRule)
+	flat.handle(http.MethodDelete, "/alerts", deleteAlertRule)
+	flat.handle(http.MethodGet, "/annotations", listAnnotations)
+	flat.handle(http.MethodPost, "/annotations", createAnnotation)
+	flat.handle(http.MethodDelete, "/annotations", deleteAnnotation)
+
+	// Run the named Flux queries your team has saved, for the user identified
+	// by their user_id parameter.
+	flat.handle(http.MethodGet, "/queries", listSavedQueries)
+	flat.handle(http.MethodGet, "/queries/{name}", runSavedQuery)
+
+	// Receive the notifications of alert rules. InfluxDB calls this webhook
+	// without an API key, so it checks the token of each rule instead, and the
+	// notifications, which hold the data of every user, require the admin key.
+	routes.handle(http.MethodGet, "/alerts/receiver", admin(listReceivedAlerts))
+	routes.handle(http.MethodPost, "/alerts/receiver", validated(receiveAlert))
+
+	// Administer your application. These routes require the admin key rather
+	// than the key of a user, and act on the organization named by the
+	// X-Organization header.
+	adminRoutes := routes.group("/admin", admin, tenanted, validated)
+
+	// Inspect, replay and purge the points that InfluxDB rejected.
+	adminRoutes.handle(http.MethodGet, "/dead-letters", listDeadLetters)
+	adminRoutes.handle(http.MethodDelete, "/dead-letters", purgeDeadLetters)
+	adminRoutes.handle(http.MethodPost, "/dead-letters/replay", replayDeadLetters)
+	adminRoutes.handle(http.MethodGet, "/dead-letters/{id}", listDeadLetters)
+	adminRoutes.handle(http.MethodDelete, "/dead-letters/{id}", purgeDeadLetters)
+	adminRoutes.handle(http.MethodPost, "/dead-letters/{id}/replay", replayDeadLetters)
+	adminRoutes.handle(http.MethodGet, "/buffer", bufferStats)
+
+	// Count the hits and misses of the query cache.
+	adminRoutes.handle(http.MethodGet, "/cache", cacheStatus)
+
+	// Declare the measurements, tags and fields that may be ingested.
+	adminRoutes.handle(http.MethodGet, "/schema", listSchema)
+	adminRoutes.handle(http.MethodPost, "/schema", defineMeasurement)
+	adminRoutes.handle(http.MethodDelete, "/schema", removeMeasurement)
+	adminRoutes.handle(http.MethodDelete, "/schema/{measurement}", removeMeasurement)
+	adminRoutes.handle(http.MethodGet, "/schema/draft", draftSchema)
+
+	// Erase all the data of a user, e.g. to honour a GDPR erasure request.
+	adminRoutes.handle(http.MethodDelete, "/users/{user_id}", deleteUser)
+	adminRoutes.handle(http.MethodPost, "/users/erase", eraseUserData)
+
+	// Replay an archive downloaded from /export into a bucket, e.g. to migrate
+	// a user between environments.
+	adminRoutes.handle(http.MethodPost, "/import", importUserData)
+
+	return routes
 }
 
 func welcome(w http.ResponseWriter, r *http.Request) {
@@ -111,38 +316,95 @@ func welcome(w http.ResponseWriter, r *http.Request) {
 // https://influxdb-client.readthedocs.io/en/stable/usage.html#write
 func ingest(w http.ResponseWriter, r *http.Request) {
 
-	// Parse the JSON request body. Production code should authenticate the caller
-	// and authorize access to the user identified by the provided user ID.
+	// Parse the JSON request body. The caller is authenticated by the middleware
+	// registered for this route, and writePoint authorizes access to the user
+	// identified by the provided user ID.
 	var request struct {
 		UserID      string  `json:"user_id"`
 		Measurement string  `json:"measurement"`
 		Field       float64 `json:"field1"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		handleError(w, invalidBody(err))
+		return
+	}
+	if err := bindUserID(r, &request.UserID); err != nil {
+		handleError(w, err)
 		return
 	}
 
-	// Construct an InfluxDB point from the JSON request suitable for writing.
-	point := influxdb2.NewPoint(request.Measurement, map[string]string{
-		"user_id": request.UserID,
-	}, map[string]interface{}{
-		"field1": request.Field,
-	}, time.Now())
-
-	// Write the point to InfluxDB using the non-blocking write API.
-	if err := writeAPI.WritePoint(r.Context(), point); err != nil {
+	if err := writePoint(r.Context(), request.UserID, request.Measurement, request.Field); err != nil {
 		handleError(w, err)
 		return
 	}
 
+	// The point is safely queued, but may not have been written to InfluxDB yet.
+	w.WriteHeader(http.StatusAccepted)
+
 	// You can view the data written by this function by navigating to
 	// the InfluxDB UI for your account and using the Data Explorer.
 }
 
+// writePoint queues a point with a single field for a user to be written to
+// InfluxDB. It holds the logic shared by the HTTP and gRPC ingest endpoints.
+func writePoint(ctx context.Context, userID, measurement string, field float64) error {
+	point, err := newPoint(ctx, userID, measurement, field)
+	if err != nil {
+		return err
+	}
+	return queuePoints(ctx, point)
+}
+
+// newPoint authorizes the caller to write for a user, and returns a point with
+// a single field for the user that conforms to the schema registry.
+func newPoint(ctx context.Context, userID, measurement string, field float64) (*write.Point, error) {
+	if err := authorize(ctx, userID); err != nil {
+		return nil, err
+	}
+	// The rollups, alerts and annotations of users are read back by the names
+	// of their measurements, so callers can't write to those.
+	if isInternalMeasurement(measurement) {
+		return nil, invalidRequest("measurement %q is reserved for the application", measurement)
+	}
+
+	// Construct an InfluxDB point from the request suitable for writing, and
+	// check it against the schema registry so that points InfluxDB would reject
+	// with a field type conflict are rejected here instead.
+	tags := map[string]string{
+		"user_id": userID,
+	}
+	fields := map[string]interface{}{
+		"field1": field,
+	}
+	if err := schemas.validate(measurement, tags, fields); err != nil {
+		return nil, err
+	}
+	return influxdb2.NewPoint(measurement, tags, fields, time.Now()), nil
+}
+
+// queuePoints queues points returned by newPoint to be written to InfluxDB as
+// a single batch, so that either all of them or none are queued.
+func queuePoints(ctx context.Context, points ...*write.Point) error {
+	// Rather than writing the points to InfluxDB straight away with the blocking
+	// write API, append them to the write queue in line protocol. The queue
+	// writes them as soon as it can, retrying while InfluxDB is unavailable or
+	// rate limits writes, so that the points are not lost when a write fails.
+	var lines strings.Builder
+	for _, point := range points {
+		lines.WriteString(write.PointToLineProtocol(point, time.Nanosecond))
+	}
+	return organizationOf(ctx).queue.enqueue(lines.String())
+}
+
 // query serves down sampled data for a user in JSON format. It returns the last
 // value for each field of the data, returning the latest min, max and mean value
-// within the last 24 hours.
+// within the last 24 hours. Set include_annotations to also return the user's
+// annotations within the same range.
+//
+// Set limit, and then cursor, to page through all of the values instead (see
+// queryPage), or start, stop and window to return the values aggregated into
+// windows over a time range from the coarsest tier of rollups that holds them
+// (see queryRollups). The response metadata reports the tier that was read.
 //
 // Note that "user" here refers to a user in your application, not an InfluxDB user.
 //
@@ -150,15 +412,166 @@ func ingest(w http.ResponseWriter, r *http.Request) {
 // {"user_id":"user1"}
 func query(w http.ResponseWriter, r *http.Request) {
 
-	// Parse the JSON request body. Production code should authenticate the caller
-	// and authorize access to the user identified by the provided user ID.
+	// Parse the JSON request body. The caller is authenticated by the middleware
+	// registered for this route, and queryLatest authorizes access to the user
+	// identified by the provided user ID.
 	var request struct {
-		UserID string `json:"user_id"`
+		UserID             string `json:"user_id"`
+		IncludeAnnotations bool   `json:"include_annotations"`
+		Limit              int    `json:"limit"`
+		Cursor             string `json:"cursor"`
+		Start              string `json:"start"`
+		Stop               string `json:"stop"`
+		Window             string `json:"window"`
+		Timezone           string `json:"timezone"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		handleError(w, invalidBody(err))
+		return
+	}
+	limit := ""
+	if request.Limit != 0 {
+		limit = strconv.Itoa(request.Limit)
+	}
+	options, err := parseQueryOptions(request.IncludeAnnotations, limit, request.Cursor, request.Start, request.Stop, request.Window, request.Timezone)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	writeQueryResult(w, r, request.UserID, options)
+}
+
+// getPoints serves the same data as query for the user in the path, e.g.
+// GET /users/user1/points?include_annotations=true, a page at a time with
+// GET /users/user1/points?limit=100, or over a year of daily windows with
+// GET /users/user1/points?start=-8760h&window=24h.
+func getPoints(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	options, err := parseQueryOptions(values.Get("include_annotations") == "true",
+		values.Get("limit"), values.Get("cursor"), values.Get("start"), values.Get("stop"), values.Get("window"), values.Get("timezone"))
+	if err != nil {
+		handleError(w, err)
 		return
 	}
+	writeQueryResult(w, r, param(r, "user_id"), options)
+}
+
+// queryOptions are the options of a request to query or getPoints.
+type queryOptions struct {
+	includeAnnotations bool
+	// At most one of page and rollups is set, to page through the data or to
+	// aggregate it over a time range rather than return its latest values.
+	page    *pageRequest
+	rollups *rollupRequest
+}
+
+// parseQueryOptions parses the options of a request to query or getPoints.
+func parseQueryOptions(includeAnnotations bool, limit, cursor, start, stop, window, timezone string) (queryOptions, error) {
+	options := queryOptions{includeAnnotations: includeAnnotations}
+	var err error
+	if options.page, err = parsePageRequest(limit, cursor); err != nil {
+		return options, err
+	}
+	if options.rollups, err = parseRollupRequest(start, stop, window, timezone); err != nil {
+		return options, err
+	}
+	if options.page != nil && options.rollups != nil {
+		return options, invalidRequest("limit and cursor can't be combined with start, stop, window and timezone")
+	}
+	return options, nil
+}
+
+// writeQueryResult writes the down sampled data of a user requested by the
+// options, and optionally their annotations within the queried range, as the
+// JSON response to a request.
+func writeQueryResult(w http.ResponseWriter, r *http.Request, userID string, options queryOptions) {
+	// Format all records into JSON, starting a new table in the response
+	// whenever the query result moves on to a new table.
+	type Table struct {
+		Records []map[string]string `json:"records"`
+	}
+	var response struct {
+		Tables      []Table       `json:"tables"`
+		Annotations *[]annotation `json:"annotations,omitempty"`
+		NextCursor  string        `json:"next_cursor,omitempty"`
+		Metadata    queryMetadata `json:"metadata"`
+	}
+	currentTable := -1
+	appendRecord := func(table int, record map[string]string) error {
+		if table != currentTable {
+			response.Tables = append(response.Tables, Table{})
+			currentTable = table
+		}
+		last := &response.Tables[len(response.Tables)-1]
+		last.Records = append(last.Records, record)
+		return nil
+	}
+	// The range ends at the next minute rather than now, so that the same
+	// annotations query is repeated, and its result cached, for a minute at a time.
+	annotationsStop := time.Now().Truncate(time.Minute).Add(time.Minute)
+	annotationsStart := annotationsStop.Add(-24 * time.Hour)
+
+	var err error
+	switch {
+	case options.page != nil:
+		// A page holds the records of all series in a single table.
+		var page *page
+		page, err = queryPage(r.Context(), userID, *options.page)
+		if err == nil {
+			response.Tables = []Table{{Records: page.records}}
+			if page.next != nil {
+				response.NextCursor = page.next.encode()
+			}
+			response.Metadata.Tier = rollupTiers[0].name
+		}
+	case options.rollups != nil:
+		var tier rollupTier
+		tier, err = queryRollups(r.Context(), userID, *options.rollups, appendRecord)
+		response.Metadata = queryMetadata{
+			Tier:   tier.name,
+			Window: options.rollups.window.String(),
+			Start:  &options.rollups.start,
+			Stop:   &options.rollups.stop,
+		}
+		if options.rollups.window.calendar() {
+			response.Metadata.Timezone = options.rollups.location.String()
+		}
+		annotationsStart, annotationsStop = options.rollups.start, options.rollups.stop
+	default:
+		err = queryLatest(r.Context(), userID, appendRecord)
+		response.Metadata.Tier = rollupTiers[0].name
+	}
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if options.includeAnnotations {
+		annotations, err := findAnnotations(r.Context(), userID, "", annotationsStart, annotationsStop)
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		response.Annotations = &annotations
+	}
+
+	// Marshal the response into JSON and return it to the client.
+	responseBytes, err := json.Marshal(&response)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	w.Header().Set("ContentType", "application/json")
+	w.Write(responseBytes)
+}
+
+// queryLatest queries the latest rollups of the finest tier for a user, or the
+// latest downsampled data of users set up before there were tiers, and calls fn
+// with the position of the table and the columns of each record in the result.
+// It holds the logic shared by the HTTP and gRPC query endpoints.
+func queryLatest(ctx context.Context, userID string, fn func(table int, record map[string]string) error) error {
+	if err := authorize(ctx, userID); err != nil {
+		return err
+	}
 
 	// Queries can be written in either Flux or InfluxQL.
 	// Here we use a parameterized Flux query.
@@ -167,66 +580,91 @@ func query(w http.ResponseWriter, r *http.Request) {
 	// Flux can also be used to do complex data transformations as well as integrations.
 	// Follow this link to learn more about using Flux:
 	// https://awesome.influxdata.com/docs/part-2/introduction-to-flux/
-	params := map[string]string{
-		"bucket_name": bucketName,
-		"user_id":     request.UserID,
+	//
+	// The query is built with internal/flux, which passes the bucket and user ID
+	// as parameters rather than formatting them into the query.
+	org := organizationOf(ctx)
+	latest := func(measurement string) (string, map[string]string) {
+		return flux.From(org.bucket).
+			Range(flux.Duration(-24 * time.Hour)).
+			Filter(flux.Measurement(measurement)).
+			Filter(flux.Tag("user_id", userID)).
+			Aggregate(flux.Last).
+			Render()
 	}
-	query := `from(bucket: params.bucket_name) 
-				|> range(start: -24h) 
-				|> filter(fn: (r) => r._measurement == "downsampled")
-				|> filter(fn: (r) => r.user_id == params.user_id)
-				|> last()`
+	query, params := latest(rollupTiers[0].measurement())
+
+	// Dashboards repeat this query, so its results are cached for a while, and
+	// until new data for the user is ingested. See cache.go for details.
+	result, err := cache.get(ctx, cacheEndpointPoints, userID, query, params, func() (interface{}, error) {
+		records, err := queryLatestRecords(ctx, org, query, params)
+		if err == nil && len(records) == 0 {
+			// Users set up before there were tiers of rollups have their
+			// data down sampled into the downsampled measurement instead, and
+			// have no rollups until /setup is called for them again.
+			legacyQuery, legacyParams := latest(legacyDownsampledMeasurement)
+			records, err = queryLatestRecords(ctx, org, legacyQuery, legacyParams)
+		}
+		return records, err
+	})
+	if err != nil {
+		return err
+	}
+	for _, record := range result.([]latestRecord) {
+		if err := fn(record.table, record.columns); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// queryLatestRecords runs a query of queryLatest and returns the records of
+// its result.
+func queryLatestRecords(ctx context.Context, org *organization, query string, params map[string]string) ([]latestRecord, error) {
 	// The query API offers the ability to retrieve raw data via QueryRaw and QueryRawWithParams, or
 	// a parsed representation via Query and QueryWithParams. We use the latter here.
-	tables, err := queryAPI.QueryWithParams(r.Context(), query, params)
+	tables, err := org.queryAPI.QueryWithParams(ctx, query, params)
 	if err != nil {
-		handleError(w, err)
-		return
+		return nil, err
 	}
+	defer tables.Close()
 
 	// Use the parsed representation of the query results to iterate over the
-	// returned tables and format all records into JSON. For more examples of iterating
-	// over parsed query results, see the influxdb-client-go documentation:
+	// returned tables and records. For more examples of iterating over parsed
+	// query results, see the influxdb-client-go documentation:
 	// https://github.com/influxdata/influxdb-client-go#basic-example
-	type Table struct {
-		Records []map[string]string `json:"records"`
-	}
-	var response struct {
-		Tables []Table `json:"tables"`
-	}
-	var currentTable *Table
+	var records []latestRecord
 	for tables.Next() {
-		if tables.TableChanged() {
-			if currentTable != nil {
-				response.Tables = append(response.Tables, *currentTable)
-			}
-			currentTable = &Table{}
-		}
 		pairs := strings.Split(tables.Record().String(), ",")
 		record := make(map[string]string)
 		for _, pair := range pairs {
 			kv := strings.Split(pair, ":")
 			record[kv[0]] = kv[1]
 		}
-		currentTable.Records = append(currentTable.Records, record)
-	}
-	if currentTable != nil {
-		response.Tables = append(response.Tables, *currentTable)
+		records = append(records, latestRecord{table: tables.TablePosition(), columns: record})
 	}
+	return records, tables.Err()
+}
 
-	// Marshal the response into JSON and return it to the client.
-	responseBytes, err := json.Marshal(&response)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+// latestRecord is a record of the result of queryLatest, with the position of
+// its table.
+type latestRecord struct {
+	table   int
+	columns map[string]string
+}
+
+// formatRecord formats the columns of a record of a query result as strings.
+func formatRecord(values map[string]interface{}) map[string]string {
+	columns := make(map[string]string, len(values))
+	for column, value := range values {
+		columns[column] = fmt.Sprint(value)
 	}
-	w.Header().Set("ContentType", "application/json")
-	w.Write(responseBytes)
+	return columns
 }
 
-// setup creates a task owned by the requested user that will down sample their data and write
-// the min, max and mean of each field of each measurement to a new measurement every five minutes.
+// setup creates the tasks owned by the requested user that roll up their data into
+// each tier of rollups, writing the min, max and mean of each field of each measurement
+// every minute, hour and day. See rollups.go for details.
 //
 // Note that "user" here refers to a user in your application, not an InfluxDB user.
 //
@@ -234,85 +672,111 @@ func query(w http.ResponseWriter, r *http.Request) {
 // {"user_id":"user1"}
 func setup(w http.ResponseWriter, r *http.Request) {
 
-	// Parse the JSON request body. Production code should authenticate the caller
-	// and authorize access to the user identified by the provided user ID.
+	// Parse the JSON request body. The caller is authenticated by the middleware
+	// registered for this route, and createRollupTasks authorizes access to
+	// the user identified by the provided user ID.
 	var request struct {
-		UserID string `json:"user_id"`
+		UserID   string `json:"user_id"`
+		Timezone string `json:"timezone"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		handleError(w, invalidBody(err))
 		return
 	}
-
-	// Format a query that will down sample each field of each measurement included
-	// in the data by calculating the mean, min and max and writing the results to
-	// a new measurement in the same bucket.
-	taskQuery := fmt.Sprintf(`
-	data = from(bucket: %q)
-		|> range(start: -5m)
-		|> filter(fn: (r) => r.user_id == %q)
-        |> filter(fn: (r) => r._measurement != "downsampled")
-		|> drop(columns: ["_start", "_time", "_stop"])
-
-	max_data = data
-		|> max()
-		|> map(fn: (r) => ({ r with _field: r._field + "_max"}))
-
-	min_data = data
-		|> min()
-		|> map(fn: (r) => ({ r with _field: r._field + "_min"}))
-
-	mean_data = data
-		|> mean()
-		|> map(fn: (r) => ({ r with _field: r._field + "_mean"}))
-
-	union(tables: [max_data, min_data, mean_data])
-	 	|> map(fn: (r) => ({ r with _time: now(), _measurement: "downsampled" }))
-		|> to(bucket: %q)`,
-		bucketName, request.UserID, bucketName)
-
-	name := fmt.Sprintf("%s_task", request.UserID)
-	_, err := client.TasksAPI().CreateTaskWithEvery(r.Context(), name, taskQuery, "5m", organizationID)
+	location, err := parseTimezone(request.Timezone)
 	if err != nil {
 		handleError(w, err)
 		return
 	}
-}
 
-var (
-	// POST is the only request method allowed by this middleware.
-	POST = method(http.MethodPost)
-	// GET is the only request method allowed by this middleware.
-	GET = method(http.MethodGet)
-)
+	if _, err := createRollupTasks(r.Context(), request.UserID, location); err != nil {
+		handleError(w, err)
+		return
+	}
+}
 
 // middleware wraps one http.HandlerFunc with another in order to
 // modify its request and response.
 type middleware func(http.HandlerFunc) http.HandlerFunc
 
-// method is a middleware that verifies the request is of a certain
-// HTTP method and returns a 405 http.StatusMethodNotAllowed otherwise.
-func method(allowed string) middleware {
+// chain composes middlewares into a single middleware that applies them in
+// the order given, the first being the outermost.
+func chain(middlewares ...middleware) middleware {
 	return func(handler http.HandlerFunc) http.HandlerFunc {
-		return func(w http.ResponseWriter, r *http.Request) {
-			if r.Method != allowed {
-				w.WriteHeader(http.StatusMethodNotAllowed)
-				return
-			}
-			handler(w, r)
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			handler = middlewares[i](handler)
 		}
+		return handler
 	}
 }
 
-// handleError checks whether the provided error includes a status code and writes
-// it to the ResponseWriter if so, otherwise defaulting to an internal server error.
+// handleError writes the JSON error response for the provided error. Errors
+// returned by InfluxDB keep their status code, and are mapped onto the errors of
+// your app so that clients can tell, for example, a missing bucket apart from a
+// missing alert rule. Any other error defaults to an internal server error.
 func handleError(w http.ResponseWriter, err error) {
-	// You can build on this code to interpret errors from the InfluxDB API and
-	// handle them differently, e.g. returning an application error in the event
-	// your bucket is not found and the InfluxDB API returns a 404 status.
-	if influxErr, ok := err.(*influxdb2http.Error); ok {
-		w.WriteHeader(influxErr.StatusCode)
+	var influxErr *influxdb2http.Error
+	var violation *schemaViolation
+	var requestErr *requestError
+	status, body := http.StatusInternalServerError, errorResponse{Code: errorCodeInternal, Message: err.Error()}
+	if errors.As(err, &influxErr) {
+		status, body.Code = influxErrorStatus(influxErr)
+		body.InfluxDBCode, body.InfluxDBMessage = influxErr.Code, influxErr.Message
+		// Pass on how long InfluxDB asked clients to wait before retrying.
+		if influxErr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.FormatUint(uint64(influxErr.RetryAfter), 10))
+		}
+	} else if errors.As(err, &requestErr) {
+		status, body.Code = requestErr.status, requestErr.code
+	} else if errors.As(err, &violation) {
+		status, body.Code = http.StatusBadRequest, errorCodeSchemaViolation
+	} else if errors.Is(err, errUnknownOrganization) {
+		status, body.Code = http.StatusBadRequest, errorCodeInvalidRequest
+	} else if errors.Is(err, errUnauthenticated) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		status, body.Code = http.StatusUnauthorized, errorCodeUnauthenticated
+	} else if errors.Is(err, errForbidden) {
+		status, body.Code = http.StatusForbidden, errorCodeForbidden
+	} else if errors.Is(err, errImportInProgress) {
+		status, body.Code = http.StatusConflict, errorCodeConflict
+	} else if errors.Is(err, errIdempotencyKeyReused) {
+		status, body.Code = http.StatusUnprocessableEntity, errorCodeIdempotencyKeyReused
+	} else if errors.Is(err, errIdempotencyKeyInvalid) {
+		status, body.Code = http.StatusUnprocessableEntity, errorCodeInvalidRequest
+	} else if errors.Is(err, errAlertRuleNotFound) || errors.Is(err, errDeadLetterNotFound) ||
+		errors.Is(err, errMeasurementNotFound) || errors.Is(err, errAnnotationNotFound) ||
+		errors.Is(err, errTaskNotFound) || errors.Is(err, errSavedQueryNotFound) {
+		status, body.Code = http.StatusNotFound, errorCodeNotFound
 	} else {
-		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Request %s failed: %v", w.Header().Get("X-Request-ID"), err)
+		body.Message = http.StatusText(status)
+	}
+	writeError(w, status, body)
+}
+
+// influxErrorStatus returns the status and code of the response to a request
+// that failed with an error returned by InfluxDB.
+func influxErrorStatus(err *influxdb2http.Error) (int, string) {
+	switch err.StatusCode {
+	case 0:
+		// InfluxDB could not be reached at all.
+		return http.StatusServiceUnavailable, errorCodeUnavailable
+	case http.StatusNotFound:
+		if strings.Contains(err.Message, "bucket") {
+			return err.StatusCode, errorCodeBucketNotFound
+		}
+		if strings.Contains(err.Message, "organization") {
+			return err.StatusCode, errorCodeOrganizationNotFound
+		}
+		return err.StatusCode, errorCodeNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return err.StatusCode, errorCodeUnauthorized
+	case http.StatusTooManyRequests:
+		return err.StatusCode, errorCodeRateLimited
+	case http.StatusRequestEntityTooLarge:
+		return err.StatusCode, errorCodePayloadTooLarge
+	case http.StatusServiceUnavailable:
+		return err.StatusCode, errorCodeUnavailable
 	}
+	return err.StatusCode, errorCodeUpstream
 }
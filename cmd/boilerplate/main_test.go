@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/domain"
+
+	"github.com/influxdata/go-snippets/internal/fakeinflux"
+	"github.com/influxdata/go-snippets/internal/flux"
+	"github.com/influxdata/go-snippets/internal/influxclient"
+)
+
+// testApp is your app serving a single organization, my-org, from a fake
+// InfluxDB. It accepts the API keys key1 for user1 and key2 for user2, and the
+// admin key admin-key.
+type testApp struct {
+	influx *fakeinflux.Server
+	// influxURL is the URL the fake InfluxDB is served at.
+	influxURL string
+	// orgID is the ID of my-org.
+	orgID string
+	// url is the URL your app is served at.
+	url string
+	// dir holds the write queue and the other files of your app.
+	dir string
+}
+
+// newTestApp configures your app as main does, but with its files in a
+// temporary directory and its clients pointed at a fake InfluxDB, and serves
+// its routes for the duration of the test.
+func newTestApp(t *testing.T) *testApp {
+	t.Helper()
+	influx := fakeinflux.New("my-token")
+	org := influx.CreateOrganization("my-org")
+	influx.CreateBucket(*org.Id, "my-bucket")
+	influxServer := httptest.NewServer(influx)
+	t.Cleanup(influxServer.Close)
+
+	// The write queue is forwarded in the background until the test ends, so
+	// the directory is removed without failing the test on a late write.
+	dir, err := ioutil.TempDir("", "boilerplate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	defaultOrganization, err = newOrganization("my-org", "my-bucket", "BOILERPLATE_TEST",
+		influxclient.Config{URL: influxServer.URL, Token: "my-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(defaultOrganization.client.Close)
+	organizations = map[string]*organization{"my-org": defaultOrganization}
+	if err := defaultOrganization.start(ctx, filepath.Join(dir, "queue")); err != nil {
+		t.Fatal(err)
+	}
+	if idempotencyKeys, err = openIdempotencyStore(filepath.Join(dir, "idempotency.db"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { idempotencyKeys.db.Close() })
+	if schemas, err = openSchemaRegistry(""); err != nil {
+		t.Fatal(err)
+	}
+	importDir = filepath.Join(dir, "imports")
+	if savedQueries, err = loadSavedQueries("queries"); err != nil {
+		t.Fatal(err)
+	}
+	cache = newQueryCache(100, defaultCacheTTLs)
+	if audit, err = openAuditLog(filepath.Join(dir, "audit.log")); err != nil {
+		t.Fatal(err)
+	}
+	apiKeys = parseAPIKeys("key1:user1,key2:user2")
+	adminKey = "admin-key"
+	rateLimit = 0
+	limiters = make(map[string]*callerLimiter)
+
+	server := httptest.NewServer(identified(newRouter().ServeHTTP))
+	t.Cleanup(server.Close)
+	return &testApp{influx: influx, influxURL: influxServer.URL, orgID: *org.Id, url: server.URL, dir: dir}
+}
+
+// do sends a request to your app with the API key, if any, and a JSON body,
+// if any, and returns the response with its body read.
+func (a *testApp) do(t *testing.T, method, path, key, body string) (*http.Response, string) {
+	t.Helper()
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, a.url+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(data)
+}
+
+// waitForPoints waits for the fake InfluxDB to hold n points and returns them.
+func (a *testApp) waitForPoints(t *testing.T, n int) []fakeinflux.Point {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		points := a.influx.Points()
+		if len(points) >= n || time.Now().After(deadline) {
+			if len(points) != n {
+				t.Fatalf("got %d points in InfluxDB, want %d", len(points), n)
+			}
+			return points
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// errorCode returns the code of a JSON error response.
+func errorCode(t *testing.T, body string) string {
+	t.Helper()
+	var response errorResponse
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		t.Fatalf("failed to decode error response %q: %v", body, err)
+	}
+	return response.Code
+}
+
+func TestIngest(t *testing.T) {
+	app := newTestApp(t)
+
+	resp, body := app.do(t, http.MethodPost, "/users/user1/points", "key1", `{"measurement":"measurement1","field1":1.5}`)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("got status %d (%s), want 202", resp.StatusCode, body)
+	}
+	points := app.waitForPoints(t, 1)
+	if got := points[0]; got.Measurement != "measurement1" || got.Bucket != "my-bucket" ||
+		got.Tags["user_id"] != "user1" || got.Fields["field1"] != 1.5 {
+		t.Errorf("got point %+v, want measurement1 for user1 with field1 1.5", got)
+	}
+
+	// The flat route takes the user ID in the body instead.
+	resp, body = app.do(t, http.MethodPost, "/ingest", "key2", `{"user_id":"user2","measurement":"measurement1","field1":2}`)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("got status %d (%s) from /ingest, want 202", resp.StatusCode, body)
+	}
+	if points := app.waitForPoints(t, 2); points[1].Tags["user_id"] != "user2" {
+		t.Errorf("got point %+v, want one for user2", points[1])
+	}
+}
+
+func TestIngestErrors(t *testing.T) {
+	app := newTestApp(t)
+	for _, test := range []struct {
+		name, path, key, body string
+		status                int
+		code                  string
+	}{
+		{"no key", "/users/user1/points", "", `{"measurement":"m","field1":1}`, http.StatusUnauthorized, errorCodeUnauthenticated},
+		{"unknown key", "/users/user1/points", "key3", `{"measurement":"m","field1":1}`, http.StatusUnauthorized, errorCodeUnauthenticated},
+		{"another user", "/users/user1/points", "key2", `{"measurement":"m","field1":1}`, http.StatusForbidden, errorCodeForbidden},
+		{"mismatched user", "/users/user1/points", "key1", `{"user_id":"user2","measurement":"m","field1":1}`, http.StatusBadRequest, errorCodeInvalidRequest},
+		{"invalid body", "/users/user1/points", "key1", `{"measurement":`, http.StatusBadRequest, errorCodeInvalidRequest},
+		{"a rollup measurement", "/users/user1/points", "key1", `{"measurement":"rollup_1h","field1":1}`, http.StatusBadRequest, errorCodeInvalidRequest},
+		{"an alert measurement", "/users/user1/points", "key1", `{"measurement":"_alerts","field1":1}`, http.StatusBadRequest, errorCodeInvalidRequest},
+		{"the downsampled measurement", "/users/user1/points", "key1", `{"measurement":"downsampled","field1":1}`, http.StatusBadRequest, errorCodeInvalidRequest},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resp, body := app.do(t, http.MethodPost, test.path, test.key, test.body)
+			if resp.StatusCode != test.status {
+				t.Errorf("got status %d (%s), want %d", resp.StatusCode, body, test.status)
+			}
+			if code := errorCode(t, body); code != test.code {
+				t.Errorf("got error code %q, want %q", code, test.code)
+			}
+		})
+	}
+	time.Sleep(50 * time.Millisecond)
+	if points := app.influx.Points(); len(points) != 0 {
+		t.Errorf("rejected requests wrote %d points", len(points))
+	}
+}
+
+func TestIngestIdempotently(t *testing.T) {
+	app := newTestApp(t)
+	send := func(body string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, app.url+"/users/user1/points", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer key1")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "request-1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := send(`{"measurement":"m","field1":1}`); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("got status %d, want 202", resp.StatusCode)
+	}
+	resp := send(`{"measurement":"m","field1":1}`)
+	if resp.StatusCode != http.StatusAccepted || resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("got status %d replayed %q for the retry, want a replayed 202", resp.StatusCode, resp.Header.Get("Idempotent-Replayed"))
+	}
+	if resp := send(`{"measurement":"m","field1":2}`); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d for another request with the same key, want 422", resp.StatusCode)
+	}
+	app.waitForPoints(t, 1)
+}
+
+func TestIngestIdempotentlyConcurrently(t *testing.T) {
+	app := newTestApp(t)
+	const requests = 10
+	type result struct {
+		status   int
+		body     string
+		replayed bool
+	}
+	results := make(chan result, requests)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest(http.MethodPost, app.url+"/users/user1/points", strings.NewReader(`{"measurement":"m","field1":1}`))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			req.Header.Set("Authorization", "Bearer key1")
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Idempotency-Key", "request-1")
+			<-start
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			results <- result{resp.StatusCode, string(body), resp.Header.Get("Idempotent-Replayed") == "true"}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(results)
+
+	// Every request but the first waits for it, and receives its response.
+	var first *result
+	replayed := 0
+	for r := range results {
+		r := r
+		if first == nil {
+			first = &r
+		}
+		if r.status != first.status || r.body != first.body {
+			t.Errorf("got status %d (%s), want the same response as status %d (%s)", r.status, r.body, first.status, first.body)
+		}
+		if r.replayed {
+			replayed++
+		}
+	}
+	if first == nil || first.status != http.StatusAccepted {
+		t.Fatalf("got response %+v, want 202", first)
+	}
+	if replayed != requests-1 {
+		t.Errorf("%d responses were replayed, want all %d but the first", replayed, requests-1)
+	}
+	app.waitForPoints(t, 1)
+	time.Sleep(50 * time.Millisecond)
+	if points := app.influx.Points(); len(points) != 1 {
+		t.Errorf("got %d points in InfluxDB, want 1", len(points))
+	}
+}
+
+func TestQuery(t *testing.T) {
+	app := newTestApp(t)
+	now := time.Now().Truncate(time.Minute)
+	writeRollups(t, app,
+		"rollup_1m,user_id=user1,_source=measurement1 field1_mean=1.5 "+formatNanos(now),
+		"rollup_1m,user_id=user2,_source=measurement1 field1_mean=9 "+formatNanos(now))
+
+	for _, test := range []struct {
+		method, path, body string
+	}{
+		{http.MethodGet, "/users/user1/points", ""},
+		{http.MethodPost, "/query", `{"user_id":"user1"}`},
+	} {
+		resp, body := app.do(t, test.method, test.path, "key1", test.body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s: got status %d (%s), want 200", test.method, test.path, resp.StatusCode, body)
+		}
+		var response struct {
+			Tables []struct {
+				Records []map[string]string `json:"records"`
+			} `json:"tables"`
+			Metadata queryMetadata `json:"metadata"`
+		}
+		if err := json.Unmarshal([]byte(body), &response); err != nil {
+			t.Fatalf("%s %s: failed to decode %q: %v", test.method, test.path, body, err)
+		}
+		if len(response.Tables) != 1 || len(response.Tables[0].Records) != 1 {
+			t.Fatalf("%s %s: got %s, want a single record", test.method, test.path, body)
+		}
+		record := response.Tables[0].Records[0]
+		if record["user_id"] != "user1" || record["_value"] != "1.5" || record["_field"] != "field1_mean" {
+			t.Errorf("%s %s: got record %v, want field1_mean 1.5 of user1", test.method, test.path, record)
+		}
+		if response.Metadata.Tier != "1m" {
+			t.Errorf("%s %s: got tier %q, want 1m", test.method, test.path, response.Metadata.Tier)
+		}
+	}
+
+	resp, body := app.do(t, http.MethodGet, "/users/user1/points", "key2", "")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got status %d (%s) querying another user, want 403", resp.StatusCode, body)
+	}
+}
+
+func TestQueryFallsBackToDownsampled(t *testing.T) {
+	app := newTestApp(t)
+	now := time.Now().Truncate(time.Minute)
+	writeRollups(t, app,
+		"downsampled,user_id=user1 field1_mean=3.5 "+formatNanos(now.Add(-5*time.Minute)),
+		"rollup_1m,user_id=user2,_source=measurement1 field1_mean=9 "+formatNanos(now))
+
+	// user1 was set up before there were tiers, and has no rollups yet.
+	latest := func(userID, key string) map[string]string {
+		t.Helper()
+		resp, body := app.do(t, http.MethodGet, "/users/"+userID+"/points", key, "")
+		var response struct {
+			Tables []struct {
+				Records []map[string]string `json:"records"`
+			} `json:"tables"`
+		}
+		if err := json.Unmarshal([]byte(body), &response); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("got status %d (%s) querying %s, want 200", resp.StatusCode, body, userID)
+		}
+		if len(response.Tables) != 1 || len(response.Tables[0].Records) != 1 {
+			t.Fatalf("got %s querying %s, want a single record", body, userID)
+		}
+		return response.Tables[0].Records[0]
+	}
+	if record := latest("user1", "key1"); record["_measurement"] != "downsampled" || record["_value"] != "3.5" {
+		t.Errorf("got record %v, want the downsampled field1_mean 3.5", record)
+	}
+	if record := latest("user2", "key2"); record["_measurement"] != "rollup_1m" || record["_value"] != "9" {
+		t.Errorf("got record %v, want the rollup of user2", record)
+	}
+
+	// Once the rollup tasks have run, the downsampled data is no longer read.
+	rollup := "rollup_1m,user_id=user1,_source=measurement1 field1_mean=1.5 " + formatNanos(now)
+	writeRollups(t, app, rollup)
+	cache.invalidateWritten(defaultOrganization.name, rollup)
+	if record := latest("user1", "key1"); record["_measurement"] != "rollup_1m" || record["_value"] != "1.5" {
+		t.Errorf("got record %v, want the rollup of user1", record)
+	}
+}
+
+func TestQueryUnavailable(t *testing.T) {
+	app := newTestApp(t)
+	app.influx.FailNext("/api/v2/query", http.StatusServiceUnavailable, "overloaded", 30)
+	resp, body := app.do(t, http.MethodGet, "/users/user1/points", "key1", "")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "30" {
+		t.Errorf("got status %d Retry-After %q (%s), want 503 after 30s", resp.StatusCode, resp.Header.Get("Retry-After"), body)
+	}
+	if code := errorCode(t, body); code != errorCodeUnavailable {
+		t.Errorf("got error code %q, want %q", code, errorCodeUnavailable)
+	}
+}
+
+func TestSetup(t *testing.T) {
+	app := newTestApp(t)
+	resp, body := app.do(t, http.MethodPost, "/setup", "key1", `{"user_id":"user1"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d (%s), want 200", resp.StatusCode, body)
+	}
+	tasks := make(map[string]domain.Task)
+	for _, task := range app.influx.Tasks() {
+		tasks[task.Name] = task
+	}
+	for _, tier := range rollupTiers {
+		name := rollupTaskName("user1", tier)
+		task, ok := tasks[name]
+		if !ok {
+			t.Errorf("no task named %q among %v", name, tasks)
+			continue
+		}
+		// Each tier runs offset from the start of its window, after the tier below.
+		every, offset := flux.FormatDuration(tier.every), flux.FormatDuration(tier.offset)
+		if task.Every == nil || *task.Every != every || task.Offset == nil || *task.Offset != offset {
+			t.Errorf("task %q runs every %v offset %v, want every %s offset %s", name, task.Every, task.Offset, every, offset)
+		}
+	}
+
+	resp, body = app.do(t, http.MethodGet, "/users/user1/tasks", "key1", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d (%s) listing tasks, want 200", resp.StatusCode, body)
+	}
+	var listed struct {
+		Tasks []userTask `json:"tasks"`
+	}
+	if err := json.Unmarshal([]byte(body), &listed); err != nil {
+		t.Fatalf("failed to decode %q: %v", body, err)
+	}
+	if len(listed.Tasks) != len(rollupTiers) {
+		t.Errorf("listed %d tasks, want %d", len(listed.Tasks), len(rollupTiers))
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	app := newTestApp(t)
+
+	resp, body := app.do(t, http.MethodGet, "/", "", "")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "Welcome") {
+		t.Errorf("got status %d (%s) from /, want the welcome page", resp.StatusCode, body)
+	}
+
+	resp, body = app.do(t, http.MethodPut, "/users/user1/points", "key1", "")
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "GET, POST" {
+		t.Errorf("got status %d Allow %q (%s), want 405 allowing GET, POST", resp.StatusCode, resp.Header.Get("Allow"), body)
+	}
+
+	resp, body = app.do(t, http.MethodGet, "/admin/schema", "key1", "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d (%s) from an admin route with a user key, want 401", resp.StatusCode, body)
+	}
+	resp, body = app.do(t, http.MethodGet, "/admin/schema", "admin-key", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d (%s) from an admin route with the admin key, want 200", resp.StatusCode, body)
+	}
+}
+
+// writeRollups writes points in line protocol straight to the fake InfluxDB,
+// as the rollup tasks would.
+func writeRollups(t *testing.T, app *testApp, lines ...string) {
+	t.Helper()
+	err := defaultOrganization.writeAPI.WriteRecord(context.Background(), lines...)
+	if err != nil {
+		t.Fatalf("failed to write rollups: %v", err)
+	}
+}
+
+// formatNanos formats t as a line protocol timestamp.
+func formatNanos(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/influxdata/go-snippets/internal/storeforward"
+)
+
+// bufferStats reports on the offline buffer: whether offline mode is enabled,
+// whether InfluxDB can currently be reached, how many points are buffered and
+// how old the oldest of them is. Poll it to monitor a deployment at the edge.
+//
+// GET /admin/buffer to test this endpoint.
+func bufferStats(w http.ResponseWriter, r *http.Request) {
+	var response struct {
+		Enabled bool `json:"enabled"`
+		Online  bool `json:"online"`
+		storeforward.Stats
+	}
+	if forwarder := organizationOf(r.Context()).forwarder; forwarder != nil {
+		stats, err := forwarder.Stats(r.Context())
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		response.Enabled, response.Online, response.Stats = true, forwarder.Online(), stats
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
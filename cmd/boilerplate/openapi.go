@@ -0,0 +1,88 @@
+package main
+
+import (
+	_ "embed" // Needed to embed the OpenAPI document.
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/legacy"
+)
+
+// openAPIDocument describes the HTTP API of this application. It is served at
+// /openapi.json, used to validate incoming requests, and used to generate the
+// client in the pkg/boilerplateclient package. Keep it up to date when you add
+// or change an endpoint.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// openAPIRouter finds the operation in openAPIDocument matching a request.
+var openAPIRouter routers.Router
+
+// init loads the OpenAPI document, failing fast if it is invalid.
+func init() {
+	// Keep validation errors to a single line rather than dumping the schema.
+	openapi3.SchemaErrorDetailsDisabled = true
+
+	doc, err := openapi3.NewLoader().LoadFromData(openAPIDocument)
+	if err != nil {
+		log.Fatalf("Failed to load the OpenAPI document: %v", err)
+	}
+	if openAPIRouter, err = legacy.NewRouter(doc); err != nil {
+		log.Fatalf("Failed to route the OpenAPI document: %v", err)
+	}
+}
+
+// openAPI serves the OpenAPI document describing this application's API.
+func openAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
+
+// validated is a middleware that validates the request against its operation
+// in the OpenAPI document and returns a 400 http.StatusBadRequest describing
+// the first violation otherwise.
+func validated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		route, pathParams, err := openAPIRouter.FindRoute(r)
+		if err != nil {
+			// Every validated route must be documented.
+			handleError(w, fmt.Errorf("no OpenAPI operation for %s %s: %v", r.Method, r.URL.Path, err))
+			return
+		}
+
+		// Handlers decode JSON request bodies whatever their declared type, so
+		// validate them that way too. This keeps requests made with tools that
+		// default to form encoding, like curl -d, working. Other bodies, such as
+		// archives, are left for the handler to read and check.
+		jsonBody := route.Operation.RequestBody == nil ||
+			route.Operation.RequestBody.Value.Content.Get("application/json") != nil
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); jsonBody && mediaType != "application/json" {
+			r.Header.Set("Content-Type", "application/json")
+		}
+
+		// ValidateRequest restores the request body after reading it, so the
+		// handler can decode it again.
+		//
+		// API keys are checked by the authenticated middleware rather than here.
+		input := &openapi3filter.RequestValidationInput{
+			Request:    r,
+			PathParams: pathParams,
+			Route:      route,
+			Options: &openapi3filter.Options{
+				ExcludeRequestBody: !jsonBody,
+				AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+			},
+		}
+		if err := openapi3filter.ValidateRequest(r.Context(), input); err != nil {
+			handleError(w, invalidRequest("%v", err))
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+
+	"github.com/influxdata/go-snippets/internal/influxclient"
+	"github.com/influxdata/go-snippets/internal/storeforward"
+)
+
+// organization is an InfluxDB organization your app serves, with its own
+// client, read and write APIs, write queue and, in offline mode, forwarder.
+//
+// Your app serves the single organization named by INFLUXDB_ORGANIZATION
+// unless BOILERPLATE_ORGS lists several, e.g. one per region, in which case
+// each request is served from the organization of the caller or the one named
+// by its X-Organization header. See selectOrganization for details.
+type organization struct {
+	name   string
+	bucket string
+	// envPrefix prefixes the names of the environment variables that configure
+	// the organization's offline buffer.
+	envPrefix string
+
+	client   influxdb2.Client
+	writeAPI api.WriteAPIBlocking
+	queryAPI api.QueryAPI
+	// queue holds points until they have been written to InfluxDB.
+	queue *writeQueue
+	// forwarder buffers points while InfluxDB cannot be reached, when offline
+	// mode is enabled. It is nil otherwise.
+	forwarder *storeforward.Forwarder
+
+	// mu guards id, which is used by the task API and is looked up by name the
+	// first time it is needed, so that your app starts while InfluxDB is
+	// unreachable.
+	mu sync.Mutex
+	id string
+}
+
+var (
+	// orgNames lists the names of the organizations your app serves, and is read
+	// from the BOILERPLATE_ORGS environment variable as a comma-separated list,
+	// e.g. "eu,us". The host, token and bucket of each organization are read
+	// from INFLUXDB_<NAME>_HOST, INFLUXDB_<NAME>_TOKEN and INFLUXDB_<NAME>_BUCKET,
+	// where <NAME> is the name in upper case, and default to INFLUXDB_HOST,
+	// INFLUXDB_TOKEN and INFLUXDB_BUCKET. The rest of the client configuration,
+	// such as INFLUXDB_<NAME>_CA_CERT, falls back in the same way. When it is
+	// unset, your app serves the organization named by INFLUXDB_ORGANIZATION.
+	orgNames = os.Getenv("BOILERPLATE_ORGS")
+
+	// organizations holds the organizations your app serves by name.
+	organizations = make(map[string]*organization)
+	// defaultOrganization serves the requests that don't select an organization.
+	// It is the first one listed in BOILERPLATE_ORGS.
+	defaultOrganization *organization
+)
+
+// errUnknownOrganization is returned when a request selects an organization
+// your app doesn't serve.
+var errUnknownOrganization = errors.New("unknown organization")
+
+// configureOrganizations sets up a client and its read and write APIs for each
+// organization your app serves. It doesn't contact InfluxDB.
+func configureOrganizations() error {
+	if orgNames == "" {
+		config, err := influxclient.ConfigFromEnv("INFLUXDB")
+		if err != nil {
+			return err
+		}
+		if defaultOrganization, err = newOrganization(organizationName, bucketName, "BOILERPLATE", config); err != nil {
+			return err
+		}
+		organizations[organizationName] = defaultOrganization
+		return nil
+	}
+	for _, name := range strings.Split(orgNames, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := organizations[name]; ok {
+			return fmt.Errorf("organization %q is listed twice", name)
+		}
+		suffix := envName(name)
+		config, err := influxclient.ConfigFromEnv("INFLUXDB_"+suffix, "INFLUXDB")
+		if err != nil {
+			return fmt.Errorf("organization %q: %v", name, err)
+		}
+		org, err := newOrganization(name, envOr("INFLUXDB_"+suffix+"_BUCKET", bucketName), "BOILERPLATE_"+suffix, config)
+		if err != nil {
+			return fmt.Errorf("organization %q: %v", name, err)
+		}
+		organizations[name] = org
+		if defaultOrganization == nil {
+			defaultOrganization = org
+		}
+	}
+	if defaultOrganization == nil {
+		return errors.New("BOILERPLATE_ORGS lists no organizations")
+	}
+	return nil
+}
+
+// newOrganization returns an organization whose client is configured by config.
+func newOrganization(name, bucket, envPrefix string, config influxclient.Config) (*organization, error) {
+	client, err := influxclient.New(config)
+	if err != nil {
+		return nil, err
+	}
+	return &organization{
+		name:      name,
+		bucket:    bucket,
+		envPrefix: envPrefix,
+		client:    client,
+		writeAPI:  client.WriteAPIBlocking(name, bucket),
+		queryAPI:  client.QueryAPI(name),
+	}, nil
+}
+
+// envName returns the name of an organization as used in the names of
+// environment variables: in upper case, with anything but letters and digits
+// replaced by underscores.
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// envOr returns the value of the environment variable named key, or fallback
+// if it is unset.
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// start opens the write queue of the organization and starts writing the points
+// in it to InfluxDB. The queue is stored in dir when your app serves a single
+// organization, and in a subdirectory of dir named after the organization
+// otherwise.
+//
+// In offline mode, points are written through a forwarder that buffers them
+// in a local database while InfluxDB cannot be reached, rather than keeping
+// them in the queue. See the storeforward package for details.
+func (o *organization) start(ctx context.Context, dir string) error {
+	if orgNames != "" {
+		dir = filepath.Join(dir, envName(o.name))
+	}
+	var err error
+	if o.queue, err = openWriteQueue(dir); err != nil {
+		return fmt.Errorf("failed to open the write queue in %q: %v", dir, err)
+	}
+	writeRecord := o.writeAPI.WriteRecord
+	if buffer, err := storeforward.OpenFromEnv(o.envPrefix); err != nil {
+		return fmt.Errorf("failed to open the offline buffer: %v", err)
+	} else if buffer != nil {
+		o.forwarder = storeforward.NewForwarder(o.client, o.name, o.bucket, buffer)
+		o.forwarder.Forwarded = func(lines []string) { cache.invalidateWritten(o.name, lines...) }
+		// Points InfluxDB rejects while the buffer is drained are kept as dead
+		// letters, like the batches of the queue it rejects.
+		o.forwarder.Rejected = func(lines []string, err error) {
+			if err := o.queue.reject(lines, err); err != nil {
+				log.Printf("Failed to store the points InfluxDB rejected as a dead letter: %v", err)
+			}
+		}
+		go o.forwarder.Run(ctx)
+		writeRecord = o.forwarder.WriteRecord
+	}
+	// Drop the cached results of the queries of the users whose points were
+	// written once they are in InfluxDB, rather than when they are queued, so
+	// that queries made in between don't cache results missing them.
+	go o.queue.forward(ctx, func(ctx context.Context, lines string) error {
+		return writeRecord(ctx, lines)
+	}, func(lines string) { cache.invalidateWritten(o.name, lines) })
+	return nil
+}
+
+// ID returns the ID of the organization, looking it up by name the first time
+// it is called. Failed lookups are retried on the next call.
+func (o *organization) ID(ctx context.Context) (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.id != "" {
+		return o.id, nil
+	}
+	org, err := o.client.OrganizationsAPI().FindOrganizationByName(ctx, o.name)
+	if err != nil {
+		return "", fmt.Errorf("failed to lookup organization named %q: %w", o.name, err)
+	}
+	o.id = *org.Id
+	return o.id, nil
+}
+
+// organizationKey is the context key of the organization a request is served from.
+type organizationKey struct{}
+
+// selectOrganization returns a context carrying the organization a request is
+// served from: the organization the caller's API key is bound to, if any, or
+// else the one named by requested, or else the default organization.
+//
+// It returns errForbidden if requested names an organization other than the
+// one the caller is bound to, and errUnknownOrganization if your app doesn't
+// serve the organization named by requested.
+func selectOrganization(ctx context.Context, requested string) (context.Context, error) {
+	org := defaultOrganization
+	if requested != "" {
+		var ok bool
+		if org, ok = organizations[requested]; !ok {
+			return ctx, errUnknownOrganization
+		}
+	}
+	if bound, ok := callerOrganization(ctx); ok {
+		if requested != "" && requested != bound {
+			return ctx, errForbidden
+		}
+		if org, ok = organizations[bound]; !ok {
+			return ctx, errUnknownOrganization
+		}
+	}
+	return context.WithValue(ctx, organizationKey{}, org), nil
+}
+
+// organizationOf returns the organization a request is served from.
+func organizationOf(ctx context.Context) *organization {
+	if org, ok := ctx.Value(organizationKey{}).(*organization); ok {
+		return org
+	}
+	return defaultOrganization
+}
+
+// tenanted is a middleware that selects the organization a request is served
+// from by the caller and the X-Organization header. It must be applied after
+// the authenticated or admin middleware.
+func tenanted(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, err := selectOrganization(r.Context(), r.Header.Get("X-Organization"))
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		handler(w, r.WithContext(ctx))
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/influxdata/go-snippets/internal/fakeinflux"
+	"github.com/influxdata/go-snippets/internal/influxclient"
+)
+
+// setOrgNames sets orgNames for the duration of the test.
+func setOrgNames(t *testing.T, names string) {
+	previous := orgNames
+	orgNames = names
+	t.Cleanup(func() { orgNames = previous })
+}
+
+func TestSelectOrganization(t *testing.T) {
+	app := newTestApp(t)
+	setOrgNames(t, "my-org,us")
+	usID := *app.influx.CreateOrganization("us").Id
+	app.influx.CreateBucket(usID, "us-bucket")
+	us, err := newOrganization("us", "us-bucket", "BOILERPLATE_TEST_US",
+		influxclient.Config{URL: app.influxURL, Token: "my-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(us.client.Close)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := us.start(ctx, app.dir); err != nil {
+		t.Fatal(err)
+	}
+	organizations["us"] = us
+	apiKeys = parseAPIKeys("key1:user1,key3:user3:us")
+
+	for _, test := range []struct {
+		name, key, userID, header string
+		status                    int
+	}{
+		{"a bound key naming another organization", "key3", "user3", "my-org", http.StatusForbidden},
+		{"an unknown organization", "key1", "user1", "mars", http.StatusBadRequest},
+		{"a bound key naming an unknown organization", "key3", "user3", "mars", http.StatusBadRequest},
+	} {
+		req, err := http.NewRequest(http.MethodGet, app.url+"/users/"+test.userID+"/points", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+test.key)
+		req.Header.Set("X-Organization", test.header)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: got status %d (%s), want %d", test.name, resp.StatusCode, body, test.status)
+		}
+	}
+
+	// Points are written to the organization the key is bound to, or else the
+	// one named by X-Organization, or else the default one.
+	ingest := func(key, userID, header string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, app.url+"/users/"+userID+"/points",
+			strings.NewReader(`{"measurement":"measurement1","field1":1}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+key)
+		req.Header.Set("Content-Type", "application/json")
+		if header != "" {
+			req.Header.Set("X-Organization", header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("got status %d ingesting with %s and X-Organization %q, want 202", resp.StatusCode, key, header)
+		}
+	}
+	ingest("key3", "user3", "")
+	ingest("key1", "user1", "us")
+	ingest("key1", "user1", "")
+	buckets := make(map[string]int)
+	for _, point := range app.waitForPoints(t, 3) {
+		buckets[point.Bucket]++
+		if point.Bucket == "us-bucket" && point.OrgID != usID {
+			t.Errorf("got point %+v in us-bucket of another organization", point)
+		}
+	}
+	if buckets["us-bucket"] != 2 || buckets["my-bucket"] != 1 {
+		t.Errorf("got points in buckets %v, want 2 in us-bucket and 1 in my-bucket", buckets)
+	}
+}
+
+func TestConfigureOrganizationsFallsBackToSharedEnv(t *testing.T) {
+	shared := fakeinflux.New("shared-token")
+	sharedOrg := shared.CreateOrganization("eu")
+	shared.CreateBucket(*sharedOrg.Id, "shared-bucket")
+	sharedServer := httptest.NewServer(shared)
+	t.Cleanup(sharedServer.Close)
+	us := fakeinflux.New("us-token")
+	usOrg := us.CreateOrganization("us")
+	us.CreateBucket(*usOrg.Id, "us-bucket")
+	usServer := httptest.NewServer(us)
+	t.Cleanup(usServer.Close)
+
+	setOrgNames(t, "eu, us")
+	previousBucket := bucketName
+	bucketName = "shared-bucket"
+	t.Cleanup(func() { bucketName = previousBucket })
+	previousOrgs, previousDefault := organizations, defaultOrganization
+	organizations, defaultOrganization = make(map[string]*organization), nil
+	t.Cleanup(func() { organizations, defaultOrganization = previousOrgs, previousDefault })
+	t.Setenv("INFLUXDB_HOST", sharedServer.URL)
+	t.Setenv("INFLUXDB_TOKEN", "shared-token")
+	t.Setenv("INFLUXDB_US_HOST", usServer.URL)
+	t.Setenv("INFLUXDB_US_TOKEN", "us-token")
+	t.Setenv("INFLUXDB_US_BUCKET", "us-bucket")
+
+	if err := configureOrganizations(); err != nil {
+		t.Fatal(err)
+	}
+	if len(organizations) != 2 || defaultOrganization != organizations["eu"] {
+		t.Fatalf("got organizations %v with default %v, want eu and us with eu first", organizations, defaultOrganization)
+	}
+	for _, org := range organizations {
+		t.Cleanup(org.client.Close)
+		if err := org.writeAPI.WriteRecord(context.Background(), "measurement1,user_id=user1 field1=1"); err != nil {
+			t.Errorf("writing to %s failed: %v", org.name, err)
+		}
+	}
+	// eu is served by the shared host, token and bucket, and us by its own.
+	if points := shared.Points(); len(points) != 1 || points[0].Bucket != "shared-bucket" {
+		t.Errorf("got points %+v in the shared InfluxDB, want 1 in shared-bucket", points)
+	}
+	if points := us.Points(); len(points) != 1 || points[0].Bucket != "us-bucket" {
+		t.Errorf("got points %+v in the InfluxDB of us, want 1 in us-bucket", points)
+	}
+
+	setOrgNames(t, "eu,eu")
+	organizations, defaultOrganization = make(map[string]*organization), nil
+	err := configureOrganizations()
+	for _, org := range organizations {
+		org.client.Close()
+	}
+	if err == nil {
+		t.Error("configured an organization listed twice")
+	}
+}
+
+func TestOrganizationIDIsLookedUpOnce(t *testing.T) {
+	app := newTestApp(t)
+	org := defaultOrganization
+
+	// Failed lookups are retried, and the ID is cached once found.
+	app.influx.FailNext("/api/v2/orgs", http.StatusServiceUnavailable, "unavailable", 0)
+	if _, err := org.ID(context.Background()); err == nil {
+		t.Fatal("looked up the ID while InfluxDB was unavailable")
+	}
+	if id, err := org.ID(context.Background()); err != nil || id != app.orgID {
+		t.Fatalf("got ID %q and error %v, want %q", id, err, app.orgID)
+	}
+	app.influx.FailNext("/api/v2/orgs", http.StatusServiceUnavailable, "unavailable", 0)
+	if id, err := org.ID(context.Background()); err != nil || id != app.orgID {
+		t.Errorf("got ID %q and error %v from the cache, want %q", id, err, app.orgID)
+	}
+}
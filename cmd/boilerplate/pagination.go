@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/go-snippets/internal/flux"
+)
+
+// The bounds of the number of records in a page of query results.
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// pageWindow is how far back pages of query results go, the same range
+// queryLatest covers.
+const pageWindow = 24 * time.Hour
+
+// pageCursor is the position of the last record of a page of query results,
+// from which the next page carries on. Records are paged newest first, and
+// records with the same time are ordered by their series key.
+type pageCursor struct {
+	Time   time.Time `json:"t"`
+	Series string    `json:"s"`
+}
+
+// pageRequest asks for a page of the finest rollups of a user's data rather
+// than the latest value of each series.
+type pageRequest struct {
+	limit int
+	// cursor is nil for the first page.
+	cursor *pageCursor
+}
+
+// page is a page of the finest rollups of a user's data.
+type page struct {
+	records []map[string]string
+	// next is nil on the last page.
+	next *pageCursor
+}
+
+// parsePageRequest returns the page requested by the limit and cursor of a
+// request, or nil if neither is set. The cursor defaults to the first page, and
+// the limit to defaultPageLimit.
+func parsePageRequest(limit, cursor string) (*pageRequest, error) {
+	if limit == "" && cursor == "" {
+		return nil, nil
+	}
+	request := &pageRequest{limit: defaultPageLimit}
+	if limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return nil, invalidRequest("invalid limit %q: must be between 1 and %d", limit, maxPageLimit)
+		}
+		request.limit = n
+	}
+	if cursor != "" {
+		decoded, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, invalidRequest("invalid cursor")
+		}
+		request.cursor = &decoded
+	}
+	return request, nil
+}
+
+// encode returns the opaque form of the cursor returned to clients.
+func (c pageCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor decodes a cursor returned by encode.
+func decodeCursor(cursor string) (pageCursor, error) {
+	var decoded pageCursor
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return decoded, err
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return decoded, err
+	}
+	if decoded.Time.IsZero() {
+		return decoded, fmt.Errorf("missing time")
+	}
+	return decoded, nil
+}
+
+// before reports whether a record at time t of a series comes after the cursor,
+// i.e. belongs to a later page.
+func (c *pageCursor) before(t time.Time, series string) bool {
+	return c == nil || t.Before(c.Time) || t.Equal(c.Time) && series > c.Series
+}
+
+// queryPage queries a page of the finest rollups of a user's data within the
+// last pageWindow, newest first.
+//
+// Each page is a bounded query: the newest limit+1 records older than the
+// cursor, found with tail, and the records at exactly the time of the cursor,
+// of which those of series not yet returned are kept. Several series usually
+// share a time, as the rollup task writes them all at once, so a page
+// ends either at its last record or, when tail cut into the records sharing
+// the oldest time it returned, just before that time, which the next page
+// reads in full. Pages may therefore hold fewer records than the limit. When
+// every record tail returned shares that time, the records at the time are
+// read in full instead, and the page holds the first limit of them.
+func queryPage(ctx context.Context, userID string, request pageRequest) (*page, error) {
+	if err := authorize(ctx, userID); err != nil {
+		return nil, err
+	}
+	org := organizationOf(ctx)
+	start := time.Now().Add(-pageWindow)
+	cursor := request.cursor
+	if cursor != nil && !cursor.Time.After(start) {
+		return &page{records: []map[string]string{}}, nil
+	}
+
+	userData := func(start, stop flux.Expr) *flux.Query {
+		return flux.From(org.bucket).
+			RangeBetween(start, stop).
+			Filter(flux.Measurement(rollupTiers[0].measurement())).
+			Filter(flux.Tag("user_id", userID)).
+			Group()
+	}
+	var program flux.Program
+	if cursor == nil {
+		program.Add(userData(flux.Duration(-pageWindow), flux.Now()).Sort("_time").Tail(request.limit + 1))
+	} else {
+		ties := program.Let("ties", userData(flux.Time(cursor.Time), flux.Time(cursor.Time.Add(time.Nanosecond))))
+		older := program.Let("older", userData(flux.Duration(-pageWindow), flux.Time(cursor.Time)).Sort("_time").Tail(request.limit+1))
+		program.Add(flux.Union(ties, older))
+	}
+	query, params := program.Render()
+
+	records, err := queryPageRecords(ctx, userID, query, params)
+	if err != nil {
+		return nil, err
+	}
+	older := 0
+	oldest := time.Time{}
+	var kept []pageRecord
+	for _, r := range records {
+		if cursor == nil || r.time.Before(cursor.Time) {
+			older++
+			if oldest.IsZero() || r.time.Before(oldest) {
+				oldest = r.time
+			}
+		}
+		if cursor.before(r.time, r.series) {
+			kept = append(kept, r)
+		}
+	}
+	records = kept
+	sortPageRecords(records)
+
+	// When tail returned as many records as it could, there are more, and
+	// those at the oldest time it returned may be incomplete.
+	more := older > request.limit
+	if more {
+		complete := 0
+		for complete < len(records) && records[complete].time.After(oldest) {
+			complete++
+		}
+		if complete == 0 {
+			// Every record shares the oldest time, so read the records at that
+			// time in full, and return the first of them with a cursor within
+			// the time.
+			query, params := userData(flux.Time(oldest), flux.Time(oldest.Add(time.Nanosecond))).Render()
+			ties, err := queryPageRecords(ctx, userID, query, params)
+			if err != nil {
+				return nil, err
+			}
+			records = append([]pageRecord(nil), ties...)
+			sortPageRecords(records)
+			complete = len(records)
+		}
+		records = records[:complete]
+	}
+	if len(records) > request.limit {
+		records, more = records[:request.limit], true
+	}
+
+	result := &page{records: make([]map[string]string, len(records))}
+	for i, r := range records {
+		result.records[i] = r.columns
+	}
+	if more && len(records) > 0 {
+		last := records[len(records)-1]
+		result.next = &pageCursor{Time: last.time, Series: last.series}
+	}
+	return result, nil
+}
+
+// pageRecord is a record of a page of query results.
+type pageRecord struct {
+	time    time.Time
+	series  string
+	columns map[string]string
+}
+
+// queryPageRecords runs a query of a user's records for a page. The records
+// are cached like the latest data, so a client scrolling back and forth
+// doesn't repeat queries, and must not be modified. See cache.go for details.
+func queryPageRecords(ctx context.Context, userID, query string, params map[string]string) ([]pageRecord, error) {
+	result, err := cache.get(ctx, cacheEndpointPoints, userID, query, params, func() (interface{}, error) {
+		tables, err := organizationOf(ctx).queryAPI.QueryWithParams(ctx, query, params)
+		if err != nil {
+			return nil, err
+		}
+		defer tables.Close()
+		var records []pageRecord
+		for tables.Next() {
+			record := tables.Record()
+			records = append(records, pageRecord{time: record.Time(), series: seriesKey(record.Values()), columns: formatRecord(record.Values())})
+		}
+		return records, tables.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.([]pageRecord), nil
+}
+
+// sortPageRecords sorts records in the order they are paged: newest first, and
+// by series key within a time.
+func sortPageRecords(records []pageRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		if !records[i].time.Equal(records[j].time) {
+			return records[i].time.After(records[j].time)
+		}
+		return records[i].series < records[j].series
+	})
+}
+
+// seriesKey returns the key of the series of a record: its measurement, field
+// and tags, formatted like the series keys of line protocol.
+func seriesKey(values map[string]interface{}) string {
+	var pairs []string
+	for column, value := range values {
+		switch column {
+		case "result", "table", "_start", "_stop", "_time", "_value":
+			continue
+		}
+		if value, ok := value.(string); ok {
+			pairs = append(pairs, column+"="+value)
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestQueryPagesThroughRecordsSharingATime(t *testing.T) {
+	app := newTestApp(t)
+	now := time.Now().Truncate(time.Minute)
+	var lines []string
+	for i := 1; i <= 5; i++ {
+		lines = append(lines, fmt.Sprintf("rollup_1m,user_id=user1,_source=measurement%d field1_mean=%d %s", i, i, formatNanos(now)))
+	}
+	lines = append(lines, "rollup_1m,user_id=user1,_source=measurement6 field1_mean=6 "+formatNanos(now.Add(-time.Minute)))
+	writeRollups(t, app, lines...)
+
+	// More records share the newest time than fit in a page, so the first
+	// page holds the first of them and the cursor carries on within the time.
+	var pages [][]string
+	cursor := ""
+	for len(pages) < 5 {
+		resp, body := app.do(t, http.MethodPost, "/query", "key1", fmt.Sprintf(`{"user_id":"user1","limit":2,"cursor":%q}`, cursor))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("got status %d (%s), want 200", resp.StatusCode, body)
+		}
+		var response struct {
+			Tables []struct {
+				Records []map[string]string `json:"records"`
+			} `json:"tables"`
+			NextCursor string `json:"next_cursor"`
+		}
+		if err := json.Unmarshal([]byte(body), &response); err != nil {
+			t.Fatal(err)
+		}
+		var values []string
+		for _, record := range response.Tables[0].Records {
+			values = append(values, record["_value"])
+		}
+		pages = append(pages, values)
+		if cursor = response.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if got, want := fmt.Sprint(pages), "[[1 2] [3 4] [5 6]]"; got != want {
+		t.Errorf("got pages %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	influxdb2http "github.com/influxdata/influxdb-client-go/v2/api/http"
+
+	"github.com/influxdata/go-snippets/internal/storeforward"
+)
+
+const (
+	// segmentSize is the size a segment of the write queue may grow to before
+	// a new one is started. Segments are deleted once every batch in them has
+	// been written.
+	segmentSize = 4 << 20
+	// retryMinBackoff and retryMaxBackoff bound the time the write queue waits
+	// between attempts to write a batch, unless InfluxDB asks for longer with
+	// a Retry-After header.
+	retryMinBackoff = time.Second
+	retryMaxBackoff = 2 * time.Minute
+)
+
+// queuedBatch is a batch of points in line protocol waiting to be written.
+type queuedBatch struct {
+	Seq      uint64    `json:"seq"`
+	Enqueued time.Time `json:"enqueued"`
+	Lines    string    `json:"lines"`
+}
+
+// writeQueue is a durable queue of batches in front of the write API. Batches
+// are appended to a log of segment files in a directory, and written to
+// InfluxDB in order by forward, which retries failed writes until they succeed
+// so that data is not lost when InfluxDB is unavailable or rate limits writes.
+// Batches that InfluxDB rejects outright are moved to a deadLetters store.
+//
+// Each segment is named after the sequence number of its first batch and holds
+// one JSON encoded batch per line. The sequence number of the last batch
+// written is kept in a file named cursor, so that forwarding resumes where it
+// left off after a restart.
+type writeQueue struct {
+	dir  string
+	dead *deadLetters
+
+	mu sync.Mutex
+	// segment is the segment batches are appended to.
+	segment *os.File
+	// size is the size of segment.
+	size int64
+	// nextSeq is the sequence number of the next batch appended.
+	nextSeq uint64
+	// appended is signalled whenever a batch is appended.
+	appended chan struct{}
+	// rewrites counts the times purge has replaced segments, so that readers
+	// know to reopen them.
+	rewrites uint64
+}
+
+// openWriteQueue opens the write queue stored in dir, creating it if needed.
+func openWriteQueue(dir string) (*writeQueue, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	dead, err := openDeadLetters(filepath.Join(dir, "dead"))
+	if err != nil {
+		return nil, err
+	}
+	q := &writeQueue{dir: dir, dead: dead, nextSeq: 1, appended: make(chan struct{}, 1)}
+
+	segments, err := q.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		acked, err := q.acked()
+		if err != nil {
+			return nil, err
+		}
+		q.nextSeq = acked + 1
+		if err := q.skipDeadLetters(); err != nil {
+			return nil, err
+		}
+		return q, q.rotate()
+	}
+
+	// Continue appending to the last segment, dropping any batch left partly
+	// written by a crash.
+	last := q.segmentPath(segments[len(segments)-1])
+	data, err := ioutil.ReadFile(last)
+	if err != nil {
+		return nil, err
+	}
+	complete := bytes.LastIndexByte(data, '\n') + 1
+	if err := os.Truncate(last, int64(complete)); err != nil {
+		return nil, err
+	}
+	q.nextSeq = segments[len(segments)-1]
+	for _, line := range bytes.Split(data[:complete], []byte("\n")) {
+		var batch queuedBatch
+		if json.Unmarshal(line, &batch) == nil {
+			q.nextSeq = batch.Seq + 1
+		}
+	}
+	if err := q.skipDeadLetters(); err != nil {
+		return nil, err
+	}
+	if q.segment, err = os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+		return nil, err
+	}
+	q.size = int64(complete)
+	return q, nil
+}
+
+// skipDeadLetters moves nextSeq past the IDs of the dead letters, which may
+// have been taken by points rejected after they left the queue. See reject.
+func (q *writeQueue) skipDeadLetters() error {
+	letters, err := q.dead.list("")
+	if err != nil {
+		return err
+	}
+	if len(letters) > 0 {
+		last, err := strconv.ParseUint(letters[len(letters)-1].ID, 10, 64)
+		if err != nil {
+			return err
+		}
+		if last >= q.nextSeq {
+			q.nextSeq = last + 1
+		}
+	}
+	return nil
+}
+
+// segments returns the sequence numbers the segments of the queue start at, in order.
+func (q *writeQueue) segments() ([]uint64, error) {
+	names, err := filepath.Glob(filepath.Join(q.dir, "*.log"))
+	if err != nil {
+		return nil, err
+	}
+	var segments []uint64
+	for _, name := range names {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".log"), 10, 64)
+		if err == nil {
+			segments = append(segments, seq)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+func (q *writeQueue) segmentPath(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d.log", seq))
+}
+
+// rotate starts a new segment. The caller must hold q.mu, except when opening the queue.
+func (q *writeQueue) rotate() error {
+	segment, err := os.OpenFile(q.segmentPath(q.nextSeq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if q.segment != nil {
+		q.segment.Close()
+	}
+	q.segment, q.size = segment, 0
+	return nil
+}
+
+// enqueue durably appends a batch of points in line protocol to the queue.
+func (q *writeQueue) enqueue(lines string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.size >= segmentSize {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(queuedBatch{Seq: q.nextSeq, Enqueued: time.Now().UTC(), Lines: strings.TrimRight(lines, "\n")})
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if _, err := q.segment.Write(data); err != nil {
+		return err
+	}
+	if err := q.segment.Sync(); err != nil {
+		return err
+	}
+	q.size += int64(len(data))
+	q.nextSeq++
+
+	select {
+	case q.appended <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// reject moves points in line protocol that InfluxDB rejected after they left
+// the queue, such as those the forwarder drops from the offline buffer, to the
+// dead letter store. They are stored as a batch of their own, with the next
+// sequence number of the queue as its ID.
+func (q *writeQueue) reject(lines []string, cause error) error {
+	q.mu.Lock()
+	batch := queuedBatch{Seq: q.nextSeq, Enqueued: time.Now().UTC(), Lines: strings.Join(lines, "\n")}
+	q.nextSeq++
+	q.mu.Unlock()
+
+	statusCode := http.StatusBadRequest
+	var influxErr *influxdb2http.Error
+	if errors.As(cause, &influxErr) && influxErr.StatusCode != 0 {
+		statusCode = influxErr.StatusCode
+	}
+	return q.dead.add(batch, statusCode, cause, 1)
+}
+
+// purge removes the points in line protocol that match reports true for from
+// the batches in the queue, for example to erase the data of a user, and
+// returns the number removed from batches not yet written to InfluxDB. Each
+// segment holding such points is replaced with a copy without them, leaving
+// out batches left empty. When dryRun is set, the points are only counted.
+//
+// The batch being written when purge is called is written as it is.
+func (q *writeQueue) purge(match func(line string) bool, dryRun bool) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	acked, err := q.acked()
+	if err != nil {
+		return 0, err
+	}
+	segments, err := q.segments()
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for i, seq := range segments {
+		path := q.segmentPath(seq)
+		data, err := ioutil.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			// The segment was read past and deleted since it was listed.
+			continue
+		}
+		if err != nil {
+			return purged, err
+		}
+		var kept bytes.Buffer
+		changed := false
+		for _, line := range bytes.Split(data, []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			var batch queuedBatch
+			if err := json.Unmarshal(line, &batch); err != nil {
+				return purged, fmt.Errorf("corrupt batch in segment %d: %v", seq, err)
+			}
+			var lines []string
+			for _, point := range strings.Split(batch.Lines, "\n") {
+				if !match(point) {
+					lines = append(lines, point)
+					continue
+				}
+				changed = true
+				if batch.Seq > acked {
+					purged++
+				}
+			}
+			if len(lines) == 0 {
+				continue
+			}
+			batch.Lines = strings.Join(lines, "\n")
+			encoded, err := json.Marshal(batch)
+			if err != nil {
+				return purged, err
+			}
+			kept.Write(append(encoded, '\n'))
+		}
+		if dryRun || !changed {
+			continue
+		}
+
+		if err := replaceFile(path, kept.Bytes()); err != nil {
+			return purged, err
+		}
+		q.rewrites++
+		if i == len(segments)-1 {
+			// Batches are appended to the last segment, so append them to its
+			// replacement from now on.
+			segment, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+			if err != nil {
+				return purged, err
+			}
+			q.segment.Close()
+			q.segment, q.size = segment, int64(kept.Len())
+		}
+	}
+	return purged, nil
+}
+
+// replaceFile durably replaces the file at path with one holding data.
+func replaceFile(path string, data []byte) error {
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// rewritten returns the number of times purge has replaced segments.
+func (q *writeQueue) rewritten() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.rewrites
+}
+
+// acked returns the sequence number of the last batch written to InfluxDB.
+func (q *writeQueue) acked() (uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(q.dir, "cursor"))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// ack records that every batch up to seq has been written to InfluxDB.
+func (q *writeQueue) ack(seq uint64) error {
+	cursor := filepath.Join(q.dir, "cursor")
+	if err := ioutil.WriteFile(cursor+".tmp", []byte(strconv.FormatUint(seq, 10)), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(cursor+".tmp", cursor)
+}
+
+// forward writes the batches in the queue to InfluxDB with write in order until
+// ctx is cancelled, waiting for new batches when the queue is empty. It calls
+// written with the lines of each batch once it has been dealt with.
+func (q *writeQueue) forward(ctx context.Context, write func(ctx context.Context, lines string) error, written func(lines string)) {
+	acked, err := q.acked()
+	if err != nil {
+		log.Printf("Failed to read the write queue cursor: %v", err)
+		return
+	}
+	reader := &segmentReader{queue: q}
+	defer reader.close()
+	for {
+		batch, err := reader.next(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Failed to read the write queue: %v", err)
+			}
+			return
+		}
+		if batch.Seq <= acked {
+			continue
+		}
+		if !q.deliver(ctx, batch, write) {
+			return
+		}
+		written(batch.Lines)
+		if err := q.ack(batch.Seq); err != nil {
+			log.Printf("Failed to update the write queue cursor: %v", err)
+		}
+		acked = batch.Seq
+	}
+}
+
+// deliver writes a batch, retrying with exponential backoff until it is
+// written, InfluxDB rejects it permanently or ctx is cancelled. Rejected
+// batches are moved to the dead letter store. It returns false if ctx was
+// cancelled before the batch was dealt with.
+func (q *writeQueue) deliver(ctx context.Context, batch queuedBatch, write func(ctx context.Context, lines string) error) bool {
+	backoff := retryMinBackoff
+	for attempt := 1; ; attempt++ {
+		err := write(ctx, batch.Lines)
+		if err == nil {
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+
+		var influxErr *influxdb2http.Error
+		rejected := 0
+		if errors.As(err, &influxErr) && permanentWriteError(influxErr.StatusCode) {
+			rejected = influxErr.StatusCode
+		} else if errors.Is(err, storeforward.ErrPointTooLarge) {
+			// In offline mode, a point too large for the offline buffer can
+			// never be buffered, so it is rejected as InfluxDB would.
+			rejected = http.StatusRequestEntityTooLarge
+		}
+		if rejected != 0 {
+			log.Printf("Queued batch %d was rejected, moving it to the dead letter store: %v", batch.Seq, err)
+			if err := q.dead.add(batch, rejected, err, attempt); err != nil {
+				log.Printf("Failed to store dead letter %d: %v", batch.Seq, err)
+			}
+			return true
+		}
+
+		// Wait as long as InfluxDB asks, or otherwise back off exponentially
+		// with jitter so that many instances don't retry in lockstep.
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if influxErr != nil && influxErr.RetryAfter > 0 {
+			wait = time.Duration(influxErr.RetryAfter) * time.Second
+		}
+		log.Printf("Failed to write queued batch %d (attempt %d), retrying in %v: %v", batch.Seq, attempt, wait, err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(wait):
+		}
+		if backoff *= 2; backoff > retryMaxBackoff {
+			backoff = retryMaxBackoff
+		}
+	}
+}
+
+// permanentWriteError reports whether a write that failed with an HTTP status
+// code will never succeed, so retrying it is pointless. Other failures, such as
+// an invalid token or a missing bucket, are usually fixed by reconfiguring
+// InfluxDB, so those writes are retried rather than given up on.
+func permanentWriteError(statusCode int) bool {
+	return statusCode == 400 || statusCode == 413 || statusCode == 422
+}
+
+// segmentReader reads the batches of a write queue in order, deleting each
+// segment once it has been read past.
+type segmentReader struct {
+	queue   *writeQueue
+	seq     uint64 // The sequence number the current segment starts at.
+	file    *os.File
+	reader  *bufio.Reader
+	offset  int64  // The number of bytes read from the current segment.
+	partial []byte // A line read before it was completely written.
+	// rewrites is the number of times the queue had replaced segments when
+	// the current one was opened, and last the sequence number of the last
+	// batch returned, from which a replaced segment is read on.
+	rewrites uint64
+	last     uint64
+}
+
+// next returns the next batch in the queue, waiting for one to be appended if
+// the reader has reached the end of the queue.
+func (r *segmentReader) next(ctx context.Context) (queuedBatch, error) {
+	for {
+		if r.file != nil && r.queue.rewritten() != r.rewrites {
+			// The segment was replaced by purge, so read on from the replacement.
+			r.file.Close()
+			if err := r.openSegment(r.seq); err != nil {
+				return queuedBatch{}, err
+			}
+		}
+		if r.file == nil {
+			if err := r.open(); err != nil {
+				return queuedBatch{}, err
+			}
+		}
+		if r.file != nil {
+			line, err := r.reader.ReadBytes('\n')
+			r.offset += int64(len(line))
+			r.partial = append(r.partial, line...)
+			if err == nil {
+				var batch queuedBatch
+				err := json.Unmarshal(r.partial, &batch)
+				r.partial = r.partial[:0]
+				if err != nil {
+					return queuedBatch{}, fmt.Errorf("corrupt batch in segment %d: %v", r.seq, err)
+				}
+				if batch.Seq <= r.last {
+					continue
+				}
+				r.last = batch.Seq
+				return batch, nil
+			}
+			if err != io.EOF {
+				return queuedBatch{}, err
+			}
+			// At the end of a segment, move on to the next one if there is one.
+			if advanced, err := r.advance(); err != nil {
+				return queuedBatch{}, err
+			} else if advanced {
+				continue
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return queuedBatch{}, ctx.Err()
+		case <-r.queue.appended:
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// open opens the first segment of the queue, if there is one.
+func (r *segmentReader) open() error {
+	segments, err := r.queue.segments()
+	if err != nil || len(segments) == 0 {
+		return err
+	}
+	return r.openSegment(segments[0])
+}
+
+func (r *segmentReader) openSegment(seq uint64) error {
+	rewrites := r.queue.rewritten()
+	file, err := os.Open(r.queue.segmentPath(seq))
+	if err != nil {
+		return err
+	}
+	r.seq, r.file, r.reader, r.offset, r.partial = seq, file, bufio.NewReader(file), 0, r.partial[:0]
+	r.rewrites = rewrites
+	return nil
+}
+
+// advance deletes the current segment and opens the next one, if the queue has
+// moved on to a later segment and every batch in the current one has been read.
+// Otherwise more batches may still be appended to the current segment, and it
+// returns false.
+func (r *segmentReader) advance() (bool, error) {
+	segments, err := r.queue.segments()
+	if err != nil {
+		return false, err
+	}
+	for _, seq := range segments {
+		if seq <= r.seq {
+			continue
+		}
+		// Nothing is appended to a segment once a later one exists, but batches
+		// may have been appended since the end of this one was reached.
+		info, err := r.file.Stat()
+		if err != nil {
+			return false, err
+		}
+		if info.Size() > r.offset {
+			return true, nil
+		}
+		r.file.Close()
+		if err := os.Remove(r.queue.segmentPath(r.seq)); err != nil {
+			return false, err
+		}
+		return true, r.openSegment(seq)
+	}
+	return false, nil
+}
+
+func (r *segmentReader) close() {
+	if r.file != nil {
+		r.file.Close()
+	}
+}
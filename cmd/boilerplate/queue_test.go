@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	influxdb2http "github.com/influxdata/influxdb-client-go/v2/api/http"
+
+	"github.com/influxdata/go-snippets/internal/storeforward"
+)
+
+func TestDeliverDeadLettersPointsTooLargeToBuffer(t *testing.T) {
+	queue, err := openWriteQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := queuedBatch{Seq: 1, Enqueued: time.Now().UTC(), Lines: "m f=1 1"}
+	delivered := queue.deliver(context.Background(), batch, func(context.Context, string) error {
+		return fmt.Errorf("failed to buffer: %w", storeforward.ErrPointTooLarge)
+	})
+	if !delivered {
+		t.Fatal("the batch was not dealt with")
+	}
+	letters, err := queue.dead.list("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].Lines != batch.Lines || letters[0].StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("got dead letters %+v, want the batch with status 413", letters)
+	}
+}
+
+func TestRejectDeadLettersPointsWithSequenceNumbersOfTheirOwn(t *testing.T) {
+	dir := t.TempDir()
+	queue, err := openWriteQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.enqueue("m f=1 1"); err != nil {
+		t.Fatal(err)
+	}
+	rejection := &influxdb2http.Error{StatusCode: http.StatusUnprocessableEntity, Message: "field type conflict"}
+	if err := queue.reject([]string{"m f=2 2", "m f=3 3"}, rejection); err != nil {
+		t.Fatal(err)
+	}
+	letters, err := queue.dead.list("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].ID != "2" || letters[0].Lines != "m f=2 2\nm f=3 3" ||
+		letters[0].StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("got dead letters %+v, want the rejected points as 2 with status 422", letters)
+	}
+
+	// The sequence numbers of dead letters are not reused after a restart.
+	queue.segment.Close()
+	if queue, err = openWriteQueue(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer queue.segment.Close()
+	if queue.nextSeq != 3 {
+		t.Errorf("the next batch is %d after reopening the queue, want 3", queue.nextSeq)
+	}
+}
+
+func TestPurgeWhileForwarding(t *testing.T) {
+	queue, err := openWriteQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lines := range []string{"m,user_id=user1 f=1 1\nm,user_id=user2 f=2 2", "m,user_id=user1 f=3 3", "m,user_id=user2 f=4 4"} {
+		if err := queue.enqueue(lines); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	writing, release := make(chan struct{}), make(chan struct{})
+	written := make(chan string, 10)
+	first := true
+	go queue.forward(ctx, func(_ context.Context, lines string) error {
+		if first {
+			first = false
+			close(writing)
+			<-release
+		}
+		written <- lines
+		return nil
+	}, func(string) {})
+
+	// Purge while the first batch is being written, which is written as it is.
+	<-writing
+	match := func(line string) bool { return strings.Contains(line, "user_id=user1 ") }
+	if purged, err := queue.purge(match, true); err != nil || purged != 2 {
+		t.Fatalf("got %d points and error %v in a dry run, want 2", purged, err)
+	}
+	if purged, err := queue.purge(match, false); err != nil || purged != 2 {
+		t.Fatalf("got %d points and error %v, want 3", purged, err)
+	}
+	close(release)
+	if err := queue.enqueue("m,user_id=user2 f=5 5"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"m,user_id=user1 f=1 1\nm,user_id=user2 f=2 2", "m,user_id=user2 f=4 4", "m,user_id=user2 f=5 5"}
+	for i, lines := range want {
+		select {
+		case got := <-written:
+			if got != lines {
+				t.Errorf("batch %d: got %q, want %q", i+1, got, lines)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("batch %d was not written", i+1)
+		}
+	}
+}
+
+func TestPurgeDeadLetters(t *testing.T) {
+	dead, err := openDeadLetters(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.add(queuedBatch{Seq: 1, Lines: "m,user_id=user1 f=1 1\nm,user_id=user2 f=2 2"}, http.StatusBadRequest, fmt.Errorf("bad"), 1)
+	dead.add(queuedBatch{Seq: 2, Lines: "m,user_id=user1 f=3 3"}, http.StatusBadRequest, fmt.Errorf("bad"), 1)
+
+	match := func(line string) bool { return strings.Contains(line, "user_id=user1 ") }
+	if purged, err := dead.purge(match, false); err != nil || purged != 2 {
+		t.Fatalf("got %d points and error %v, want 2", purged, err)
+	}
+	letters, err := dead.list("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].ID != "1" || letters[0].Lines != "m,user_id=user2 f=2 2" {
+		t.Errorf("got dead letters %+v, want only the point of user2", letters)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	// rateLimitSetting is the number of requests per second each caller may
+	// make, and is read from the BOILERPLATE_RATE_LIMIT environment variable.
+	rateLimitSetting = os.Getenv("BOILERPLATE_RATE_LIMIT")
+	// rateLimit is rateLimitSetting parsed by main. Requests are not rate
+	// limited when it is zero.
+	rateLimit float64
+)
+
+var (
+	limitersMu sync.Mutex
+	// limiters holds a token bucket for each caller seen within the idle
+	// timeout of the limiters.
+	limiters = make(map[string]*callerLimiter)
+	// limitersSwept is when idle limiters were last evicted.
+	limitersSwept time.Time
+)
+
+// callerLimiter is the token bucket of a caller and the time of their last
+// request.
+type callerLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateBurst is the number of requests a caller may make at once, one second's
+// worth of requests or at least one.
+func rateBurst() int {
+	if burst := int(rateLimit); burst > 1 {
+		return burst
+	}
+	return 1
+}
+
+// limiterIdleTimeout is how long the limiter of a caller is kept after their
+// last request. By then their bucket has refilled, so a new limiter behaves
+// the same, and evicting idle limiters keeps callers from many addresses from
+// growing the map without bound.
+func limiterIdleTimeout() time.Duration {
+	refill := time.Duration(float64(rateBurst()) / rateLimit * float64(time.Second))
+	if refill < time.Minute {
+		return time.Minute
+	}
+	return refill
+}
+
+// allow reports whether the caller identified by key may make another request.
+// Callers are identified by the user they authenticated as or, when requests
+// are not authenticated, by their IP address.
+func allow(key string) bool {
+	return allowAt(key, time.Now())
+}
+
+// allowAt is allow for a request made at now.
+func allowAt(key string, now time.Time) bool {
+	if rateLimit <= 0 {
+		return true
+	}
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	idle := limiterIdleTimeout()
+	if now.Sub(limitersSwept) >= idle {
+		for k, l := range limiters {
+			if now.Sub(l.lastSeen) >= idle {
+				delete(limiters, k)
+			}
+		}
+		limitersSwept = now
+	}
+	l, ok := limiters[key]
+	if !ok {
+		l = &callerLimiter{limiter: rate.NewLimiter(rate.Limit(rateLimit), rateBurst())}
+		limiters[key] = l
+	}
+	l.lastSeen = now
+	return l.limiter.AllowN(now, 1)
+}
+
+// rateLimited is a middleware that limits the rate of requests from each caller
+// and returns a 429 http.StatusTooManyRequests to callers over the limit. It
+// must be applied after the authenticated middleware to limit by user.
+func rateLimited(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, ok := caller(r.Context())
+		if !ok {
+			key, _, _ = net.SplitHostPort(r.RemoteAddr)
+		}
+		if !allow(key) {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusTooManyRequests, errorResponse{Code: errorCodeRateLimited, Message: "rate limit exceeded"})
+			return
+		}
+		handler(w, r)
+	}
+}
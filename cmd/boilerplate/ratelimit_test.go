@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllowEvictsIdleLimiters(t *testing.T) {
+	defer func(limit float64) { rateLimit = limit }(rateLimit)
+	rateLimit = 2
+	limiters = make(map[string]*callerLimiter)
+	limitersSwept = time.Time{}
+
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		if !allowAt("alice", now) {
+			t.Fatalf("request %d was limited within the burst", i+1)
+		}
+	}
+	if allowAt("alice", now) {
+		t.Fatal("a request over the burst was allowed")
+	}
+	if !allowAt("bob", now.Add(time.Second)) {
+		t.Fatal("another caller was limited")
+	}
+
+	// Once alice has been idle for the timeout, her limiter is evicted on the
+	// next request while bob's, who is still active, is kept.
+	allowAt("bob", now.Add(limiterIdleTimeout()-time.Second))
+	allowAt("carol", now.Add(limiterIdleTimeout()+time.Second))
+	if _, ok := limiters["alice"]; ok {
+		t.Error("the limiter of an idle caller was not evicted")
+	}
+	if _, ok := limiters["bob"]; !ok {
+		t.Error("the limiter of an active caller was evicted")
+	}
+	if len(limiters) != 2 {
+		t.Errorf("got %d limiters, want 2", len(limiters))
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	// The timezone database is embedded, so that the timezones of queries and
+	// tasks can be checked wherever the application runs.
+	_ "time/tzdata"
+
+	"github.com/influxdata/influxdb-client-go/v2/domain"
+
+	"github.com/influxdata/go-snippets/internal/flux"
+)
+
+// rollupTier is a tier of the rollups of users' data: the max, min and mean of
+// each field of each series in windows of time of length every, written to the
+// measurement named after the tier by a task of each user. Each rollup is timed
+// by the start of its window, so the rollups within a window of a coarser tier
+// are exactly those it aggregates.
+//
+// The finest tier is rolled up from the raw data, and each coarser tier from
+// the tier below it, so the task of a tier runs offset from the start of its
+// window for long enough for the tier below to have finished the same window.
+//
+// The days of the calendar tier are counted in the timezone the tasks of a
+// user were set up in, UTC by default. Its rollups in any other timezone are
+// tagged with the timezone.
+type rollupTier struct {
+	name     string
+	every    time.Duration
+	offset   time.Duration
+	calendar bool
+}
+
+// rollupTiers are the tiers of rollups, from finest to coarsest.
+var rollupTiers = []rollupTier{
+	{name: "1m", every: time.Minute, offset: 15 * time.Second},
+	{name: "1h", every: time.Hour, offset: time.Minute},
+	{name: "1d", every: 24 * time.Hour, offset: 5 * time.Minute, calendar: true},
+}
+
+// rollupAggregates are the aggregates each tier holds, as a field of each
+// field of the raw data suffixed with the name of the aggregate, e.g.
+// field1_max. Each tier aggregates the same field of the tier below with the
+// same aggregate, so the mean of a coarser tier is the mean of the means of
+// the finer one.
+var rollupAggregates = []flux.Aggregate{flux.Max, flux.Min, flux.Mean}
+
+// measurement returns the measurement the rollups of the tier are written to.
+func (t rollupTier) measurement() string {
+	return "rollup_" + t.name
+}
+
+// internalMeasurements matches the names of the measurements the application
+// keeps for itself, which aren't users' data: those starting with an
+// underscore, such as _alerts and _annotations, the rollups, and the output of
+// the former down sampling task. Rollups, alerts and derived schemas all leave
+// them out.
+const internalMeasurements = `^(_|rollup_|downsampled$)`
+
+var internalMeasurementPattern = regexp.MustCompile(internalMeasurements)
+
+// isInternalMeasurement reports whether a measurement is one the application
+// keeps for itself. See internalMeasurements.
+func isInternalMeasurement(name string) bool {
+	return internalMeasurementPattern.MatchString(name)
+}
+
+// maxRollupWindows is the number of windows a query over a range is aimed to
+// return when the window isn't given.
+const maxRollupWindows = 1000
+
+// rollupRequest asks for the rollups of a user's data within a time range, in
+// windows of a given length.
+type rollupRequest struct {
+	start, stop time.Time
+	window      rollupWindow
+	// location is the timezone calendar windows are counted in.
+	location *time.Location
+}
+
+// queryMetadata describes how a query was answered.
+type queryMetadata struct {
+	// Tier is the name of the tier of rollups the query read.
+	Tier     string     `json:"tier"`
+	Window   string     `json:"window,omitempty"`
+	Timezone string     `json:"timezone,omitempty"`
+	Start    *time.Time `json:"start,omitempty"`
+	Stop     *time.Time `json:"stop,omitempty"`
+}
+
+// parseRollupRequest returns the rollups requested by the start, stop, window
+// and timezone of a request, or nil if none is set. Times are RFC 3339
+// timestamps or negative durations relative to now, and start and stop default
+// to 24 hours ago and now.
+//
+// The window is either a whole number of minutes, such as 15m or 6h, counted in
+// UTC, or of calendar days or months, such as 1d or 3mo, counted in the
+// timezone. A timezone can only be given with calendar windows. The window
+// defaults to the interval of the finest tier that covers the range in at most
+// maxRollupWindows windows, or with a timezone to a day, or a month when there
+// are more days than that. The range is widened to whole windows.
+func parseRollupRequest(start, stop, window, timezone string) (*rollupRequest, error) {
+	if start == "" && stop == "" && window == "" && timezone == "" {
+		return nil, nil
+	}
+	now := time.Now()
+	request := &rollupRequest{start: now.Add(-24 * time.Hour), stop: now}
+	for name, value := range map[string]struct {
+		value  string
+		parsed *time.Time
+	}{"start": {start, &request.start}, "stop": {stop, &request.stop}} {
+		if value.value == "" {
+			continue
+		}
+		parsed, err := parseQueryTime(value.value, now)
+		if err != nil {
+			return nil, invalidRequest("invalid %s: %v", name, err)
+		}
+		*value.parsed = parsed
+	}
+	if !request.start.Before(request.stop) {
+		return nil, invalidRequest("start must be before stop")
+	}
+	var err error
+	if request.location, err = parseTimezone(timezone); err != nil {
+		return nil, err
+	}
+	switch {
+	case window != "":
+		if request.window, err = parseRollupWindow(window); err != nil {
+			return nil, err
+		}
+		if timezone != "" && !request.window.calendar() {
+			return nil, invalidRequest("a timezone can only be given with a window of whole days or months, e.g. 1d or 1mo")
+		}
+	case timezone != "":
+		request.window = rollupWindow{days: 1}
+		if request.stop.Sub(request.start)/(24*time.Hour) > maxRollupWindows {
+			request.window = rollupWindow{months: 1}
+		}
+	default:
+		request.window.every = rollupTiers[len(rollupTiers)-1].every
+		for _, tier := range rollupTiers {
+			if request.stop.Sub(request.start)/tier.every <= maxRollupWindows {
+				request.window.every = tier.every
+				break
+			}
+		}
+	}
+	request.start = request.window.truncate(request.start, request.location)
+	if stop := request.window.truncate(request.stop, request.location); stop.Before(request.stop) {
+		request.stop = request.window.next(stop, request.location)
+	}
+	return request, nil
+}
+
+// parseTimezone returns the location of a timezone given by its IANA name, or
+// UTC if the name is empty.
+func parseTimezone(timezone string) (*time.Location, error) {
+	if timezone == "" {
+		return time.UTC, nil
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil || timezone == "Local" {
+		return nil, invalidRequest("invalid timezone %q: must be an IANA timezone, e.g. America/New_York", timezone)
+	}
+	return location, nil
+}
+
+// parseQueryTime parses a time passed to a query, either an RFC 3339 timestamp
+// or a negative duration relative to now, such as -24h.
+func parseQueryTime(value string, now time.Time) (time.Time, error) {
+	if offset, err := time.ParseDuration(value); err == nil && strings.HasPrefix(value, "-") {
+		return now.Add(offset).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return t, fmt.Errorf("%q must be RFC 3339 or a negative duration", value)
+	}
+	return t.UTC(), nil
+}
+
+// rollupWindow is the length of the windows of a query of rollups: either a
+// fixed duration, or a whole number of calendar days or months, which start at
+// midnight in the timezone of the query and so last 23 or 25 hours on the days
+// the clocks change. Like the windows of Flux, windows are aligned to the Unix
+// epoch, in local time for calendar windows.
+type rollupWindow struct {
+	every  time.Duration
+	days   int
+	months int
+}
+
+// parseRollupWindow parses the window of a request.
+func parseRollupWindow(window string) (rollupWindow, error) {
+	for _, unit := range []struct {
+		suffix string
+		n      func(n int) rollupWindow
+	}{
+		{"mo", func(n int) rollupWindow { return rollupWindow{months: n} }},
+		{"d", func(n int) rollupWindow { return rollupWindow{days: n} }},
+	} {
+		if strings.HasSuffix(window, unit.suffix) {
+			if n, err := strconv.Atoi(strings.TrimSuffix(window, unit.suffix)); err == nil && n > 0 {
+				return unit.n(n), nil
+			}
+		}
+	}
+	every, err := time.ParseDuration(window)
+	if err != nil || every <= 0 || every%rollupTiers[0].every != 0 {
+		return rollupWindow{}, invalidRequest("invalid window %q: must be a whole number of minutes, days or months, e.g. 15m, 6h, 1d or 1mo", window)
+	}
+	return rollupWindow{every: every}, nil
+}
+
+// calendar reports whether the window is of calendar days or months.
+func (w rollupWindow) calendar() bool {
+	return w.days > 0 || w.months > 0
+}
+
+// String formats the window as a Flux duration, e.g. 15m or 1mo.
+func (w rollupWindow) String() string {
+	switch {
+	case w.months > 0:
+		return strconv.Itoa(w.months) + "mo"
+	case w.days > 0:
+		return strconv.Itoa(w.days) + "d"
+	}
+	return flux.FormatDuration(w.every)
+}
+
+// expr returns the window as the every of an aggregate window.
+func (w rollupWindow) expr() flux.Expr {
+	switch {
+	case w.months > 0:
+		return flux.Months(w.months)
+	case w.days > 0:
+		return flux.Days(w.days)
+	}
+	return flux.Duration(w.every)
+}
+
+// truncate returns the start of the window that t falls within, counting
+// calendar windows in location.
+func (w rollupWindow) truncate(t time.Time, location *time.Location) time.Time {
+	year, month, day := t.In(location).Date()
+	switch {
+	case w.months > 0:
+		months := (year-1970)*12 + int(month) - 1
+		return time.Date(year, month-time.Month(floorMod(months, w.months)), 1, 0, 0, 0, 0, location).UTC()
+	case w.days > 0:
+		days := int(time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix() / (24 * 60 * 60))
+		return time.Date(year, month, day-floorMod(days, w.days), 0, 0, 0, 0, location).UTC()
+	}
+	offset := t.Sub(time.Unix(0, 0)) % w.every
+	if offset < 0 {
+		offset += w.every
+	}
+	return t.Add(-offset).UTC()
+}
+
+// next returns the start of the window after the one starting at start.
+func (w rollupWindow) next(start time.Time, location *time.Location) time.Time {
+	year, month, day := start.In(location).Date()
+	switch {
+	case w.months > 0:
+		return time.Date(year, month+time.Month(w.months), 1, 0, 0, 0, 0, location).UTC()
+	case w.days > 0:
+		return time.Date(year, month, day+w.days, 0, 0, 0, 0, location).UTC()
+	}
+	return start.Add(w.every)
+}
+
+// floorMod returns the remainder of n divided by m, which is never negative.
+func floorMod(n, m int) int {
+	return ((n % m) + m) % m
+}
+
+// selectTiers returns the tiers whose rollups can be aggregated into the
+// requested windows, coarsest first. A tier can when each window starts at the
+// start of one of its rollups, so that each window is aggregated from whole
+// rollups; on the days the clocks change, that may only hold for finer tiers
+// than on other days. The calendar tier can when its days are counted in the
+// timezone of calendar windows, and is then filtered to the rollups of that
+// timezone. The finest tier can aggregate every valid window.
+func selectTiers(request rollupRequest) []rollupTier {
+	var tiers []rollupTier
+	for i := len(rollupTiers) - 1; i >= 0; i-- {
+		tier := rollupTiers[i]
+		if i == 0 || tier.calendar && request.window.calendar() || request.alignedTo(tier) {
+			tiers = append(tiers, tier)
+		}
+	}
+	return tiers
+}
+
+// alignedTo reports whether each window of the request starts at the start of
+// a rollup of the tier.
+func (r rollupRequest) alignedTo(tier rollupTier) bool {
+	if !r.window.calendar() {
+		return r.window.every%tier.every == 0
+	}
+	for start := r.start; start.Before(r.stop); start = r.window.next(start, r.location) {
+		if !start.Truncate(tier.every).Equal(start) {
+			return false
+		}
+	}
+	return true
+}
+
+// rollUp adds the queries that aggregate data into windows of length every to
+// a program, and returns the union of their results. Fields of raw data are
+// aggregated with each of rollupAggregates and suffixed with its name, while
+// the fields of a tier are aggregated with the aggregate they are suffixed with.
+func rollUp(program *flux.Program, data *flux.Query, every flux.Expr, raw bool) *flux.Query {
+	var rollups []*flux.Query
+	for _, fn := range rollupAggregates {
+		suffix := "_" + string(fn)
+		rollup := data
+		if !raw {
+			rollup = rollup.Filter(flux.Col("_field").Matches(regexp.QuoteMeta(suffix) + "$"))
+		}
+		rollup = rollup.AggregateWindowStart(every, fn, false)
+		if raw {
+			rollup = rollup.Map(flux.Set("_field", flux.Concat(flux.Col("_field"), flux.String(suffix))))
+		}
+		rollups = append(rollups, program.Let(string(fn)+"_data", rollup))
+	}
+	return flux.Union(rollups...)
+}
+
+// createRollupTasks creates the tasks that roll up a user's data into each
+// tier, finest first, counting the days of the calendar tier in location. It
+// holds the logic shared by the HTTP and gRPC setup endpoints.
+func createRollupTasks(ctx context.Context, userID string, location *time.Location) ([]domain.Task, error) {
+	if err := authorize(ctx, userID); err != nil {
+		return nil, err
+	}
+	org := organizationOf(ctx)
+	tasks := make([]domain.Task, 0, len(rollupTiers))
+	for i, tier := range rollupTiers {
+		// Each run rolls up the window that has just ended, which starts exactly
+		// one interval before the time the run is scheduled for. Tasks can't be
+		// given parameters, so the bucket and user ID are written into the query
+		// as quoted literals.
+		var program flux.Program
+		source := flux.From(org.bucket).Range(flux.Duration(-tier.every))
+		// below is the tier the rollups are aggregated from, or -1 for the raw
+		// data.
+		below := i - 1
+		every, window := tier.every, flux.Duration(tier.every)
+		measurement := []flux.Assignment{flux.Set("_measurement", flux.String(tier.measurement()))}
+		if tier.calendar && location != time.UTC {
+			// Local days don't start at a fixed time of day in UTC, so the task
+			// runs every hour and rolls up the last whole day in the timezone,
+			// rewriting the same rollups until the next day ends. The rollups
+			// of finer tiers only fit into local days in timezones whose offsets
+			// are whole hours.
+			program.Location(location.String())
+			source = flux.From(org.bucket).RangeBetween(
+				flux.Truncate(flux.Days(-1), flux.Days(1)),
+				flux.Truncate(flux.Now(), flux.Days(1)))
+			every, window = time.Hour, flux.Days(1)
+			measurement = append(measurement, flux.Set("timezone", flux.String(location.String())))
+			if !wholeHourOffsets(location) {
+				below = 0
+			}
+		}
+		source = source.Filter(flux.Tag("user_id", userID))
+		if below < 0 {
+			source = source.Filter(flux.Col("_measurement").NotMatches(internalMeasurements))
+		} else {
+			source = source.Filter(flux.Measurement(rollupTiers[below].measurement()))
+		}
+		data := program.Let("data", source)
+		program.Add(rollUp(&program, data, window, below < 0).
+			Map(measurement...).
+			To(org.bucket))
+
+		program.Task(rollupTaskName(userID, tier), every, tier.offset)
+		task, err := postTask(ctx, program.Inline(), nil)
+		if err != nil {
+			return tasks, err
+		}
+		tasks = append(tasks, *task)
+	}
+	return tasks, nil
+}
+
+// wholeHourOffsets reports whether the offset of a timezone from UTC is a
+// whole number of hours throughout the current year.
+func wholeHourOffsets(location *time.Location) bool {
+	year := time.Now().Year()
+	for month := time.January; month <= time.December; month++ {
+		if _, offset := time.Date(year, month, 1, 0, 0, 0, 0, location).Zone(); offset%3600 != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// rollupTaskName returns the name of the task that rolls up a user's data into
+// a tier.
+func rollupTaskName(userID string, tier rollupTier) string {
+	return fmt.Sprintf("%s_rollup_%s", userID, tier.name)
+}
+
+// queryRollups queries the rollups of a user's data in the requested windows
+// from the coarsest tier that holds them, and calls fn with the position of
+// the table and the columns of each record in the result, like queryLatest. It
+// returns the tier it read.
+//
+// The calendar tier only holds the days of the timezone a user's tasks were
+// set up in, so when it has no rollups in the requested timezone, the windows
+// are aggregated from the next tier that fits them instead.
+func queryRollups(ctx context.Context, userID string, request rollupRequest, fn func(table int, record map[string]string) error) (rollupTier, error) {
+	tiers := selectTiers(request)
+	if err := authorize(ctx, userID); err != nil {
+		return tiers[0], err
+	}
+	org := organizationOf(ctx)
+	for i, tier := range tiers {
+		var program flux.Program
+		data := program.Let("data", rollupsOf(&program, org.bucket, userID, request, tier))
+		program.Add(rollUp(&program, data, request.window.expr(), false))
+		query, params := program.Render()
+
+		result, err := cache.get(ctx, cacheEndpointPoints, userID, query, params, func() (interface{}, error) {
+			tables, err := org.queryAPI.QueryWithParams(ctx, query, params)
+			if err != nil {
+				return nil, err
+			}
+			defer tables.Close()
+			var records []latestRecord
+			for tables.Next() {
+				records = append(records, latestRecord{table: tables.TablePosition(), columns: formatRecord(tables.Record().Values())})
+			}
+			return records, tables.Err()
+		})
+		if err != nil {
+			return tier, err
+		}
+		records := result.([]latestRecord)
+		if len(records) == 0 && tier.calendar && i < len(tiers)-1 {
+			continue
+		}
+		for _, record := range records {
+			if err := fn(record.table, record.columns); err != nil {
+				return tier, err
+			}
+		}
+		return tier, nil
+	}
+	return tiers[len(tiers)-1], nil
+}
+
+// rollupsOf returns a query of the rollups of a tier of a user's data within
+// the range of a request, setting the location of the program to the timezone
+// of calendar windows. Rollups of the calendar tier are filtered to those of
+// the timezone.
+func rollupsOf(program *flux.Program, bucket, userID string, request rollupRequest, tier rollupTier) *flux.Query {
+	local := request.window.calendar() && request.location != time.UTC
+	if local {
+		program.Location(request.location.String())
+	}
+	data := flux.From(bucket).
+		RangeBetween(flux.Time(request.start), flux.Time(request.stop)).
+		Filter(flux.Measurement(tier.measurement())).
+		Filter(flux.Tag("user_id", userID))
+	if tier.calendar {
+		// Rollups of days in UTC aren't tagged with their timezone, as they
+		// weren't before there were timezones.
+		timezone := flux.Not(flux.Col("timezone").Exists())
+		if local {
+			timezone = flux.Tag("timezone", request.location.String())
+		}
+		data = data.Filter(timezone)
+	}
+	return data
+}
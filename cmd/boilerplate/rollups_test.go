@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mustLoadLocation loads the location of an IANA timezone.
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
+
+func TestCalendarWindowsOnDaysTheClocksChange(t *testing.T) {
+	for _, test := range []struct {
+		timezone string
+		// at is a time within the local day, and start the local midnight
+		// starting it, in UTC.
+		at, start string
+		length    time.Duration
+	}{
+		// The clocks spring forward at 2am, so the day lasts 23 hours...
+		{"America/New_York", "2022-03-13T12:00:00Z", "2022-03-13T05:00:00Z", 23 * time.Hour},
+		// ...and fall back at 2am, so it lasts 25 hours.
+		{"America/New_York", "2022-11-06T12:00:00Z", "2022-11-06T04:00:00Z", 25 * time.Hour},
+		// Its 25th hour is still part of it.
+		{"America/New_York", "2022-11-07T04:30:00Z", "2022-11-06T04:00:00Z", 25 * time.Hour},
+		{"America/New_York", "2022-11-07T05:00:00Z", "2022-11-07T05:00:00Z", 24 * time.Hour},
+		// India has no daylight saving time, and is offset by half an hour.
+		{"Asia/Kolkata", "2022-03-13T12:00:00Z", "2022-03-12T18:30:00Z", 24 * time.Hour},
+		{"UTC", "2022-03-13T12:00:00Z", "2022-03-13T00:00:00Z", 24 * time.Hour},
+	} {
+		location := mustLoadLocation(t, test.timezone)
+		at, _ := time.Parse(time.RFC3339, test.at)
+		window := rollupWindow{days: 1}
+		start := window.truncate(at, location)
+		if got := start.Format(time.RFC3339); got != test.start {
+			t.Errorf("%s: the day of %s starts at %s, want %s", test.timezone, test.at, got, test.start)
+		}
+		if got := window.next(start, location).Sub(start); got != test.length {
+			t.Errorf("%s: the day of %s lasts %v, want %v", test.timezone, test.at, got, test.length)
+		}
+	}
+
+	// A month holding a day the clocks change is an hour shorter or longer.
+	newYork := mustLoadLocation(t, "America/New_York")
+	march := time.Date(2022, 3, 1, 5, 0, 0, 0, time.UTC)
+	if got := (rollupWindow{months: 1}).next(march, newYork).Sub(march); got != 31*24*time.Hour-time.Hour {
+		t.Errorf("March 2022 lasts %v in New York, want 743h", got)
+	}
+}
+
+func TestParseRollupRequestWidensToLocalDays(t *testing.T) {
+	request, err := parseRollupRequest("2022-03-13T12:00:00Z", "2022-03-14T12:00:00Z", "", "America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := request.start.Format(time.RFC3339), "2022-03-13T05:00:00Z"; got != want {
+		t.Errorf("got start %s, want %s", got, want)
+	}
+	if got, want := request.stop.Format(time.RFC3339), "2022-03-15T04:00:00Z"; got != want {
+		t.Errorf("got stop %s, want %s", got, want)
+	}
+	if request.window.String() != "1d" {
+		t.Errorf("got window %s, want 1d", request.window)
+	}
+}
+
+func TestCalendarTaskInTimezone(t *testing.T) {
+	for _, test := range []struct {
+		timezone string
+		// source is the measurement the calendar tier is rolled up from.
+		source string
+	}{
+		{"America/New_York", "rollup_1h"},
+		// The hours of timezones offset by half an hour don't fit into their
+		// days, so their days are rolled up from minutes.
+		{"Asia/Kolkata", "rollup_1m"},
+	} {
+		app := newTestApp(t)
+		resp, body := app.do(t, http.MethodPost, "/users/user1/tasks?timezone="+test.timezone, "key1", "")
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+			t.Fatalf("%s: got status %d (%s), want the tasks", test.timezone, resp.StatusCode, body)
+		}
+
+		calendar := rollupTiers[len(rollupTiers)-1]
+		var script string
+		for _, task := range app.influx.Tasks() {
+			if task.Name == rollupTaskName("user1", calendar) {
+				script = task.Flux
+				// Local days don't start at a fixed time of day in UTC, so the
+				// task runs every hour.
+				if task.Every == nil || *task.Every != "1h" || task.Offset == nil || *task.Offset != "5m" {
+					t.Errorf("%s: the task runs every %v offset %v, want every 1h offset 5m", test.timezone, task.Every, task.Offset)
+				}
+			}
+		}
+		// Flux requires the imports to come before the options.
+		header := "import \"date\"\nimport \"timezone\"\n\noption location = timezone.location(name: \"" + test.timezone + "\")\n" +
+			"option task = {name: \"user1_rollup_1d\", every: 1h, offset: 5m}\n\n"
+		if !strings.HasPrefix(script, header) {
+			t.Errorf("%s: got script\n%s\nwant it to start with\n%s", test.timezone, script, header)
+		}
+		for _, want := range []string{
+			"range(start: date.truncate(t: -1d, unit: 1d), stop: date.truncate(t: now(), unit: 1d))",
+			`r._measurement == "` + test.source + `"`,
+			`timezone: "` + test.timezone + `"`,
+		} {
+			if !strings.Contains(script, want) {
+				t.Errorf("%s: the script doesn't contain %s:\n%s", test.timezone, want, script)
+			}
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// router routes requests to handlers by method and path. Paths are matched
+// against patterns segment by segment, where a segment in braces, such as
+// {user_id} in /users/{user_id}/points, matches any value and makes it
+// available to the handler with param.
+//
+// When several patterns match a path, the one with a literal segment where the
+// others have a parameter earliest in the path wins, so /admin/schema/draft
+// takes precedence over /admin/schema/{measurement}. Requests that match a
+// pattern but not any of its methods get a 405 http.StatusMethodNotAllowed
+// listing the allowed methods in the Allow header, and requests that match no
+// pattern get a 404 http.StatusNotFound.
+type router struct {
+	routes []*route
+}
+
+// route holds the handlers registered for a pattern by method.
+type route struct {
+	segments []string
+	handlers map[string]http.HandlerFunc
+}
+
+// routeGroup registers routes under a common path prefix, wrapping each of
+// their handlers with the same middleware.
+type routeGroup struct {
+	router     *router
+	prefix     string
+	middleware middleware
+}
+
+// handle registers the handler for requests with the method and a path
+// matching the pattern.
+func (rt *router) handle(method, pattern string, handler http.HandlerFunc) {
+	segments := splitPath(pattern)
+	for _, route := range rt.routes {
+		if equalSegments(route.segments, segments) {
+			route.handlers[method] = handler
+			return
+		}
+	}
+	rt.routes = append(rt.routes, &route{segments: segments, handlers: map[string]http.HandlerFunc{method: handler}})
+}
+
+// group returns a group of routes under prefix whose handlers are wrapped with
+// the middlewares, applied in the order given like chain.
+func (rt *router) group(prefix string, middlewares ...middleware) *routeGroup {
+	return &routeGroup{router: rt, prefix: prefix, middleware: chain(middlewares...)}
+}
+
+// handle registers the handler, wrapped with the middleware of the group, for
+// requests with the method and a path matching the prefix of the group
+// followed by pattern.
+func (g *routeGroup) handle(method, pattern string, handler http.HandlerFunc) {
+	g.router.handle(method, g.prefix+pattern, g.middleware(handler))
+}
+
+// ServeHTTP routes the request to the handler registered for its method and
+// the most specific pattern matching its path.
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := splitPath(r.URL.Path)
+	var best *route
+	for _, route := range rt.routes {
+		if route.matches(segments) && (best == nil || route.moreSpecific(best)) {
+			best = route
+		}
+	}
+	if best == nil {
+		handleError(w, errRouteNotFound)
+		return
+	}
+	handler, ok := best.handlers[r.Method]
+	if !ok {
+		allowed := make([]string, 0, len(best.handlers))
+		for method := range best.handlers {
+			allowed = append(allowed, method)
+		}
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+
+	params := make(map[string]string)
+	for i, segment := range best.segments {
+		if name, ok := paramName(segment); ok {
+			params[name] = segments[i]
+		}
+	}
+	handler(w, r.WithContext(context.WithValue(r.Context(), pathParamsKey{}, params)))
+}
+
+// matches reports whether a path split into segments matches the pattern of the route.
+func (rt *route) matches(segments []string) bool {
+	if len(segments) != len(rt.segments) {
+		return false
+	}
+	for i, segment := range rt.segments {
+		if _, ok := paramName(segment); ok {
+			if segments[i] == "" {
+				return false
+			}
+		} else if segment != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// moreSpecific reports whether the pattern of the route has a literal segment
+// where the pattern of other has a parameter, before the reverse is true.
+func (rt *route) moreSpecific(other *route) bool {
+	for i, segment := range rt.segments {
+		_, param := paramName(segment)
+		_, otherParam := paramName(other.segments[i])
+		if param != otherParam {
+			return otherParam
+		}
+	}
+	return false
+}
+
+// pathParamsKey is the context key of the path parameters of a request.
+type pathParamsKey struct{}
+
+// param returns the value of the path parameter with the given name, falling
+// back to the query parameter of the same name. This lets handlers serve both
+// resource routes such as /users/{user_id}/alerts and the flat routes they
+// replace, such as /alerts?user_id=user1, which are kept as aliases.
+func param(r *http.Request, name string) string {
+	if params, ok := r.Context().Value(pathParamsKey{}).(map[string]string); ok {
+		if value, ok := params[name]; ok {
+			return value
+		}
+	}
+	return r.URL.Query().Get(name)
+}
+
+// bindUserID reconciles the user ID in the body of a request with the one in
+// its path, if any, so that handlers serve both /users/{user_id}/... routes and
+// flat routes that take the user ID in the body. It returns an error if the
+// two differ.
+func bindUserID(r *http.Request, userID *string) error {
+	params, _ := r.Context().Value(pathParamsKey{}).(map[string]string)
+	pathUserID, ok := params["user_id"]
+	if !ok {
+		return nil
+	}
+	if *userID != "" && *userID != pathUserID {
+		return invalidRequest("user_id %q in the body does not match %q in the path", *userID, pathUserID)
+	}
+	*userID = pathUserID
+	return nil
+}
+
+// splitPath splits a path into its segments, ignoring a trailing slash.
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// paramName returns the name of the parameter a pattern segment captures, if any.
+func paramName(segment string) (string, bool) {
+	if len(segment) > 2 && strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+		return segment[1 : len(segment)-1], true
+	}
+	return "", false
+}
+
+func equalSegments(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// savedQueriesDir is the directory saved queries are loaded from, and is read
+// from the BOILERPLATE_QUERIES_DIR environment variable. It defaults to
+// "queries", which holds a couple of examples.
+var savedQueriesDir = os.Getenv("BOILERPLATE_QUERIES_DIR")
+
+// savedQueries holds the saved queries by name.
+var savedQueries map[string]*savedQuery
+
+// errSavedQueryNotFound is returned when there is no saved query with the requested name.
+var errSavedQueryNotFound = errors.New("saved query not found")
+
+// savedQuery is a named Flux query with declared, typed parameters, so that
+// the queries your team needs are kept in one place rather than copied around.
+//
+// Each saved query is loaded from a .flux file named after it, which starts
+// with YAML front matter between lines of three dashes describing the query
+// and its parameters:
+//
+//	---
+//	description: The mean of a field of a user's data in windows.
+//	params:
+//	  user_id:
+//	    type: string
+//	    required: true
+//	  every:
+//	    type: duration
+//	    default: 1h
+//	---
+//	from(bucket: params.bucket_name)
+//	    |> range(start: -24h)
+//	    |> filter(fn: (r) => r.user_id == params.user_id)
+//	    |> aggregateWindow(every: duration(v: params.every), fn: mean)
+//
+// Every saved query must declare a user_id parameter and filter on it, as it
+// is run on behalf of the user it identifies. The bucket_name parameter is
+// always set to the bucket of the organization the query is run against.
+type savedQuery struct {
+	Name        string                     `json:"name"`
+	Description string                     `json:"description,omitempty" yaml:"description"`
+	Params      map[string]savedQueryParam `json:"params" yaml:"params"`
+	flux        string
+}
+
+// savedQueryParam declares a parameter of a saved query.
+type savedQueryParam struct {
+	// Type is one of the savedQueryParamTypes.
+	Type        string `json:"type" yaml:"type"`
+	Description string `json:"description,omitempty" yaml:"description"`
+	Required    bool   `json:"required" yaml:"required"`
+	// Default is the value of an optional parameter that isn't passed.
+	Default string `json:"default,omitempty" yaml:"default"`
+}
+
+// savedQueryParamTypes describes the types of the parameters of saved queries,
+// and how their values are passed to Flux.
+var savedQueryParamTypes = map[string]string{
+	"string":   "a string",
+	"int":      "an integer",
+	"float":    "a float",
+	"bool":     "a boolean, true or false",
+	"duration": "a Flux duration such as 1h30m, passed as a string to convert with duration(v:)",
+	"time":     "an RFC 3339 timestamp, or a negative duration relative to now such as -24h, passed as a string to convert with time(v:)",
+}
+
+var (
+	// savedQueryNamePattern matches the names of saved queries.
+	savedQueryNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+	// savedQueryParamPattern matches the names of the parameters of saved queries.
+	savedQueryParamPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+)
+
+// loadSavedQueries loads the saved queries in the .flux files of a directory.
+// A missing directory holds no queries.
+func loadSavedQueries(dir string) (map[string]*savedQuery, error) {
+	queries := make(map[string]*savedQuery)
+	paths, err := filepath.Glob(filepath.Join(dir, "*.flux"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		query, err := loadSavedQuery(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		queries[query.Name] = query
+	}
+	return queries, nil
+}
+
+// loadSavedQuery loads and checks the saved query in a .flux file.
+func loadSavedQuery(path string) (*savedQuery, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	if !bytes.HasPrefix(data, []byte("---\n")) {
+		return nil, errors.New("missing front matter")
+	}
+	end := bytes.Index(data[4:], []byte("\n---\n"))
+	if end < 0 {
+		return nil, errors.New("unterminated front matter")
+	}
+	query := &savedQuery{Name: strings.TrimSuffix(filepath.Base(path), ".flux")}
+	if err := yaml.UnmarshalStrict(data[4:4+end+1], query); err != nil {
+		return nil, fmt.Errorf("invalid front matter: %v", err)
+	}
+	query.flux = strings.TrimSpace(string(data[4+end+5:]))
+
+	if !savedQueryNamePattern.MatchString(query.Name) {
+		return nil, fmt.Errorf("invalid name %q: must be lower case letters, digits, underscores and dashes", query.Name)
+	}
+	if query.flux == "" {
+		return nil, errors.New("empty query")
+	}
+	if query.Params == nil {
+		query.Params = make(map[string]savedQueryParam)
+	}
+	for name, param := range query.Params {
+		if !savedQueryParamPattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid parameter name %q", name)
+		}
+		if name == "bucket_name" {
+			return nil, errors.New("bucket_name is set by the application and can't be declared")
+		}
+		if _, ok := savedQueryParamTypes[param.Type]; !ok {
+			return nil, fmt.Errorf("parameter %s has unknown type %q", name, param.Type)
+		}
+		if param.Default != "" {
+			if param.Required {
+				return nil, fmt.Errorf("required parameter %s can't have a default", name)
+			}
+			if _, err := param.parse(param.Default); err != nil {
+				return nil, fmt.Errorf("invalid default of parameter %s: %v", name, err)
+			}
+		}
+	}
+	if param, ok := query.Params["user_id"]; !ok || param.Type != "string" || !param.Required {
+		return nil, errors.New("must declare a required user_id parameter of type string")
+	}
+	return query, nil
+}
+
+// parse converts the value of a parameter passed in a request into the value
+// passed to QueryWithParams.
+func (p savedQueryParam) parse(value string) (interface{}, error) {
+	var parsed interface{}
+	var err error
+	switch p.Type {
+	case "int":
+		parsed, err = strconv.ParseInt(value, 10, 64)
+	case "float":
+		parsed, err = strconv.ParseFloat(value, 64)
+	case "bool":
+		parsed, err = strconv.ParseBool(value)
+	case "duration":
+		if !fluxDurationPattern.MatchString(value) {
+			return nil, fmt.Errorf("invalid duration %q", value)
+		}
+		parsed = value
+	case "time":
+		t, err := parseQueryTime(value, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("invalid time: %v", err)
+		}
+		return t.Format(time.RFC3339Nano), nil
+	default:
+		return value, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q", p.Type, value)
+	}
+	return parsed, nil
+}
+
+// bind checks the values of the parameters of a request against those the
+// query declares, and returns the parameters to run the query with, along with
+// their values as passed or defaulted.
+func (q *savedQuery) bind(values url.Values) (map[string]interface{}, map[string]string, error) {
+	for name := range values {
+		if _, ok := q.Params[name]; !ok {
+			return nil, nil, invalidRequest("unknown parameter %q", name)
+		}
+	}
+	params := make(map[string]interface{}, len(q.Params)+1)
+	passed := make(map[string]string, len(q.Params)+1)
+	for name, param := range q.Params {
+		value := values.Get(name)
+		if value == "" {
+			if param.Required {
+				return nil, nil, invalidRequest("missing required parameter %q", name)
+			}
+			if param.Default == "" {
+				continue
+			}
+			value = param.Default
+		}
+		parsed, err := param.parse(value)
+		if err != nil {
+			return nil, nil, invalidRequest("invalid parameter %q: %v", name, err)
+		}
+		params[name] = parsed
+		passed[name] = value
+	}
+	return params, passed, nil
+}
+
+// listSavedQueries lists the saved queries with the schema of their
+// parameters, sorted by name.
+//
+// GET /queries to test this endpoint.
+func listSavedQueries(w http.ResponseWriter, r *http.Request) {
+	queries := make([]*savedQuery, 0, len(savedQueries))
+	for _, query := range savedQueries {
+		queries = append(queries, query)
+	}
+	sort.Slice(queries, func(i, j int) bool { return queries[i].Name < queries[j].Name })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Queries    []*savedQuery     `json:"queries"`
+		ParamTypes map[string]string `json:"param_types"`
+	}{queries, savedQueryParamTypes})
+}
+
+// runSavedQuery runs a saved query with the parameters in the query string,
+// on behalf of the user identified by its user_id parameter, and returns the
+// records of each table of the result. Results are cached like those of /query.
+//
+// GET /queries/mean_by_window?user_id=user1&measurement=measurement1 to test
+// this endpoint.
+func runSavedQuery(w http.ResponseWriter, r *http.Request) {
+	query, ok := savedQueries[param(r, "name")]
+	if !ok {
+		handleError(w, errSavedQueryNotFound)
+		return
+	}
+	params, passed, err := query.bind(r.URL.Query())
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	userID := passed["user_id"]
+	if err := authorize(r.Context(), userID); err != nil {
+		handleError(w, err)
+		return
+	}
+	org := organizationOf(r.Context())
+	params["bucket_name"] = org.bucket
+	passed["bucket_name"] = org.bucket
+
+	// Results are cached by the parameters as passed rather than as run, so that
+	// repeating a query with a relative time such as -24h hits the cache.
+	result, err := cache.get(r.Context(), cacheEndpointQueries, userID, query.flux, passed, func() (interface{}, error) {
+		tables, err := org.queryAPI.QueryWithParams(r.Context(), query.flux, params)
+		if err != nil {
+			return nil, err
+		}
+		defer tables.Close()
+		type Table struct {
+			Records []map[string]interface{} `json:"records"`
+		}
+		response := struct {
+			Tables []Table `json:"tables"`
+		}{Tables: []Table{}}
+		for tables.Next() {
+			if tables.TableChanged() || len(response.Tables) == 0 {
+				response.Tables = append(response.Tables, Table{})
+			}
+			last := &response.Tables[len(response.Tables)-1]
+			last.Records = append(last.Records, tables.Record().Values())
+		}
+		if err := tables.Err(); err != nil {
+			return nil, err
+		}
+		return json.Marshal(response)
+	})
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result.([]byte))
+}
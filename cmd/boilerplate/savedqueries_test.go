@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadSavedQuery(t *testing.T) {
+	const query = "from(bucket: params.bucket_name) |> range(start: -1h) |> filter(fn: (r) => r.user_id == params.user_id)"
+	const userID = "  user_id:\n    type: string\n    required: true\n"
+	for _, test := range []struct {
+		name, file, err string
+	}{
+		{"valid", "---\nparams:\n" + userID + "---\n" + query, ""},
+		{"valid with CRLF line endings", strings.ReplaceAll("---\ndescription: d\nparams:\n"+userID+"---\n"+query, "\n", "\r\n"), ""},
+		{"no front matter", query, "missing front matter"},
+		{"unterminated front matter", "---\nparams:\n" + userID + query, "unterminated front matter"},
+		{"unknown front matter", "---\ntitle: t\nparams:\n" + userID + "---\n" + query, "invalid front matter"},
+		{"empty query", "---\nparams:\n" + userID + "---\n", "empty query"},
+		{"no user_id", "---\nparams:\n  field:\n    type: string\n---\n" + query, "must declare a required user_id"},
+		{"optional user_id", "---\nparams:\n  user_id:\n    type: string\n---\n" + query, "must declare a required user_id"},
+		{"unknown type", "---\nparams:\n" + userID + "  every:\n    type: interval\n---\n" + query, `unknown type "interval"`},
+		{"invalid name", "---\nparams:\n" + userID + "  Every:\n    type: duration\n---\n" + query, `invalid parameter name "Every"`},
+		{"bucket_name", "---\nparams:\n" + userID + "  bucket_name:\n    type: string\n---\n" + query, "bucket_name is set by the application"},
+		{"invalid default", "---\nparams:\n" + userID + "  every:\n    type: duration\n    default: hourly\n---\n" + query, "invalid default of parameter every"},
+		{"required with default", "---\nparams:\n" + userID + "  limit:\n    type: int\n    required: true\n    default: 10\n---\n" + query, "can't have a default"},
+	} {
+		path := filepath.Join(t.TempDir(), "my-query.flux")
+		if err := os.WriteFile(path, []byte(test.file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := loadSavedQuery(path)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: got error %v", test.name, err)
+			} else if loaded.Name != "my-query" || loaded.flux != query {
+				t.Errorf("%s: got query %q named %q", test.name, loaded.flux, loaded.Name)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestBindSavedQueryParams(t *testing.T) {
+	query := &savedQuery{Params: map[string]savedQueryParam{
+		"user_id":   {Type: "string", Required: true},
+		"threshold": {Type: "float", Required: true},
+		"limit":     {Type: "int", Default: "10"},
+		"raw":       {Type: "bool"},
+		"every":     {Type: "duration", Default: "1h"},
+		"start":     {Type: "time", Default: "-1h"},
+	}}
+
+	params, passed, err := query.bind(url.Values{"user_id": {"user1"}, "threshold": {"2.5"}, "start": {"2022-01-01T00:00:00Z"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Values are passed to Flux typed, and optional parameters without a
+	// default are left out.
+	if params["user_id"] != "user1" || params["threshold"] != 2.5 || params["limit"] != int64(10) ||
+		params["every"] != "1h" || params["start"] != "2022-01-01T00:00:00Z" {
+		t.Errorf("got params %#v", params)
+	}
+	if _, ok := params["raw"]; ok {
+		t.Errorf("got raw %v, want it left out", params["raw"])
+	}
+	if passed["limit"] != "10" || passed["threshold"] != "2.5" {
+		t.Errorf("got passed values %v, want the defaults and values as passed", passed)
+	}
+
+	for _, test := range []struct {
+		values url.Values
+		err    string
+	}{
+		{url.Values{"threshold": {"1"}}, `missing required parameter "user_id"`},
+		{url.Values{"user_id": {"user1"}, "threshold": {"high"}}, `invalid parameter "threshold"`},
+		{url.Values{"user_id": {"user1"}, "threshold": {"1"}, "limit": {"1.5"}}, `invalid parameter "limit"`},
+		{url.Values{"user_id": {"user1"}, "threshold": {"1"}, "raw": {"maybe"}}, `invalid parameter "raw"`},
+		{url.Values{"user_id": {"user1"}, "threshold": {"1"}, "every": {"hourly"}}, `invalid parameter "every"`},
+		{url.Values{"user_id": {"user1"}, "threshold": {"1"}, "start": {"yesterday"}}, `invalid parameter "start"`},
+		{url.Values{"user_id": {"user1"}, "threshold": {"1"}, "bucket_name": {"other"}}, `unknown parameter "bucket_name"`},
+	} {
+		if _, _, err := query.bind(test.values); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("binding %v: got error %v, want %q", test.values, err, test.err)
+		}
+	}
+}
+
+func TestSavedQueryEndpoints(t *testing.T) {
+	app := newTestApp(t)
+	now := time.Now().Truncate(time.Second)
+	writeRollups(t, app,
+		"measurement1,user_id=user1 field1=1.5 "+formatNanos(now.Add(-time.Minute)),
+		"measurement1,user_id=user2 field1=9 "+formatNanos(now.Add(-time.Minute)),
+		"measurement2,user_id=user1 field1=7 "+formatNanos(now.Add(-time.Minute)))
+
+	// The listing describes the parameters of each query and their types.
+	resp, body := app.do(t, http.MethodGet, "/queries", "key1", "")
+	var listed struct {
+		Queries    []savedQuery      `json:"queries"`
+		ParamTypes map[string]string `json:"param_types"`
+	}
+	if err := json.Unmarshal([]byte(body), &listed); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d (%s) listing saved queries, want 200", resp.StatusCode, body)
+	}
+	if len(listed.Queries) != 2 || listed.Queries[0].Name != "above_threshold" || listed.Queries[1].Name != "mean_by_window" {
+		t.Fatalf("got queries %+v, want above_threshold and mean_by_window", listed.Queries)
+	}
+	if param := listed.Queries[0].Params["threshold"]; param.Type != "float" || !param.Required {
+		t.Errorf("got threshold %+v, want a required float", param)
+	}
+	if param := listed.Queries[1].Params["every"]; param.Type != "duration" || param.Required || param.Default != "1h" {
+		t.Errorf("got every %+v, want a duration defaulting to 1h", param)
+	}
+	if len(listed.ParamTypes) != len(savedQueryParamTypes) {
+		t.Errorf("got parameter types %v, want %d", listed.ParamTypes, len(savedQueryParamTypes))
+	}
+
+	resp, body = app.do(t, http.MethodGet, "/queries/above_threshold?user_id=user1&measurement=measurement1&threshold=1", "key1", "")
+	var response struct {
+		Tables []struct {
+			Records []map[string]interface{} `json:"records"`
+		} `json:"tables"`
+	}
+	if err := json.Unmarshal([]byte(body), &response); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d (%s) running a saved query, want 200", resp.StatusCode, body)
+	}
+	if len(response.Tables) != 1 || len(response.Tables[0].Records) != 1 ||
+		response.Tables[0].Records[0]["user_id"] != "user1" || response.Tables[0].Records[0]["_value"] != 1.5 {
+		t.Errorf("got %s, want the point of measurement1 of user1", body)
+	}
+
+	for _, test := range []struct {
+		path, key string
+		status    int
+		code      string
+	}{
+		{"/queries/above_threshold?user_id=user1&measurement=measurement1", "key1", http.StatusBadRequest, errorCodeInvalidRequest},
+		{"/queries/above_threshold?user_id=user1&measurement=measurement1&threshold=high", "key1", http.StatusBadRequest, errorCodeInvalidRequest},
+		{"/queries/above_threshold?user_id=user1&measurement=measurement1&threshold=1&limit=1", "key1", http.StatusBadRequest, errorCodeInvalidRequest},
+		{"/queries/above_threshold?user_id=user1&measurement=measurement1&threshold=1", "key2", http.StatusForbidden, errorCodeForbidden},
+		{"/queries/below_threshold?user_id=user1", "key1", http.StatusNotFound, errorCodeNotFound},
+	} {
+		resp, body := app.do(t, http.MethodGet, test.path, test.key, "")
+		if resp.StatusCode != test.status || errorCode(t, body) != test.code {
+			t.Errorf("GET %s with %s: got status %d (%s), want %d with code %s", test.path, test.key, resp.StatusCode, body, test.status, test.code)
+		}
+	}
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/go-snippets/internal/flux"
+)
+
+// The types a field can be declared with, named as in Flux.
+const (
+	fieldTypeFloat    = "float"
+	fieldTypeInteger  = "integer"
+	fieldTypeUInteger = "uinteger"
+	fieldTypeString   = "string"
+	fieldTypeBoolean  = "boolean"
+)
+
+// fieldSchema declares a field of a measurement.
+type fieldSchema struct {
+	Name string `json:"name"`
+	// Type is one of float, integer, uinteger, string or boolean.
+	Type string `json:"type"`
+	// Unit documents the unit of the field's values, e.g. "°C".
+	Unit string `json:"unit,omitempty"`
+	// Min and Max bound the values of numeric fields, when set.
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+}
+
+// measurementSchema declares a measurement along with the tags and fields its
+// points may have.
+type measurementSchema struct {
+	Name   string        `json:"name"`
+	Tags   []string      `json:"tags"`
+	Fields []fieldSchema `json:"fields"`
+}
+
+// schemaDocument is the JSON representation of the schema registry, in files
+// and in the admin API.
+type schemaDocument struct {
+	Measurements []measurementSchema `json:"measurements"`
+}
+
+// schemaViolation describes why a point does not match the schema registry.
+type schemaViolation struct {
+	Measurement string
+	// Tag or Field names the part of the point at fault, if any.
+	Tag, Field string
+	Reason     string
+}
+
+func (v *schemaViolation) Error() string {
+	message := fmt.Sprintf("measurement %q", v.Measurement)
+	if v.Tag != "" {
+		message += fmt.Sprintf(": tag %q", v.Tag)
+	}
+	if v.Field != "" {
+		message += fmt.Sprintf(": field %q", v.Field)
+	}
+	return message + ": " + v.Reason
+}
+
+// errMeasurementNotFound is returned when there is no measurement with the
+// requested name in the schema registry.
+var errMeasurementNotFound = errors.New("measurement not found in the schema registry")
+
+// schemaRegistry declares the measurements that may be written, the tags they
+// may have, and the types and ranges of their fields, so that points which
+// would cause field type conflicts in InfluxDB are rejected at ingest instead.
+//
+// The registry is loaded from a JSON file, and changes made through the admin
+// API are saved back to it. While no measurement is declared every point is
+// accepted; once one is, points of undeclared measurements are rejected.
+type schemaRegistry struct {
+	path string
+
+	mu           sync.RWMutex
+	measurements map[string]measurementSchema
+}
+
+// schemas is the schema registry ingested points are validated against.
+var schemas *schemaRegistry
+
+// openSchemaRegistry loads the schema registry from the JSON file at path, if
+// it exists. When path is empty, the registry is only kept in memory.
+func openSchemaRegistry(path string) (*schemaRegistry, error) {
+	registry := &schemaRegistry{path: path, measurements: make(map[string]measurementSchema)}
+	if path == "" {
+		return registry, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return registry, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var document schemaDocument
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	for _, measurement := range document.Measurements {
+		if err := validateMeasurementSchema(measurement); err != nil {
+			return nil, err
+		}
+		if measurement.Tags == nil {
+			measurement.Tags = []string{}
+		}
+		registry.measurements[measurement.Name] = measurement
+	}
+	return registry, nil
+}
+
+// fieldTypes are the types a field can be declared with.
+var fieldTypes = map[string]bool{
+	fieldTypeFloat:    true,
+	fieldTypeInteger:  true,
+	fieldTypeUInteger: true,
+	fieldTypeString:   true,
+	fieldTypeBoolean:  true,
+}
+
+// validateMeasurementSchema checks that a measurement declaration is complete
+// and consistent.
+func validateMeasurementSchema(measurement measurementSchema) error {
+	if measurement.Name == "" {
+		return errors.New("measurement name is required")
+	}
+	if len(measurement.Fields) == 0 {
+		return fmt.Errorf("measurement %q must declare at least one field", measurement.Name)
+	}
+	seen := make(map[string]bool)
+	for _, field := range measurement.Fields {
+		switch {
+		case field.Name == "":
+			return fmt.Errorf("measurement %q: field name is required", measurement.Name)
+		case seen[field.Name]:
+			return fmt.Errorf("measurement %q: field %q is declared twice", measurement.Name, field.Name)
+		case !fieldTypes[field.Type]:
+			return fmt.Errorf("measurement %q: field %q has unknown type %q, expected float, integer, uinteger, string or boolean",
+				measurement.Name, field.Name, field.Type)
+		case (field.Min != nil || field.Max != nil) && !numericFieldType(field.Type):
+			return fmt.Errorf("measurement %q: field %q of type %s cannot have a range", measurement.Name, field.Name, field.Type)
+		case field.Min != nil && field.Max != nil && *field.Min > *field.Max:
+			return fmt.Errorf("measurement %q: field %q has a min greater than its max", measurement.Name, field.Name)
+		}
+		seen[field.Name] = true
+	}
+	return nil
+}
+
+func numericFieldType(fieldType string) bool {
+	return fieldType == fieldTypeFloat || fieldType == fieldTypeInteger || fieldType == fieldTypeUInteger
+}
+
+// list returns the declared measurements, sorted by name.
+func (s *schemaRegistry) list() []measurementSchema {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	measurements := make([]measurementSchema, 0, len(s.measurements))
+	for _, measurement := range s.measurements {
+		measurements = append(measurements, measurement)
+	}
+	sort.Slice(measurements, func(i, j int) bool { return measurements[i].Name < measurements[j].Name })
+	return measurements
+}
+
+// define declares a measurement, replacing any previous declaration of it.
+func (s *schemaRegistry) define(measurement measurementSchema) error {
+	if err := validateMeasurementSchema(measurement); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, existed := s.measurements[measurement.Name]
+	s.measurements[measurement.Name] = measurement
+	if err := s.save(); err != nil {
+		if existed {
+			s.measurements[measurement.Name] = previous
+		} else {
+			delete(s.measurements, measurement.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+// remove deletes the declaration of a measurement.
+func (s *schemaRegistry) remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, ok := s.measurements[name]
+	if !ok {
+		return errMeasurementNotFound
+	}
+	delete(s.measurements, name)
+	if err := s.save(); err != nil {
+		s.measurements[name] = previous
+		return err
+	}
+	return nil
+}
+
+// save writes the registry to its file, if it has one. The caller must hold s.mu.
+func (s *schemaRegistry) save() error {
+	if s.path == "" {
+		return nil
+	}
+	document := schemaDocument{Measurements: make([]measurementSchema, 0, len(s.measurements))}
+	for _, measurement := range s.measurements {
+		document.Measurements = append(document.Measurements, measurement)
+	}
+	sort.Slice(document.Measurements, func(i, j int) bool {
+		return document.Measurements[i].Name < document.Measurements[j].Name
+	})
+	data, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.path+".tmp", append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(s.path+".tmp", s.path)
+}
+
+// validate checks a point against the registry, returning a *schemaViolation
+// describing the first problem found. The user_id tag is always allowed, as
+// this application tags every point with it.
+func (s *schemaRegistry) validate(measurement string, tags map[string]string, fields map[string]interface{}) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.measurements) == 0 {
+		return nil
+	}
+	declared, ok := s.measurements[measurement]
+	if !ok {
+		return &schemaViolation{Measurement: measurement, Reason: "measurement is not declared in the schema registry"}
+	}
+
+	for _, tag := range sortedKeys(tags) {
+		if tag != "user_id" && !containsString(declared.Tags, tag) {
+			return &schemaViolation{Measurement: measurement, Tag: tag, Reason: "tag is not declared"}
+		}
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var field *fieldSchema
+		for i := range declared.Fields {
+			if declared.Fields[i].Name == name {
+				field = &declared.Fields[i]
+			}
+		}
+		if field == nil {
+			return &schemaViolation{Measurement: measurement, Field: name, Reason: "field is not declared"}
+		}
+		if err := field.check(fields[name]); err != "" {
+			return &schemaViolation{Measurement: measurement, Field: name, Reason: err}
+		}
+	}
+	return nil
+}
+
+// check returns why a value does not match the field's declaration, or an
+// empty string if it does.
+func (f *fieldSchema) check(value interface{}) string {
+	var number float64
+	valueType := ""
+	switch value := value.(type) {
+	case float32:
+		valueType, number = fieldTypeFloat, float64(value)
+	case float64:
+		valueType, number = fieldTypeFloat, value
+	case int:
+		valueType, number = fieldTypeInteger, float64(value)
+	case int64:
+		valueType, number = fieldTypeInteger, float64(value)
+	case uint64:
+		valueType, number = fieldTypeUInteger, float64(value)
+	case string:
+		valueType = fieldTypeString
+	case bool:
+		valueType = fieldTypeBoolean
+	}
+	if valueType != f.Type {
+		return fmt.Sprintf("value %v is of type %s, expected %s", value, valueType, f.Type)
+	}
+	unit := ""
+	if f.Unit != "" {
+		unit = " " + f.Unit
+	}
+	if f.Min != nil && number < *f.Min {
+		return fmt.Sprintf("value %v is below the minimum of %v%s", value, *f.Min, unit)
+	}
+	if f.Max != nil && number > *f.Max {
+		return fmt.Sprintf("value %v is above the maximum of %v%s", value, *f.Max, unit)
+	}
+	return ""
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// deriveSchema drafts a schema from the data written to the bucket of the
+// organization a request is served from within the last 30 days, using the
+// functions of Flux's schema package to find the measurements, tag keys and
+// field keys, and the latest value of each field to find its type. The
+// measurements the application keeps for itself are left out. Ranges and
+// units cannot be derived, so review the draft and add them before defining it.
+func deriveSchema(ctx context.Context) ([]measurementSchema, error) {
+	org := organizationOf(ctx)
+	params := map[string]string{"bucket_name": org.bucket}
+	names, err := queryStrings(ctx, `import "influxdata/influxdb/schema"
+
+schema.measurements(bucket: params.bucket_name)`, params)
+	if err != nil {
+		return nil, err
+	}
+
+	var draft []measurementSchema
+	for _, name := range names {
+		if isInternalMeasurement(name) {
+			continue
+		}
+		params := map[string]string{"bucket_name": org.bucket, "measurement": name}
+		tags, err := queryStrings(ctx, `import "influxdata/influxdb/schema"
+
+schema.measurementTagKeys(bucket: params.bucket_name, measurement: params.measurement)`, params)
+		if err != nil {
+			return nil, err
+		}
+		fields, err := queryStrings(ctx, `import "influxdata/influxdb/schema"
+
+schema.measurementFieldKeys(bucket: params.bucket_name, measurement: params.measurement)`, params)
+		if err != nil {
+			return nil, err
+		}
+
+		// The schema package doesn't report the types of fields, so read the
+		// latest value of each field of each series instead.
+		types := make(map[string]string)
+		query, params := flux.From(org.bucket).
+			Range(flux.Duration(-30 * 24 * time.Hour)).
+			Filter(flux.Measurement(name)).
+			Aggregate(flux.Last).
+			Render()
+		tables, err := org.queryAPI.QueryWithParams(ctx, query, params)
+		if err != nil {
+			return nil, err
+		}
+		for tables.Next() {
+			field := tables.Record().Field()
+			if _, ok := types[field]; ok {
+				continue
+			}
+			switch tables.Record().Value().(type) {
+			case float64:
+				types[field] = fieldTypeFloat
+			case int64:
+				types[field] = fieldTypeInteger
+			case uint64:
+				types[field] = fieldTypeUInteger
+			case string:
+				types[field] = fieldTypeString
+			case bool:
+				types[field] = fieldTypeBoolean
+			}
+		}
+		err = tables.Err()
+		tables.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		measurement := measurementSchema{Name: name, Tags: []string{}, Fields: []fieldSchema{}}
+		for _, tag := range tags {
+			// Skip the group key columns the schema functions include.
+			if !strings.HasPrefix(tag, "_") && tag != "user_id" {
+				measurement.Tags = append(measurement.Tags, tag)
+			}
+		}
+		for _, field := range fields {
+			measurement.Fields = append(measurement.Fields, fieldSchema{Name: field, Type: types[field]})
+		}
+		draft = append(draft, measurement)
+	}
+	return draft, nil
+}
+
+// queryStrings runs a query and returns the string values of its _value column.
+func queryStrings(ctx context.Context, query string, params map[string]string) ([]string, error) {
+	tables, err := organizationOf(ctx).queryAPI.QueryWithParams(ctx, query, params)
+	if err != nil {
+		return nil, err
+	}
+	defer tables.Close()
+	var values []string
+	for tables.Next() {
+		if value, ok := tables.Record().Value().(string); ok && !containsString(values, value) {
+			values = append(values, value)
+		}
+	}
+	return values, tables.Err()
+}
+
+// measurementNamePattern matches the names of measurements in the admin API.
+var measurementNamePattern = regexp.MustCompile(`^[^\s,]+$`)
+
+// listSchema lists the measurements declared in the schema registry.
+//
+// GET /admin/schema to test this endpoint.
+func listSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schemaDocument{Measurements: schemas.list()})
+}
+
+// defineMeasurement declares a measurement in the schema registry, replacing
+// any previous declaration of it. Ingest rejects points that don't match it.
+//
+// POST the following to test this endpoint:
+// {"name":"measurement1","tags":[],"fields":[{"name":"field1","type":"float","unit":"°C","min":-40,"max":125}]}
+func defineMeasurement(w http.ResponseWriter, r *http.Request) {
+	var measurement measurementSchema
+	if err := json.NewDecoder(r.Body).Decode(&measurement); err != nil {
+		handleError(w, invalidBody(err))
+		return
+	}
+	if measurement.Tags == nil {
+		measurement.Tags = []string{}
+	}
+	if !measurementNamePattern.MatchString(measurement.Name) {
+		handleError(w, invalidRequest("measurement name must not be empty or contain spaces or commas"))
+		return
+	}
+	if err := validateMeasurementSchema(measurement); err != nil {
+		handleError(w, invalidRequest("%v", err))
+		return
+	}
+	if err := schemas.define(measurement); err != nil {
+		handleError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(measurement)
+}
+
+// removeMeasurement removes the declaration of a measurement from the schema
+// registry.
+//
+// DELETE /admin/schema?measurement=measurement1 to test this endpoint.
+func removeMeasurement(w http.ResponseWriter, r *http.Request) {
+	if err := schemas.remove(param(r, "measurement")); err != nil {
+		handleError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// draftSchema derives a draft schema from the data already in the bucket. See
+// deriveSchema for details. Review the draft, then POST each measurement to
+// /admin/schema to define it.
+//
+// GET /admin/schema/draft to test this endpoint.
+func draftSchema(w http.ResponseWriter, r *http.Request) {
+	draft, err := deriveSchema(r.Context())
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if draft == nil {
+		draft = []measurementSchema{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schemaDocument{Measurements: draft})
+}
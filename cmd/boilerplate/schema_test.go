@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stringsCSV returns an annotated CSV response with a row for each value.
+func stringsCSV(values ...string) string {
+	csv := "#datatype,string,long,string\r\n#group,false,false,false\r\n#default,_result,,\r\n,result,table,_value\r\n"
+	for _, value := range values {
+		csv += ",,0," + value + "\r\n"
+	}
+	return csv + "\r\n"
+}
+
+func TestDraftSchemaLeavesOutInternalMeasurements(t *testing.T) {
+	app := newTestApp(t)
+	app.influx.HandleQuery(`schema\.measurements\(`,
+		stringsCSV("measurement1", "_alerts", "_annotations", "rollup_1m", "rollup_1d", "downsampled"))
+	app.influx.HandleQuery(`schema\.measurementTagKeys\(`, stringsCSV("_measurement", "user_id", "tag1"))
+	app.influx.HandleQuery(`schema\.measurementFieldKeys\(`, stringsCSV("field1"))
+	writeRollups(t, app, "measurement1,user_id=user1,tag1=a field1=1.5 "+formatNanos(time.Now()))
+
+	resp, body := app.do(t, http.MethodGet, "/admin/schema/draft", "admin-key", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d (%s), want 200", resp.StatusCode, body)
+	}
+	var draft schemaDocument
+	if err := json.NewDecoder(strings.NewReader(body)).Decode(&draft); err != nil {
+		t.Fatal(err)
+	}
+	if len(draft.Measurements) != 1 {
+		t.Fatalf("got measurements %+v, want only measurement1", draft.Measurements)
+	}
+	got := draft.Measurements[0]
+	if got.Name != "measurement1" || len(got.Tags) != 1 || got.Tags[0] != "tag1" ||
+		len(got.Fields) != 1 || got.Fields[0] != (fieldSchema{Name: "field1", Type: fieldTypeFloat}) {
+		t.Errorf("got %+v, want measurement1 with tag1 and the float field1", got)
+	}
+}
+
+func TestIsInternalMeasurement(t *testing.T) {
+	for name, want := range map[string]bool{
+		"_alerts":          true,
+		"_annotations":     true,
+		"rollup_1m":        true,
+		"downsampled":      true,
+		"measurement1":     false,
+		"downsampled_data": false,
+		"my_rollup_1m":     false,
+	} {
+		if got := isInternalMeasurement(name); got != want {
+			t.Errorf("isInternalMeasurement(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestSchemaEndpoints(t *testing.T) {
+	app := newTestApp(t)
+	const measurement = `{"name":"measurement1","tags":[],"fields":[{"name":"field1","type":"float","min":0,"max":10}]}`
+	if resp, body := app.do(t, http.MethodPost, "/admin/schema", "key1", measurement); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d (%s) defining a measurement without the admin key, want 401", resp.StatusCode, body)
+	}
+	if resp, body := app.do(t, http.MethodPost, "/admin/schema", "admin-key", measurement); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d (%s), want 201", resp.StatusCode, body)
+	}
+	resp, body := app.do(t, http.MethodGet, "/admin/schema", "admin-key", "")
+	var listed schemaDocument
+	if err := json.Unmarshal([]byte(body), &listed); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d (%s) listing the schema, want 200", resp.StatusCode, body)
+	}
+	if len(listed.Measurements) != 1 || listed.Measurements[0].Name != "measurement1" {
+		t.Errorf("got measurements %+v, want measurement1", listed.Measurements)
+	}
+
+	// Ingest rejects points that don't match the declaration.
+	for _, test := range []struct {
+		point  string
+		status int
+	}{
+		{`{"measurement":"measurement1","field1":20}`, http.StatusBadRequest},
+		{`{"measurement":"measurement1","field1":5}`, http.StatusAccepted},
+	} {
+		resp, body := app.do(t, http.MethodPost, "/users/user1/points", "key1", test.point)
+		if resp.StatusCode != test.status {
+			t.Errorf("got status %d (%s) ingesting %s, want %d", resp.StatusCode, body, test.point, test.status)
+		}
+		if test.status == http.StatusBadRequest && errorCode(t, body) != errorCodeSchemaViolation {
+			t.Errorf("got %s ingesting %s, want a schema violation", body, test.point)
+		}
+	}
+
+	if resp, body := app.do(t, http.MethodDelete, "/admin/schema/measurement1", "admin-key", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("got status %d (%s) removing the measurement, want 204", resp.StatusCode, body)
+	}
+	if resp, body := app.do(t, http.MethodPost, "/users/user1/points", "key1", `{"measurement":"measurement1","field1":20}`); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("got status %d (%s) once the measurement is removed, want 202", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	influxquery "github.com/influxdata/influxdb-client-go/v2/api/query"
+
+	"github.com/influxdata/go-snippets/internal/flux"
+)
+
+const (
+	// streamLookback is how long after their time records may be written and
+	// still be streamed. Points ingested through the write queue are written
+	// once InfluxDB accepts them, which may be minutes after they were stamped.
+	streamLookback = 5 * time.Minute
+	// streamMaxResume is how far back a client resuming with Last-Event-ID is
+	// sent the events it missed. Clients that were away for longer only
+	// receive those of the last streamMaxResume.
+	streamMaxResume = time.Hour
+	// streamHeartbeatInterval is how often an idle stream sends a comment to keep
+	// proxies and clients from timing out the connection.
+	streamHeartbeatInterval = 15 * time.Second
+	// streamBuffer is the number of events a subscriber may fall behind by before
+	// it is disconnected. Disconnected clients resume with Last-Event-ID.
+	streamBuffer = 64
+)
+
+// streamEvent holds every record of a user's data written at one point in time.
+// Its ID is the time in nanoseconds since the Unix epoch, which clients send
+// back in the Last-Event-ID header to resume a stream after reconnecting.
+type streamEvent struct {
+	time    time.Time
+	records []map[string]string
+}
+
+// id returns the ID of the event.
+func (e streamEvent) id() string {
+	return strconv.FormatInt(e.time.UnixNano(), 10)
+}
+
+// userStream polls the data of a single user and fans out new records to all
+// of its subscribers, so that any number of clients can watch a user while
+// InfluxDB is queried only once per poll interval.
+type userStream struct {
+	userID      string
+	cancel      context.CancelFunc
+	subscribers map[chan streamEvent]struct{}
+}
+
+var (
+	streamsMu sync.Mutex
+	// streamPollInterval is how often the data of each streamed user is queried.
+	streamPollInterval = 5 * time.Second
+	// streams holds the stream of each user with at least one subscriber, keyed
+	// by the user's organization and ID.
+	streams = make(map[streamKey]*userStream)
+)
+
+// streamKey identifies the stream of a user. Users of different organizations
+// may have the same ID.
+type streamKey struct {
+	organization string
+	userID       string
+}
+
+// subscribe registers a subscriber to the data of a user in the organization
+// the request with ctx is served from, starting a polling loop for the user if
+// it is the first, and returns the channel events are delivered on. The channel
+// is closed if the subscriber falls too far behind. Call the returned function
+// to unsubscribe.
+func subscribe(ctx context.Context, userID string) (<-chan streamEvent, func()) {
+	org := organizationOf(ctx)
+	key := streamKey{organization: org.name, userID: userID}
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+	stream, ok := streams[key]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.WithValue(context.Background(), organizationKey{}, org))
+		stream = &userStream{userID: userID, cancel: cancel, subscribers: make(map[chan streamEvent]struct{})}
+		streams[key] = stream
+		go stream.poll(ctx, streamPollInterval)
+	}
+	events := make(chan streamEvent, streamBuffer)
+	stream.subscribers[events] = struct{}{}
+
+	return events, func() {
+		streamsMu.Lock()
+		defer streamsMu.Unlock()
+		if _, ok := stream.subscribers[events]; ok {
+			delete(stream.subscribers, events)
+			close(events)
+		}
+		// Stop polling once the last subscriber is gone.
+		if len(stream.subscribers) == 0 && streams[key] == stream {
+			stream.cancel()
+			delete(streams, key)
+		}
+	}
+}
+
+// poll queries the user's data for new records every interval until ctx is
+// cancelled and publishes them to the subscribers.
+//
+// Records may be written well after their time, e.g. when the write queue
+// retries a batch, so rather than only querying records newer than the last
+// one seen, each poll queries the records of the last streamLookback and
+// publishes those it hasn't seen before.
+func (s *userStream) poll(ctx context.Context, interval time.Duration) {
+	started := time.Now()
+	// seen holds the keys of the records published within the lookback, with
+	// their times.
+	seen := make(map[string]time.Time)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		since := time.Now().Add(-streamLookback)
+		if since.Before(started) {
+			since = started
+		}
+		events, err := queryEventsSince(ctx, s.userID, since)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Failed to poll data of user %q: %v", s.userID, err)
+			}
+			continue
+		}
+		for key, at := range seen {
+			if !at.After(since) {
+				delete(seen, key)
+			}
+		}
+		for _, event := range events {
+			if event = unseenRecords(event, seen); len(event.records) > 0 {
+				s.publish(event)
+			}
+		}
+	}
+}
+
+// unseenRecords returns the records of an event whose keys are not in seen,
+// adding them to it.
+func unseenRecords(event streamEvent, seen map[string]time.Time) streamEvent {
+	unseen := streamEvent{time: event.time}
+	for _, record := range event.records {
+		key := recordKey(record)
+		if _, ok := seen[key]; !ok {
+			seen[key] = event.time
+			unseen.records = append(unseen.records, record)
+		}
+	}
+	return unseen
+}
+
+// unsentRecords returns the records of an event whose keys are not in sent.
+func unsentRecords(event streamEvent, sent map[string]time.Time) streamEvent {
+	unsent := streamEvent{time: event.time}
+	for _, record := range event.records {
+		if _, ok := sent[recordKey(record)]; !ok {
+			unsent.records = append(unsent.records, record)
+		}
+	}
+	return unsent
+}
+
+// recordKey identifies a record of a user's data by its time, measurement,
+// field and tags, ignoring its value and the columns describing the query.
+func recordKey(record map[string]string) string {
+	columns := make([]string, 0, len(record))
+	for column, value := range record {
+		switch column {
+		case "result", "table", "_start", "_stop", "_value":
+		default:
+			columns = append(columns, strconv.Quote(column)+"="+strconv.Quote(value))
+		}
+	}
+	sort.Strings(columns)
+	return strings.Join(columns, ",")
+}
+
+// publish delivers an event to every subscriber, disconnecting subscribers
+// whose buffer is full rather than blocking the others.
+func (s *userStream) publish(event streamEvent) {
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+	for events := range s.subscribers {
+		select {
+		case events <- event:
+		default:
+			delete(s.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// queryEventsSince queries all records of a user's data written after since,
+// grouped into one event per point in time and sorted by time. The rollups,
+// alerts and annotations the application keeps in the same bucket are left
+// out.
+func queryEventsSince(ctx context.Context, userID string, since time.Time) ([]streamEvent, error) {
+	org := organizationOf(ctx)
+	// The start of a range is inclusive, so records at exactly the time of the
+	// last event sent are filtered out explicitly.
+	query, params := flux.From(org.bucket).
+		Range(flux.Time(since)).
+		Filter(flux.Tag("user_id", userID)).
+		Filter(flux.Col("_measurement").NotMatches(internalMeasurements)).
+		Filter(flux.Col("_time").Greater(flux.Time(since))).
+		Group().
+		Sort("_time").
+		Render()
+	tables, err := org.queryAPI.QueryWithParams(ctx, query, params)
+	if err != nil {
+		return nil, err
+	}
+	defer tables.Close()
+
+	var events []streamEvent
+	for tables.Next() {
+		record := tables.Record()
+		if n := len(events); n == 0 || !events[n-1].time.Equal(record.Time()) {
+			events = append(events, streamEvent{time: record.Time()})
+		}
+		last := &events[len(events)-1]
+		last.records = append(last.records, recordColumns(record))
+	}
+	return events, tables.Err()
+}
+
+// recordColumns formats the columns of a record as strings, formatting times
+// as RFC 3339 with nanoseconds.
+func recordColumns(record *influxquery.FluxRecord) map[string]string {
+	columns := make(map[string]string, len(record.Values()))
+	for name, value := range record.Values() {
+		switch value := value.(type) {
+		case time.Time:
+			columns[name] = value.Format(time.RFC3339Nano)
+		case nil:
+			columns[name] = ""
+		default:
+			columns[name] = fmt.Sprint(value)
+		}
+	}
+	return columns
+}
+
+// stream sends the data of a user to the client as Server-Sent Events as soon as
+// it is written, in place of polling the /query endpoint.
+//
+// Note that "user" here refers to a user in your application, not an InfluxDB user.
+//
+// Open the following URL with an EventSource, or with curl -N, to test this endpoint:
+// http://localhost:8080/stream?user_id=user1
+//
+// Each event carries the JSON encoded records of the user's data written at one
+// point in time, in the same shape as the records returned by /query. Clients
+// that reconnect with a Last-Event-ID header receive everything written since
+// that event, up to streamMaxResume ago, which EventSource does automatically. Records written late, such
+// as points retried by the write queue, are sent when they are written, so an
+// event may be older than the one before it.
+func stream(w http.ResponseWriter, r *http.Request) {
+	userID := param(r, "user_id")
+	if err := authorize(r.Context(), userID); err != nil {
+		handleError(w, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		handleError(w, errors.New("streaming is not supported by the response writer"))
+		return
+	}
+
+	// Subscribe before catching up on missed events, so that nothing written in
+	// between is lost. Events already sent are skipped below.
+	events, unsubscribe := subscribe(r.Context(), userID)
+	defer unsubscribe()
+
+	var backlog []streamEvent
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		nanos, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil {
+			handleError(w, invalidRequest("invalid Last-Event-ID"))
+			return
+		}
+		since := time.Unix(0, nanos)
+		if earliest := time.Now().Add(-streamMaxResume); since.Before(earliest) {
+			since = earliest
+		}
+		if backlog, err = queryEventsSince(r.Context(), userID, since); err != nil {
+			handleError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	fmt.Fprintf(w, "retry: %d\n\n", (3 * time.Second).Milliseconds())
+	flusher.Flush()
+
+	send := func(event streamEvent) bool {
+		data, err := json.Marshal(event.records)
+		if err != nil {
+			return false
+		}
+		if _, err := fmt.Fprintf(w, "id: %s\nevent: records\ndata: %s\n\n", event.id(), data); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+	// Events published while the backlog was queried may hold records of the
+	// backlog, which are skipped. The events published are otherwise new.
+	backlogKeys := make(map[string]time.Time)
+	for _, event := range backlog {
+		if !send(unseenRecords(event, backlogKeys)) {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				// The client fell behind; it will reconnect and resume from
+				// the last event it received.
+				return
+			}
+			if event = unsentRecords(event, backlogKeys); len(event.records) > 0 && !send(event) {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sentEvent is an event received from the /stream endpoint.
+type sentEvent struct {
+	id      string
+	records []map[string]string
+}
+
+// openStream opens the stream of user1 with the Last-Event-ID, if any, and
+// returns the channel the events received are delivered on. Call the returned
+// function to disconnect.
+func openStream(t *testing.T, app *testApp, lastEventID string) (<-chan sentEvent, func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, app.url+"/users/user1/points/stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer key1")
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		resp.Body.Close()
+		t.Fatalf("got status %d and type %q, want an event stream", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	events := make(chan sentEvent, streamBuffer)
+	go func() {
+		defer resp.Body.Close()
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		var event sentEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				event.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				// Invalid data leaves the event without records.
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.records)
+			case line == "" && event.id != "":
+				events <- event
+				event = sentEvent{}
+			}
+		}
+	}()
+	t.Cleanup(cancel)
+	return events, cancel
+}
+
+// nextEvent returns the next event received, failing the test if none is
+// received in time.
+func nextEvent(t *testing.T, events <-chan sentEvent) sentEvent {
+	t.Helper()
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("the stream ended")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	return sentEvent{}
+}
+
+// pollStreamsQuickly makes streams poll every few milliseconds for the
+// duration of the test.
+func pollStreamsQuickly(t *testing.T) {
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+	interval := streamPollInterval
+	streamPollInterval = 20 * time.Millisecond
+	t.Cleanup(func() {
+		streamsMu.Lock()
+		defer streamsMu.Unlock()
+		streamPollInterval = interval
+	})
+}
+
+func TestStreamResumesFromLastEventID(t *testing.T) {
+	app := newTestApp(t)
+	pollStreamsQuickly(t)
+	now := time.Now().Truncate(time.Second)
+	writeRollups(t, app,
+		"m1,user_id=user1 field1=1 "+formatNanos(now.Add(-3*time.Minute)),
+		"m1,user_id=user1 field1=2 "+formatNanos(now.Add(-2*time.Minute)),
+		"m1,user_id=user2 field1=3 "+formatNanos(now.Add(-2*time.Minute)),
+		"m1,user_id=user1 field1=4 "+formatNanos(now.Add(-time.Minute)))
+
+	// Only the events after the last one received are sent again.
+	events, _ := openStream(t, app, formatNanos(now.Add(-3*time.Minute)))
+	for _, want := range []struct {
+		at    time.Time
+		value string
+	}{{now.Add(-2 * time.Minute), "2"}, {now.Add(-time.Minute), "4"}} {
+		event := nextEvent(t, events)
+		if event.id != formatNanos(want.at) || len(event.records) != 1 ||
+			event.records[0]["_value"] != want.value || event.records[0]["user_id"] != "user1" {
+			t.Errorf("got event %s with records %v, want %s with field1=%s of user1", event.id, event.records, formatNanos(want.at), want.value)
+		}
+	}
+
+	resp, body := app.do(t, http.MethodGet, "/users/user1/points/stream", "key2", "")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got status %d (%s) streaming another user's data, want 403", resp.StatusCode, body)
+	}
+}
+
+func TestStreamResumesAtMostStreamMaxResumeAgo(t *testing.T) {
+	app := newTestApp(t)
+	now := time.Now().Truncate(time.Second)
+	writeRollups(t, app,
+		"m1,user_id=user1 field1=1 "+formatNanos(now.Add(-streamMaxResume-time.Hour)),
+		"m1,user_id=user1 field1=2 "+formatNanos(now.Add(-streamMaxResume/2)))
+
+	// A client resuming from the start of time only receives the recent event.
+	events, _ := openStream(t, app, "0")
+	if event := nextEvent(t, events); event.id != formatNanos(now.Add(-streamMaxResume/2)) {
+		t.Errorf("got event %s with records %v, want only the one at %s", event.id, event.records, formatNanos(now.Add(-streamMaxResume/2)))
+	}
+}
+
+func TestStreamLeavesOutInternalMeasurements(t *testing.T) {
+	app := newTestApp(t)
+	pollStreamsQuickly(t)
+	events, _ := openStream(t, app, "")
+
+	start := time.Now().Add(time.Minute).Truncate(time.Second)
+	writeRollups(t, app,
+		"rollup_1m,user_id=user1,_source=m1 field1_mean=1 "+formatNanos(start),
+		"_alerts,user_id=user1 state=\"firing\" "+formatNanos(start),
+		"_annotations,user_id=user1 title=\"deploy\" "+formatNanos(start),
+		"downsampled,user_id=user1 field1_mean=1 "+formatNanos(start),
+		"m1,user_id=user1 field1=2 "+formatNanos(start.Add(time.Second)))
+	event := nextEvent(t, events)
+	if len(event.records) != 1 || event.records[0]["_measurement"] != "m1" {
+		t.Errorf("got event %s with records %v, want only the record of m1", event.id, event.records)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("got event %s with records %v of internal measurements", event.id, event.records)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestStreamSendsRecordsWrittenLate(t *testing.T) {
+	app := newTestApp(t)
+	pollStreamsQuickly(t)
+	events, _ := openStream(t, app, "")
+
+	// The records are stamped after the stream starts, but the second is
+	// written after a newer one, as a retried batch of the write queue would be.
+	start := time.Now().Add(time.Minute).Truncate(time.Second)
+	writeRollups(t, app, "m1,user_id=user1 field1=2 "+formatNanos(start.Add(time.Second)))
+	if event := nextEvent(t, events); event.id != formatNanos(start.Add(time.Second)) {
+		t.Fatalf("got event %s, want %s", event.id, formatNanos(start.Add(time.Second)))
+	}
+	writeRollups(t, app, "m1,user_id=user1 field1=1 "+formatNanos(start))
+	event := nextEvent(t, events)
+	if event.id != formatNanos(start) || len(event.records) != 1 || event.records[0]["_value"] != "1" {
+		t.Errorf("got event %s with records %v, want the late record at %s", event.id, event.records, formatNanos(start))
+	}
+
+	// Records already sent are not sent again on the next polls.
+	select {
+	case event := <-events:
+		t.Errorf("got event %s with records %v sent again", event.id, event.records)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestStreamStopsPollingOnDisconnect(t *testing.T) {
+	app := newTestApp(t)
+	pollStreamsQuickly(t)
+	_, disconnect1 := openStream(t, app, "")
+	_, disconnect2 := openStream(t, app, "")
+
+	// Both clients share the stream of user1.
+	streamsMu.Lock()
+	stream := streams[streamKey{organization: "my-org", userID: "user1"}]
+	subscribers := 0
+	if stream != nil {
+		subscribers = len(stream.subscribers)
+	}
+	streamsMu.Unlock()
+	if subscribers != 2 {
+		t.Fatalf("got %d subscribers to the stream of user1, want 2", subscribers)
+	}
+
+	disconnect1()
+	disconnect2()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		streamsMu.Lock()
+		n := len(streams)
+		streamsMu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d streams are still polled after their clients disconnected", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/domain"
+)
+
+// errTaskNotFound is returned when a user has no task with the requested ID.
+var errTaskNotFound = errors.New("task not found")
+
+// userTask describes a task run for a user: either one of the tasks that roll
+// up their data, created by /setup, or the task that evaluates one of their
+// alert rules.
+type userTask struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	// Tier is the name of the tier of rollups a downsampling task writes.
+	Tier   string `json:"tier,omitempty"`
+	Every  string `json:"every,omitempty"`
+	Status string `json:"status,omitempty"`
+}
+
+// The kinds of tasks run for users.
+const (
+	taskKindDownsampling = "downsampling"
+	taskKindAlert        = "alert"
+)
+
+// findUserTasks returns the downsampling and alert tasks of a user. The tasks of
+// a user are told apart by their names.
+//
+// The downsampling tasks are those of the tiers of rollups and, for users set up
+// before there were tiers, the single task that wrote the downsampled measurement
+// every five minutes.
+func findUserTasks(ctx context.Context, userID string) ([]domain.Task, error) {
+	org := organizationOf(ctx)
+	orgID, err := org.ID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var tasks []domain.Task
+	names := []string{legacyDownsamplingTaskName(userID), alertTaskName(userID)}
+	for _, tier := range rollupTiers {
+		names = append(names, rollupTaskName(userID, tier))
+	}
+	for _, name := range names {
+		found, err := org.client.TasksAPI().FindTasks(ctx, &api.TaskFilter{Name: name, OrgID: orgID, Limit: 500})
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, found...)
+	}
+	return tasks, nil
+}
+
+// postTask creates a task in the organization a request is served from from a
+// script that sets the task option itself. The tasks API of the client
+// prepends the task option to the script, but Flux requires imports to come
+// first, so tasks are created directly.
+func postTask(ctx context.Context, script string, description *string) (*domain.Task, error) {
+	org := organizationOf(ctx)
+	orgID, err := org.ID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	response, err := domain.NewClientWithResponses(org.client.HTTPService()).PostTasksWithResponse(ctx,
+		&domain.PostTasksParams{},
+		domain.PostTasksJSONRequestBody{
+			OrgID:       &orgID,
+			Flux:        script,
+			Description: description,
+		})
+	if err != nil {
+		return nil, err
+	}
+	if response.JSONDefault != nil {
+		return nil, domain.ErrorToHTTPError(response.JSONDefault, response.StatusCode())
+	}
+	if response.JSON201 == nil {
+		return nil, fmt.Errorf("failed to create task: unexpected status %d", response.StatusCode())
+	}
+	return response.JSON201, nil
+}
+
+// describeTask returns the description of a task of a user.
+func describeTask(userID string, task domain.Task) userTask {
+	described := userTask{ID: task.Id, Name: task.Name, Kind: taskKindDownsampling}
+	if task.Name == alertTaskName(userID) {
+		described.Kind = taskKindAlert
+	}
+	for _, tier := range rollupTiers {
+		if task.Name == rollupTaskName(userID, tier) {
+			described.Tier = tier.name
+		}
+	}
+	if task.Every != nil {
+		described.Every = *task.Every
+	}
+	if task.Status != nil {
+		described.Status = string(*task.Status)
+	}
+	return described
+}
+
+// findUserTask returns the task of a user with the given ID, or errTaskNotFound.
+func findUserTask(ctx context.Context, userID, id string) (userTask, error) {
+	if err := authorize(ctx, userID); err != nil {
+		return userTask{}, err
+	}
+	tasks, err := findUserTasks(ctx, userID)
+	if err != nil {
+		return userTask{}, err
+	}
+	for _, task := range tasks {
+		if task.Id == id {
+			return describeTask(userID, task), nil
+		}
+	}
+	return userTask{}, errTaskNotFound
+}
+
+// createTask creates the tasks that roll up a user's data, like /setup, and
+// returns them.
+//
+// Note that "user" here refers to a user in your application, not an InfluxDB user.
+//
+// POST /users/user1/tasks to test this endpoint, GET it to list the tasks of
+// the user, and GET or DELETE /users/user1/tasks/<task ID> to inspect or
+// remove one of them.
+func createTask(w http.ResponseWriter, r *http.Request) {
+	userID := param(r, "user_id")
+	location, err := parseTimezone(r.URL.Query().Get("timezone"))
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	tasks, err := createRollupTasks(r.Context(), userID, location)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	described := make([]userTask, 0, len(tasks))
+	for _, task := range tasks {
+		described = append(described, describeTask(userID, task))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		Tasks []userTask `json:"tasks"`
+	}{described})
+}
+
+// legacyDownsampledMeasurement is the measurement the task named by
+// legacyDownsamplingTaskName writes.
+const legacyDownsampledMeasurement = "downsampled"
+
+// legacyDownsamplingTaskName returns the name of the task that down sampled a
+// user's data before there were tiers of rollups.
+func legacyDownsamplingTaskName(userID string) string {
+	return fmt.Sprintf("%s_task", userID)
+}
+
+func listTasks(w http.ResponseWriter, r *http.Request) {
+	userID := param(r, "user_id")
+	if err := authorize(r.Context(), userID); err != nil {
+		handleError(w, err)
+		return
+	}
+	tasks, err := findUserTasks(r.Context(), userID)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	described := make([]userTask, 0, len(tasks))
+	for _, task := range tasks {
+		described = append(described, describeTask(userID, task))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Tasks []userTask `json:"tasks"`
+	}{described})
+}
+
+func getTask(w http.ResponseWriter, r *http.Request) {
+	task, err := findUserTask(r.Context(), param(r, "user_id"), param(r, "id"))
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(task)
+}
+
+// deleteTask removes a task of a user. Removing the task of an alert rule
+// removes the rule.
+func deleteTask(w http.ResponseWriter, r *http.Request) {
+	task, err := findUserTask(r.Context(), param(r, "user_id"), param(r, "id"))
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if err := organizationOf(r.Context()).client.TasksAPI().DeleteTaskWithID(r.Context(), task.ID); err != nil {
+		handleError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
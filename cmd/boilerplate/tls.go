@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// tlsCertFile and tlsKeyFile are the paths of the PEM encoded certificate
+	// chain and private key both servers present, and are read from the
+	// BOILERPLATE_TLS_CERT and BOILERPLATE_TLS_KEY environment variables. When
+	// they are set, your app serves HTTPS on port 8080 and gRPC over TLS on port
+	// 9090 instead of plain HTTP.
+	tlsCertFile = os.Getenv("BOILERPLATE_TLS_CERT")
+	tlsKeyFile  = os.Getenv("BOILERPLATE_TLS_KEY")
+	// tlsClientCAFile is the path of the PEM encoded certificates of the
+	// authorities that sign client certificates, and is read from the
+	// BOILERPLATE_TLS_CLIENT_CA environment variable. Setting it enables mutual
+	// TLS: clients may present a certificate signed by one of the authorities,
+	// which authenticates them as the user named by its common name (CN).
+	tlsClientCAFile = os.Getenv("BOILERPLATE_TLS_CLIENT_CA")
+	// tlsClientAuth is read from the BOILERPLATE_TLS_CLIENT_AUTH environment
+	// variable, and is "optional" (the default) to let clients authenticate with
+	// either a certificate or an API key, or "required" to reject connections
+	// without a valid client certificate.
+	tlsClientAuth = os.Getenv("BOILERPLATE_TLS_CLIENT_AUTH")
+)
+
+// certReloadInterval is how often the certificate files are checked for changes.
+const certReloadInterval = 10 * time.Second
+
+// certificateReloader loads the certificate, private key and client
+// authorities of the servers from files, and reloads them when the files
+// change or the process receives SIGHUP.
+//
+// Each TLS handshake uses whatever was loaded last, so a renewed certificate
+// takes effect for new connections while established ones carry on undisturbed.
+// When the files can't be loaded, for example because the certificate has been
+// replaced but its key hasn't yet, the previous certificate is kept in use.
+type certificateReloader struct {
+	certFile, keyFile, clientCAFile string
+	clientAuth                      tls.ClientAuthType
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTime   time.Time
+}
+
+// newCertificateReloader returns a certificateReloader configured from the
+// environment, or nil if TLS is not enabled.
+func newCertificateReloader() (*certificateReloader, error) {
+	if tlsCertFile == "" && tlsKeyFile == "" {
+		if tlsClientCAFile != "" {
+			return nil, errors.New("BOILERPLATE_TLS_CLIENT_CA requires BOILERPLATE_TLS_CERT and BOILERPLATE_TLS_KEY")
+		}
+		return nil, nil
+	}
+	if tlsCertFile == "" || tlsKeyFile == "" {
+		return nil, errors.New("BOILERPLATE_TLS_CERT and BOILERPLATE_TLS_KEY must be set together")
+	}
+	reloader := &certificateReloader{certFile: tlsCertFile, keyFile: tlsKeyFile, clientCAFile: tlsClientCAFile}
+	if tlsClientCAFile != "" {
+		switch tlsClientAuth {
+		case "", "optional":
+			reloader.clientAuth = tls.VerifyClientCertIfGiven
+		case "required":
+			reloader.clientAuth = tls.RequireAndVerifyClientCert
+		default:
+			return nil, fmt.Errorf("invalid BOILERPLATE_TLS_CLIENT_AUTH %q: must be optional or required", tlsClientAuth)
+		}
+	}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// files returns the paths of the files the reloader loads.
+func (c *certificateReloader) files() []string {
+	files := []string{c.certFile, c.keyFile}
+	if c.clientCAFile != "" {
+		files = append(files, c.clientCAFile)
+	}
+	return files
+}
+
+// reload loads the certificate, private key and client authorities from their files.
+func (c *certificateReloader) reload() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load the certificate: %w", err)
+	}
+	var clientCAs *x509.CertPool
+	if c.clientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read the client authorities: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %q", c.clientCAFile)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert, c.clientCAs, c.modTime = &cert, clientCAs, modTime
+	return nil
+}
+
+// latestModTime returns the time the most recently modified file was modified.
+func (c *certificateReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range c.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// watch reloads the files whenever the process receives SIGHUP or, checking
+// every interval, any of them has been modified since they were last loaded,
+// until ctx is done.
+func (c *certificateReloader) watch(ctx context.Context, interval time.Duration) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+		case <-ticker.C:
+			modTime, err := c.latestModTime()
+			c.mu.RLock()
+			unchanged := err == nil && !modTime.After(c.modTime)
+			c.mu.RUnlock()
+			if unchanged {
+				continue
+			}
+		}
+		if err := c.reload(); err != nil {
+			log.Printf("Failed to reload the TLS certificate, keeping the previous one: %v", err)
+			continue
+		}
+		log.Printf("Reloaded the TLS certificate from %q", c.certFile)
+	}
+}
+
+// config returns a TLS configuration for a server negotiating one of the given
+// application protocols, which presents the certificate loaded last and
+// verifies client certificates against the authorities loaded last.
+func (c *certificateReloader) config(nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: nextProtos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				NextProtos:   nextProtos,
+				Certificates: []tls.Certificate{*c.cert},
+				ClientAuth:   c.clientAuth,
+				ClientCAs:    c.clientCAs,
+			}, nil
+		},
+	}
+}
+
+// authenticateCertificate returns a context carrying the user named by the
+// common name of the verified client certificate of a connection, if it has
+// one. Client certificates are only verified when mutual TLS is enabled.
+func authenticateCertificate(ctx context.Context, state *tls.ConnectionState) (context.Context, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ctx, false
+	}
+	userID := state.VerifiedChains[0][0].Subject.CommonName
+	if userID == "" {
+		return ctx, false
+	}
+	return context.WithValue(ctx, callerKey{}, userID), true
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/influxdata/go-snippets/pkg/boilerplatepb"
+)
+
+// testCA is a certificate authority that issues the certificates of a test.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// pem is the PEM encoded certificate of the authority.
+	pem []byte
+}
+
+// newTestCA returns a new certificate authority.
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM encoded certificate and private key of a server for
+// 127.0.0.1, or of a client, with the common name.
+func (ca *testCA) issue(t *testing.T, commonName string, server bool) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// clientConfig returns a TLS configuration trusting the authority, which
+// presents a client certificate with the common name, if any.
+func (ca *testCA) clientConfig(t *testing.T, commonName string) *tls.Config {
+	t.Helper()
+	config := &tls.Config{RootCAs: x509.NewCertPool()}
+	config.RootCAs.AddCert(ca.cert)
+	if commonName != "" {
+		cert, err := tls.X509KeyPair(ca.issue(t, commonName, false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config
+}
+
+// writeServerCertificate writes a server certificate with the common name
+// issued by the authority to the files the reloader loads, dated modTime.
+func writeServerCertificate(t *testing.T, ca *testCA, commonName string, modTime time.Time) {
+	t.Helper()
+	cert, key := ca.issue(t, commonName, true)
+	for file, data := range map[string][]byte{tlsCertFile: cert, tlsKeyFile: key, tlsClientCAFile: ca.pem} {
+		if err := ioutil.WriteFile(file, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newTestCertificateReloader writes a server certificate with the common name
+// issued by a new authority, which also signs client certificates, and returns
+// a reloader configured to load it.
+func newTestCertificateReloader(t *testing.T, commonName string) (*certificateReloader, *testCA) {
+	t.Helper()
+	dir := t.TempDir()
+	previous := []string{tlsCertFile, tlsKeyFile, tlsClientCAFile, tlsClientAuth}
+	t.Cleanup(func() {
+		tlsCertFile, tlsKeyFile, tlsClientCAFile, tlsClientAuth = previous[0], previous[1], previous[2], previous[3]
+	})
+	tlsCertFile = filepath.Join(dir, "cert.pem")
+	tlsKeyFile = filepath.Join(dir, "key.pem")
+	tlsClientCAFile = filepath.Join(dir, "ca.pem")
+	tlsClientAuth = ""
+
+	ca := newTestCA(t)
+	writeServerCertificate(t, ca, commonName, time.Now().Add(-time.Minute))
+	reloader, err := newCertificateReloader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reloader, ca
+}
+
+// servedCommonName returns the common name of the certificate a server presents.
+func servedCommonName(t *testing.T, server *httptest.Server, ca *testCA) string {
+	t.Helper()
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(), ca.clientConfig(t, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+// waitForCommonName waits for a server to present a certificate with the
+// common name, calling poke before each attempt.
+func waitForCommonName(t *testing.T, server *httptest.Server, ca *testCA, commonName string, poke func()) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		poke()
+		got := servedCommonName(t, server, ca)
+		if got == commonName {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the server presents %s, want %s", got, commonName)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// newTestTLSServer serves handler over TLS with the certificates of reloader.
+func newTestTLSServer(t *testing.T, reloader *certificateReloader, handler http.Handler) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = reloader.config("http/1.1")
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCertificateReloadsWhenFilesChange(t *testing.T) {
+	reloader, ca := newTestCertificateReloader(t, "server-1")
+	server := newTestTLSServer(t, reloader, http.NotFoundHandler())
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go reloader.watch(ctx, 10*time.Millisecond)
+
+	if got := servedCommonName(t, server, ca); got != "server-1" {
+		t.Fatalf("the server presents %s, want server-1", got)
+	}
+	writeServerCertificate(t, ca, "server-2", time.Now())
+	waitForCommonName(t, server, ca, "server-2", func() {})
+
+	// A certificate without its key is not loaded, and the previous one is kept.
+	if err := ioutil.WriteFile(tlsKeyFile, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(tlsKeyFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := servedCommonName(t, server, ca); got != "server-2" {
+		t.Errorf("the server presents %s after a failed reload, want server-2", got)
+	}
+}
+
+func TestCertificateReloadsOnSIGHUP(t *testing.T) {
+	// Keep SIGHUP from terminating the test before the reloader handles it.
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	t.Cleanup(func() { signal.Stop(hangups) })
+
+	reloader, ca := newTestCertificateReloader(t, "server-1")
+	server := newTestTLSServer(t, reloader, http.NotFoundHandler())
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go reloader.watch(ctx, time.Hour)
+
+	// The files keep their modification time, so only SIGHUP reloads them.
+	writeServerCertificate(t, ca, "server-2", time.Now().Add(-time.Minute))
+	waitForCommonName(t, server, ca, "server-2", func() {
+		if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestClientCertificateAuthenticatesOverHTTP(t *testing.T) {
+	newTestApp(t)
+	reloader, ca := newTestCertificateReloader(t, "server")
+	server := newTestTLSServer(t, reloader, identified(newRouter().ServeHTTP))
+
+	for _, test := range []struct {
+		name, commonName, path, key string
+		status                      int
+	}{
+		{"the user of the certificate", "user1", "/users/user1/points", "", http.StatusOK},
+		{"another user", "user1", "/users/user2/points", "", http.StatusForbidden},
+		{"no certificate", "", "/users/user1/points", "", http.StatusUnauthorized},
+		{"an API key over the certificate", "user1", "/users/user1/points", "key2", http.StatusForbidden},
+	} {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: ca.clientConfig(t, test.commonName)}}
+		req, err := http.NewRequest(http.MethodGet, server.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.key != "" {
+			req.Header.Set("Authorization", "Bearer "+test.key)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, resp.StatusCode, test.status)
+		}
+	}
+
+	// Certificates of other authorities are rejected during the handshake.
+	other := newTestCA(t)
+	config := ca.clientConfig(t, "")
+	config.Certificates = other.clientConfig(t, "user1").Certificates
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	if resp, err := client.Get(server.URL + "/users/user1/points"); err == nil {
+		resp.Body.Close()
+		t.Errorf("got status %d with a certificate of another authority, want a failed handshake", resp.StatusCode)
+	}
+}
+
+func TestClientCertificateAuthenticatesOverGRPC(t *testing.T) {
+	app := newTestApp(t)
+	reloader, ca := newTestCertificateReloader(t, "server")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newGRPCServer(reloader)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	dial := func(commonName string) pb.BoilerplateClient {
+		t.Helper()
+		conn, err := grpc.Dial(listener.Addr().String(),
+			grpc.WithTransportCredentials(credentials.NewTLS(ca.clientConfig(t, commonName))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return pb.NewBoilerplateClient(conn)
+	}
+
+	client := dial("user1")
+	if _, err := client.Ingest(context.Background(), &pb.IngestRequest{UserId: "user1", Measurement: "measurement1", Field1: 1}); err != nil {
+		t.Fatalf("Ingest failed: %v", err)
+	}
+	if points := app.waitForPoints(t, 1); points[0].Tags["user_id"] != "user1" {
+		t.Errorf("got point %+v, want one for user1", points[0])
+	}
+	_, err = client.Ingest(context.Background(), &pb.IngestRequest{UserId: "user2", Measurement: "measurement1", Field1: 1})
+	if code := status.Code(err); code != codes.PermissionDenied {
+		t.Errorf("got %v for another user, want PermissionDenied", err)
+	}
+	_, err = dial("").Ingest(context.Background(), &pb.IngestRequest{UserId: "user1", Measurement: "measurement1", Field1: 1})
+	if code := status.Code(err); code != codes.Unauthenticated {
+		t.Errorf("got %v without a certificate, want Unauthenticated", err)
+	}
+}
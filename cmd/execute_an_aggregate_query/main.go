@@ -5,23 +5,27 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 
-	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/go-snippets/internal/flux"
+	"github.com/influxdata/go-snippets/internal/influxclient"
 )
 
 func main() {
-	token := os.Getenv("INFLUXDB_TOKEN")
-	url := os.Getenv("INFLUXDB_HOST")
-	client := influxdb2.NewClient(url, token)
+	client, err := influxclient.NewFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	org := os.Getenv("INFLUXDB_ORGANIZATION")
 	bucket := os.Getenv("INFLUXDB_BUCKET")
 	queryAPI := client.QueryAPI(org)
-	query := fmt.Sprintf(`from(bucket: %q)
-				  |> range(start: -10m)
-				  |> filter(fn: (r) => r._measurement == "measurement1")
-				  |> mean()`, bucket)
-	results, err := queryAPI.Query(context.Background(), query)
+	query, params := flux.From(bucket).
+		Range(flux.Duration(-10 * time.Minute)).
+		Filter(flux.Measurement("measurement1")).
+		Aggregate(flux.Mean).
+		Render()
+	results, err := queryAPI.QueryWithParams(context.Background(), query, params)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,48 @@
+// Package main runs a fake InfluxDB v2 server for local development.
+//
+// The server keeps everything in memory and implements only the parts of the
+// API used by the other commands in this repository, so that they can be run
+// and exercised without an InfluxDB Cloud account.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/influxdata/go-snippets/internal/fakeinflux"
+)
+
+func main() {
+	addr := flag.String("addr", ":8086", "address to listen on")
+	org := flag.String("org", "my-org", "name of the organization to create at startup")
+	bucket := flag.String("bucket", "my-bucket", "name of the bucket to create at startup")
+	token := flag.String("token", "my-token", "operator token accepted by the server, empty to disable authentication")
+	recordings := flag.String("recordings", "", "directory of recorded query responses to replay")
+	recordURL := flag.String("record-url", "", "URL of a real InfluxDB to record unmatched queries from, requires -recordings")
+	flag.Parse()
+
+	server := fakeinflux.New(*token)
+	organization := server.CreateOrganization(*org)
+	server.CreateBucket(*organization.Id, *bucket)
+
+	if *recordings != "" {
+		if err := os.MkdirAll(*recordings, 0o755); err != nil {
+			log.Fatalf("Failed to create recordings directory: %v", err)
+		}
+		server.ReplayFrom(*recordings)
+	}
+	if *recordURL != "" {
+		if *recordings == "" {
+			log.Fatal("The -record-url flag requires -recordings to be set.")
+		}
+		// Credentials for the real server are read from the same environment
+		// variables the other commands use.
+		server.RecordTo(*recordURL, os.Getenv("INFLUXDB_TOKEN"), os.Getenv("INFLUXDB_ORGANIZATION"))
+	}
+
+	log.Printf("Serving fake InfluxDB at %s with organization %q (ID %s) and bucket %q",
+		*addr, *org, *organization.Id, *bucket)
+	log.Fatal(http.ListenAndServe(*addr, server))
+}
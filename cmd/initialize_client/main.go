@@ -2,14 +2,15 @@ package main
 
 import (
 	"context"
-	"os"
+	"log"
 
-	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/go-snippets/internal/influxclient"
 )
 
 func main() {
-	token := os.Getenv("INFLUXDB_TOKEN")
-	url := os.Getenv("INFLUXDB_HOST")
-	client := influxdb2.NewClient(url, token)
+	client, err := influxclient.NewFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
 	client.Ping(context.Background())
 }
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"golang.org/x/net/websocket"
+)
+
+// livePoint is the message sent to the profile page for each newly written point.
+type livePoint struct {
+	Time        time.Time `json:"time"`
+	Measurement string    `json:"measurement"`
+	Field       string    `json:"field"`
+	Value       float64   `json:"value"`
+}
+
+// liveBuffer is the number of points a live feed may fall behind by before it
+// is disconnected. The profile page reconnects automatically.
+const liveBuffer = 64
+
+var (
+	liveFeedsMu sync.Mutex
+	// liveFeeds holds a channel for each open live feed, by the email of the
+	// user who opened it.
+	liveFeeds = make(map[string]map[chan livePoint]struct{})
+)
+
+// publishPoint sends each field of a point newly written by a user to every
+// live feed the user has open.
+func publishPoint(email string, point *write.Point) {
+	liveFeedsMu.Lock()
+	defer liveFeedsMu.Unlock()
+	feeds := liveFeeds[email]
+	for _, field := range point.FieldList() {
+		value, ok := toFloat(field.Value)
+		if !ok {
+			continue // Only numeric fields can be graphed.
+		}
+		message := livePoint{
+			Time:        point.Time(),
+			Measurement: point.Name(),
+			Field:       field.Key,
+			Value:       value,
+		}
+		for feed := range feeds {
+			select {
+			case feed <- message:
+			default:
+				// The feed is too slow to keep up; drop it rather than block writes.
+				removeLiveFeed(email, feed)
+			}
+		}
+	}
+}
+
+// removeLiveFeed closes a live feed of a user and forgets it. liveFeedsMu must
+// be held.
+func removeLiveFeed(email string, feed chan livePoint) {
+	feeds := liveFeeds[email]
+	if _, ok := feeds[feed]; !ok {
+		return
+	}
+	delete(feeds, feed)
+	close(feed)
+	if len(feeds) == 0 {
+		delete(liveFeeds, email)
+	}
+}
+
+// toFloat converts a numeric field value to a float64.
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// liveDataHandler streams the points written by the logged in user over a
+// WebSocket until either side closes the connection. The profile page uses it
+// to extend its graph as new data arrives. The feed stays with the user who
+// opened it, and so doesn't receive the points of anyone logging in later.
+func liveDataHandler(ws *websocket.Conn) {
+	defer ws.Close()
+	user := activeUser
+	if !user.valid {
+		fmt.Println("Not logged in, refusing live data connection.")
+		return
+	}
+
+	feed := make(chan livePoint, liveBuffer)
+	liveFeedsMu.Lock()
+	if liveFeeds[user.email] == nil {
+		liveFeeds[user.email] = make(map[chan livePoint]struct{})
+	}
+	liveFeeds[user.email][feed] = struct{}{}
+	liveFeedsMu.Unlock()
+	defer func() {
+		liveFeedsMu.Lock()
+		removeLiveFeed(user.email, feed)
+		liveFeedsMu.Unlock()
+	}()
+
+	// The page never sends anything, so reading only serves to notice when the
+	// connection is closed.
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, ws)
+		close(closed)
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case point, ok := <-feed:
+			if !ok {
+				return
+			}
+			if err := websocket.JSON.Send(ws, point); err != nil {
+				fmt.Printf("Live data send failed: %q\n", err)
+				return
+			}
+		}
+	}
+}
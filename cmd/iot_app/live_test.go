@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"golang.org/x/net/websocket"
+)
+
+// openLiveFeed opens a live feed of the logged in user, and waits for the app
+// to register it.
+func openLiveFeed(t *testing.T, appURL string) *websocket.Conn {
+	t.Helper()
+	email := activeUser.email
+	liveFeedsMu.Lock()
+	open := len(liveFeeds[email])
+	liveFeedsMu.Unlock()
+
+	wsURL := "ws" + strings.TrimPrefix(appURL, "http") + "/graph_live_data"
+	ws, err := websocket.Dial(wsURL, "", appURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		liveFeedsMu.Lock()
+		registered := len(liveFeeds[email]) > open
+		liveFeedsMu.Unlock()
+		if registered {
+			return ws
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the live feed of %s was never registered", email)
+		}
+	}
+}
+
+// receiveLivePoint receives the next point of a live feed.
+func receiveLivePoint(t *testing.T, ws *websocket.Conn) livePoint {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var point livePoint
+	if err := websocket.JSON.Receive(ws, &point); err != nil {
+		t.Fatal(err)
+	}
+	return point
+}
+
+func TestLiveDataIsSentToTheUserWhoWroteIt(t *testing.T) {
+	_, appURL, token := newTestApp(t)
+	db := mustLoginDB(t)
+	for _, name := range []string{"minnie", "donald"} {
+		if err := registerUser(db, name+"@example.com", name, "secret", token, token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeData := func() {
+		t.Helper()
+		resp, err := http.Post(appURL+"/graph_write_data", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("got status %d writing data, want 200", resp.StatusCode)
+		}
+	}
+
+	if ws, err := websocket.Dial("ws"+strings.TrimPrefix(appURL, "http")+"/graph_live_data", "", appURL); err == nil {
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var point livePoint
+		if err := websocket.JSON.Receive(ws, &point); err == nil {
+			t.Errorf("got point %+v without logging in", point)
+		}
+		ws.Close()
+	}
+
+	postForm(t, appURL+"/login", url.Values{"email": {"minnie@example.com"}, "password": {"secret"}})
+	minnie := openLiveFeed(t, appURL)
+	writeData()
+	if point := receiveLivePoint(t, minnie); point.Measurement != "measurement1" || point.Field != "field1" {
+		t.Errorf("got point %+v, want field1 of measurement1", point)
+	}
+
+	// Once donald logs in, the points donald writes are sent to donald's feed
+	// and not to minnie's.
+	postForm(t, appURL+"/login", url.Values{"email": {"donald@example.com"}, "password": {"secret"}})
+	donald := openLiveFeed(t, appURL)
+	writeData()
+	if point := receiveLivePoint(t, donald); point.Field != "field1" {
+		t.Errorf("got point %+v on the feed of donald, want field1", point)
+	}
+	publishPoint("minnie@example.com", write.NewPoint("measurement2", nil,
+		map[string]interface{}{"field2": 1.5}, time.Now()))
+	if point := receiveLivePoint(t, minnie); point.Measurement != "measurement2" || point.Value != 1.5 {
+		t.Errorf("got point %+v on the feed of minnie, want only minnie's own measurement2", point)
+	}
+}
@@ -22,12 +22,18 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/influxdata/influxdb-client-go/v2/api"
 	"github.com/influxdata/influxdb-client-go/v2/api/write"
 	_ "github.com/mattn/go-sqlite3" // Need the sqlite3 driver.
+	"golang.org/x/net/websocket"
+
+	"github.com/influxdata/go-snippets/internal/flux"
+	"github.com/influxdata/go-snippets/internal/influxclient"
+	"github.com/influxdata/go-snippets/internal/storeforward"
 )
 
 type User struct {
@@ -44,12 +50,26 @@ var (
 	writeClient influxdb2.Client
 	queryJson   string
 
-	hostUrl = os.Getenv("INFLUXDB_HOST")
-	orgId   = os.Getenv("INFLUXDB_ORGANIZATION_ID")
-	bucket  = os.Getenv("INFLUX_BUCKET")
+	// clientConfig configures the InfluxDB clients of the logged in user, and is
+	// read from INFLUXDB_HOST and the other INFLUXDB_ environment variables
+	// described in internal/influxclient.
+	clientConfig influxclient.Config
+	orgId        = os.Getenv("INFLUXDB_ORGANIZATION_ID")
+	bucket       = os.Getenv("INFLUX_BUCKET")
+
+	// Offline mode, enabled by setting IOT_APP_OFFLINE_BUFFER, buffers written
+	// points on disk while InfluxDB cannot be reached.
+	offlineBuffer *storeforward.Buffer
+
+	// forwarderMu guards the forwarder, which is replaced at each login while
+	// handlers write through it.
+	forwarderMu   sync.Mutex
+	forwarder     *storeforward.Forwarder
+	stopForwarder context.CancelFunc
 )
 
-const loginDatabase = "logins.db"
+// loginDatabase is the path of the local login database.
+var loginDatabase = "logins.db"
 
 // getLoginDB connects to the local login database. Creates one with a default account if there isn't one.
 func getLoginDB() (*sql.DB, error) {
@@ -141,8 +161,13 @@ func tryLoginCredentials(db *sql.DB, user string, plainPassword string) error {
 		activeUser = newUser
 
 		// Update our read/write clients since we just retrieved the tokens.
-		readClient = influxdb2.NewClient(hostUrl, readToken)
-		writeClient = influxdb2.NewClient(hostUrl, writeToken)
+		if readClient, err = newClient(readToken); err != nil {
+			return fmt.Errorf("failed to create read client: %q", err)
+		}
+		if writeClient, err = newClient(writeToken); err != nil {
+			return fmt.Errorf("failed to create write client: %q", err)
+		}
+		startForwarder()
 
 		return nil
 	}
@@ -150,6 +175,14 @@ func tryLoginCredentials(db *sql.DB, user string, plainPassword string) error {
 	return errors.New("failed to find any matching user account emails")
 }
 
+// newClient returns an InfluxDB client configured by clientConfig that
+// authenticates with token.
+func newClient(token string) (influxdb2.Client, error) {
+	config := clientConfig
+	config.Token = token
+	return influxclient.New(config)
+}
+
 func registerUser(db *sql.DB, email string, name string, password string, readToken string, writeToken string) error {
 	hasher := sha256.New()
 	hasher.Write([]byte(password))
@@ -173,11 +206,9 @@ func registerUser(db *sql.DB, email string, name string, password string, readTo
 func queryData(cl influxdb2.Client) (*api.QueryTableResult, error) {
 	queryApi := cl.QueryAPI(orgId)
 
-	params := map[string]string{
-		"bucket_name": bucket,
-	}
-	query := `from(bucket: params.bucket_name)
-				|> range(start: -100h)`
+	query, params := flux.From(bucket).
+		Range(flux.Duration(-100 * time.Hour)).
+		Render()
 	results, err := queryApi.QueryWithParams(context.Background(), query, params)
 	if err != nil {
 		return nil, fmt.Errorf("failed to run db query: %q", err)
@@ -186,6 +217,31 @@ func queryData(cl influxdb2.Client) (*api.QueryTableResult, error) {
 	return results, nil
 }
 
+// startForwarder starts forwarding buffered points with the write client of
+// the logged in user, if offline mode is enabled.
+func startForwarder() {
+	if offlineBuffer == nil {
+		return
+	}
+	forwarderMu.Lock()
+	defer forwarderMu.Unlock()
+	if stopForwarder != nil {
+		stopForwarder()
+	}
+	var ctx context.Context
+	ctx, stopForwarder = context.WithCancel(context.Background())
+	forwarder = storeforward.NewForwarder(writeClient, orgId, bucket, offlineBuffer)
+	go forwarder.Run(ctx)
+}
+
+// currentForwarder returns the forwarder of the logged in user, or nil if
+// offline mode is disabled or no one has logged in yet.
+func currentForwarder() *storeforward.Forwarder {
+	forwarderMu.Lock()
+	defer forwarderMu.Unlock()
+	return forwarder
+}
+
 // writeData writes a random data point.
 func writeData(cl influxdb2.Client) error {
 	writeApi := cl.WriteAPIBlocking(orgId, bucket)
@@ -199,10 +255,17 @@ func writeData(cl influxdb2.Client) error {
 	}
 
 	point := write.NewPoint("measurement1", tags, fields, time.Now())
+	if forwarder := currentForwarder(); forwarder != nil {
+		// In offline mode, the point is buffered if InfluxDB can't be reached.
+		writeApi = forwarder
+	}
 	if err := writeApi.WritePoint(context.Background(), point); err != nil {
 		return fmt.Errorf("failed to run db write: %q", err)
 	}
 
+	// Let the live feeds of the user know about the new point.
+	publishPoint(activeUser.email, point)
+
 	return nil
 }
 
@@ -318,6 +381,30 @@ func writeDataHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// bufferStatsHandler reports on the offline buffer: how many points are
+// buffered, how old the oldest of them is and whether InfluxDB can currently be
+// reached.
+func bufferStatsHandler(w http.ResponseWriter, r *http.Request) {
+	var response struct {
+		Enabled bool `json:"enabled"`
+		Online  bool `json:"online"`
+		storeforward.Stats
+	}
+	if offlineBuffer != nil {
+		stats, err := offlineBuffer.Stats(r.Context())
+		if err != nil {
+			fmt.Printf("Buffer stats failed: %q\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		response.Enabled, response.Stats = true, stats
+		forwarder := currentForwarder()
+		response.Online = forwarder != nil && forwarder.Online()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
 func signupHandler(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
@@ -345,13 +432,15 @@ func signupHandler(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func setupWebHandlers(db *sql.DB) {
-	http.HandleFunc("/", indexHandler)
-	http.HandleFunc("/login", loginHandler(db))
-	http.HandleFunc("/profile", profileHandler)
-	http.HandleFunc("/graph_query_data", queryDataHandler)
-	http.HandleFunc("/graph_write_data", writeDataHandler)
-	http.HandleFunc("/signup", signupHandler(db))
+func setupWebHandlers(mux *http.ServeMux, db *sql.DB) {
+	mux.HandleFunc("/", indexHandler)
+	mux.HandleFunc("/login", loginHandler(db))
+	mux.HandleFunc("/profile", profileHandler)
+	mux.HandleFunc("/graph_query_data", queryDataHandler)
+	mux.HandleFunc("/graph_write_data", writeDataHandler)
+	mux.Handle("/graph_live_data", websocket.Handler(liveDataHandler))
+	mux.HandleFunc("/buffer_stats", bufferStatsHandler)
+	mux.HandleFunc("/signup", signupHandler(db))
 }
 
 func main() {
@@ -362,8 +451,13 @@ func main() {
 	}
 	defer db.Close()
 
+	clientConfig, err = influxclient.ConfigFromEnv("INFLUXDB")
+	if err != nil {
+		log.Fatalf("InfluxDB client configuration failed: %q", err)
+	}
+
 	// Make sure the host URL has a scheme, and default to https if not.
-	parsedUrl, err := url.Parse(hostUrl)
+	parsedUrl, err := url.Parse(clientConfig.URL)
 	if err != nil {
 		log.Fatalf("Host URL parsing failed: %q", err)
 	}
@@ -373,10 +467,15 @@ func main() {
 	if !strings.EqualFold(parsedUrl.Scheme, "http") && !strings.EqualFold(parsedUrl.Scheme, "https") {
 		parsedUrl.Scheme = "https"
 	}
-	hostUrl = parsedUrl.String()
+	clientConfig.URL = parsedUrl.String()
+
+	offlineBuffer, err = storeforward.OpenFromEnv("IOT_APP")
+	if err != nil {
+		log.Fatalf("Opening offline buffer failed: %q", err)
+	}
 
 	fmt.Println("Starting server at http://localhost:8080")
 
-	setupWebHandlers(db)
+	setupWebHandlers(http.DefaultServeMux, db)
 	http.ListenAndServe(":8080", nil)
 }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/influxdata/go-snippets/internal/fakeinflux"
+	"github.com/influxdata/go-snippets/internal/influxclient"
+)
+
+// newTestApp serves the handlers of the app with a login database in a
+// temporary directory and its clients pointed at a fake InfluxDB with an
+// organization named my-org holding a bucket named my-bucket.
+func newTestApp(t *testing.T) (*fakeinflux.Server, string, string) {
+	t.Helper()
+	influx := fakeinflux.New("my-token")
+	org := influx.CreateOrganization("my-org")
+	influx.CreateBucket(*org.Id, "my-bucket")
+	influxServer := httptest.NewServer(influx)
+	t.Cleanup(influxServer.Close)
+
+	// The fake looks organizations up by name, which InfluxDB also accepts.
+	clientConfig = influxclient.Config{URL: influxServer.URL}
+	orgId, bucket = "my-org", "my-bucket"
+	activeUser = User{}
+	offlineBuffer = nil
+	forwarderMu.Lock()
+	if stopForwarder != nil {
+		stopForwarder()
+	}
+	forwarder, stopForwarder = nil, nil
+	forwarderMu.Unlock()
+
+	loginDatabase = filepath.Join(t.TempDir(), "logins.db")
+	db, err := getLoginDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	mux := http.NewServeMux()
+	setupWebHandlers(mux, db)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	token := *influx.CreateAuthorization(*org.Id, "iot_app").Token
+	return influx, server.URL, token
+}
+
+// postForm posts a form to the app without following redirects.
+func postForm(t *testing.T, target string, form url.Values) *http.Response {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.PostForm(target, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestSignupAndLogin(t *testing.T) {
+	_, appURL, token := newTestApp(t)
+
+	resp := postForm(t, appURL+"/signup", url.Values{
+		"email": {"minnie@example.com"}, "name": {"minnie"}, "password": {"secret"},
+		"readToken": {token}, "writeToken": {token},
+	})
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/login" {
+		t.Fatalf("got status %d redirecting to %q from signup, want 303 to /login", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	resp = postForm(t, appURL+"/login", url.Values{"email": {"minnie@example.com"}, "password": {"wrong"}})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got status %d with the wrong password, want 403", resp.StatusCode)
+	}
+	if activeUser.valid {
+		t.Error("a failed login logged the user in")
+	}
+
+	resp = postForm(t, appURL+"/login", url.Values{"email": {"minnie@example.com"}, "password": {"secret"}})
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/profile" {
+		t.Fatalf("got status %d redirecting to %q from login, want 303 to /profile", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if !activeUser.valid || activeUser.name != "minnie" {
+		t.Errorf("got active user %+v, want minnie", activeUser)
+	}
+}
+
+func TestWriteAndQueryData(t *testing.T) {
+	influx, appURL, token := newTestApp(t)
+	if err := registerUser(mustLoginDB(t), "minnie@example.com", "minnie", "secret", token, token); err != nil {
+		t.Fatal(err)
+	}
+	postForm(t, appURL+"/login", url.Values{"email": {"minnie@example.com"}, "password": {"secret"}})
+
+	resp, err := http.Post(appURL+"/graph_write_data", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d writing data, want 200", resp.StatusCode)
+	}
+	points := influx.Points()
+	if len(points) != 1 {
+		t.Fatalf("got %d points in InfluxDB, want 1", len(points))
+	}
+	point := points[0]
+	if point.Measurement != "measurement1" || point.Bucket != "my-bucket" || point.Tags["tagname1"] != "tagvalue1" {
+		t.Errorf("got point %+v, want measurement1 tagged tagname1=tagvalue1 in my-bucket", point)
+	}
+	written, ok := point.Fields["field1"].(float64)
+	if !ok || written < -64 || written > 64 {
+		t.Errorf("got field1 %v, want a float between -64 and 64", point.Fields["field1"])
+	}
+
+	resp, err = http.Get(appURL + "/graph_query_data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d (%s) querying data, want 200", resp.StatusCode, body)
+	}
+	// The graph data is encoded as a JSON string holding the JSON expected by
+	// Plotly.js.
+	var encoded string
+	var graph []struct {
+		X []int     `json:"x"`
+		Y []float64 `json:"y"`
+	}
+	if err := json.Unmarshal(body, &encoded); err != nil {
+		t.Fatalf("failed to decode %q: %v", body, err)
+	}
+	if err := json.Unmarshal([]byte(encoded), &graph); err != nil {
+		t.Fatalf("failed to decode %q: %v", encoded, err)
+	}
+	if len(graph) != 1 || len(graph[0].Y) != 1 || float32(graph[0].Y[0]) != float32(written) {
+		t.Errorf("got graph data %s, want the written value %v", encoded, written)
+	}
+}
+
+func TestWriteDataFailure(t *testing.T) {
+	influx, appURL, token := newTestApp(t)
+	if err := registerUser(mustLoginDB(t), "minnie@example.com", "minnie", "secret", token, token); err != nil {
+		t.Fatal(err)
+	}
+	postForm(t, appURL+"/login", url.Values{"email": {"minnie@example.com"}, "password": {"secret"}})
+
+	influx.FailNext("/api/v2/write", http.StatusServiceUnavailable, "down for maintenance", 0)
+	resp, err := http.Post(appURL+"/graph_write_data", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusInternalServerError || !strings.Contains(string(body), "down for maintenance") {
+		t.Errorf("got status %d (%s), want 500 with the error", resp.StatusCode, body)
+	}
+	if points := influx.Points(); len(points) != 0 {
+		t.Errorf("got %d points in InfluxDB after a failed write, want none", len(points))
+	}
+}
+
+func TestBufferStats(t *testing.T) {
+	_, appURL, _ := newTestApp(t)
+	resp, err := http.Get(appURL + "/buffer_stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var stats struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || stats.Enabled {
+		t.Errorf("got status %d enabled %v, want 200 with offline mode disabled", resp.StatusCode, stats.Enabled)
+	}
+}
+
+// mustLoginDB opens the login database of the test app.
+func mustLoginDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := getLoginDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
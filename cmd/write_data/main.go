@@ -6,14 +6,16 @@ import (
 	"os"
 	"time"
 
-	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/influxdata/influxdb-client-go/v2/api/write"
+
+	"github.com/influxdata/go-snippets/internal/influxclient"
 )
 
 func main() {
-	token := os.Getenv("INFLUXDB_TOKEN")
-	url := os.Getenv("INFLUXDB_HOST")
-	client := influxdb2.NewClient(url, token)
+	client, err := influxclient.NewFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	org := os.Getenv("INFLUXDB_ORGANIZATION")
 	bucket := os.Getenv("INFLUXDB_BUCKET")
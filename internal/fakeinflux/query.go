@@ -0,0 +1,410 @@
+package fakeinflux
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cannedQuery is an annotated CSV response served for matching queries.
+type cannedQuery struct {
+	match    *regexp.Regexp
+	response string
+}
+
+// queryRequest is the body the client posts to the query endpoint.
+type queryRequest struct {
+	Query  string                 `json:"query"`
+	Params map[string]interface{} `json:"params"`
+}
+
+// upstream is a real InfluxDB instance that unmatched queries are forwarded to
+// so that their responses can be recorded.
+type upstream struct {
+	url, token, org string
+	client          *http.Client
+}
+
+// HandleQuery serves response, which must be annotated CSV, to every query
+// whose Flux matches the regular expression pattern. Patterns are tried in the
+// order they were added, after any recorded responses.
+func (s *Server) HandleQuery(pattern, response string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queries = append(s.queries, cannedQuery{regexp.MustCompile(pattern), response})
+}
+
+// ReplayFrom serves recorded responses from dir. A query whose Flux and
+// parameters were recorded with RecordTo is answered with the stored response.
+func (s *Server) ReplayFrom(dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recordings = dir
+}
+
+// RecordTo forwards queries without a recorded or canned response to the
+// InfluxDB instance at url and stores the responses in the directory set with
+// ReplayFrom, so that later runs can replay them without the upstream server.
+func (s *Server) RecordTo(url, token, org string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.upstream = &upstream{url: strings.TrimSuffix(url, "/"), token: token, org: org, client: &http.Client{Timeout: time.Minute}}
+}
+
+// query answers a Flux query from recordings, canned responses, the upstream
+// server or, failing those, from the points written to the queried bucket.
+func (s *Server) query(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	body, err := readBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var request queryRequest
+	if err := json.Unmarshal(body, &request); err != nil || request.Query == "" {
+		writeError(w, http.StatusBadRequest, "failed to decode request body: query is required")
+		return
+	}
+
+	s.mu.Lock()
+	values := r.URL.Query()
+	org, ok := s.findOrganization(values.Get("org"), values.Get("orgID"))
+	recordings, up := s.recordings, s.upstream
+	var canned *cannedQuery
+	for i := range s.queries {
+		if s.queries[i].match.MatchString(request.Query) {
+			canned = &s.queries[i]
+			break
+		}
+	}
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "organization not found")
+		return
+	}
+
+	recording := ""
+	if recordings != "" {
+		recording = filepath.Join(recordings, recordingKey(request)+".csv")
+		if response, err := os.ReadFile(recording); err == nil {
+			writeCSV(w, string(response))
+			return
+		}
+	}
+	if canned != nil {
+		writeCSV(w, canned.response)
+		return
+	}
+	if up != nil && recording != "" {
+		response, err := up.query(body)
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		if err := os.WriteFile(recording, []byte(response), 0o644); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeCSV(w, response)
+		return
+	}
+
+	s.mu.Lock()
+	points := s.matchingPoints(*org.Id, request)
+	s.mu.Unlock()
+	writeCSV(w, renderPoints(points))
+}
+
+// recordingKey identifies a query and its parameters in the recordings directory.
+func recordingKey(request queryRequest) string {
+	params, _ := json.Marshal(request.Params) // Map keys are marshalled in sorted order.
+	sum := sha256.Sum256(append([]byte(request.Query+"\n"), params...))
+	return hex.EncodeToString(sum[:])
+}
+
+// query posts body to the upstream query endpoint and returns the response.
+func (u *upstream) query(body []byte) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, u.url+"/api/v2/query?org="+u.org, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Token "+u.token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/csv")
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	response, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("upstream query failed with status %d: %s", resp.StatusCode, response)
+	}
+	return string(response), nil
+}
+
+// writeCSV writes an annotated CSV query response.
+func writeCSV(w http.ResponseWriter, response string) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, response)
+}
+
+var (
+	// bucketPattern finds the bucket a query reads from.
+	bucketPattern = regexp.MustCompile(`from\(\s*bucket\s*:\s*(?:"([^"]*)"|params\.(\w+))`)
+	// equalityPattern finds simple equality predicates in filter functions.
+	equalityPattern = regexp.MustCompile(`r\.(\w+)\s*==\s*(?:"([^"]*)"|params\.(\w+))`)
+	// measurementExclusionPattern finds regular expressions that measurements
+	// must not match in filter functions.
+	measurementExclusionPattern = regexp.MustCompile(`r\._measurement\s*!~\s*/((?:[^/\\]|\\.)*)/`)
+	// rangePattern finds the absolute start and stop passed to range(), either
+	// as time literals or as parameters converted with time().
+	rangePattern = regexp.MustCompile(`range\(\s*start\s*:\s*` + timeExpr + `(?:\s*,\s*stop\s*:\s*` + timeExpr + `)?\s*\)`)
+	// timeComparisonPattern finds comparisons of _time in filter functions.
+	timeComparisonPattern = regexp.MustCompile(`r\._time\s*(>=|>|<=|<)\s*` + timeExpr)
+)
+
+// timeExpr matches a time literal or a parameter converted with time(), and
+// captures either the literal or the name of the parameter.
+const timeExpr = `(?:([0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9:.]+(?:Z|[+-][0-9:]+))|time\(v:\s*params\.(\w+)\))`
+
+// timeBound is a bound on the times of the points a query reads.
+type timeBound struct {
+	op string // One of >=, >, <= or <.
+	t  time.Time
+}
+
+func (b timeBound) admits(t time.Time) bool {
+	switch b.op {
+	case ">=":
+		return !t.Before(b.t)
+	case ">":
+		return t.After(b.t)
+	case "<=":
+		return !t.After(b.t)
+	}
+	return t.Before(b.t)
+}
+
+// matchingPoints returns the points that a query would plausibly read: those
+// in the bucket passed to from() that satisfy every equality predicate found in
+// the query, whose measurements don't match any regular expression they are
+// excluded by, and that lie within its range and any comparisons of _time with
+// absolute times. Relative ranges, such as -24h, the ranges of queries that
+// read data more than once, and all other transformations are ignored. The
+// caller must hold s.mu.
+func (s *Server) matchingPoints(orgID string, request queryRequest) []Point {
+	param := func(name string) string {
+		return fmt.Sprint(request.Params[name])
+	}
+	bucket := ""
+	if match := bucketPattern.FindStringSubmatch(request.Query); match != nil {
+		bucket = match[1]
+		if match[2] != "" {
+			bucket = param(match[2])
+		}
+	}
+	predicates := make(map[string]string)
+	for _, match := range equalityPattern.FindAllStringSubmatch(request.Query, -1) {
+		predicates[match[1]] = match[2]
+		if match[3] != "" {
+			predicates[match[1]] = param(match[3])
+		}
+	}
+	var exclusions []*regexp.Regexp
+	for _, match := range measurementExclusionPattern.FindAllStringSubmatch(request.Query, -1) {
+		if pattern, err := regexp.Compile(strings.ReplaceAll(match[1], `\/`, "/")); err == nil {
+			exclusions = append(exclusions, pattern)
+		}
+	}
+
+	if strings.Count(request.Query, "range(") != 1 {
+		// The bounds of each pipeline of the query can't be told apart.
+		return s.filterPoints(orgID, bucket, predicates, exclusions, nil)
+	}
+	var bounds []timeBound
+	addBound := func(op, literal, name string) {
+		if name != "" {
+			literal = param(name)
+		}
+		if t, err := time.Parse(time.RFC3339Nano, literal); err == nil {
+			bounds = append(bounds, timeBound{op, t})
+		}
+	}
+	if match := rangePattern.FindStringSubmatch(request.Query); match != nil {
+		addBound(">=", match[1], match[2])
+		if match[3] != "" || match[4] != "" {
+			addBound("<", match[3], match[4])
+		}
+	}
+	for _, match := range timeComparisonPattern.FindAllStringSubmatch(request.Query, -1) {
+		addBound(match[1], match[2], match[3])
+	}
+
+	return s.filterPoints(orgID, bucket, predicates, exclusions, bounds)
+}
+
+// filterPoints returns the points in a bucket that satisfy every predicate,
+// whose measurements match none of the exclusions, and that lie within every
+// bound. The caller must hold s.mu.
+func (s *Server) filterPoints(orgID, bucket string, predicates map[string]string, exclusions []*regexp.Regexp, bounds []timeBound) []Point {
+	var points []Point
+	for _, point := range s.points {
+		if point.OrgID != orgID || (bucket != "" && point.Bucket != bucket) {
+			continue
+		}
+		matches := true
+		for _, bound := range bounds {
+			matches = matches && bound.admits(point.Time)
+		}
+		for _, exclusion := range exclusions {
+			matches = matches && !exclusion.MatchString(point.Measurement)
+		}
+		for column, value := range predicates {
+			switch column {
+			case "_measurement":
+				matches = matches && point.Measurement == value
+			case "_field":
+				_, ok := point.Fields[value]
+				matches = matches && ok
+			default:
+				matches = matches && point.Tags[column] == value
+			}
+		}
+		if matches {
+			points = append(points, point)
+		}
+	}
+	return points
+}
+
+// fluxTable is one table of a rendered query response.
+type fluxTable struct {
+	measurement, field, datatype string
+	tags                         map[string]string
+	rows                         [][2]string // _time and _value
+}
+
+// renderPoints renders points as annotated CSV with one table per series and
+// field, in the shape a from() |> range() query would return.
+func renderPoints(points []Point) string {
+	var tables []*fluxTable
+	byKey := make(map[string]*fluxTable)
+	for _, point := range points {
+		for field, value := range point.Fields {
+			datatype, formatted := fluxValue(value)
+			key := seriesKey(point.Measurement, point.Tags) + " " + field + " " + datatype
+			table, ok := byKey[key]
+			if !ok {
+				table = &fluxTable{measurement: point.Measurement, field: field, datatype: datatype, tags: point.Tags}
+				byKey[key] = table
+				tables = append(tables, table)
+			}
+			table.rows = append(table.rows, [2]string{point.Time.UTC().Format(time.RFC3339Nano), formatted})
+		}
+	}
+	if len(tables) == 0 {
+		return "\r\n"
+	}
+
+	var start, stop time.Time
+	for _, point := range points {
+		if start.IsZero() || point.Time.Before(start) {
+			start = point.Time
+		}
+		if point.Time.After(stop) {
+			stop = point.Time
+		}
+	}
+	bounds := [2]string{start.UTC().Format(time.RFC3339Nano), stop.Add(time.Nanosecond).UTC().Format(time.RFC3339Nano)}
+
+	var buf bytes.Buffer
+	out := csv.NewWriter(&buf)
+	out.UseCRLF = true
+	for i, table := range tables {
+		if i > 0 {
+			out.Flush()
+			buf.WriteString("\r\n")
+		}
+		tagKeys := make([]string, 0, len(table.tags))
+		for key := range table.tags {
+			tagKeys = append(tagKeys, key)
+		}
+		sort.Strings(tagKeys)
+
+		datatypes := []string{"#datatype", "string", "long", "dateTime:RFC3339", "dateTime:RFC3339", "dateTime:RFC3339", table.datatype, "string", "string"}
+		groups := []string{"#group", "false", "false", "true", "true", "false", "false", "true", "true"}
+		defaults := []string{"#default", "_result", "", "", "", "", "", "", ""}
+		header := []string{"", "result", "table", "_start", "_stop", "_time", "_value", "_field", "_measurement"}
+		for _, key := range tagKeys {
+			datatypes = append(datatypes, "string")
+			groups = append(groups, "true")
+			defaults = append(defaults, "")
+			header = append(header, key)
+		}
+		out.Write(datatypes)
+		out.Write(groups)
+		out.Write(defaults)
+		out.Write(header)
+		for _, row := range table.rows {
+			record := []string{"", "", strconv.Itoa(i), bounds[0], bounds[1], row[0], row[1], table.field, table.measurement}
+			for _, key := range tagKeys {
+				record = append(record, table.tags[key])
+			}
+			out.Write(record)
+		}
+	}
+	out.Flush()
+	buf.WriteString("\r\n")
+	return buf.String()
+}
+
+// seriesKey identifies the series of a point by its measurement and tag set.
+func seriesKey(measurement string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(measurement)
+	for _, key := range keys {
+		fmt.Fprintf(&b, ",%s=%s", key, tags[key])
+	}
+	return b.String()
+}
+
+// fluxValue returns the annotated CSV data type and formatted value of a field.
+func fluxValue(value interface{}) (string, string) {
+	switch v := value.(type) {
+	case float64:
+		return "double", strconv.FormatFloat(v, 'f', -1, 64)
+	case int64:
+		return "long", strconv.FormatInt(v, 10)
+	case uint64:
+		return "unsignedLong", strconv.FormatUint(v, 10)
+	case bool:
+		return "boolean", strconv.FormatBool(v)
+	default:
+		return "string", fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,457 @@
+package fakeinflux
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/domain"
+)
+
+// resourceID returns the path segment following prefix, or an empty string if
+// the request addresses the collection or a nested resource.
+func resourceID(r *http.Request, prefix string) string {
+	id := strings.TrimPrefix(r.URL.Path, prefix)
+	if strings.Contains(id, "/") {
+		return ""
+	}
+	return id
+}
+
+// findOrganization looks up an organization by name or ID. The caller must hold s.mu.
+func (s *Server) findOrganization(name, id string) (domain.Organization, bool) {
+	for _, org := range s.orgs {
+		if (id != "" && *org.Id == id) || (id == "" && org.Name == name) {
+			return org, true
+		}
+	}
+	return domain.Organization{}, false
+}
+
+// createOrganization adds an organization. The caller must hold s.mu.
+func (s *Server) createOrganization(name string) domain.Organization {
+	now := time.Now().UTC()
+	id := s.nextID()
+	status := domain.OrganizationStatusActive
+	org := domain.Organization{Id: &id, Name: name, Status: &status, CreatedAt: &now, UpdatedAt: &now}
+	s.orgs = append(s.orgs, org)
+	return org
+}
+
+func (s *Server) orgsCollection(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		values := r.URL.Query()
+		orgs := []domain.Organization{}
+		for _, org := range s.orgs {
+			if (values.Get("org") == "" || org.Name == values.Get("org")) &&
+				(values.Get("orgID") == "" || *org.Id == values.Get("orgID")) {
+				orgs = append(orgs, org)
+			}
+		}
+		if len(orgs) == 0 && (values.Get("org") != "" || values.Get("orgID") != "") {
+			writeError(w, http.StatusNotFound, "organization not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, domain.Organizations{Orgs: &orgs})
+	case http.MethodPost:
+		var request domain.PostOrganizationRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Name == "" {
+			writeError(w, http.StatusBadRequest, "organization name is required")
+			return
+		}
+		if _, ok := s.findOrganization(request.Name, ""); ok {
+			writeError(w, http.StatusConflict, "organization with name "+request.Name+" already exists")
+			return
+		}
+		writeJSON(w, http.StatusCreated, s.createOrganization(request.Name))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *Server) orgsResource(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := resourceID(r, "/api/v2/orgs/")
+	for i, org := range s.orgs {
+		if *org.Id != id {
+			continue
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, org)
+		case http.MethodDelete:
+			s.orgs = append(s.orgs[:i], s.orgs[i+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	}
+	writeError(w, http.StatusNotFound, "organization not found")
+}
+
+// findBucket looks up a bucket of an organization by name or ID. The caller
+// must hold s.mu.
+func (s *Server) findBucket(orgID, nameOrID string) (domain.Bucket, bool) {
+	for _, bucket := range s.buckets {
+		if *bucket.OrgID == orgID && (bucket.Name == nameOrID || *bucket.Id == nameOrID) {
+			return bucket, true
+		}
+	}
+	return domain.Bucket{}, false
+}
+
+// createBucket adds a bucket. The caller must hold s.mu.
+func (s *Server) createBucket(request domain.PostBucketRequest) domain.Bucket {
+	now := time.Now().UTC()
+	id, orgID := s.nextID(), request.OrgID
+	bucketType := domain.BucketTypeUser
+	rules := request.RetentionRules
+	if rules == nil {
+		rules = domain.RetentionRules{}
+	}
+	bucket := domain.Bucket{
+		Id:             &id,
+		Name:           request.Name,
+		OrgID:          &orgID,
+		Description:    request.Description,
+		RetentionRules: rules,
+		Type:           &bucketType,
+		CreatedAt:      &now,
+		UpdatedAt:      &now,
+	}
+	s.buckets = append(s.buckets, bucket)
+	return bucket
+}
+
+func (s *Server) bucketsCollection(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		values := r.URL.Query()
+		orgID := values.Get("orgID")
+		if org, ok := s.findOrganization(values.Get("org"), ""); values.Get("org") != "" && ok {
+			orgID = *org.Id
+		}
+		buckets := []domain.Bucket{}
+		for _, bucket := range s.buckets {
+			if (orgID == "" || *bucket.OrgID == orgID) &&
+				(values.Get("name") == "" || bucket.Name == values.Get("name")) &&
+				(values.Get("id") == "" || *bucket.Id == values.Get("id")) {
+				buckets = append(buckets, bucket)
+			}
+		}
+		writeJSON(w, http.StatusOK, domain.Buckets{Buckets: &buckets})
+	case http.MethodPost:
+		var request domain.PostBucketRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Name == "" {
+			writeError(w, http.StatusBadRequest, "bucket name is required")
+			return
+		}
+		if _, ok := s.findOrganization("", request.OrgID); !ok {
+			writeError(w, http.StatusNotFound, "organization not found")
+			return
+		}
+		if _, ok := s.findBucket(request.OrgID, request.Name); ok {
+			writeError(w, http.StatusUnprocessableEntity, "bucket with name "+request.Name+" already exists")
+			return
+		}
+		writeJSON(w, http.StatusCreated, s.createBucket(request))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *Server) bucketsResource(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := resourceID(r, "/api/v2/buckets/")
+	for i, bucket := range s.buckets {
+		if *bucket.Id != id {
+			continue
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, bucket)
+		case http.MethodDelete:
+			s.buckets = append(s.buckets[:i], s.buckets[i+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	}
+	writeError(w, http.StatusNotFound, "bucket not found")
+}
+
+// checkTaskFlux rejects the scripts of tasks that InfluxDB would fail to
+// compile for want of a task option, or because an import follows another
+// statement, as happens when the task option is prepended to a script that
+// has imports.
+func checkTaskFlux(flux string) error {
+	if !taskOptionPattern.MatchString(flux) {
+		return errors.New("compilation failed: no task options defined")
+	}
+	statements := false
+	for _, line := range strings.Split(flux, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "//"):
+		case strings.HasPrefix(line, "import "):
+			if statements {
+				return fmt.Errorf("compilation failed: %s must come before any other statement", line)
+			}
+		default:
+			statements = true
+		}
+	}
+	return nil
+}
+
+// applyTaskFlux sets the flux of a task along with the name and schedule
+// declared in its option statement.
+func applyTaskFlux(task *domain.Task, flux string) {
+	task.Flux = flux
+	match := taskOptionPattern.FindStringSubmatch(flux)
+	if match == nil {
+		return
+	}
+	if name, ok := taskOptionValue(match[1], "name"); ok {
+		task.Name = name
+	}
+	if every, ok := taskOptionValue(match[1], "every"); ok {
+		task.Every = &every
+	}
+	if cron, ok := taskOptionValue(match[1], "cron"); ok {
+		task.Cron = &cron
+	}
+	if offset, ok := taskOptionValue(match[1], "offset"); ok {
+		task.Offset = &offset
+	}
+}
+
+func (s *Server) tasksCollection(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		values := r.URL.Query()
+		tasks := []domain.Task{}
+		for _, task := range s.tasks {
+			if (values.Get("name") == "" || task.Name == values.Get("name")) &&
+				(values.Get("orgID") == "" || task.OrgID == values.Get("orgID")) &&
+				(values.Get("org") == "" || (task.Org != nil && *task.Org == values.Get("org"))) &&
+				(values.Get("status") == "" || (task.Status != nil && string(*task.Status) == values.Get("status"))) {
+				tasks = append(tasks, task)
+			}
+		}
+		writeJSON(w, http.StatusOK, domain.Tasks{Tasks: &tasks})
+	case http.MethodPost:
+		var request domain.TaskCreateRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Flux == "" {
+			writeError(w, http.StatusBadRequest, "task flux is required")
+			return
+		}
+		if err := checkTaskFlux(request.Flux); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var org domain.Organization
+		var ok bool
+		switch {
+		case request.OrgID != nil:
+			org, ok = s.findOrganization("", *request.OrgID)
+		case request.Org != nil:
+			org, ok = s.findOrganization(*request.Org, "")
+		}
+		if !ok {
+			writeError(w, http.StatusNotFound, "organization not found")
+			return
+		}
+		now := time.Now().UTC()
+		status := domain.TaskStatusTypeActive
+		if request.Status != nil {
+			status = *request.Status
+		}
+		task := domain.Task{
+			Id:          s.nextID(),
+			OrgID:       *org.Id,
+			Org:         &org.Name,
+			Description: request.Description,
+			Status:      &status,
+			CreatedAt:   &now,
+			UpdatedAt:   &now,
+		}
+		applyTaskFlux(&task, request.Flux)
+		s.tasks = append(s.tasks, task)
+		writeJSON(w, http.StatusCreated, task)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *Server) tasksResource(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := resourceID(r, "/api/v2/tasks/")
+	for i := range s.tasks {
+		if s.tasks[i].Id != id {
+			continue
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, s.tasks[i])
+		case http.MethodPatch:
+			var request domain.TaskUpdateRequest
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			task := &s.tasks[i]
+			if request.Flux != nil {
+				if err := checkTaskFlux(*request.Flux); err != nil {
+					writeError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+				applyTaskFlux(task, *request.Flux)
+			}
+			if request.Name != nil {
+				task.Name = *request.Name
+			}
+			if request.Every != nil {
+				task.Every = request.Every
+			}
+			if request.Cron != nil {
+				task.Cron = request.Cron
+			}
+			if request.Offset != nil {
+				task.Offset = request.Offset
+			}
+			if request.Description != nil {
+				task.Description = request.Description
+			}
+			if request.Status != nil {
+				task.Status = request.Status
+			}
+			now := time.Now().UTC()
+			task.UpdatedAt = &now
+			writeJSON(w, http.StatusOK, *task)
+		case http.MethodDelete:
+			s.tasks = append(s.tasks[:i], s.tasks[i+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	}
+	writeError(w, http.StatusNotFound, "task not found")
+}
+
+// createAuthorization adds an authorization. The caller must hold s.mu.
+func (s *Server) createAuthorization(orgID, description string, permissions []domain.Permission) domain.Authorization {
+	now := time.Now().UTC()
+	id := s.nextID()
+	token := "fake-token-" + id
+	status := domain.AuthorizationUpdateRequestStatusActive
+	if permissions == nil {
+		permissions = []domain.Permission{}
+	}
+	auth := domain.Authorization{
+		AuthorizationUpdateRequest: domain.AuthorizationUpdateRequest{
+			Description: &description,
+			Status:      &status,
+		},
+		Id:          &id,
+		OrgID:       &orgID,
+		Permissions: &permissions,
+		Token:       &token,
+		CreatedAt:   &now,
+		UpdatedAt:   &now,
+	}
+	if org, ok := s.findOrganization("", orgID); ok {
+		auth.Org = &org.Name
+	}
+	s.authorizations = append(s.authorizations, auth)
+	return auth
+}
+
+func (s *Server) authorizationsCollection(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		values := r.URL.Query()
+		auths := []domain.Authorization{}
+		for _, auth := range s.authorizations {
+			if (values.Get("orgID") == "" || *auth.OrgID == values.Get("orgID")) &&
+				(values.Get("org") == "" || (auth.Org != nil && *auth.Org == values.Get("org"))) {
+				auths = append(auths, auth)
+			}
+		}
+		writeJSON(w, http.StatusOK, domain.Authorizations{Authorizations: &auths})
+	case http.MethodPost:
+		var request domain.AuthorizationPostRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.OrgID == nil {
+			writeError(w, http.StatusBadRequest, "authorization orgID is required")
+			return
+		}
+		if _, ok := s.findOrganization("", *request.OrgID); !ok {
+			writeError(w, http.StatusNotFound, "organization not found")
+			return
+		}
+		description := ""
+		if request.Description != nil {
+			description = *request.Description
+		}
+		var permissions []domain.Permission
+		if request.Permissions != nil {
+			permissions = *request.Permissions
+		}
+		writeJSON(w, http.StatusCreated, s.createAuthorization(*request.OrgID, description, permissions))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *Server) authorizationsResource(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := resourceID(r, "/api/v2/authorizations/")
+	for i := range s.authorizations {
+		if *s.authorizations[i].Id != id {
+			continue
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, s.authorizations[i])
+		case http.MethodPatch:
+			var request domain.AuthorizationUpdateRequest
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if request.Status != nil {
+				s.authorizations[i].Status = request.Status
+			}
+			if request.Description != nil {
+				s.authorizations[i].Description = request.Description
+			}
+			writeJSON(w, http.StatusOK, s.authorizations[i])
+		case http.MethodDelete:
+			s.authorizations = append(s.authorizations[:i], s.authorizations[i+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	}
+	writeError(w, http.StatusNotFound, "authorization not found")
+}
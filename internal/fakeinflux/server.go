@@ -0,0 +1,424 @@
+// Package fakeinflux implements an in-memory stand-in for the subset of the
+// InfluxDB v2 HTTP API used by the samples in this repository.
+//
+// It is intended for tests and local development only. Writes are parsed from
+// line protocol and kept in memory, queries are answered from recorded or canned
+// annotated CSV responses, and the organizations, buckets, tasks and
+// authorizations APIs store just enough state for the influxdb-client-go module
+// to round-trip its requests. Nothing here evaluates Flux.
+package fakeinflux
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/domain"
+	protocol "github.com/influxdata/line-protocol"
+)
+
+// Version is reported by the /ping and /health endpoints.
+const Version = "fakeinflux"
+
+// Point is a single point received through the write endpoint.
+type Point struct {
+	OrgID       string
+	Bucket      string
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]interface{}
+	Time        time.Time
+}
+
+// Server is an http.Handler serving the fake InfluxDB API. The zero value is
+// not usable; create one with New.
+type Server struct {
+	// Token, when not empty, is an operator token accepted in addition to the
+	// tokens of any authorizations created through the API. When both are empty
+	// requests are not authenticated at all.
+	Token string
+
+	mux *http.ServeMux
+
+	mu             sync.Mutex
+	lastID         uint64
+	orgs           []domain.Organization
+	buckets        []domain.Bucket
+	tasks          []domain.Task
+	authorizations []domain.Authorization
+	points         []Point
+	queries        []cannedQuery
+	failures       map[string][]failure
+	recordings     string
+	upstream       *upstream
+}
+
+// failure is an error response injected with FailNext.
+type failure struct {
+	status     int
+	message    string
+	retryAfter int
+}
+
+// New returns an empty Server that accepts requests using token. Use an empty
+// token to disable authentication.
+func New(token string) *Server {
+	s := &Server{
+		Token:    token,
+		mux:      http.NewServeMux(),
+		failures: make(map[string][]failure),
+	}
+	s.mux.HandleFunc("/ping", s.ping)
+	s.mux.HandleFunc("/health", s.health)
+	s.mux.HandleFunc("/api/v2/write", s.authenticated(s.write))
+	s.mux.HandleFunc("/api/v2/query", s.authenticated(s.query))
+	s.mux.HandleFunc("/api/v2/delete", s.authenticated(s.delete))
+	s.mux.HandleFunc("/api/v2/orgs", s.authenticated(s.orgsCollection))
+	s.mux.HandleFunc("/api/v2/orgs/", s.authenticated(s.orgsResource))
+	s.mux.HandleFunc("/api/v2/buckets", s.authenticated(s.bucketsCollection))
+	s.mux.HandleFunc("/api/v2/buckets/", s.authenticated(s.bucketsResource))
+	s.mux.HandleFunc("/api/v2/tasks", s.authenticated(s.tasksCollection))
+	s.mux.HandleFunc("/api/v2/tasks/", s.authenticated(s.tasksResource))
+	s.mux.HandleFunc("/api/v2/authorizations", s.authenticated(s.authorizationsCollection))
+	s.mux.HandleFunc("/api/v2/authorizations/", s.authenticated(s.authorizationsResource))
+	return s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	pending := s.failures[r.URL.Path]
+	var injected *failure
+	if len(pending) > 0 {
+		injected = &pending[0]
+		s.failures[r.URL.Path] = pending[1:]
+	}
+	s.mu.Unlock()
+	if injected != nil {
+		if injected.retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(injected.retryAfter))
+		}
+		writeError(w, injected.status, injected.message)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// FailNext makes the next request to path fail with the given status code and
+// message. A positive retryAfter is sent as a Retry-After header in seconds.
+// Calls accumulate, so FailNext can be used to script a series of failures.
+func (s *Server) FailNext(path string, status int, message string, retryAfter int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[path] = append(s.failures[path], failure{status, message, retryAfter})
+}
+
+// CreateOrganization adds an organization named name and returns it.
+func (s *Server) CreateOrganization(name string) domain.Organization {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.createOrganization(name)
+}
+
+// CreateBucket adds a bucket named name to the organization with the given ID
+// and returns it.
+func (s *Server) CreateBucket(orgID, name string) domain.Bucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.createBucket(domain.PostBucketRequest{Name: name, OrgID: orgID})
+}
+
+// CreateAuthorization adds an authorization for the organization with the
+// given ID and returns it, including its generated token.
+func (s *Server) CreateAuthorization(orgID, description string) domain.Authorization {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.createAuthorization(orgID, description, nil)
+}
+
+// Points returns a copy of all points written so far.
+func (s *Server) Points() []Point {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Point(nil), s.points...)
+}
+
+// Tasks returns a copy of all tasks created so far.
+func (s *Server) Tasks() []domain.Task {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]domain.Task(nil), s.tasks...)
+}
+
+// Reset discards all written points, leaving every other resource in place.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.points = nil
+}
+
+// nextID returns a new 16 character hexadecimal ID in the style of InfluxDB.
+// The caller must hold s.mu.
+func (s *Server) nextID() string {
+	s.lastID++
+	return fmt.Sprintf("%016x", 0x0a00000000000000+s.lastID)
+}
+
+// authenticated is a middleware that rejects requests without a known token.
+func (s *Server) authenticated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Token ")
+		if !s.validToken(token) {
+			writeError(w, http.StatusUnauthorized, "unauthorized access")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// validToken reports whether token may be used to access the API.
+func (s *Server) validToken(token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Token == "" && len(s.authorizations) == 0 {
+		return true
+	}
+	if s.Token != "" && token == s.Token {
+		return true
+	}
+	for _, auth := range s.authorizations {
+		if auth.Token != nil && *auth.Token == token &&
+			(auth.Status == nil || *auth.Status == domain.AuthorizationUpdateRequestStatusActive) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) ping(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Influxdb-Build", "OSS")
+	w.Header().Set("X-Influxdb-Version", Version)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) health(w http.ResponseWriter, r *http.Request) {
+	message, version := "ready for queries and writes", Version
+	writeJSON(w, http.StatusOK, domain.HealthCheck{
+		Name:    "influxdb",
+		Message: &message,
+		Status:  domain.HealthCheckStatusPass,
+		Checks:  &[]domain.HealthCheck{},
+		Version: &version,
+	})
+}
+
+// write parses line protocol from the request body and stores the points.
+func (s *Server) write(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	values := r.URL.Query()
+	precision, ok := precisions[values.Get("precision")]
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid precision %q", values.Get("precision")))
+		return
+	}
+
+	s.mu.Lock()
+	org, orgOK := s.findOrganization(values.Get("org"), values.Get("orgID"))
+	var bucket domain.Bucket
+	bucketOK := false
+	if orgOK {
+		bucket, bucketOK = s.findBucket(*org.Id, values.Get("bucket"))
+	}
+	s.mu.Unlock()
+	if !orgOK {
+		writeError(w, http.StatusNotFound, "organization not found")
+		return
+	}
+	if !bucketOK {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("bucket %q not found", values.Get("bucket")))
+		return
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	handler := protocol.NewMetricHandler()
+	handler.SetTimePrecision(precision)
+	metrics, err := protocol.NewParser(handler).Parse(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, metric := range metrics {
+		point := Point{
+			OrgID:       *org.Id,
+			Bucket:      bucket.Name,
+			Measurement: metric.Name(),
+			Tags:        make(map[string]string),
+			Fields:      make(map[string]interface{}),
+			Time:        metric.Time(),
+		}
+		for _, tag := range metric.TagList() {
+			point.Tags[tag.Key] = tag.Value
+		}
+		for _, field := range metric.FieldList() {
+			point.Fields[field.Key] = field.Value
+		}
+		s.points = append(s.points, point)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var (
+	// deleteConjunctionPattern splits a delete predicate into its comparisons.
+	deleteConjunctionPattern = regexp.MustCompile(`(?i)\s+and\s+`)
+	// deletePredicatePattern matches one key="value" comparison of a delete predicate.
+	deletePredicatePattern = regexp.MustCompile(`^\s*(\w+)\s*=\s*"([^"]*)"\s*$`)
+)
+
+// delete removes the points of a bucket within a time range that match a
+// predicate. Only predicates made of key="value" comparisons joined with AND
+// are supported, where the key is _measurement or a tag.
+func (s *Server) delete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var request domain.DeletePredicateRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	predicates := make(map[string]string)
+	if request.Predicate != nil && strings.TrimSpace(*request.Predicate) != "" {
+		for _, comparison := range deleteConjunctionPattern.Split(*request.Predicate, -1) {
+			match := deletePredicatePattern.FindStringSubmatch(comparison)
+			if match == nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("unsupported predicate %q", comparison))
+				return
+			}
+			predicates[match[1]] = match[2]
+		}
+	}
+
+	values := r.URL.Query()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	org, ok := s.findOrganization(values.Get("org"), values.Get("orgID"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "organization not found")
+		return
+	}
+	bucketName := values.Get("bucket")
+	if bucketName == "" {
+		bucketName = values.Get("bucketID")
+	}
+	bucket, ok := s.findBucket(*org.Id, bucketName)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("bucket %q not found", bucketName))
+		return
+	}
+
+	kept := s.points[:0]
+	for _, point := range s.points {
+		matches := point.OrgID == *org.Id && point.Bucket == bucket.Name &&
+			!point.Time.Before(request.Start) && !point.Time.After(request.Stop)
+		for key, value := range predicates {
+			if key == "_measurement" {
+				matches = matches && point.Measurement == value
+			} else {
+				matches = matches && point.Tags[key] == value
+			}
+		}
+		if !matches {
+			kept = append(kept, point)
+		}
+	}
+	s.points = kept
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// precisions maps the write endpoint's precision parameter to durations.
+var precisions = map[string]time.Duration{
+	"":   time.Nanosecond,
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// readBody reads the request body, decompressing it if it is gzip encoded.
+func readBody(r *http.Request) ([]byte, error) {
+	var reader io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	return io.ReadAll(reader)
+}
+
+// taskOptionPattern extracts the name and schedule from a task's option statement.
+var taskOptionPattern = regexp.MustCompile(`option\s+task\s*=\s*{([^}]*)}`)
+
+// taskOptionValue extracts one property from the body of a task option statement.
+func taskOptionValue(options, key string) (string, bool) {
+	pattern := regexp.MustCompile(key + `\s*:\s*("([^"]*)"|[^,\s}]+)`)
+	match := pattern.FindStringSubmatch(options)
+	if match == nil {
+		return "", false
+	}
+	if strings.HasPrefix(match[1], `"`) {
+		return match[2], true
+	}
+	return match[1], true
+}
+
+// writeJSON writes value as the JSON response body.
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeError writes an error in the JSON format used by InfluxDB, which the
+// client decodes into an *http.Error.
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{
+		"code":    errorCodes[status],
+		"message": message,
+	})
+}
+
+// errorCodes maps HTTP status codes to the error codes InfluxDB returns.
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            "invalid",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not found",
+	http.StatusMethodNotAllowed:      "method not allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "request too large",
+	http.StatusUnprocessableEntity:   "unprocessable entity",
+	http.StatusTooManyRequests:       "too many requests",
+	http.StatusInternalServerError:   "internal error",
+	http.StatusServiceUnavailable:    "unavailable",
+}
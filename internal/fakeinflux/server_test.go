@@ -0,0 +1,308 @@
+package fakeinflux
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	influxdb2http "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/influxdata/influxdb-client-go/v2/domain"
+)
+
+// newTestServer serves a fake with an organization named my-org holding a
+// bucket named my-bucket, and returns it with a client authenticated by the
+// operator token.
+func newTestServer(t *testing.T) (*Server, influxdb2.Client, string) {
+	t.Helper()
+	server := New("my-token")
+	org := server.CreateOrganization("my-org")
+	server.CreateBucket(*org.Id, "my-bucket")
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	client := influxdb2.NewClient(httpServer.URL, "my-token")
+	t.Cleanup(client.Close)
+	return server, client, *org.Id
+}
+
+func TestWriteAndQuery(t *testing.T) {
+	server, client, orgID := newTestServer(t)
+	ctx := context.Background()
+	at := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	err := client.WriteAPIBlocking("my-org", "my-bucket").WritePoint(ctx,
+		write.NewPoint("measurement1", map[string]string{"user_id": "user1"}, map[string]interface{}{"field1": 1.5}, at),
+		write.NewPoint("measurement1", map[string]string{"user_id": "user2"}, map[string]interface{}{"field1": 2.5}, at.Add(time.Second)))
+	if err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	points := server.Points()
+	if len(points) != 2 {
+		t.Fatalf("got %d points, want 2", len(points))
+	}
+	want := Point{OrgID: orgID, Bucket: "my-bucket", Measurement: "measurement1", Time: at}
+	if got := points[0]; got.OrgID != want.OrgID || got.Bucket != want.Bucket ||
+		got.Measurement != want.Measurement || !got.Time.Equal(want.Time) ||
+		got.Tags["user_id"] != "user1" || got.Fields["field1"] != 1.5 {
+		t.Errorf("got point %+v, want %+v with user_id user1 and field1 1.5", got, want)
+	}
+
+	// Queries without a recorded or canned response are answered from the
+	// points that match their equality predicates.
+	result, err := client.QueryAPI("my-org").QueryWithParams(ctx,
+		`from(bucket: params.bucket) |> range(start: -1h) |> filter(fn: (r) => r.user_id == params.user)`,
+		map[string]interface{}{"bucket": "my-bucket", "user": "user2"})
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	var values []interface{}
+	for result.Next() {
+		if user := result.Record().ValueByKey("user_id"); user != "user2" {
+			t.Errorf("got a record of %v, want only user2", user)
+		}
+		values = append(values, result.Record().Value())
+	}
+	if result.Err() != nil {
+		t.Fatalf("reading the query result failed: %v", result.Err())
+	}
+	if len(values) != 1 || values[0] != 2.5 {
+		t.Errorf("got values %v, want [2.5]", values)
+	}
+
+	server.Reset()
+	if points := server.Points(); len(points) != 0 {
+		t.Errorf("got %d points after Reset, want none", len(points))
+	}
+}
+
+func TestQueryTimeBounds(t *testing.T) {
+	_, client, _ := newTestServer(t)
+	ctx := context.Background()
+	at := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	var points []*write.Point
+	for i := 0; i < 4; i++ {
+		points = append(points, write.NewPoint("measurement1", nil, map[string]interface{}{"field1": float64(i)}, at.Add(time.Duration(i)*time.Minute)))
+	}
+	if err := client.WriteAPIBlocking("my-org", "my-bucket").WritePoint(ctx, points...); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	for _, test := range []struct {
+		name, query string
+		params      map[string]interface{}
+		want        []interface{}
+	}{
+		{"a relative range", `from(bucket: "my-bucket") |> range(start: -1h)`, nil, []interface{}{0.0, 1.0, 2.0, 3.0}},
+		{"an absolute range", `from(bucket: "my-bucket") |> range(start: 2022-03-01T12:01:00Z, stop: 2022-03-01T12:03:00Z)`,
+			nil, []interface{}{1.0, 2.0}},
+		{"a range of parameters", `from(bucket: "my-bucket") |> range(start: time(v: params.start))`,
+			map[string]interface{}{"start": at.Add(2 * time.Minute).Format(time.RFC3339Nano)}, []interface{}{2.0, 3.0}},
+		{"a comparison of _time", `from(bucket: "my-bucket") |> range(start: -1h) |> filter(fn: (r) => r._time > time(v: params.after))`,
+			map[string]interface{}{"after": at.Add(time.Minute).Format(time.RFC3339Nano)}, []interface{}{2.0, 3.0}},
+		{"two ranges", `union(tables: [from(bucket: "my-bucket") |> range(start: 2022-03-01T12:03:00Z), from(bucket: "my-bucket") |> range(start: -1h)])`,
+			nil, []interface{}{0.0, 1.0, 2.0, 3.0}},
+	} {
+		if got := queryValues(t, client, test.query, test.params); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestQueryMeasurementExclusions(t *testing.T) {
+	_, client, _ := newTestServer(t)
+	at := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	var points []*write.Point
+	for i, measurement := range []string{"measurement1", "_alerts", "rollup_1m", "a/b"} {
+		points = append(points, write.NewPoint(measurement, nil, map[string]interface{}{"field1": float64(i)}, at))
+	}
+	if err := client.WriteAPIBlocking("my-org", "my-bucket").WritePoint(context.Background(), points...); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	query := `from(bucket: "my-bucket") |> range(start: -1h) |> filter(fn: (r) => r._measurement !~ /^(_|rollup_)/ and r._measurement !~ /\//)`
+	if got := queryValues(t, client, query, nil); fmt.Sprint(got) != "[0]" {
+		t.Errorf("got %v, want only the value of measurement1", got)
+	}
+}
+
+func TestWriteToUnknownBucket(t *testing.T) {
+	_, client, _ := newTestServer(t)
+	err := client.WriteAPIBlocking("my-org", "missing").WriteRecord(context.Background(), "m f=1")
+	var httpErr *influxdb2http.Error
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusNotFound {
+		t.Errorf("got error %v, want a 404", err)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	server, _, orgID := newTestServer(t)
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	ctx := context.Background()
+
+	unknown := influxdb2.NewClient(httpServer.URL, "wrong-token")
+	defer unknown.Close()
+	err := unknown.WriteAPIBlocking("my-org", "my-bucket").WriteRecord(ctx, "m f=1")
+	var httpErr *influxdb2http.Error
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got error %v with an unknown token, want a 401", err)
+	}
+
+	// The tokens of authorizations are accepted alongside the operator token.
+	auth := server.CreateAuthorization(orgID, "test")
+	authorized := influxdb2.NewClient(httpServer.URL, *auth.Token)
+	defer authorized.Close()
+	if err := authorized.WriteAPIBlocking("my-org", "my-bucket").WriteRecord(ctx, "m f=1"); err != nil {
+		t.Errorf("write with the token of an authorization failed: %v", err)
+	}
+}
+
+func TestFailNext(t *testing.T) {
+	server, client, _ := newTestServer(t)
+	server.FailNext("/api/v2/write", http.StatusServiceUnavailable, "try later", 5)
+	writeAPI := client.WriteAPIBlocking("my-org", "my-bucket")
+	ctx := context.Background()
+
+	err := writeAPI.WriteRecord(ctx, "m f=1")
+	var httpErr *influxdb2http.Error
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusServiceUnavailable ||
+		httpErr.Message != "try later" || httpErr.RetryAfter != 5 {
+		t.Fatalf("got error %v, want a 503 retried after 5s", err)
+	}
+	if len(server.Points()) != 0 {
+		t.Error("a failed write stored points")
+	}
+	if err := writeAPI.WriteRecord(ctx, "m f=1"); err != nil {
+		t.Errorf("the write after the injected failure failed: %v", err)
+	}
+	if len(server.Points()) != 1 {
+		t.Errorf("got %d points, want 1", len(server.Points()))
+	}
+}
+
+func TestDelete(t *testing.T) {
+	server, client, _ := newTestServer(t)
+	ctx := context.Background()
+	at := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	err := client.WriteAPIBlocking("my-org", "my-bucket").WriteRecord(ctx,
+		"m,user_id=user1 f=1 "+itoa(at), "m,user_id=user2 f=2 "+itoa(at), "other,user_id=user1 f=3 "+itoa(at))
+	if err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	err = client.DeleteAPI().DeleteWithName(ctx, "my-org", "my-bucket", at.Add(-time.Hour), at.Add(time.Hour),
+		`_measurement="m" AND user_id="user1"`)
+	if err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	points := server.Points()
+	if len(points) != 2 {
+		t.Fatalf("got %d points after the delete, want 2", len(points))
+	}
+	for _, point := range points {
+		if point.Measurement == "m" && point.Tags["user_id"] == "user1" {
+			t.Errorf("point %+v matching the predicate was not deleted", point)
+		}
+	}
+
+	err = client.DeleteAPI().DeleteWithName(ctx, "my-org", "my-bucket", at, at, `f > 1`)
+	var httpErr *influxdb2http.Error
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("got error %v for an unsupported predicate, want a 400", err)
+	}
+}
+
+func TestCannedAndRecordedQueries(t *testing.T) {
+	server, client, _ := newTestServer(t)
+	const canned = "#datatype,string,long,double\r\n#group,false,false,false\r\n#default,_result,,\r\n,result,table,_value\r\n,,0,42\r\n\r\n"
+	server.HandleQuery(`\|> count\(\)`, canned)
+
+	query := `from(bucket: "my-bucket") |> range(start: -1h) |> count()`
+	if got := queryValues(t, client, query, nil); len(got) != 1 || got[0] != 42.0 {
+		t.Errorf("got %v from the canned response, want [42]", got)
+	}
+
+	// Recorded responses take precedence over canned ones.
+	dir := t.TempDir()
+	server.ReplayFrom(dir)
+	recorded := "#datatype,string,long,double\r\n#group,false,false,false\r\n#default,_result,,\r\n,result,table,_value\r\n,,0,7\r\n\r\n"
+	key := recordingKey(queryRequest{Query: query, Params: map[string]interface{}{"x": "y"}})
+	if err := os.WriteFile(filepath.Join(dir, key+".csv"), []byte(recorded), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := queryValues(t, client, query, map[string]interface{}{"x": "y"}); len(got) != 1 || got[0] != 7.0 {
+		t.Errorf("got %v from the recording, want [7]", got)
+	}
+	if got := queryValues(t, client, query, nil); len(got) != 1 || got[0] != 42.0 {
+		t.Errorf("got %v for other parameters, want the canned [42]", got)
+	}
+}
+
+func TestTasks(t *testing.T) {
+	server, client, orgID := newTestServer(t)
+	ctx := context.Background()
+	flux := "import \"date\"\n\noption task = {name: \"rollup\", every: 1h, offset: 5m}\n\nfrom(bucket: \"my-bucket\")"
+	response, err := domain.NewClientWithResponses(client.HTTPService()).PostTasksWithResponse(ctx,
+		&domain.PostTasksParams{}, domain.PostTasksJSONRequestBody{OrgID: &orgID, Flux: flux})
+	if err != nil {
+		t.Fatalf("creating the task failed: %v", err)
+	}
+	if response.JSON201 == nil {
+		t.Fatalf("creating the task failed with status %d", response.StatusCode())
+	}
+	task := response.JSON201
+	if task.Name != "rollup" || task.Every == nil || *task.Every != "1h" || task.Offset == nil || *task.Offset != "5m" {
+		t.Errorf("got task %q every %v offset %v, want rollup every 1h offset 5m", task.Name, task.Every, task.Offset)
+	}
+	if tasks := server.Tasks(); len(tasks) != 1 || tasks[0].Id != task.Id || tasks[0].Flux != flux {
+		t.Errorf("got tasks %+v, want the one created", tasks)
+	}
+
+	// Like InfluxDB, the fake fails to compile scripts with an import after
+	// another statement, such as the task option the client prepends.
+	_, err = client.TasksAPI().CreateTaskWithEvery(ctx, "prepended", "import \"date\"\n\nfrom(bucket: \"my-bucket\")", "1h", orgID)
+	var httpErr *influxdb2http.Error
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("got error %v creating a task with an import after its option, want a 400", err)
+	}
+
+	found, err := client.TasksAPI().FindTasks(ctx, nil)
+	if err != nil || len(found) != 1 {
+		t.Fatalf("got %d tasks and error %v, want the one created", len(found), err)
+	}
+	if err := client.TasksAPI().DeleteTaskWithID(ctx, task.Id); err != nil {
+		t.Fatalf("deleting the task failed: %v", err)
+	}
+	if tasks := server.Tasks(); len(tasks) != 0 {
+		t.Errorf("got %d tasks after deleting it, want none", len(tasks))
+	}
+}
+
+// queryValues runs query and returns the values of its records.
+func queryValues(t *testing.T, client influxdb2.Client, query string, params interface{}) []interface{} {
+	t.Helper()
+	result, err := client.QueryAPI("my-org").QueryWithParams(context.Background(), query, params)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	var values []interface{}
+	for result.Next() {
+		values = append(values, result.Record().Value())
+	}
+	if result.Err() != nil {
+		t.Fatalf("reading the query result failed: %v", result.Err())
+	}
+	return values
+}
+
+// itoa formats t as a line protocol timestamp in nanoseconds.
+func itoa(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
@@ -0,0 +1,209 @@
+package flux
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Expr is a Flux expression, such as a value or a column of the record a
+// function is called with.
+type Expr interface {
+	// render renders the expression, naming any parameter it needs after hint.
+	render(r *renderer, hint string) string
+}
+
+type exprFunc func(r *renderer, hint string) string
+
+func (f exprFunc) render(r *renderer, hint string) string { return f(r, hint) }
+
+// String returns a string value, which is passed as a parameter.
+func String(s string) Expr {
+	return exprFunc(func(r *renderer, hint string) string { return r.string(hint, s) })
+}
+
+// Time returns a time value, which is passed as a parameter.
+func Time(t time.Time) Expr {
+	return exprFunc(func(r *renderer, hint string) string { return r.time(hint, t) })
+}
+
+// Duration returns a duration literal. Negative durations are relative to now
+// when passed to Query.Range.
+func Duration(d time.Duration) Expr {
+	return exprFunc(func(*renderer, string) string { return FormatDuration(d) })
+}
+
+// Days returns a calendar duration literal of n days, counted from midnight in
+// the location of the program.
+func Days(n int) Expr {
+	return exprFunc(func(*renderer, string) string { return strconv.Itoa(n) + "d" })
+}
+
+// Months returns a calendar duration literal of n months, counted from the
+// first of the month in the location of the program.
+func Months(n int) Expr {
+	return exprFunc(func(*renderer, string) string { return strconv.Itoa(n) + "mo" })
+}
+
+// Truncate returns the time t, a Time or a Duration relative to now, truncated
+// to a whole unit, such as the midnight starting its day for Days(1).
+func Truncate(t, unit Expr) Expr {
+	return exprFunc(func(r *renderer, hint string) string {
+		r.use("date")
+		return "date.truncate(t: " + t.render(r, hint) + ", unit: " + unit.render(r, hint) + ")"
+	})
+}
+
+// Int returns an integer literal.
+func Int(i int64) Expr {
+	return exprFunc(func(*renderer, string) string { return strconv.FormatInt(i, 10) })
+}
+
+// Float returns a float literal.
+func Float(f float64) Expr {
+	return exprFunc(func(*renderer, string) string { return FormatFloat(f) })
+}
+
+// Bool returns a boolean literal.
+func Bool(b bool) Expr {
+	return exprFunc(func(*renderer, string) string { return strconv.FormatBool(b) })
+}
+
+// Now returns the time the query is run.
+func Now() Expr {
+	return exprFunc(func(*renderer, string) string { return "now()" })
+}
+
+// Concat returns the concatenation of strings.
+func Concat(values ...Expr) Expr {
+	return exprFunc(func(r *renderer, hint string) string {
+		rendered := make([]string, len(values))
+		for i, value := range values {
+			rendered[i] = value.render(r, hint)
+		}
+		return strings.Join(rendered, " + ")
+	})
+}
+
+// Column is a column of the record a function is called with.
+type Column string
+
+// Col returns the column with the given name.
+func Col(name string) Column {
+	return Column(name)
+}
+
+func (c Column) render(*renderer, string) string {
+	if identifierPattern.MatchString(string(c)) {
+		return "r." + string(c)
+	}
+	return "r[" + quote(string(c)) + "]"
+}
+
+func (c Column) compare(operator string, value Expr) Predicate {
+	return exprFunc(func(r *renderer, _ string) string {
+		return c.render(r, "") + " " + operator + " " + value.render(r, string(c))
+	})
+}
+
+// Equal matches the records whose column equals value.
+func (c Column) Equal(value Expr) Predicate { return c.compare("==", value) }
+
+// NotEqual matches the records whose column doesn't equal value.
+func (c Column) NotEqual(value Expr) Predicate { return c.compare("!=", value) }
+
+// Greater matches the records whose column is greater than value.
+func (c Column) Greater(value Expr) Predicate { return c.compare(">", value) }
+
+// GreaterOrEqual matches the records whose column is at least value.
+func (c Column) GreaterOrEqual(value Expr) Predicate { return c.compare(">=", value) }
+
+// Less matches the records whose column is less than value.
+func (c Column) Less(value Expr) Predicate { return c.compare("<", value) }
+
+// LessOrEqual matches the records whose column is at most value.
+func (c Column) LessOrEqual(value Expr) Predicate { return c.compare("<=", value) }
+
+// Matches matches the records whose column matches a regular expression,
+// which is written into the query, so it must not come from user input.
+func (c Column) Matches(pattern string) Predicate { return c.compare("=~", regex(pattern)) }
+
+// Exists matches the records that have a value in the column.
+func (c Column) Exists() Predicate {
+	return exprFunc(func(r *renderer, _ string) string { return "exists " + c.render(r, "") })
+}
+
+// NotMatches matches the records whose column doesn't match a regular
+// expression, like Matches.
+func (c Column) NotMatches(pattern string) Predicate { return c.compare("!~", regex(pattern)) }
+
+// regex returns a regular expression literal.
+func regex(pattern string) Expr {
+	return exprFunc(func(*renderer, string) string {
+		return "/" + strings.ReplaceAll(pattern, "/", `\/`) + "/"
+	})
+}
+
+// Predicate is a boolean expression that filters records.
+type Predicate = Expr
+
+// Measurement matches the records of a measurement.
+func Measurement(name string) Predicate {
+	return Col("_measurement").Equal(String(name))
+}
+
+// Field matches the records of a field.
+func Field(name string) Predicate {
+	return Col("_field").Equal(String(name))
+}
+
+// Tag matches the records with a tag set to value.
+func Tag(key, value string) Predicate {
+	return Col(key).Equal(String(value))
+}
+
+// And matches the records matching all of the predicates, or all records
+// without any.
+func And(predicates ...Predicate) Predicate {
+	return join(" and ", predicates)
+}
+
+// Or matches the records matching any of the predicates, or none without any.
+func Or(predicates ...Predicate) Predicate {
+	if len(predicates) == 0 {
+		return exprFunc(func(*renderer, string) string { return "false" })
+	}
+	return join(" or ", predicates)
+}
+
+// Not matches the records that don't match a predicate.
+func Not(predicate Predicate) Predicate {
+	return exprFunc(func(r *renderer, hint string) string { return "not (" + predicate.render(r, hint) + ")" })
+}
+
+func join(operator string, predicates []Predicate) Predicate {
+	return exprFunc(func(r *renderer, hint string) string {
+		switch len(predicates) {
+		case 0:
+			return "true"
+		case 1:
+			return predicates[0].render(r, hint)
+		}
+		rendered := make([]string, len(predicates))
+		for i, predicate := range predicates {
+			rendered[i] = "(" + predicate.render(r, hint) + ")"
+		}
+		return strings.Join(rendered, operator)
+	})
+}
+
+// Assignment sets a column of the records passed to Query.Map.
+type Assignment struct {
+	column string
+	value  Expr
+}
+
+// Set returns an assignment of value to a column.
+func Set(column string, value Expr) Assignment {
+	return Assignment{column: column, value: value}
+}
@@ -0,0 +1,440 @@
+// Package flux builds Flux queries with a fluent, typed API rather than by
+// formatting strings, so that values such as bucket names and user IDs can't
+// change the meaning of a query however they are spelled.
+//
+// A query starts with From and is refined by chaining methods that each add a
+// function to its pipeline:
+//
+//	query, params := flux.From(bucket).
+//		Range(flux.Duration(-24 * time.Hour)).
+//		Filter(flux.Measurement("downsampled"), flux.Tag("user_id", userID)).
+//		Aggregate(flux.Last).
+//		Render()
+//	tables, err := queryAPI.QueryWithParams(ctx, query, params)
+//
+// Render passes strings and times as query parameters, and returns them in
+// the map to pass to QueryWithParams alongside the query. Other values, such
+// as durations and numbers, are rendered from their Go types, so they are
+// written into the query as literals. Tasks can't be given parameters, so
+// Inline renders every value as a literal instead, quoted as Flux requires.
+//
+// Queries are immutable: each method returns a new query, so a query can be
+// shared as the start of several others.
+//
+// Durations of whole days and months, such as Days(1), are calendar durations:
+// in the location set with Program.Location, a day lasts from one local
+// midnight to the next, and so is 23 or 25 hours long when the clocks change.
+package flux
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query is a Flux pipeline: a source of tables, such as from, followed by the
+// functions the tables are piped through.
+type Query struct {
+	source func(r *renderer) string
+	stages []func(r *renderer) string
+}
+
+// From returns a query reading the data in a bucket.
+func From(bucket string) *Query {
+	return &Query{source: func(r *renderer) string {
+		return "from(bucket: " + r.string("bucket_name", bucket) + ")"
+	}}
+}
+
+// Var returns a query reading the tables assigned to a variable of a Program.
+func Var(name string) *Query {
+	return &Query{source: func(r *renderer) string { return name }}
+}
+
+// Union returns a query reading the tables of all of the queries.
+func Union(queries ...*Query) *Query {
+	return &Query{source: func(r *renderer) string {
+		tables := make([]string, len(queries))
+		for i, query := range queries {
+			tables[i] = query.render(r)
+		}
+		return "union(tables: [" + strings.Join(tables, ", ") + "])"
+	}}
+}
+
+// then returns a copy of the query with a function added to its pipeline.
+func (q *Query) then(stage func(r *renderer) string) *Query {
+	stages := make([]func(r *renderer) string, len(q.stages), len(q.stages)+1)
+	copy(stages, q.stages)
+	return &Query{source: q.source, stages: append(stages, stage)}
+}
+
+// Range keeps the records from start, which is a Time or a negative Duration
+// relative to now, until now.
+func (q *Query) Range(start Expr) *Query {
+	return q.then(func(r *renderer) string {
+		return "range(start: " + start.render(r, "start") + ")"
+	})
+}
+
+// RangeBetween keeps the records from start until stop, each of which is a
+// Time or a Duration relative to now.
+func (q *Query) RangeBetween(start, stop Expr) *Query {
+	return q.then(func(r *renderer) string {
+		return "range(start: " + start.render(r, "start") + ", stop: " + stop.render(r, "stop") + ")"
+	})
+}
+
+// Filter keeps the records matching all of the predicates.
+func (q *Query) Filter(predicates ...Predicate) *Query {
+	return q.then(func(r *renderer) string {
+		return "filter(fn: (r) => " + And(predicates...).render(r, "") + ")"
+	})
+}
+
+// Aggregate is a Flux function that aggregates each table into a single record,
+// or selects a single record of each table.
+type Aggregate string
+
+// The aggregates and selectors that can be passed to Query.Aggregate and
+// Query.AggregateWindow.
+const (
+	Count  Aggregate = "count"
+	First  Aggregate = "first"
+	Last   Aggregate = "last"
+	Max    Aggregate = "max"
+	Mean   Aggregate = "mean"
+	Median Aggregate = "median"
+	Min    Aggregate = "min"
+	Sum    Aggregate = "sum"
+)
+
+// Aggregate aggregates each table with fn, e.g. mean().
+func (q *Query) Aggregate(fn Aggregate) *Query {
+	return q.then(func(r *renderer) string { return string(fn) + "()" })
+}
+
+// AggregateWindow aggregates each table with fn in windows of time of length
+// every, a Duration or a calendar duration such as Days or Months. Windows
+// without records are left out unless createEmpty is true.
+func (q *Query) AggregateWindow(every Expr, fn Aggregate, createEmpty bool) *Query {
+	return q.then(func(r *renderer) string {
+		return fmt.Sprintf("aggregateWindow(every: %s, fn: %s, createEmpty: %t)", every.render(r, "every"), fn, createEmpty)
+	})
+}
+
+// AggregateWindowStart is like AggregateWindow, but times each aggregate by
+// the start of its window rather than its end.
+func (q *Query) AggregateWindowStart(every Expr, fn Aggregate, createEmpty bool) *Query {
+	return q.then(func(r *renderer) string {
+		return fmt.Sprintf("aggregateWindow(every: %s, fn: %s, createEmpty: %t, timeSrc: \"_start\")", every.render(r, "every"), fn, createEmpty)
+	})
+}
+
+// HoltWinters forecasts the next n values of each table with the Holt-Winters
+// method, from values spaced by interval, with a seasonal pattern repeating
+// every seasonality values, or without seasonality if it is 0.
+func (q *Query) HoltWinters(n, seasonality int, interval Expr) *Query {
+	return q.then(func(r *renderer) string {
+		return fmt.Sprintf("holtWinters(n: %d, seasonality: %d, interval: %s)", n, seasonality, interval.render(r, "interval"))
+	})
+}
+
+// Pivot turns the values of valueColumn into columns named after columnKey,
+// with a row for each distinct value of rowKey.
+func (q *Query) Pivot(rowKey, columnKey []string, valueColumn string) *Query {
+	return q.then(func(r *renderer) string {
+		return "pivot(rowKey: " + quoteList(rowKey) + ", columnKey: " + quoteList(columnKey) + ", valueColumn: " + quote(valueColumn) + ")"
+	})
+}
+
+// Group regroups the records into tables by the values of the columns, or into
+// a single table without any.
+func (q *Query) Group(columns ...string) *Query {
+	return q.then(func(r *renderer) string {
+		if len(columns) == 0 {
+			return "group()"
+		}
+		return "group(columns: " + quoteList(columns) + ")"
+	})
+}
+
+// Sort sorts the records of each table by the columns.
+func (q *Query) Sort(columns ...string) *Query {
+	return q.then(func(r *renderer) string { return "sort(columns: " + quoteList(columns) + ")" })
+}
+
+// Limit keeps the first n records of each table.
+func (q *Query) Limit(n int) *Query {
+	return q.then(func(r *renderer) string { return "limit(n: " + strconv.Itoa(n) + ")" })
+}
+
+// Tail keeps the last n records of each table.
+func (q *Query) Tail(n int) *Query {
+	return q.then(func(r *renderer) string { return "tail(n: " + strconv.Itoa(n) + ")" })
+}
+
+// Drop removes the columns from each table.
+func (q *Query) Drop(columns ...string) *Query {
+	return q.then(func(r *renderer) string { return "drop(columns: " + quoteList(columns) + ")" })
+}
+
+// Map sets columns of each record to the values of expressions, keeping the
+// other columns.
+func (q *Query) Map(assignments ...Assignment) *Query {
+	return q.then(func(r *renderer) string {
+		sets := make([]string, len(assignments))
+		for i, assignment := range assignments {
+			sets[i] = identifier(assignment.column) + ": " + assignment.value.render(r, assignment.column)
+		}
+		return "map(fn: (r) => ({r with " + strings.Join(sets, ", ") + "}))"
+	})
+}
+
+// Yield names the result of the query, for queries that return several.
+func (q *Query) Yield(name string) *Query {
+	return q.then(func(r *renderer) string { return "yield(name: " + quote(name) + ")" })
+}
+
+// To writes the records to a bucket.
+func (q *Query) To(bucket string) *Query {
+	return q.then(func(r *renderer) string { return "to(bucket: " + r.string("bucket_name", bucket) + ")" })
+}
+
+// Render renders the query, passing strings and times as parameters, and
+// returns it with the parameters to pass to QueryWithParams.
+func (q *Query) Render() (string, map[string]string) {
+	r := newRenderer(false)
+	return r.script(nil, q.render(r)), r.params
+}
+
+// Inline renders the query with every value as a literal, for tasks.
+func (q *Query) Inline() string {
+	r := newRenderer(true)
+	return r.script(nil, q.render(r))
+}
+
+func (q *Query) render(r *renderer) string {
+	var query strings.Builder
+	query.WriteString(q.source(r))
+	for _, stage := range q.stages {
+		query.WriteString("\n    |> ")
+		query.WriteString(stage(r))
+	}
+	return query.String()
+}
+
+// Program is a Flux script of several statements, such as the body of a task
+// that assigns the tables of queries to variables to combine them.
+type Program struct {
+	imports    []string
+	options    []string
+	statements []func(r *renderer) string
+}
+
+// Location sets the location of the program to a timezone, given by its IANA
+// name such as America/New_York, in which calendar durations such as Days and
+// Months and the windows of AggregateWindow are counted. Without it, they are
+// counted in UTC. The name is written into the program as a literal.
+func (p *Program) Location(timezone string) {
+	p.imports = append(p.imports, "timezone")
+	p.options = append(p.options, "option location = timezone.location(name: "+quote(timezone)+")")
+}
+
+// Task sets the task option of the program, for the script of a task: its
+// name, how often it runs, and how long after the end of each interval it runs,
+// if at all. Like every option, it is rendered after the imports of the
+// program, as Flux requires.
+func (p *Program) Task(name string, every, offset time.Duration) {
+	option := "option task = {name: " + quote(name) + ", every: " + FormatDuration(every)
+	if offset != 0 {
+		option += ", offset: " + FormatDuration(offset)
+	}
+	p.options = append(p.options, option+"}")
+}
+
+// Let assigns the tables of a query to a variable, and returns a query reading
+// them.
+func (p *Program) Let(name string, query *Query) *Query {
+	p.statements = append(p.statements, func(r *renderer) string { return name + " = " + query.render(r) })
+	return Var(name)
+}
+
+// Add adds a query to the program, whose tables are its result unless it
+// writes them elsewhere with To.
+func (p *Program) Add(query *Query) {
+	p.statements = append(p.statements, query.render)
+}
+
+// Render renders the program like Query.Render.
+func (p *Program) Render() (string, map[string]string) {
+	r := newRenderer(false)
+	return p.render(r), r.params
+}
+
+// Inline renders the program like Query.Inline.
+func (p *Program) Inline() string {
+	return p.render(newRenderer(true))
+}
+
+func (p *Program) render(r *renderer) string {
+	statements := make([]string, len(p.statements))
+	for i, statement := range p.statements {
+		statements[i] = statement(r)
+	}
+	for _, pkg := range p.imports {
+		r.use(pkg)
+	}
+	return r.script(p.options, strings.Join(statements, "\n\n"))
+}
+
+// renderer renders the values of a query either as literals or as references
+// to parameters, collecting the parameters.
+type renderer struct {
+	inline bool
+	params map[string]string
+	// names holds the name of the parameter of each value, so that a value used
+	// several times is passed once.
+	names map[string]string
+	// imports holds the packages the rendered functions belong to.
+	imports map[string]bool
+}
+
+func newRenderer(inline bool) *renderer {
+	return &renderer{inline: inline, params: make(map[string]string), names: make(map[string]string), imports: make(map[string]bool)}
+}
+
+// use imports a package into the script being rendered.
+func (r *renderer) use(pkg string) {
+	r.imports[pkg] = true
+}
+
+// script returns a rendered body preceded by the imports it uses and options.
+func (r *renderer) script(options []string, body string) string {
+	var header []string
+	for pkg := range r.imports {
+		header = append(header, "import "+quote(pkg))
+	}
+	sort.Strings(header)
+	if len(header) > 0 && len(options) > 0 {
+		header = append(header, "")
+	}
+	header = append(header, options...)
+	if len(header) == 0 {
+		return body
+	}
+	return strings.Join(header, "\n") + "\n\n" + body
+}
+
+// string renders a string, as a parameter named after hint unless inline.
+func (r *renderer) string(hint, value string) string {
+	if r.inline {
+		return quote(value)
+	}
+	if name, ok := r.names[value]; ok {
+		return "params." + name
+	}
+	name := paramName(hint)
+	for i := 2; ; i++ {
+		if _, taken := r.params[name]; !taken {
+			break
+		}
+		name = fmt.Sprintf("%s_%d", paramName(hint), i)
+	}
+	r.params[name] = value
+	r.names[value] = name
+	return "params." + name
+}
+
+// time renders a time, as a string parameter converted with time() unless inline.
+func (r *renderer) time(hint string, t time.Time) string {
+	formatted := t.UTC().Format(time.RFC3339Nano)
+	if r.inline {
+		return formatted
+	}
+	return "time(v: " + r.string(hint, formatted) + ")"
+}
+
+var (
+	identifierPattern   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	paramNameReplacer   = regexp.MustCompile(`[^A-Za-z0-9_]`)
+	stringLiteralEscape = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "${", `\${`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+)
+
+// paramName returns a valid parameter name made from hint.
+func paramName(hint string) string {
+	name := strings.TrimLeft(paramNameReplacer.ReplaceAllString(hint, "_"), "_")
+	if name == "" {
+		return "p"
+	}
+	if name[0] >= '0' && name[0] <= '9' {
+		return "p_" + name
+	}
+	return name
+}
+
+// identifier renders the name of a record property, quoting it unless it is a
+// valid identifier.
+func identifier(name string) string {
+	if identifierPattern.MatchString(name) {
+		return name
+	}
+	return quote(name)
+}
+
+// quote renders a string literal.
+func quote(s string) string {
+	return `"` + stringLiteralEscape.Replace(s) + `"`
+}
+
+// Quote renders s as a Flux string literal, escaping backslashes, quotes and
+// the ${ of interpolations, for scripts that are not built with a Query.
+func Quote(s string) string {
+	return quote(s)
+}
+
+// FormatFloat renders f as a Flux float literal, which unlike a Go one always
+// has a decimal point, for scripts that are not built with a Query.
+func FormatFloat(f float64) string {
+	literal := strconv.FormatFloat(f, 'f', -1, 64)
+	if !strings.Contains(literal, ".") {
+		literal += ".0"
+	}
+	return literal
+}
+
+// quoteList renders an array of string literals.
+func quoteList(values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = quote(value)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// FormatDuration formats a duration as a Flux duration literal, e.g. 1h30m or
+// -5m.
+func FormatDuration(d time.Duration) string {
+	if d == 0 {
+		return "0s"
+	}
+	var literal strings.Builder
+	if d < 0 {
+		literal.WriteByte('-')
+		d = -d
+	}
+	for _, unit := range []struct {
+		size time.Duration
+		name string
+	}{{time.Hour, "h"}, {time.Minute, "m"}, {time.Second, "s"}, {time.Millisecond, "ms"}, {time.Microsecond, "us"}, {time.Nanosecond, "ns"}} {
+		if n := d / unit.size; n > 0 {
+			literal.WriteString(strconv.FormatInt(int64(n), 10))
+			literal.WriteString(unit.name)
+			d -= n * unit.size
+		}
+	}
+	return literal.String()
+}
@@ -0,0 +1,159 @@
+package flux
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// renderable is a Query or a Program.
+type renderable interface {
+	Render() (string, map[string]string)
+	Inline() string
+}
+
+// goldenTests are rendered both with Render and with Inline, and compared
+// with testdata/<name>.render.golden and testdata/<name>.inline.golden.
+var goldenTests = []struct {
+	name  string
+	build func() renderable
+}{
+	{"params", func() renderable {
+		start := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+		return From("my-bucket").
+			RangeBetween(Time(start), Time(start.Add(time.Hour))).
+			// The same value is passed once, and different values named
+			// after the same hint are numbered.
+			Filter(Measurement("measurement1"), Or(Tag("user_id", "user1"), Tag("user_id", "user2")), Tag("owner", "user1")).
+			Map(Set("label", String("first")), Set("2nd", String("second"))).
+			Filter(Col("_value").Greater(Float(1)), Col("count").LessOrEqual(Int(10)), Col("valid").Equal(Bool(true))).
+			AggregateWindow(Duration(90*time.Minute), Mean, false).
+			Sort("_time").
+			Limit(10)
+	}},
+	{"program", func() renderable {
+		var program Program
+		program.Location("America/New_York")
+		program.Task("rollup \"1d\"", time.Hour, 5*time.Minute)
+		data := program.Let("data", From("my-bucket").
+			RangeBetween(Truncate(Days(-1), Days(1)), Truncate(Now(), Days(1))).
+			Filter(Tag("user_id", "user1"), Col("_measurement").NotMatches("^rollup_")))
+		program.Add(data.
+			AggregateWindowStart(Days(1), Max, false).
+			Map(Set("_measurement", String("rollup_1d")), Set("_field", Concat(Col("_field"), String("_max")))).
+			To("my-bucket"))
+		return &program
+	}},
+	{"task", func() renderable {
+		var program Program
+		program.Task("rollup", time.Minute, 0)
+		program.Add(From("my-bucket").Range(Duration(-time.Minute)).To("my-bucket"))
+		return &program
+	}},
+	{"escaping", func() renderable {
+		return From(`my "bucket" ${bucket}`).
+			Range(Duration(-24*time.Hour)).
+			Filter(
+				Col("non identifier").Equal(String("a \"quoted\" ${interpolation} with a \\ and\na newline\tand a tab")),
+				Col("_value").Matches(`^a/b$`),
+				Not(Or(Col("user-id").Exists(), Col("1st").Equal(String("x"))))).
+			Map(Set("my column", String("${value}"))).
+			Group("a \"quoted\" column").
+			Pivot([]string{"_time"}, []string{"_field"}, "_value").
+			Yield(`"results"`)
+	}},
+}
+
+func TestGolden(t *testing.T) {
+	for _, test := range goldenTests {
+		t.Run(test.name, func(t *testing.T) {
+			query, params := test.build().Render()
+			var rendered strings.Builder
+			rendered.WriteString(query + "\n")
+			if len(params) > 0 {
+				rendered.WriteString("\n// params\n")
+				names := make([]string, 0, len(params))
+				for name := range params {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				for _, name := range names {
+					fmt.Fprintf(&rendered, "// %s = %q\n", name, params[name])
+				}
+			}
+			golden(t, test.name+".render.golden", rendered.String())
+			golden(t, test.name+".inline.golden", test.build().Inline()+"\n")
+		})
+	}
+}
+
+// golden compares got with the golden file of the given name, or replaces the
+// file with got when the tests are run with -update.
+func golden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run the tests with -update to create it)", err)
+	}
+	if got != string(want) {
+		t.Errorf("%s differs from the golden file:\ngot:\n%s\nwant:\n%s", name, got, want)
+	}
+}
+
+func TestQuote(t *testing.T) {
+	for s, want := range map[string]string{
+		`plain`:            `"plain"`,
+		`a "quoted" word`:  `"a \"quoted\" word"`,
+		`${interpolation}`: `"\${interpolation}"`,
+		`$ and {`:          `"$ and {"`,
+		`back\slash`:       `"back\\slash"`,
+		"new\nline\r\t":    `"new\nline\r\t"`,
+	} {
+		if got := Quote(s); got != want {
+			t.Errorf("Quote(%q) = %s, want %s", s, got, want)
+		}
+	}
+}
+
+func TestFormatFloat(t *testing.T) {
+	for f, want := range map[float64]string{
+		0:      "0.0",
+		100:    "100.0",
+		-2.5:   "-2.5",
+		1e21:   "1000000000000000000000.0",
+		0.0001: "0.0001",
+	} {
+		if got := FormatFloat(f); got != want {
+			t.Errorf("FormatFloat(%v) = %s, want %s", f, got, want)
+		}
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		0:                                  "0s",
+		90 * time.Minute:                   "1h30m",
+		-5 * time.Minute:                   "-5m",
+		24*time.Hour + 15*time.Second:      "24h15s",
+		1500 * time.Millisecond:            "1s500ms",
+		time.Microsecond + time.Nanosecond: "1us1ns",
+	} {
+		if got := FormatDuration(d); got != want {
+			t.Errorf("FormatDuration(%v) = %s, want %s", d, got, want)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+// Package influxclient builds the InfluxDB clients of the samples in this
+// repository from a shared configuration, so that every sample can reach an
+// InfluxDB instance that uses a private certificate authority, requires client
+// certificates or sits behind an HTTP proxy.
+//
+// Configuration is usually read from environment variables with ConfigFromEnv,
+// and turned into a client with New:
+//
+//	config, err := influxclient.ConfigFromEnv("INFLUXDB")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	client, err := influxclient.New(config)
+package influxclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// DefaultTimeout is how long HTTP requests to InfluxDB may take when Config
+// doesn't say, the same as the default of the client library.
+const DefaultTimeout = 20 * time.Second
+
+// Config describes how to connect to InfluxDB. The zero value of every field
+// but URL and Token keeps the default of the client library.
+type Config struct {
+	// URL is the URL of the InfluxDB instance or Cloud environment.
+	URL string
+	// Token authenticates requests.
+	Token string
+
+	// CAFile is the path of a PEM encoded bundle of the certificate authorities
+	// that InfluxDB certificates are verified against, instead of those of the
+	// system.
+	CAFile string
+	// CertFile and KeyFile are the paths of the PEM encoded client certificate
+	// and private key presented to InfluxDB, if it requires one.
+	CertFile, KeyFile string
+	// InsecureSkipVerify disables the verification of InfluxDB certificates.
+	// Only use it in development.
+	InsecureSkipVerify bool
+
+	// Proxy is the URL of the HTTP proxy requests are sent through. When it is
+	// empty, the proxy is taken from the HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+	// environment variables.
+	Proxy string
+	// Timeout bounds how long each HTTP request may take, including reading the
+	// response. It defaults to DefaultTimeout.
+	Timeout time.Duration
+
+	// Gzip compresses written points.
+	Gzip bool
+	// BatchSize is the number of points the non-blocking write API sends at a time.
+	BatchSize uint
+	// FlushInterval is how often the non-blocking write API sends buffered points.
+	FlushInterval time.Duration
+}
+
+// ConfigFromEnv reads a Config from the environment variables named with the
+// given prefix:
+//
+//   - prefix_HOST and prefix_TOKEN are the URL and Token.
+//   - prefix_CA_CERT is the CAFile.
+//   - prefix_CLIENT_CERT and prefix_CLIENT_KEY are the CertFile and KeyFile.
+//   - prefix_INSECURE_SKIP_VERIFY is InsecureSkipVerify, true or false.
+//   - prefix_PROXY is the Proxy.
+//   - prefix_TIMEOUT is the Timeout, as a Go duration, e.g. "30s".
+//   - prefix_GZIP is Gzip, true or false.
+//   - prefix_BATCH_SIZE is the BatchSize.
+//   - prefix_FLUSH_INTERVAL is the FlushInterval, as a Go duration.
+//
+// When several prefixes are given, each variable is read with the first prefix
+// it is set with, so that more specific settings can fall back on shared ones.
+func ConfigFromEnv(prefixes ...string) (Config, error) {
+	lookup := func(name string) (string, string) {
+		for _, prefix := range prefixes {
+			if value := os.Getenv(prefix + "_" + name); value != "" {
+				return prefix + "_" + name, value
+			}
+		}
+		return "", ""
+	}
+
+	var config Config
+	_, config.URL = lookup("HOST")
+	_, config.Token = lookup("TOKEN")
+	_, config.CAFile = lookup("CA_CERT")
+	_, config.CertFile = lookup("CLIENT_CERT")
+	_, config.KeyFile = lookup("CLIENT_KEY")
+	_, config.Proxy = lookup("PROXY")
+
+	var err error
+	if name, value := lookup("INSECURE_SKIP_VERIFY"); value != "" {
+		if config.InsecureSkipVerify, err = strconv.ParseBool(value); err != nil {
+			return config, fmt.Errorf("invalid %s: %v", name, err)
+		}
+	}
+	if name, value := lookup("TIMEOUT"); value != "" {
+		if config.Timeout, err = time.ParseDuration(value); err != nil {
+			return config, fmt.Errorf("invalid %s: %v", name, err)
+		}
+	}
+	if name, value := lookup("GZIP"); value != "" {
+		if config.Gzip, err = strconv.ParseBool(value); err != nil {
+			return config, fmt.Errorf("invalid %s: %v", name, err)
+		}
+	}
+	if name, value := lookup("BATCH_SIZE"); value != "" {
+		size, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || size == 0 {
+			return config, fmt.Errorf("invalid %s: must be a positive integer", name)
+		}
+		config.BatchSize = uint(size)
+	}
+	if name, value := lookup("FLUSH_INTERVAL"); value != "" {
+		if config.FlushInterval, err = time.ParseDuration(value); err != nil {
+			return config, fmt.Errorf("invalid %s: %v", name, err)
+		}
+	}
+	return config, nil
+}
+
+// Options returns the client options described by the configuration, starting
+// from influxdb2.DefaultOptions.
+func (c Config) Options() (*influxdb2.Options, error) {
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	proxy := http.ProxyFromEnvironment
+	if c.Proxy != "" {
+		proxyURL, err := url.Parse(c.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %v", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
+	// The client library ignores proxies, so its HTTP client is replaced by one
+	// with the same settings and a proxy. Setting it makes the library ignore
+	// its own TLS and timeout options, so they are set here too.
+	httpClient := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy: proxy,
+			DialContext: (&net.Dialer{
+				Timeout: 5 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+			TLSClientConfig:     tlsConfig,
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+
+	options := influxdb2.DefaultOptions().
+		SetHTTPClient(httpClient).
+		SetUseGZip(c.Gzip)
+	if c.BatchSize > 0 {
+		options.SetBatchSize(c.BatchSize)
+	}
+	if c.FlushInterval > 0 {
+		options.SetFlushInterval(uint(c.FlushInterval / time.Millisecond))
+	}
+	return options, nil
+}
+
+// tlsConfig returns the TLS configuration for connections to InfluxDB, or nil
+// to use the defaults.
+func (c Config) tlsConfig() (*tls.Config, error) {
+	if c.CAFile == "" && c.CertFile == "" && c.KeyFile == "" && !c.InsecureSkipVerify {
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the CA bundle: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", c.CAFile)
+		}
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, errors.New("a client certificate needs both a certificate and a key file")
+		}
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// New returns a client configured by config.
+func New(config Config) (influxdb2.Client, error) {
+	options, err := config.Options()
+	if err != nil {
+		return nil, err
+	}
+	return influxdb2.NewClientWithOptions(config.URL, config.Token, options), nil
+}
+
+// NewFromEnv returns a client configured by the INFLUXDB_ environment
+// variables, as described by ConfigFromEnv.
+func NewFromEnv() (influxdb2.Client, error) {
+	config, err := ConfigFromEnv("INFLUXDB")
+	if err != nil {
+		return nil, err
+	}
+	return New(config)
+}
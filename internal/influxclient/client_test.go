@@ -0,0 +1,206 @@
+package influxclient
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ping answers the /ping requests of the client with 204 No Content.
+func ping(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/ping" {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pingWith pings InfluxDB with a client configured by config.
+func pingWith(t *testing.T, config Config) error {
+	t.Helper()
+	client, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ok, err := client.Ping(context.Background())
+	if err == nil && !ok {
+		t.Errorf("the ping of %s failed without an error", config.URL)
+	}
+	return err
+}
+
+// writePEM writes a PEM block to a file in dir and returns its path.
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("TEST_HOST", "https://shared.example.com")
+	t.Setenv("TEST_TOKEN", "shared-token")
+	t.Setenv("TEST_PROXY", "http://proxy.example.com:3128")
+	t.Setenv("TEST_TIMEOUT", "30s")
+	t.Setenv("TEST_EU_HOST", "https://eu.example.com")
+	t.Setenv("TEST_EU_CA_CERT", "/etc/eu/ca.pem")
+	t.Setenv("TEST_EU_CLIENT_CERT", "/etc/eu/client.pem")
+	t.Setenv("TEST_EU_CLIENT_KEY", "/etc/eu/client-key.pem")
+	t.Setenv("TEST_EU_GZIP", "true")
+	t.Setenv("TEST_EU_BATCH_SIZE", "500")
+	t.Setenv("TEST_EU_FLUSH_INTERVAL", "2s")
+
+	// Each setting is read with the first prefix it is set with.
+	config, err := ConfigFromEnv("TEST_EU", "TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{
+		URL:           "https://eu.example.com",
+		Token:         "shared-token",
+		CAFile:        "/etc/eu/ca.pem",
+		CertFile:      "/etc/eu/client.pem",
+		KeyFile:       "/etc/eu/client-key.pem",
+		Proxy:         "http://proxy.example.com:3128",
+		Timeout:       30 * time.Second,
+		Gzip:          true,
+		BatchSize:     500,
+		FlushInterval: 2 * time.Second,
+	}
+	if config != want {
+		t.Errorf("got config %+v, want %+v", config, want)
+	}
+
+	for name, value := range map[string]string{
+		"TEST_INSECURE_SKIP_VERIFY": "maybe",
+		"TEST_TIMEOUT":              "30",
+		"TEST_GZIP":                 "yes please",
+		"TEST_BATCH_SIZE":           "0",
+		"TEST_FLUSH_INTERVAL":       "often",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := ConfigFromEnv("TEST"); err == nil || !strings.Contains(err.Error(), name) {
+				t.Errorf("got error %v for %s=%q, want one naming it", err, name, value)
+			}
+		})
+	}
+}
+
+func TestNewTrustsCA(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(ping))
+	t.Cleanup(server.Close)
+
+	if err := pingWith(t, Config{URL: server.URL, Token: "my-token"}); err == nil {
+		t.Error("pinged a server with a certificate of an unknown authority")
+	}
+	caFile := writePEM(t, t.TempDir(), "ca.pem", "CERTIFICATE", server.Certificate().Raw)
+	if err := pingWith(t, Config{URL: server.URL, Token: "my-token", CAFile: caFile}); err != nil {
+		t.Errorf("failed to ping a server with a certificate of the CA: %v", err)
+	}
+	if err := pingWith(t, Config{URL: server.URL, Token: "my-token", InsecureSkipVerify: true}); err != nil {
+		t.Errorf("failed to ping a server without verifying its certificate: %v", err)
+	}
+
+	if _, err := New(Config{URL: server.URL, CAFile: filepath.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Error("created a client with a missing CA bundle")
+	}
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(empty, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(Config{URL: server.URL, CAFile: empty}); err == nil || !strings.Contains(err.Error(), "no certificates") {
+		t.Errorf("got error %v for an empty CA bundle, want one saying it holds no certificates", err)
+	}
+}
+
+func TestNewPresentsClientCertificate(t *testing.T) {
+	var commonName string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		commonName = r.TLS.PeerCertificates[0].Subject.CommonName
+		ping(w, r)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "my-app"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := writePEM(t, dir, "client.pem", "CERTIFICATE", der)
+	keyFile := writePEM(t, dir, "client-key.pem", "EC PRIVATE KEY", keyDER)
+
+	if err := pingWith(t, Config{URL: server.URL, Token: "my-token", InsecureSkipVerify: true}); err == nil {
+		t.Error("pinged a server requiring a client certificate without one")
+	}
+	config := Config{URL: server.URL, Token: "my-token", InsecureSkipVerify: true, CertFile: certFile, KeyFile: keyFile}
+	if err := pingWith(t, config); err != nil {
+		t.Fatalf("failed to ping with a client certificate: %v", err)
+	}
+	if commonName != "my-app" {
+		t.Errorf("the server got a certificate of %q, want my-app", commonName)
+	}
+
+	if _, err := New(Config{URL: server.URL, CertFile: certFile}); err == nil || !strings.Contains(err.Error(), "both") {
+		t.Errorf("got error %v for a certificate without a key, want one asking for both", err)
+	}
+	if _, err := New(Config{URL: server.URL, CertFile: keyFile, KeyFile: certFile}); err == nil {
+		t.Error("created a client with the certificate and key swapped")
+	}
+}
+
+func TestNewConnectsThroughProxy(t *testing.T) {
+	// A proxy of plain HTTP requests receives them with the absolute URL of
+	// their destination.
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		ping(w, r)
+	}))
+	t.Cleanup(proxy.Close)
+
+	config := Config{URL: "http://influxdb.invalid:8086", Token: "my-token", Proxy: proxy.URL}
+	if err := pingWith(t, config); err != nil {
+		t.Fatalf("failed to ping through the proxy: %v", err)
+	}
+	if len(proxied) != 1 || proxied[0] != "http://influxdb.invalid:8086/ping" {
+		t.Errorf("the proxy received %v, want a single request for http://influxdb.invalid:8086/ping", proxied)
+	}
+
+	if _, err := New(Config{URL: "http://influxdb.invalid:8086", Proxy: "http://[::1"}); err == nil || !strings.Contains(err.Error(), "proxy") {
+		t.Errorf("got error %v for an invalid proxy URL, want one about the proxy", err)
+	}
+}
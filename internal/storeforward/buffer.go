@@ -0,0 +1,433 @@
+// Package storeforward implements an offline store-and-forward mode for the
+// samples in this repository, for edge deployments that lose connectivity to
+// InfluxDB for long periods.
+//
+// A Forwarder writes points to InfluxDB directly while it can be reached. As
+// soon as a write fails for want of connectivity, or a ping fails, points are
+// stored in a Buffer instead, a SQLite database in WAL mode on local disk. Once
+// InfluxDB responds to pings again the Forwarder drains the buffer in
+// timestamp order before writing directly again. Buffered points that
+// InfluxDB rejects as invalid are dropped, while writes that fail for any
+// other reason, such as rate limiting, are retried until they succeed.
+//
+// The buffer is bounded: when it is full, either the oldest points are dropped
+// to make room for new ones or new points are dropped, as configured.
+package storeforward
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	_ "github.com/mattn/go-sqlite3" // Need the sqlite3 driver.
+)
+
+// DropPolicy decides which points are dropped when a Buffer is full.
+type DropPolicy int
+
+const (
+	// DropOldest drops the points with the oldest timestamps to make room for new ones.
+	DropOldest DropPolicy = iota
+	// DropNewest drops new points until there is room for them again.
+	DropNewest
+)
+
+// ParseDropPolicy parses "oldest" or "newest" into a DropPolicy. An empty
+// string yields DropOldest.
+func ParseDropPolicy(value string) (DropPolicy, error) {
+	switch strings.ToLower(value) {
+	case "", "oldest":
+		return DropOldest, nil
+	case "newest":
+		return DropNewest, nil
+	}
+	return 0, fmt.Errorf("unknown drop policy %q, expected oldest or newest", value)
+}
+
+func (p DropPolicy) String() string {
+	if p == DropNewest {
+		return "newest"
+	}
+	return "oldest"
+}
+
+// DefaultMaxBytes is the size of the line protocol a Buffer holds at most
+// unless configured otherwise.
+const DefaultMaxBytes = 100 << 20
+
+// ErrPointTooLarge is returned when a point is larger than a Buffer may hold
+// at all, so that no drop policy could make room for it.
+var ErrPointTooLarge = errors.New("point is larger than the buffer")
+
+// Buffer is a bounded, durable buffer of points in line protocol, stored in a
+// SQLite database in WAL mode. It is safe for concurrent use.
+type Buffer struct {
+	db       *sql.DB
+	maxBytes int64
+	drop     DropPolicy
+
+	mu sync.Mutex
+	// bytes is the size of the line protocol of the points in the buffer.
+	bytes int64
+	// dropped counts the points dropped since the buffer was opened.
+	dropped int64
+}
+
+// Stats describes the contents of a Buffer.
+type Stats struct {
+	// Depth is the number of points in the buffer.
+	Depth int64 `json:"depth"`
+	// Bytes is the size of the line protocol of the points in the buffer.
+	Bytes int64 `json:"bytes"`
+	// MaxBytes is the size Bytes is bounded by.
+	MaxBytes int64 `json:"max_bytes"`
+	// Oldest is the timestamp of the oldest point in the buffer, if any.
+	Oldest *time.Time `json:"oldest,omitempty"`
+	// OldestAgeSeconds is how long ago Oldest was, or zero if the buffer is empty.
+	OldestAgeSeconds float64 `json:"oldest_age_seconds"`
+	// Dropped is the number of points dropped since the buffer was opened,
+	// whether to bound its size or because InfluxDB rejected them.
+	Dropped int64 `json:"dropped"`
+	// DropPolicy is the drop policy of the buffer, oldest or newest.
+	DropPolicy string `json:"drop_policy"`
+}
+
+// Open opens the buffer stored in the SQLite database at path, creating it if
+// needed. The line protocol of the points in it is bounded by maxBytes, or by
+// DefaultMaxBytes if maxBytes is not positive.
+func Open(path string, maxBytes int64, drop DropPolicy) (*Buffer, error) {
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+	// WAL mode lets the forwarder read while points are added, and a normal
+	// synchronous level is durable enough in WAL mode for a buffer.
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000&_auto_vacuum=incremental", path))
+	if err != nil {
+		return nil, err
+	}
+	create := `CREATE TABLE IF NOT EXISTS points(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		time INTEGER NOT NULL,
+		line TEXT NOT NULL);
+		CREATE INDEX IF NOT EXISTS points_time ON points(time, id)`
+	if _, err := db.Exec(create); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("buffer table create failed: %v", err)
+	}
+	b := &Buffer{db: db, maxBytes: maxBytes, drop: drop}
+	if err := db.QueryRow(`SELECT COALESCE(SUM(LENGTH(line)), 0) FROM points`).Scan(&b.bytes); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// OpenFromEnv opens the buffer configured by the environment variables named
+// with the given prefix:
+//
+//   - prefix_OFFLINE_BUFFER is the path of the SQLite database. Offline mode is
+//     disabled, and OpenFromEnv returns nil, when it is unset.
+//   - prefix_OFFLINE_MAX_BYTES bounds the size of the buffered line protocol.
+//   - prefix_OFFLINE_DROP is the drop policy, oldest or newest.
+func OpenFromEnv(prefix string) (*Buffer, error) {
+	path := os.Getenv(prefix + "_OFFLINE_BUFFER")
+	if path == "" {
+		return nil, nil
+	}
+	var maxBytes int64
+	if value := os.Getenv(prefix + "_OFFLINE_MAX_BYTES"); value != "" {
+		var err error
+		if maxBytes, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid %s_OFFLINE_MAX_BYTES: %v", prefix, err)
+		}
+	}
+	drop, err := ParseDropPolicy(os.Getenv(prefix + "_OFFLINE_DROP"))
+	if err != nil {
+		return nil, err
+	}
+	return Open(path, maxBytes, drop)
+}
+
+// Close closes the database of the buffer.
+func (b *Buffer) Close() error {
+	return b.db.Close()
+}
+
+// Add stores points in the buffer, dropping points as the drop policy decides
+// if there is not enough room for them.
+func (b *Buffer) Add(ctx context.Context, points ...*write.Point) error {
+	lines := make([]string, len(points))
+	for i, point := range points {
+		lines[i] = write.PointToLineProtocol(point, time.Nanosecond)
+	}
+	return b.AddRecord(ctx, lines...)
+}
+
+// AddRecord is like Add, but takes points in line protocol with timestamps in
+// nanoseconds. Points without a timestamp are given the current time, so that
+// they are not stamped with the time they are forwarded instead.
+//
+// When a point is larger than the buffer's bound, none of the points are
+// stored and an error wrapping ErrPointTooLarge is returned.
+func (b *Buffer) AddRecord(ctx context.Context, lines ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	bytes, dropped := b.bytes, int64(0)
+	for _, record := range lines {
+		for _, line := range strings.Split(record, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			timestamp, ok := lineTimestamp(line)
+			if !ok {
+				timestamp = time.Now().UnixNano()
+				line += " " + strconv.FormatInt(timestamp, 10)
+			}
+			size := int64(len(line))
+			if size > b.maxBytes {
+				return fmt.Errorf("%w: %d bytes, and the buffer holds at most %d", ErrPointTooLarge, size, b.maxBytes)
+			}
+			if bytes+size > b.maxBytes {
+				if b.drop == DropNewest {
+					dropped++
+					continue
+				}
+				freed, count, err := dropOldest(ctx, tx, bytes+size-b.maxBytes)
+				if err != nil {
+					return err
+				}
+				bytes -= freed
+				dropped += count
+			}
+			if _, err := tx.ExecContext(ctx, `INSERT INTO points(time, line) VALUES($1, $2)`, timestamp, line); err != nil {
+				return err
+			}
+			bytes += size
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	b.bytes, b.dropped = bytes, b.dropped+dropped
+	return nil
+}
+
+// lineTimestamp returns the timestamp of a point in line protocol, which is
+// the last element of the line when present. A line protocol point has at
+// least a measurement and a field set, separated by an unescaped space, so a
+// timestamp is only present when there are three elements.
+func lineTimestamp(line string) (int64, bool) {
+	i := strings.LastIndexByte(line, ' ')
+	if i < 0 {
+		return 0, false
+	}
+	timestamp, err := strconv.ParseInt(line[i+1:], 10, 64)
+	if err != nil || strings.Count(line[:i], " ")-strings.Count(line[:i], "\\ ") < 1 {
+		return 0, false
+	}
+	return timestamp, true
+}
+
+// dropOldest deletes the points with the oldest timestamps until at least
+// size bytes are freed, and returns the bytes freed and points deleted.
+func dropOldest(ctx context.Context, tx *sql.Tx, size int64) (int64, int64, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT id, LENGTH(line) FROM points ORDER BY time, id`)
+	if err != nil {
+		return 0, 0, err
+	}
+	var ids []interface{}
+	var freed int64
+	for freed < size && rows.Next() {
+		var id, length int64
+		if err := rows.Scan(&id, &length); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		ids = append(ids, id)
+		freed += length
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	if _, err := deleteIDs(ctx, tx, ids); err != nil {
+		return 0, 0, err
+	}
+	return freed, int64(len(ids)), nil
+}
+
+// deleteIDs deletes the points with the given IDs, and returns the number of
+// points deleted.
+func deleteIDs(ctx context.Context, tx *sql.Tx, ids []interface{}) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	result, err := tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM points WHERE id IN (%s)`, placeholders), ids...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// batch is a batch of points read from a Buffer, in timestamp order.
+type batch struct {
+	ids   []interface{}
+	lines []string
+	bytes int64
+}
+
+// next reads up to limit of the oldest points in the buffer.
+func (b *Buffer) next(ctx context.Context, limit int) (batch, error) {
+	rows, err := b.db.QueryContext(ctx, `SELECT id, line FROM points ORDER BY time, id LIMIT $1`, limit)
+	if err != nil {
+		return batch{}, err
+	}
+	defer rows.Close()
+	var next batch
+	for rows.Next() {
+		var id int64
+		var line string
+		if err := rows.Scan(&id, &line); err != nil {
+			return batch{}, err
+		}
+		next.ids = append(next.ids, id)
+		next.lines = append(next.lines, line)
+		next.bytes += int64(len(line))
+	}
+	return next, rows.Err()
+}
+
+// split splits a batch into two halves, in timestamp order.
+func (b batch) split() (batch, batch) {
+	half := len(b.ids) / 2
+	first := batch{ids: b.ids[:half], lines: b.lines[:half]}
+	second := batch{ids: b.ids[half:], lines: b.lines[half:]}
+	for _, line := range first.lines {
+		first.bytes += int64(len(line))
+	}
+	second.bytes = b.bytes - first.bytes
+	return first, second
+}
+
+// remove deletes a batch read with next from the buffer, counting its points
+// as dropped if they were not written.
+func (b *Buffer) remove(ctx context.Context, done batch, written bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	deleted, err := deleteIDs(ctx, tx, done.ids)
+	if err != nil {
+		return err
+	}
+	bytes := b.bytes - done.bytes
+	if deleted != int64(len(done.ids)) {
+		// Some of the points were purged while the batch was forwarded, so
+		// count the bytes left instead.
+		if err := tx.QueryRowContext(ctx, `SELECT COALESCE(SUM(LENGTH(line)), 0) FROM points`).Scan(&bytes); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	b.bytes = bytes
+	if !written {
+		b.dropped += deleted
+	}
+	return nil
+}
+
+// Purge deletes the points whose line protocol match reports true for, for
+// example to erase the data of a user, and returns the number deleted. When
+// dryRun is set, the points are only counted. Purged points are not counted
+// as dropped.
+func (b *Buffer) Purge(ctx context.Context, match func(line string) bool, dryRun bool) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `SELECT id, line FROM points`)
+	if err != nil {
+		return 0, err
+	}
+	var ids []interface{}
+	var freed int64
+	for rows.Next() {
+		var id int64
+		var line string
+		if err := rows.Scan(&id, &line); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if match(line) {
+			ids = append(ids, id)
+			freed += int64(len(line))
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if dryRun {
+		return int64(len(ids)), nil
+	}
+	if _, err := deleteIDs(ctx, tx, ids); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	b.bytes -= freed
+	return int64(len(ids)), nil
+}
+
+// compact returns the pages freed by drained points to the file system, so
+// that the database does not stay at its largest size after an outage.
+func (b *Buffer) compact(ctx context.Context) error {
+	if _, err := b.db.ExecContext(ctx, `PRAGMA incremental_vacuum`); err != nil {
+		return err
+	}
+	_, err := b.db.ExecContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`)
+	return err
+}
+
+// Stats returns the depth of the buffer and the age of its oldest point.
+func (b *Buffer) Stats(ctx context.Context) (Stats, error) {
+	b.mu.Lock()
+	stats := Stats{Bytes: b.bytes, MaxBytes: b.maxBytes, Dropped: b.dropped, DropPolicy: b.drop.String()}
+	b.mu.Unlock()
+
+	var oldest sql.NullInt64
+	if err := b.db.QueryRowContext(ctx, `SELECT COUNT(*), MIN(time) FROM points`).Scan(&stats.Depth, &oldest); err != nil {
+		return Stats{}, err
+	}
+	if oldest.Valid {
+		t := time.Unix(0, oldest.Int64).UTC()
+		stats.Oldest = &t
+		stats.OldestAgeSeconds = time.Since(t).Seconds()
+	}
+	return stats, nil
+}
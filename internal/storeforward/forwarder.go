@@ -0,0 +1,276 @@
+package storeforward
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	influxdb2http "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+const (
+	// PingInterval is how often a Forwarder pings InfluxDB while offline, and
+	// checks that it is still reachable while online.
+	PingInterval = 10 * time.Second
+	// drainBatchSize is the number of points a Forwarder writes at a time when
+	// draining its buffer.
+	drainBatchSize = 500
+	// retryMinBackoff and retryMaxBackoff bound the time a Forwarder waits
+	// between attempts to forward a batch that InfluxDB failed to write,
+	// unless InfluxDB asks for longer with a Retry-After header.
+	retryMinBackoff = time.Second
+	retryMaxBackoff = 2 * time.Minute
+)
+
+// Forwarder writes points to InfluxDB, storing them in a Buffer while InfluxDB
+// cannot be reached and forwarding them once it can. Create one with
+// NewForwarder and call Run to start forwarding. It implements
+// api.WriteAPIBlocking, so it can stand in for the blocking write API.
+type Forwarder struct {
+	client   influxdb2.Client
+	writeAPI api.WriteAPIBlocking
+	buffer   *Buffer
+
+	// Forwarded, if set, is called with the points in line protocol of each
+	// batch forwarded from the buffer to InfluxDB. Set it before calling Run.
+	Forwarded func(lines []string)
+	// Rejected, if set, is called with the points in line protocol that
+	// InfluxDB rejected and that are dropped from the buffer, along with the
+	// error InfluxDB returned, so that they can be kept elsewhere for
+	// inspection. Set it before calling Run.
+	Rejected func(lines []string, err error)
+
+	mu sync.Mutex
+	// online is true while InfluxDB can be reached and the buffer is empty.
+	online bool
+}
+
+// NewForwarder returns a Forwarder that writes to bucket in org through client,
+// using buffer while InfluxDB cannot be reached. It starts offline, so that
+// points buffered before a restart are forwarded before any new ones.
+func NewForwarder(client influxdb2.Client, org, bucket string, buffer *Buffer) *Forwarder {
+	return &Forwarder{
+		client:   client,
+		writeAPI: client.WriteAPIBlocking(org, bucket),
+		buffer:   buffer,
+	}
+}
+
+// Online reports whether points are currently written straight to InfluxDB.
+func (f *Forwarder) Online() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.online
+}
+
+// Stats returns the statistics of the forwarder's buffer.
+func (f *Forwarder) Stats(ctx context.Context) (Stats, error) {
+	return f.buffer.Stats(ctx)
+}
+
+// Purge deletes points from the forwarder's buffer. See Buffer.Purge for details.
+func (f *Forwarder) Purge(ctx context.Context, match func(line string) bool, dryRun bool) (int64, error) {
+	return f.buffer.Purge(ctx, match, dryRun)
+}
+
+// WritePoint writes points to InfluxDB, or stores them in the buffer if the
+// forwarder is offline or the write fails for want of connectivity. Errors
+// returned by InfluxDB for any other reason, such as invalid points, are
+// returned as is.
+func (f *Forwarder) WritePoint(ctx context.Context, points ...*write.Point) error {
+	return f.write(ctx,
+		func() error { return f.writeAPI.WritePoint(ctx, points...) },
+		func() error { return f.buffer.Add(ctx, points...) })
+}
+
+// WriteRecord is like WritePoint, but takes points in line protocol with
+// timestamps in nanoseconds.
+func (f *Forwarder) WriteRecord(ctx context.Context, lines ...string) error {
+	return f.write(ctx,
+		func() error { return f.writeAPI.WriteRecord(ctx, lines...) },
+		func() error { return f.buffer.AddRecord(ctx, lines...) })
+}
+
+// write calls direct to write points straight to InfluxDB while online, and
+// buffered to buffer them otherwise.
+func (f *Forwarder) write(ctx context.Context, direct, buffered func() error) error {
+	f.mu.Lock()
+	if !f.online {
+		defer f.mu.Unlock()
+		return buffered()
+	}
+	f.mu.Unlock()
+
+	err := direct()
+	if err == nil || !unreachable(err) || ctx.Err() != nil {
+		return err
+	}
+	log.Printf("InfluxDB is unreachable, buffering points until it is back: %v", err)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.online = false
+	return buffered()
+}
+
+// unreachable reports whether a write failed because InfluxDB could not be
+// reached, rather than because it rejected the points.
+func unreachable(err error) bool {
+	var influxErr *influxdb2http.Error
+	if !errors.As(err, &influxErr) || influxErr.StatusCode == 0 {
+		return true
+	}
+	switch influxErr.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// rejected reports whether InfluxDB refused to write points because they are
+// invalid, so that writing them again is pointless. Other failures, such as
+// rate limiting, an invalid token or a server error, are retried.
+func rejected(err error) bool {
+	var influxErr *influxdb2http.Error
+	if !errors.As(err, &influxErr) {
+		return false
+	}
+	switch influxErr.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+// Run pings InfluxDB every PingInterval until ctx is cancelled. While it can
+// be reached, Run drains the buffer in timestamp order and then lets points be
+// written straight to InfluxDB again. While it cannot, points are buffered.
+func (f *Forwarder) Run(ctx context.Context) {
+	ticker := time.NewTicker(PingInterval)
+	defer ticker.Stop()
+	for {
+		if ok, err := f.client.Ping(ctx); !ok {
+			if f.Online() {
+				log.Printf("InfluxDB is unreachable, buffering points until it is back: %v", err)
+			}
+			f.mu.Lock()
+			f.online = false
+			f.mu.Unlock()
+		} else if !f.Online() {
+			if err := f.drain(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("Failed to forward buffered points: %v", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// drain writes the points in the buffer to InfluxDB, oldest first, and goes
+// online once the buffer is empty.
+func (f *Forwarder) drain(ctx context.Context) error {
+	forwarded := 0
+	for {
+		next, err := f.buffer.next(ctx, drainBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(next.ids) == 0 {
+			// Points may have been added since the buffer was read, so check
+			// again while holding the lock that WritePoint takes.
+			f.mu.Lock()
+			stats, err := f.buffer.Stats(ctx)
+			if err == nil && stats.Depth == 0 {
+				f.online = true
+			}
+			f.mu.Unlock()
+			if err != nil {
+				return err
+			}
+			if stats.Depth > 0 {
+				continue
+			}
+			if forwarded > 0 {
+				log.Printf("Forwarded %d buffered points to InfluxDB", forwarded)
+			}
+			return f.buffer.compact(ctx)
+		}
+
+		written, err := f.forward(ctx, next)
+		if err != nil {
+			return err
+		}
+		forwarded += written
+	}
+}
+
+// forward writes a batch of buffered points to InfluxDB and removes it from
+// the buffer, returning the number of points written. When InfluxDB rejects
+// the batch, it is split in halves that are forwarded in turn, so that only
+// the points InfluxDB will never accept are dropped rather than the whole
+// batch. Points of a rejected batch that InfluxDB did write are written again,
+// which overwrites them with the same values. Writes that fail for any other
+// reason are retried with exponential backoff, or as long as InfluxDB asks
+// with a Retry-After header, until they succeed or InfluxDB can't be reached.
+func (f *Forwarder) forward(ctx context.Context, next batch) (int, error) {
+	backoff := retryMinBackoff
+	for {
+		err := f.writeAPI.WriteRecord(ctx, next.lines...)
+		switch {
+		case err == nil:
+			if f.Forwarded != nil {
+				f.Forwarded(next.lines)
+			}
+			return len(next.ids), f.buffer.remove(ctx, next, true)
+		case unreachable(err) || ctx.Err() != nil:
+			return 0, err
+		case rejected(err):
+			return f.split(ctx, next, err)
+		}
+
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		var influxErr *influxdb2http.Error
+		if errors.As(err, &influxErr) && influxErr.RetryAfter > 0 {
+			wait = time.Duration(influxErr.RetryAfter) * time.Second
+		}
+		log.Printf("Failed to forward buffered points, retrying in %v: %v", wait, err)
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(wait):
+		}
+		if backoff *= 2; backoff > retryMaxBackoff {
+			backoff = retryMaxBackoff
+		}
+	}
+}
+
+// split forwards the halves of a batch that InfluxDB rejected with err in turn,
+// dropping the batch if it holds a single point.
+func (f *Forwarder) split(ctx context.Context, next batch, err error) (int, error) {
+	if len(next.ids) == 1 {
+		// InfluxDB will never accept this point, so drop it rather than hold
+		// up the rest of the buffer.
+		log.Printf("InfluxDB rejected a buffered point, dropping it: %v", err)
+		if f.Rejected != nil {
+			f.Rejected(next.lines, err)
+		}
+		return 0, f.buffer.remove(ctx, next, false)
+	}
+	first, second := next.split()
+	written, err := f.forward(ctx, first)
+	if err != nil {
+		return written, err
+	}
+	more, err := f.forward(ctx, second)
+	return written + more, err
+}
@@ -0,0 +1,208 @@
+package storeforward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	influxdb2http "github.com/influxdata/influxdb-client-go/v2/api/http"
+
+	"github.com/influxdata/go-snippets/internal/fakeinflux"
+)
+
+// openTestBuffer opens a buffer in a temporary directory.
+func openTestBuffer(t *testing.T, maxBytes int64, drop DropPolicy) *Buffer {
+	t.Helper()
+	buffer, err := Open(filepath.Join(t.TempDir(), "buffer.db"), maxBytes, drop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { buffer.Close() })
+	return buffer
+}
+
+func TestDrainDropsOnlyRejectedPoints(t *testing.T) {
+	influx := fakeinflux.New("my-token")
+	org := influx.CreateOrganization("my-org")
+	influx.CreateBucket(*org.Id, "my-bucket")
+	server := httptest.NewServer(influx)
+	defer server.Close()
+	client := influxdb2.NewClient(server.URL, "my-token")
+	defer client.Close()
+
+	buffer := openTestBuffer(t, 0, DropOldest)
+	ctx := context.Background()
+	var lines []string
+	for i := 0; i < 2*drainBatchSize; i++ {
+		lines = append(lines, fmt.Sprintf("m f=%d %d", i, i+1))
+	}
+	// InfluxDB rejects a batch holding a line it can't parse as a whole.
+	lines[drainBatchSize+10] = `m f="unterminated 1`
+	if err := buffer.AddRecord(ctx, lines...); err != nil {
+		t.Fatal(err)
+	}
+
+	forwarder := NewForwarder(client, "my-org", "my-bucket", buffer)
+	var rejected []string
+	forwarder.Rejected = func(lines []string, err error) {
+		var influxErr *influxdb2http.Error
+		if !errors.As(err, &influxErr) || influxErr.StatusCode != http.StatusBadRequest {
+			t.Errorf("got error %v for rejected points, want a 400 from InfluxDB", err)
+		}
+		rejected = append(rejected, lines...)
+	}
+	if err := forwarder.drain(ctx); err != nil {
+		t.Fatalf("drain failed: %v", err)
+	}
+	if len(rejected) != 1 || rejected[0] != lines[drainBatchSize+10] {
+		t.Errorf("got rejected points %q, want only %q", rejected, lines[drainBatchSize+10])
+	}
+	if got, want := len(influx.Points()), len(lines)-1; got != want {
+		t.Errorf("got %d points in InfluxDB, want %d", got, want)
+	}
+	stats, err := buffer.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Depth != 0 || stats.Bytes != 0 || stats.Dropped != 1 {
+		t.Errorf("got depth %d, %d bytes and %d dropped, want an empty buffer with 1 dropped", stats.Depth, stats.Bytes, stats.Dropped)
+	}
+	if !forwarder.Online() {
+		t.Error("the forwarder is offline after draining the buffer")
+	}
+}
+
+func TestDrainRetriesPointsInfluxDBFailedToWrite(t *testing.T) {
+	for _, test := range []struct {
+		status     int
+		retryAfter int
+	}{
+		{http.StatusTooManyRequests, 1},
+		{http.StatusInternalServerError, 0},
+	} {
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+			influx := fakeinflux.New("my-token")
+			org := influx.CreateOrganization("my-org")
+			influx.CreateBucket(*org.Id, "my-bucket")
+			server := httptest.NewServer(influx)
+			defer server.Close()
+			client := influxdb2.NewClient(server.URL, "my-token")
+			defer client.Close()
+
+			buffer := openTestBuffer(t, 0, DropOldest)
+			ctx := context.Background()
+			if err := buffer.AddRecord(ctx, "m f=1 1", "m f=2 2", "m f=3 3"); err != nil {
+				t.Fatal(err)
+			}
+			influx.FailNext("/api/v2/write", test.status, "try again later", test.retryAfter)
+
+			forwarder := NewForwarder(client, "my-org", "my-bucket", buffer)
+			start := time.Now()
+			if err := forwarder.drain(ctx); err != nil {
+				t.Fatalf("drain failed: %v", err)
+			}
+			if elapsed := time.Since(start); elapsed < time.Duration(test.retryAfter)*time.Second {
+				t.Errorf("retried after %v, want at least the %ds InfluxDB asked for", elapsed, test.retryAfter)
+			}
+			if got := len(influx.Points()); got != 3 {
+				t.Errorf("got %d points in InfluxDB, want 3", got)
+			}
+			stats, err := buffer.Stats(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Depth != 0 || stats.Dropped != 0 {
+				t.Errorf("got depth %d and %d dropped, want an empty buffer with none dropped", stats.Depth, stats.Dropped)
+			}
+		})
+	}
+}
+
+func TestAddRejectsPointsLargerThanTheBuffer(t *testing.T) {
+	for _, drop := range []DropPolicy{DropOldest, DropNewest} {
+		t.Run(drop.String(), func(t *testing.T) {
+			buffer := openTestBuffer(t, 32, drop)
+			ctx := context.Background()
+			if err := buffer.AddRecord(ctx, "m f=1 1"); err != nil {
+				t.Fatal(err)
+			}
+			err := buffer.AddRecord(ctx, "m f=2 2", "a_measurement_with_a_long_name f=3 3")
+			if !errors.Is(err, ErrPointTooLarge) {
+				t.Fatalf("got error %v, want ErrPointTooLarge", err)
+			}
+			stats, err := buffer.Stats(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Depth != 1 || stats.Bytes != int64(len("m f=1 1")) || stats.Bytes > stats.MaxBytes {
+				t.Errorf("got depth %d and %d bytes, want only the first point", stats.Depth, stats.Bytes)
+			}
+		})
+	}
+}
+
+func TestAddDropsOldestToMakeRoom(t *testing.T) {
+	buffer := openTestBuffer(t, 21, DropOldest)
+	ctx := context.Background()
+	if err := buffer.AddRecord(ctx, "m f=1 1", "m f=2 2", "m f=3 3", "m f=4 4"); err != nil {
+		t.Fatal(err)
+	}
+	next, err := buffer.next(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(next.lines) != "[m f=2 2 m f=3 3 m f=4 4]" {
+		t.Errorf("got %q in the buffer, want the newest three points", next.lines)
+	}
+	stats, err := buffer.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Dropped != 1 || stats.Bytes > stats.MaxBytes {
+		t.Errorf("got %d dropped and %d bytes, want 1 dropped within %d bytes", stats.Dropped, stats.Bytes, stats.MaxBytes)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	buffer := openTestBuffer(t, 0, DropOldest)
+	ctx := context.Background()
+	if err := buffer.AddRecord(ctx, "m,user_id=user1 f=1 1", "m,user_id=user2 f=2 2", "m,user_id=user1 f=3 3"); err != nil {
+		t.Fatal(err)
+	}
+	match := func(line string) bool { return strings.Contains(line, "user_id=user1 ") }
+
+	purged, err := buffer.Purge(ctx, match, true)
+	if err != nil || purged != 2 {
+		t.Fatalf("got %d points and error %v in a dry run, want 2", purged, err)
+	}
+	if stats, _ := buffer.Stats(ctx); stats.Depth != 3 {
+		t.Fatalf("a dry run purged %d points", 3-stats.Depth)
+	}
+
+	// Purging points of a batch being forwarded leaves the size of the buffer
+	// correct once the batch is removed.
+	next, err := buffer.next(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged, err = buffer.Purge(ctx, match, false); err != nil || purged != 2 {
+		t.Fatalf("got %d points and error %v, want 2", purged, err)
+	}
+	if err := buffer.remove(ctx, next, false); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := buffer.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Depth != 0 || stats.Bytes != 0 || stats.Dropped != 1 {
+		t.Errorf("got depth %d, %d bytes and %d dropped, want an empty buffer with 1 dropped", stats.Depth, stats.Bytes, stats.Dropped)
+	}
+}
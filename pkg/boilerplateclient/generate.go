@@ -0,0 +1,7 @@
+package boilerplateclient
+
+// The client is generated from the OpenAPI document served by the boilerplate
+// application at /openapi.json. Run `go generate` after changing the document;
+// TestGenerated fails until you do. The generator is run at the version go.mod
+// requires, v1.8.2.
+//go:generate go run github.com/deepmap/oapi-codegen/cmd/oapi-codegen -generate types,client -package boilerplateclient -o client.gen.go ../../cmd/boilerplate/openapi.json
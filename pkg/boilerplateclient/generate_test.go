@@ -0,0 +1,36 @@
+package boilerplateclient
+
+import (
+	"io/ioutil"
+	"regexp"
+	"testing"
+
+	"github.com/deepmap/oapi-codegen/pkg/codegen"
+	"github.com/deepmap/oapi-codegen/pkg/util"
+)
+
+// generatedHeader matches the line naming the generator, whose version is
+// read from the build info of the binary the generator is run from.
+var generatedHeader = regexp.MustCompile(`(?m)^// Code generated by .* DO NOT EDIT\.$`)
+
+// TestGenerated fails when the client checked in is not the one `go generate`
+// generates from the OpenAPI document, e.g. because the document was changed
+// without regenerating the client.
+func TestGenerated(t *testing.T) {
+	swagger, err := util.LoadSwagger("../../cmd/boilerplate/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The options match the flags of the go:generate directive in generate.go.
+	want, err := codegen.Generate(swagger, "boilerplateclient", codegen.Options{GenerateTypes: true, GenerateClient: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile("client.gen.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if generatedHeader.ReplaceAllString(string(got), "") != generatedHeader.ReplaceAllString(want, "") {
+		t.Error("client.gen.go is out of date with the OpenAPI document, run `go generate ./pkg/boilerplateclient`")
+	}
+}
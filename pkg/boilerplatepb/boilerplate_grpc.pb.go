@@ -0,0 +1,285 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             (unknown)
+// source: boilerplate.proto
+
+package boilerplatepb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// BoilerplateClient is the client API for Boilerplate service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type BoilerplateClient interface {
+	// Ingest queues a point for a user to be written to InfluxDB.
+	Ingest(ctx context.Context, in *IngestRequest, opts ...grpc.CallOption) (*IngestResponse, error)
+	// IngestStream queues each point sent by the client, and responds with the
+	// number of points queued once the client closes the stream.
+	IngestStream(ctx context.Context, opts ...grpc.CallOption) (Boilerplate_IngestStreamClient, error)
+	// Query streams the latest down sampled records for a user.
+	Query(ctx context.Context, in *QueryRequest, opts ...grpc.CallOption) (Boilerplate_QueryClient, error)
+	// Setup creates the tasks that roll up a user's data every minute, hour and day.
+	Setup(ctx context.Context, in *SetupRequest, opts ...grpc.CallOption) (*SetupResponse, error)
+}
+
+type boilerplateClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewBoilerplateClient(cc grpc.ClientConnInterface) BoilerplateClient {
+	return &boilerplateClient{cc}
+}
+
+func (c *boilerplateClient) Ingest(ctx context.Context, in *IngestRequest, opts ...grpc.CallOption) (*IngestResponse, error) {
+	out := new(IngestResponse)
+	err := c.cc.Invoke(ctx, "/boilerplate.v1.Boilerplate/Ingest", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *boilerplateClient) IngestStream(ctx context.Context, opts ...grpc.CallOption) (Boilerplate_IngestStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Boilerplate_ServiceDesc.Streams[0], "/boilerplate.v1.Boilerplate/IngestStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &boilerplateIngestStreamClient{stream}
+	return x, nil
+}
+
+type Boilerplate_IngestStreamClient interface {
+	Send(*IngestRequest) error
+	CloseAndRecv() (*IngestResponse, error)
+	grpc.ClientStream
+}
+
+type boilerplateIngestStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *boilerplateIngestStreamClient) Send(m *IngestRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *boilerplateIngestStreamClient) CloseAndRecv() (*IngestResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(IngestResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *boilerplateClient) Query(ctx context.Context, in *QueryRequest, opts ...grpc.CallOption) (Boilerplate_QueryClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Boilerplate_ServiceDesc.Streams[1], "/boilerplate.v1.Boilerplate/Query", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &boilerplateQueryClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Boilerplate_QueryClient interface {
+	Recv() (*Record, error)
+	grpc.ClientStream
+}
+
+type boilerplateQueryClient struct {
+	grpc.ClientStream
+}
+
+func (x *boilerplateQueryClient) Recv() (*Record, error) {
+	m := new(Record)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *boilerplateClient) Setup(ctx context.Context, in *SetupRequest, opts ...grpc.CallOption) (*SetupResponse, error) {
+	out := new(SetupResponse)
+	err := c.cc.Invoke(ctx, "/boilerplate.v1.Boilerplate/Setup", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// BoilerplateServer is the server API for Boilerplate service.
+// All implementations must embed UnimplementedBoilerplateServer
+// for forward compatibility
+type BoilerplateServer interface {
+	// Ingest queues a point for a user to be written to InfluxDB.
+	Ingest(context.Context, *IngestRequest) (*IngestResponse, error)
+	// IngestStream queues each point sent by the client, and responds with the
+	// number of points queued once the client closes the stream.
+	IngestStream(Boilerplate_IngestStreamServer) error
+	// Query streams the latest down sampled records for a user.
+	Query(*QueryRequest, Boilerplate_QueryServer) error
+	// Setup creates the tasks that roll up a user's data every minute, hour and day.
+	Setup(context.Context, *SetupRequest) (*SetupResponse, error)
+	mustEmbedUnimplementedBoilerplateServer()
+}
+
+// UnimplementedBoilerplateServer must be embedded to have forward compatible implementations.
+type UnimplementedBoilerplateServer struct {
+}
+
+func (UnimplementedBoilerplateServer) Ingest(context.Context, *IngestRequest) (*IngestResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Ingest not implemented")
+}
+func (UnimplementedBoilerplateServer) IngestStream(Boilerplate_IngestStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method IngestStream not implemented")
+}
+func (UnimplementedBoilerplateServer) Query(*QueryRequest, Boilerplate_QueryServer) error {
+	return status.Errorf(codes.Unimplemented, "method Query not implemented")
+}
+func (UnimplementedBoilerplateServer) Setup(context.Context, *SetupRequest) (*SetupResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Setup not implemented")
+}
+func (UnimplementedBoilerplateServer) mustEmbedUnimplementedBoilerplateServer() {}
+
+// UnsafeBoilerplateServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to BoilerplateServer will
+// result in compilation errors.
+type UnsafeBoilerplateServer interface {
+	mustEmbedUnimplementedBoilerplateServer()
+}
+
+func RegisterBoilerplateServer(s grpc.ServiceRegistrar, srv BoilerplateServer) {
+	s.RegisterService(&Boilerplate_ServiceDesc, srv)
+}
+
+func _Boilerplate_Ingest_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(IngestRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BoilerplateServer).Ingest(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/boilerplate.v1.Boilerplate/Ingest",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BoilerplateServer).Ingest(ctx, req.(*IngestRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Boilerplate_IngestStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(BoilerplateServer).IngestStream(&boilerplateIngestStreamServer{stream})
+}
+
+type Boilerplate_IngestStreamServer interface {
+	SendAndClose(*IngestResponse) error
+	Recv() (*IngestRequest, error)
+	grpc.ServerStream
+}
+
+type boilerplateIngestStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *boilerplateIngestStreamServer) SendAndClose(m *IngestResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *boilerplateIngestStreamServer) Recv() (*IngestRequest, error) {
+	m := new(IngestRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Boilerplate_Query_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(QueryRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(BoilerplateServer).Query(m, &boilerplateQueryServer{stream})
+}
+
+type Boilerplate_QueryServer interface {
+	Send(*Record) error
+	grpc.ServerStream
+}
+
+type boilerplateQueryServer struct {
+	grpc.ServerStream
+}
+
+func (x *boilerplateQueryServer) Send(m *Record) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Boilerplate_Setup_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetupRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BoilerplateServer).Setup(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/boilerplate.v1.Boilerplate/Setup",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BoilerplateServer).Setup(ctx, req.(*SetupRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Boilerplate_ServiceDesc is the grpc.ServiceDesc for Boilerplate service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Boilerplate_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "boilerplate.v1.Boilerplate",
+	HandlerType: (*BoilerplateServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Ingest",
+			Handler:    _Boilerplate_Ingest_Handler,
+		},
+		{
+			MethodName: "Setup",
+			Handler:    _Boilerplate_Setup_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "IngestStream",
+			Handler:       _Boilerplate_IngestStream_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Query",
+			Handler:       _Boilerplate_Query_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "boilerplate.proto",
+}
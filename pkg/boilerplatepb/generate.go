@@ -0,0 +1,5 @@
+// Package boilerplatepb contains the protocol buffer messages and gRPC service
+// of the boilerplate application, generated from boilerplate.proto.
+package boilerplatepb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative boilerplate.proto